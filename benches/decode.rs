@@ -0,0 +1,91 @@
+//! Benchmarks comparing the ways of decoding a batch of small messages.
+use criterion::{black_box, criterion_group, criterion_main, Criterion, Throughput};
+use oasis_cbor as cbor;
+
+/// Number of messages decoded in each iteration.
+const BATCH_SIZE: usize = 1000;
+
+#[derive(Debug, Default, cbor::Encode, cbor::Decode)]
+struct Transfer {
+    from: String,
+    to: String,
+    amount: u64,
+    nonce: u64,
+    #[cbor(optional)]
+    memo: Vec<u8>,
+}
+
+#[allow(dead_code)] // Fields are only decoded.
+#[derive(Debug, Default, cbor::Decode)]
+struct BorrowedTransfer<'a> {
+    from: &'a str,
+    to: &'a str,
+    amount: u64,
+    nonce: u64,
+    #[cbor(optional)]
+    memo: &'a [u8],
+}
+
+fn encoded_batch() -> Vec<Vec<u8>> {
+    (0..BATCH_SIZE as u64)
+        .map(|nonce| {
+            cbor::to_vec(Transfer {
+                from: "oasis1qzzd6khm3acqskpxlk9vd5044cmmcce78y5l6000".to_owned(),
+                to: "oasis1qrd3mnzhhgst26hsp96uf45yhq6zlax0cuzdgcfc".to_owned(),
+                amount: 1_000_000_000 + nonce,
+                nonce,
+                memo: b"payment for services".to_vec(),
+            })
+        })
+        .collect()
+}
+
+fn bench_decode(c: &mut Criterion) {
+    let batch = encoded_batch();
+    let mut group = c.benchmark_group("decode_batch");
+    group.throughput(Throughput::Elements(BATCH_SIZE as u64));
+
+    group.bench_function("owned", |b| {
+        b.iter(|| {
+            let decoded: Vec<Transfer> = batch
+                .iter()
+                .map(|enc| cbor::from_slice(black_box(enc)).unwrap())
+                .collect();
+            decoded.len()
+        })
+    });
+
+    // Borrowing directly from the input, for reference. This is only possible when the input
+    // outlives the decoded messages.
+    group.bench_function("borrowed", |b| {
+        b.iter(|| {
+            let decoded: Vec<BorrowedTransfer<'_>> = batch
+                .iter()
+                .map(|enc| cbor::from_slice_borrowed(black_box(enc)).unwrap())
+                .collect();
+            decoded.len()
+        })
+    });
+
+    // Borrowing from copies in an arena which is reused across batches. Compared to "borrowed",
+    // this adds a copy of each message into the arena, but the `ValueRef` vectors of its maps are
+    // allocated from the arena too instead of being allocated and freed for every message.
+    let mut arena = cbor::Arena::new();
+    group.bench_function("arena", |b| {
+        b.iter(|| {
+            let decoded: Vec<BorrowedTransfer<'_>> = batch
+                .iter()
+                .map(|enc| arena.decode(black_box(enc)).unwrap())
+                .collect();
+            let len = decoded.len();
+            drop(decoded);
+            arena.reset();
+            len
+        })
+    });
+
+    group.finish();
+}
+
+criterion_group!(benches, bench_decode);
+criterion_main!(benches);
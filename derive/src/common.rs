@@ -1,9 +1,15 @@
 //! Common definitions for both encoder and decoder.
-use darling::{util::Flag, Error, FromDeriveInput, FromField, FromVariant, Result};
+use darling::{
+    util::{Flag, Override},
+    Error, FromDeriveInput, FromField, FromVariant, Result,
+};
 use oasis_cbor_value::values::IntoCborValue;
 use proc_macro2::TokenStream;
-use quote::quote;
-use syn::{Expr, Generics, Ident, Lit, Path, Type};
+use quote::{quote, quote_spanned};
+use syn::{
+    parse::Parser, punctuated::Punctuated, spanned::Spanned, Expr, Generics, Ident, Lit, Meta,
+    NestedMeta, Path, Token, Type, WherePredicate,
+};
 
 #[derive(FromDeriveInput)]
 #[darling(supports(any), attributes(cbor))]
@@ -23,9 +29,24 @@ pub struct Codable {
     #[darling(rename = "tag")]
     pub tag: Option<Key>,
 
+    #[darling(rename = "semantic_tag")]
+    pub semantic_tag: Option<u64>,
+
+    #[darling(rename = "rename_all")]
+    pub rename_all: Option<RenameRule>,
+
+    #[darling(rename = "repr")]
+    pub repr: Option<Repr>,
+
     #[darling(rename = "as_array")]
     pub as_array: Flag,
 
+    #[darling(rename = "as_null")]
+    pub as_null: Flag,
+
+    #[darling(rename = "accept_array_or_map")]
+    pub accept_array_or_map: Flag,
+
     #[darling(rename = "no_default")]
     pub no_default: Flag,
 
@@ -34,10 +55,19 @@ pub struct Codable {
 
     #[darling(rename = "allow_unknown")]
     pub allow_unknown: Flag,
+
+    #[darling(rename = "deny_unknown_fields")]
+    pub deny_unknown_fields: Flag,
+
+    #[darling(rename = "allow_mixed_keys")]
+    pub allow_mixed_keys: Flag,
+
+    #[darling(rename = "bound")]
+    pub bound: Option<Bound>,
 }
 
 impl Codable {
-    fn validate(self) -> Result<Self> {
+    fn validate(mut self) -> Result<Self> {
         if self.no_default.is_present() && self.with_default.is_present() {
             return Err(Error::custom("Cannot set no_default and with_default")
                 .with_span(&self.with_default));
@@ -48,8 +78,699 @@ impl Codable {
                 .with_span(&self.untagged));
         }
 
+        if self.deny_unknown_fields.is_present() {
+            match &self.data {
+                darling::ast::Data::Struct(fields) => validate_deny_unknown_fields(
+                    &self.deny_unknown_fields,
+                    &self.allow_unknown,
+                    &fields.fields,
+                )?,
+                darling::ast::Data::Enum(_) => {
+                    return Err(Error::custom(
+                        "Cannot set deny_unknown_fields on an enum, set it on the variants instead",
+                    )
+                    .with_span(&self.deny_unknown_fields));
+                }
+            }
+        }
+
+        if let Some(repr) = &self.repr {
+            if self.rename_all.is_some() {
+                return Err(Error::custom("Cannot set repr and rename_all").with_span(&self.ident));
+            }
+            if self.untagged.is_present() || self.tag.is_some() {
+                return Err(Error::custom("Cannot set repr and tag").with_span(&self.ident));
+            }
+            match &mut self.data {
+                darling::ast::Data::Struct(_) => {
+                    return Err(Error::custom("Cannot set repr on a struct").with_span(&self.ident));
+                }
+                darling::ast::Data::Enum(variants) => repr.assign_discriminants(variants)?,
+            }
+        }
+
+        if let Some(rule) = &self.rename_all {
+            // Apply the rename rule to all field keys (or variant names) without an explicit rename.
+            match &mut self.data {
+                darling::ast::Data::Struct(fields) => {
+                    for field in fields.fields.iter_mut() {
+                        if let (None, Some(ident)) = (&field.rename, &field.ident) {
+                            field.rename = Some(Key::String(rule.apply(&ident.to_string())));
+                        }
+                    }
+                }
+                darling::ast::Data::Enum(variants) => {
+                    for variant in variants.iter_mut() {
+                        if variant.rename.is_none() {
+                            variant.rename =
+                                Some(Key::String(rule.apply(&variant.ident.to_string())));
+                        }
+                    }
+                }
+            }
+        }
+
+        if self.transparent.is_present() {
+            match &self.data {
+                darling::ast::Data::Struct(fields) => {
+                    validate_transparent(fields, &self.transparent)?
+                }
+                darling::ast::Data::Enum(_) => {
+                    return Err(Error::custom("Cannot set transparent on an enum")
+                        .with_span(&self.transparent));
+                }
+            }
+            if self.as_array.is_present() {
+                return Err(
+                    Error::custom("Cannot set transparent and as_array").with_span(&self.as_array)
+                );
+            }
+        }
+
+        if self.as_null.is_present() {
+            let fields = match &self.data {
+                darling::ast::Data::Struct(fields) => fields,
+                darling::ast::Data::Enum(_) => {
+                    return Err(
+                        Error::custom("Cannot set as_null on an enum").with_span(&self.as_null)
+                    );
+                }
+            };
+            if self.transparent.is_present() || self.as_array.is_present() {
+                return Err(
+                    Error::custom("Cannot set as_null and transparent or as_array")
+                        .with_span(&self.as_null),
+                );
+            }
+            if let Some(field) = fields.iter().find(|f| !f.skip.is_present()) {
+                return Err(
+                    Error::custom("Cannot set as_null on a struct with encoded fields")
+                        .with_span(&field.ty),
+                );
+            }
+        }
+
+        if self.accept_array_or_map.is_present() {
+            let fields = match &self.data {
+                darling::ast::Data::Struct(fields) if fields.is_struct() => fields,
+                _ => {
+                    return Err(Error::custom(
+                        "Cannot set accept_array_or_map on a type other than a struct with named fields",
+                    )
+                    .with_span(&self.accept_array_or_map));
+                }
+            };
+            if self.transparent.is_present()
+                || self.as_array.is_present()
+                || self.as_null.is_present()
+            {
+                return Err(Error::custom(
+                    "Cannot set accept_array_or_map and transparent, as_array or as_null",
+                )
+                .with_span(&self.accept_array_or_map));
+            }
+            if let Some(field) = fields
+                .iter()
+                .find(|f| f.is_flattened() && !f.skip.is_present())
+            {
+                return Err(Error::custom(
+                    "Cannot use embed or flatten_rest together with accept_array_or_map",
+                )
+                .with_span(&field.ty));
+            }
+        }
+
+        let allow_mixed_keys = self.allow_mixed_keys.is_present();
+        match &self.data {
+            darling::ast::Data::Struct(fields) => {
+                validate_keys(&fields.fields, allow_mixed_keys)?;
+                if fields.is_struct() && !self.as_array.is_present() {
+                    validate_unique_keys(&fields.fields, None)?;
+                }
+                validate_embed(&fields.fields)?;
+                if !self.transparent.is_present()
+                    && (fields.is_tuple() || self.as_array.is_present())
+                {
+                    validate_array_fields(&fields.fields)?;
+                }
+            }
+            darling::ast::Data::Enum(variants) => {
+                if !self.untagged.is_present() {
+                    validate_unique_variant_keys(variants, self.tag.is_some())?;
+                    validate_variant_shapes(variants, self.tag.is_some())?;
+                }
+                for variant in variants {
+                    validate_keys(&variant.fields.fields, allow_mixed_keys)?;
+                    if variant.fields.is_struct() && !variant.as_array.is_present() {
+                        validate_unique_keys(&variant.fields.fields, self.tag.as_ref())?;
+                    }
+                    validate_embed(&variant.fields.fields)?;
+                    // Newtype variants encode as their inner value instead.
+                    if !variant.fields.is_newtype()
+                        && (variant.fields.is_tuple() || variant.as_array.is_present())
+                    {
+                        validate_array_fields(&variant.fields.fields)?;
+                    }
+                }
+                validate_unknown(variants)?;
+            }
+        }
+
         Ok(self)
     }
+
+    /// Fields of the struct, or of all enum variants which are not skipped (together with their
+    /// variant).
+    pub fn coded_fields(&self) -> Vec<(Option<&Variant>, &Field)> {
+        match &self.data {
+            darling::ast::Data::Struct(fields) => fields.iter().map(|f| (None, f)).collect(),
+            darling::ast::Data::Enum(variants) => variants
+                .iter()
+                .filter(|v| !v.skip.is_present())
+                .flat_map(|v| v.fields.iter().map(move |f| (Some(v), f)))
+                .collect(),
+        }
+    }
+}
+
+/// Whether the type is `PhantomData`, however it is qualified.
+fn is_phantom_data(ty: &Type) -> bool {
+    match ty {
+        Type::Path(path) if path.qself.is_none() => path
+            .path
+            .segments
+            .last()
+            .map_or(false, |s| s.ident == "PhantomData"),
+        _ => false,
+    }
+}
+
+/// Validate a struct forwarding its encoding to its only field via the transparent attribute. Only
+/// attributes changing how the field itself is encoded (e.g. with) are allowed on the field.
+fn validate_transparent(fields: &darling::ast::Fields<Field>, transparent: &Flag) -> Result<()> {
+    if !fields.is_newtype() {
+        return Err(
+            Error::custom("Cannot set transparent on a struct which is not a newtype")
+                .with_span(transparent),
+        );
+    }
+    let field = &fields.fields[0];
+    if field.skip.is_present()
+        || field.optional.is_present()
+        || field.is_flattened()
+        || field.skip_serializing_if_default.is_present()
+        || field.skip_serializing_if.is_some()
+    {
+        return Err(Error::custom(
+            "Cannot set transparent on a newtype whose field is skipped, optional or flattened",
+        )
+        .with_span(&field.ty));
+    }
+
+    Ok(())
+}
+
+/// Validate integer keys assigned to fields via the key attribute.
+fn validate_keys(fields: &[Field], allow_mixed_keys: bool) -> Result<()> {
+    if fields.iter().all(|f| f.key.is_none()) {
+        return Ok(());
+    }
+
+    let mut seen = std::collections::BTreeSet::new();
+    for field in fields
+        .iter()
+        .filter(|f| !f.skip.is_present() && !f.is_flattened())
+    {
+        match field.key {
+            Some(key) if !seen.insert(key) => {
+                return Err(Error::custom(format!("Duplicate key {}", key)).with_span(&field.ty));
+            }
+            None if !allow_mixed_keys && !matches!(field.rename, Some(Key::Integer(_))) => {
+                return Err(Error::custom(
+                    "Cannot mix integer and string keys without allow_mixed_keys",
+                )
+                .with_span(&field.ty));
+            }
+            _ => {}
+        }
+    }
+
+    Ok(())
+}
+
+/// Describe the given map key as it appears in the source, for error messages.
+fn describe_key(key: &oasis_cbor_value::Value) -> String {
+    match key {
+        oasis_cbor_value::Value::TextString(name) => format!("{:?}", name),
+        oasis_cbor_value::Value::Unsigned(n) => n.to_string(),
+        key => format!("{:?}", key),
+    }
+}
+
+/// Validate that no two fields encoded as map entries resolve to the same key (e.g. via rename,
+/// rename_all or key), as one would shadow the other. For struct variants of internally tagged
+/// enums, the fields must not use the tag key either.
+fn validate_unique_keys(fields: &[Field], tag: Option<&Key>) -> Result<()> {
+    let mut seen: std::collections::BTreeMap<_, &Field> = std::collections::BTreeMap::new();
+    for field in fields
+        .iter()
+        .filter(|f| !f.skip.is_present() && !f.is_flattened())
+    {
+        let key = field.to_cbor_key();
+        if matches!(tag, Some(tag) if tag.to_cbor_key() == key) {
+            return Err(Error::custom(format!(
+                "Key {} of field conflicts with the tag",
+                describe_key(&key)
+            ))
+            .with_span(&field.ty));
+        }
+        if let Some(first) = seen.get(&key) {
+            return Err(Error::multiple(vec![
+                Error::custom(format!("Duplicate key {}", describe_key(&key))).with_span(&field.ty),
+                Error::custom(format!("Key {} first used here", describe_key(&key)))
+                    .with_span(&first.ty),
+            ]));
+        }
+        seen.insert(key, field);
+    }
+
+    Ok(())
+}
+
+/// Validate that no two variants resolve to the same key (e.g. via rename, rename_all or key), as
+/// only one of them could ever be decoded. Unit variants of externally tagged enums with a literal
+/// discriminant are encoded as that discriminant instead of their key.
+fn validate_unique_variant_keys(variants: &[Variant], tagged: bool) -> Result<()> {
+    let mut seen: std::collections::BTreeMap<_, &Variant> = std::collections::BTreeMap::new();
+    for variant in variants
+        .iter()
+        .filter(|v| !v.skip.is_present() && !v.unknown.is_present())
+    {
+        let key = if !tagged && variant.is_bare_unit() {
+            match variant.unit_value() {
+                Some(value) => value,
+                // Not known until the discriminant expression is evaluated.
+                None => continue,
+            }
+        } else {
+            variant.to_cbor_key()
+        };
+        if let Some(first) = seen.get(&key) {
+            return Err(Error::multiple(vec![
+                Error::custom(format!("Duplicate key {}", describe_key(&key)))
+                    .with_span(&variant.ident),
+                Error::custom(format!("Key {} first used here", describe_key(&key)))
+                    .with_span(&first.ident),
+            ]));
+        }
+        seen.insert(key, variant);
+    }
+
+    Ok(())
+}
+
+/// Validate that the variants of an enum which is not untagged can be told apart when decoding.
+/// Embedded variants are only attempted after the unit variants and in order, so they must not
+/// embed the same type as another embedded variant, nor a string or integer type when unit
+/// variants of the same kind exist, as such values would decode as the unit variant.
+fn validate_variant_shapes(variants: &[Variant], tagged: bool) -> Result<()> {
+    let variants: Vec<_> = variants.iter().filter(|v| !v.skip.is_present()).collect();
+
+    if !tagged {
+        if let Some(variant) = variants.iter().find(|v| v.missing.is_present()) {
+            return Err(Error::custom(
+                "Cannot set missing on a variant of an enum which is not internally tagged",
+            )
+            .with_span(&variant.missing));
+        }
+    }
+
+    let embedded: Vec<_> = variants
+        .iter()
+        .filter(|v| v.embed.is_present() && v.fields.is_newtype())
+        .map(|v| (*v, &v.fields.fields[0].ty))
+        .collect();
+    for (index, (variant, ty)) in embedded.iter().enumerate() {
+        let ty_name = quote!(#ty).to_string();
+        if let Some((first, _)) = embedded[..index]
+            .iter()
+            .find(|(_, other)| quote!(#other).to_string() == ty_name)
+        {
+            return Err(Error::multiple(vec![
+                Error::custom(format!(
+                    "Variant embeds the same type as variant {}, so it is never decoded",
+                    first.ident
+                ))
+                .with_span(&variant.ident),
+                Error::custom("Type first embedded here").with_span(&first.ident),
+            ]));
+        }
+
+        let kind = match scalar_kind(ty) {
+            Some(kind) => kind,
+            None => continue,
+        };
+        let unit = variants.iter().find(|v| {
+            !tagged
+                && v.is_bare_unit()
+                && !v.unknown.is_present()
+                && !v.embed.is_present()
+                && v.unit_value().and_then(|value| value_kind(&value)) == Some(kind)
+        });
+        if let Some(unit) = unit {
+            return Err(Error::multiple(vec![
+                Error::custom(format!(
+                    "Variant embeds {} type, which is ambiguous with unit variant {}",
+                    kind, unit.ident
+                ))
+                .with_span(&variant.ident),
+                Error::custom(format!("Unit variant encoded as {} here", kind))
+                    .with_span(&unit.ident),
+            ]));
+        }
+    }
+
+    Ok(())
+}
+
+/// Kind of encoding ("a string" or "an integer") of the given primitive type, if it is one.
+fn scalar_kind(ty: &Type) -> Option<&'static str> {
+    match ty {
+        Type::Reference(reference) => scalar_kind(&reference.elem),
+        Type::Path(path) if path.qself.is_none() => {
+            let segment = path.path.segments.last()?;
+            if !segment.arguments.is_empty() {
+                return None;
+            }
+            match segment.ident.to_string().as_str() {
+                "String" | "str" => Some("a string"),
+                "u8" | "u16" | "u32" | "u64" | "usize" | "i8" | "i16" | "i32" | "i64" | "isize" => {
+                    Some("an integer")
+                }
+                _ => None,
+            }
+        }
+        _ => None,
+    }
+}
+
+/// Kind of encoding of the given value, as returned by `scalar_kind`.
+fn value_kind(value: &oasis_cbor_value::Value) -> Option<&'static str> {
+    match value {
+        oasis_cbor_value::Value::TextString(_) => Some("a string"),
+        oasis_cbor_value::Value::Unsigned(_) | oasis_cbor_value::Value::Negative(_) => {
+            Some("an integer")
+        }
+        _ => None,
+    }
+}
+
+/// Validate fields embedded via the embed and flatten_rest attributes.
+fn validate_embed(fields: &[Field]) -> Result<()> {
+    let mut embedded = fields
+        .iter()
+        .filter(|f| f.embed.is_present() && !f.skip.is_present());
+    embedded.next();
+    if let Some(field) = embedded.next() {
+        return Err(Error::custom("Cannot embed more than one field").with_span(&field.embed));
+    }
+
+    // A field collecting all the remaining entries leaves nothing for other such fields.
+    let mut rest = fields
+        .iter()
+        .filter(|f| f.flatten_rest.is_present() && !f.skip.is_present());
+    if rest.next().is_some() {
+        if let Some(field) = rest.next() {
+            return Err(
+                Error::custom("Cannot have more than one flatten_rest field")
+                    .with_span(&field.flatten_rest),
+            );
+        }
+        if let Some(field) = fields
+            .iter()
+            .find(|f| f.embed.is_present() && !f.skip.is_present())
+        {
+            return Err(
+                Error::custom("Cannot combine embed and flatten_rest").with_span(&field.embed)
+            );
+        }
+    }
+
+    Ok(())
+}
+
+/// Validate the deny_unknown_fields attribute, which conflicts with anything accepting unknown
+/// fields: the allow_unknown attribute and a flatten_rest field collecting them.
+fn validate_deny_unknown_fields(
+    deny_unknown_fields: &Flag,
+    allow_unknown: &Flag,
+    fields: &[Field],
+) -> Result<()> {
+    if allow_unknown.is_present() {
+        return Err(
+            Error::custom("Cannot set deny_unknown_fields and allow_unknown")
+                .with_span(deny_unknown_fields),
+        );
+    }
+    if let Some(field) = fields
+        .iter()
+        .find(|f| f.flatten_rest.is_present() && !f.skip.is_present())
+    {
+        return Err(
+            Error::custom("Cannot set deny_unknown_fields with a flatten_rest field")
+                .with_span(&field.flatten_rest),
+        );
+    }
+
+    Ok(())
+}
+
+/// Validate fields encoded as array elements. As elements are identified by their position, fields
+/// may only be omitted from the end of the array, so all fields following an omittable field must
+/// be omittable as well.
+fn validate_array_fields(fields: &[Field]) -> Result<()> {
+    let mut omittable = false;
+    for field in fields.iter().filter(|f| !f.skip.is_present()) {
+        if field.is_omittable() {
+            omittable = true;
+        } else if omittable {
+            return Err(Error::custom(
+                "Cannot have a required field after an optional or default field in an array",
+            )
+            .with_span(&field.ty));
+        }
+    }
+
+    Ok(())
+}
+
+/// Validate the fallback variant configured via the unknown attribute.
+fn validate_unknown(variants: &[Variant]) -> Result<()> {
+    let mut unknown = variants.iter().filter(|v| v.unknown.is_present());
+    if let Some(variant) = unknown.next() {
+        if !variant.fields.is_unit() && !variant.fields.is_newtype() {
+            return Err(
+                Error::custom("Cannot set unknown on variant with multiple fields")
+                    .with_span(&variant.unknown),
+            );
+        }
+        if variant.skip.is_present() || variant.embed.is_present() || variant.missing.is_present() {
+            return Err(
+                Error::custom("Cannot set unknown and skip, embed or missing")
+                    .with_span(&variant.unknown),
+            );
+        }
+    }
+    if let Some(variant) = unknown.next() {
+        return Err(Error::custom("Cannot set unknown on more than one variant")
+            .with_span(&variant.unknown));
+    }
+
+    Ok(())
+}
+
+/// Representation of enums.
+pub enum Repr {
+    /// Unit variants encoded as bare integer discriminants.
+    Int,
+}
+
+impl Repr {
+    /// Assign integer discriminants to all variants which do not have an explicit key, counting up
+    /// from the previous variant (or zero).
+    fn assign_discriminants(&self, variants: &mut [Variant]) -> Result<()> {
+        let mut next = 0u64;
+        let mut seen = std::collections::BTreeSet::new();
+        for variant in variants.iter_mut() {
+            if variant.unknown.is_present() && variant.fields.is_newtype() {
+                // The fallback variant captures the raw value and needs no discriminant.
+                continue;
+            }
+            if !variant.fields.is_unit() || variant.as_struct.is_present() {
+                return Err(
+                    Error::custom("Cannot set repr on enum with non-unit variants")
+                        .with_span(&variant.ident),
+                );
+            }
+            if variant.discriminant.is_some() {
+                return Err(
+                    Error::custom("Cannot use discriminants with repr, use key instead")
+                        .with_span(&variant.ident),
+                );
+            }
+
+            let discriminant = match variant.rename {
+                None => next,
+                Some(Key::Integer(key)) => key,
+                Some(Key::String(_)) => {
+                    return Err(
+                        Error::custom("Cannot use string keys with repr").with_span(&variant.ident)
+                    );
+                }
+            };
+            if !seen.insert(discriminant) {
+                return Err(Error::custom(format!("Duplicate key {}", discriminant))
+                    .with_span(&variant.ident));
+            }
+            variant.rename = Some(Key::Integer(discriminant));
+            next = discriminant.wrapping_add(1);
+        }
+
+        Ok(())
+    }
+}
+
+impl darling::FromMeta for Repr {
+    fn from_string(value: &str) -> darling::Result<Self> {
+        match value {
+            "int" => Ok(Repr::Int),
+            _ => Err(darling::Error::unknown_value(value)),
+        }
+    }
+}
+
+/// Where clause predicates replacing the bounds inferred for the derived impls, given either for
+/// both derives (`bound = "..."`) or separately (`bound(encode = "...", decode = "...")`).
+pub struct Bound {
+    pub encode: Option<Vec<WherePredicate>>,
+    pub decode: Option<Vec<WherePredicate>>,
+}
+
+impl Bound {
+    fn parse_predicates(value: &str) -> darling::Result<Vec<WherePredicate>> {
+        let predicates = Punctuated::<WherePredicate, Token![,]>::parse_terminated
+            .parse_str(value)
+            .map_err(|e| darling::Error::custom(format!("invalid bound: {}", e)))?;
+        Ok(predicates.into_iter().collect())
+    }
+}
+
+impl darling::FromMeta for Bound {
+    fn from_string(value: &str) -> darling::Result<Self> {
+        let predicates = Self::parse_predicates(value)?;
+        Ok(Bound {
+            encode: Some(predicates.clone()),
+            decode: Some(predicates),
+        })
+    }
+
+    fn from_list(items: &[NestedMeta]) -> darling::Result<Self> {
+        let mut bound = Bound {
+            encode: None,
+            decode: None,
+        };
+        for item in items {
+            let expected = || Error::custom("Expected encode = \"...\" or decode = \"...\"");
+            let nv = match item {
+                NestedMeta::Meta(Meta::NameValue(nv)) => nv,
+                _ => return Err(expected().with_span(item)),
+            };
+            let predicates = if nv.path.is_ident("encode") {
+                &mut bound.encode
+            } else if nv.path.is_ident("decode") {
+                &mut bound.decode
+            } else {
+                return Err(expected().with_span(&nv.path));
+            };
+            if predicates.is_some() {
+                return Err(Error::custom("Duplicate bound").with_span(&nv.path));
+            }
+            *predicates = Some(match &nv.lit {
+                Lit::Str(s) => Self::parse_predicates(&s.value()).map_err(|e| e.with_span(s))?,
+                lit => return Err(Error::unexpected_lit_type(lit).with_span(lit)),
+            });
+        }
+        Ok(bound)
+    }
+}
+
+/// Rule for transforming identifiers into keys.
+pub enum RenameRule {
+    SnakeCase,
+    CamelCase,
+    KebabCase,
+    PascalCase,
+}
+
+impl RenameRule {
+    /// Transform the given identifier (either in snake_case or PascalCase) according to the rule.
+    fn apply(&self, ident: &str) -> String {
+        // Split the identifier into lowercase words.
+        let mut words: Vec<String> = vec![];
+        let mut prev_lowercase = false;
+        for c in ident.chars() {
+            if c == '_' {
+                words.push(String::new());
+                prev_lowercase = false;
+                continue;
+            }
+            if (c.is_uppercase() && prev_lowercase) || words.is_empty() {
+                words.push(String::new());
+            }
+            words.last_mut().unwrap().extend(c.to_lowercase());
+            prev_lowercase = c.is_lowercase() || c.is_numeric();
+        }
+        words.retain(|w| !w.is_empty());
+
+        let capitalize = |w: &String| {
+            let mut chars = w.chars();
+            chars
+                .next()
+                .map(|c| c.to_uppercase().chain(chars).collect())
+                .unwrap_or_default()
+        };
+
+        match self {
+            RenameRule::SnakeCase => words.join("_"),
+            RenameRule::KebabCase => words.join("-"),
+            RenameRule::PascalCase => words.iter().map(capitalize).collect(),
+            RenameRule::CamelCase => words
+                .iter()
+                .enumerate()
+                .map(|(i, w)| if i == 0 { w.clone() } else { capitalize(w) })
+                .collect(),
+        }
+    }
+}
+
+impl darling::FromMeta for RenameRule {
+    fn from_string(value: &str) -> darling::Result<Self> {
+        match value {
+            "snake_case" => Ok(RenameRule::SnakeCase),
+            "camelCase" => Ok(RenameRule::CamelCase),
+            "kebab-case" => Ok(RenameRule::KebabCase),
+            "PascalCase" => Ok(RenameRule::PascalCase),
+            _ => Err(darling::Error::unknown_value(value)),
+        }
+    }
+
+    fn from_value(value: &Lit) -> darling::Result<Self> {
+        (match *value {
+            Lit::Str(ref s) => Self::from_string(&s.value()),
+            _ => Err(darling::Error::unexpected_lit_type(value)),
+        })
+        .map_err(|e| e.with_span(value))
+    }
 }
 
 pub enum Key {
@@ -94,6 +815,7 @@ impl darling::FromMeta for Key {
 
 #[derive(FromField)]
 #[darling(attributes(cbor))]
+#[darling(and_then = "Self::validate")]
 pub struct Field {
     pub ident: Option<Ident>,
     pub ty: Type,
@@ -101,23 +823,192 @@ pub struct Field {
     #[darling(rename = "rename")]
     pub rename: Option<Key>,
 
+    #[darling(rename = "key")]
+    pub key: Option<u64>,
+
     #[darling(rename = "optional")]
     pub optional: Flag,
 
     #[darling(rename = "skip")]
     pub skip: Flag,
 
+    #[darling(rename = "embed")]
+    pub embed: Flag,
+
+    #[darling(rename = "flatten_rest")]
+    pub flatten_rest: Flag,
+
+    #[darling(rename = "default")]
+    pub default: Option<Override<Path>>,
+
     #[darling(rename = "skip_serializing_if")]
     pub skip_serializing_if: Option<Path>,
 
+    #[darling(rename = "skip_serializing_if_default")]
+    pub skip_serializing_if_default: Flag,
+
     #[darling(rename = "serialize_with")]
     pub serialize_with: Option<Path>,
 
     #[darling(rename = "deserialize_with")]
     pub deserialize_with: Option<Path>,
+
+    #[darling(rename = "with")]
+    pub with: Option<Path>,
 }
 
 impl Field {
+    fn validate(mut self) -> Result<Self> {
+        // Markers carry no data, so they are never encoded.
+        if is_phantom_data(&self.ty) {
+            self.skip = Flag::present();
+        }
+
+        if let Some(with) = self.with.take() {
+            if self.serialize_with.is_some() || self.deserialize_with.is_some() {
+                return Err(Error::custom("Cannot set with and serialize_with").with_span(&with));
+            }
+            // Delegate to the encode and decode functions of the given module.
+            let function = |name| {
+                let mut path = with.clone();
+                path.segments.push(Ident::new(name, with.span()).into());
+                path
+            };
+            self.serialize_with = Some(function("encode"));
+            self.deserialize_with = Some(function("decode"));
+        }
+
+        if self.skip.is_present() {
+            // Skipped fields never appear in the encoding, so only the default value may be set.
+            if self.rename.is_some() || self.key.is_some() {
+                return Err(Error::custom("Cannot set skip and rename").with_span(&self.skip));
+            }
+            if self.optional.is_present()
+                || self.skip_serializing_if.is_some()
+                || self.skip_serializing_if_default.is_present()
+            {
+                return Err(Error::custom("Cannot set skip and optional").with_span(&self.skip));
+            }
+            if self.embed.is_present() || self.flatten_rest.is_present() {
+                return Err(Error::custom("Cannot set skip and embed").with_span(&self.skip));
+            }
+            if self.serialize_with.is_some() || self.deserialize_with.is_some() {
+                return Err(
+                    Error::custom("Cannot set skip and serialize_with").with_span(&self.skip)
+                );
+            }
+        }
+
+        if self.embed.is_present() {
+            if self.rename.is_some() || self.key.is_some() {
+                return Err(Error::custom("Cannot set embed and rename").with_span(&self.embed));
+            }
+            if self.optional.is_present()
+                || self.skip_serializing_if.is_some()
+                || self.skip_serializing_if_default.is_present()
+            {
+                return Err(Error::custom("Cannot set embed and optional").with_span(&self.embed));
+            }
+            if self.default.is_some() {
+                return Err(Error::custom("Cannot set embed and default").with_span(&self.embed));
+            }
+            if self.serialize_with.is_some() || self.deserialize_with.is_some() {
+                return Err(
+                    Error::custom("Cannot set embed and serialize_with").with_span(&self.embed)
+                );
+            }
+        }
+
+        if self.flatten_rest.is_present() {
+            if self.embed.is_present() {
+                return Err(Error::custom("Cannot set flatten_rest and embed")
+                    .with_span(&self.flatten_rest));
+            }
+            if self.rename.is_some() || self.key.is_some() {
+                return Err(Error::custom("Cannot set flatten_rest and rename")
+                    .with_span(&self.flatten_rest));
+            }
+            if self.optional.is_present()
+                || self.skip_serializing_if.is_some()
+                || self.skip_serializing_if_default.is_present()
+            {
+                return Err(Error::custom("Cannot set flatten_rest and optional")
+                    .with_span(&self.flatten_rest));
+            }
+            if self.default.is_some() {
+                return Err(Error::custom("Cannot set flatten_rest and default")
+                    .with_span(&self.flatten_rest));
+            }
+            if self.serialize_with.is_some() || self.deserialize_with.is_some() {
+                return Err(Error::custom("Cannot set flatten_rest and serialize_with")
+                    .with_span(&self.flatten_rest));
+            }
+        }
+
+        if self.optional.is_present() && self.default.is_some() {
+            // A missing key of an optional field always decodes the same as a null value.
+            return Err(Error::custom("Cannot set optional and default").with_span(&self.optional));
+        }
+
+        if self.skip_serializing_if.is_some() && self.skip_serializing_if_default.is_present() {
+            return Err(Error::custom(
+                "Cannot set skip_serializing_if and skip_serializing_if_default",
+            )
+            .with_span(&self.skip_serializing_if_default));
+        }
+
+        if let Some(key) = self.key {
+            if self.rename.is_some() {
+                return Err(Error::custom("Cannot set rename and key").with_span(&self.ty));
+            }
+            self.rename = Some(Key::Integer(key));
+        }
+
+        Ok(self)
+    }
+
+    /// Whether the entries of the field are hoisted into the parent map, either because it is
+    /// embedded or because it collects all the remaining entries.
+    pub fn is_flattened(&self) -> bool {
+        self.embed.is_present() || self.flatten_rest.is_present()
+    }
+
+    /// Whether the field may be left out of the encoding, either because it is omitted when
+    /// encoding or because it has a value to use when missing.
+    pub fn is_omittable(&self) -> bool {
+        self.optional.is_present()
+            || self.default.is_some()
+            || self.skip_serializing_if.is_some()
+            || self.skip_serializing_if_default.is_present()
+    }
+
+    /// Whether the default value of the field type is used when the field is skipped or missing.
+    pub fn uses_type_default(&self) -> bool {
+        match &self.default {
+            Some(Override::Explicit(_)) => false,
+            Some(Override::Inherit) => true,
+            None => self.skip.is_present() || self.skip_serializing_if_default.is_present(),
+        }
+    }
+
+    /// Expression constructing the value used when the field is missing, if configured.
+    ///
+    /// Fields omitted when equal to their default value always use the default value.
+    pub fn to_default_expr(&self) -> Option<TokenStream> {
+        let default = match &self.default {
+            None if self.skip_serializing_if_default.is_present() => &Override::Inherit,
+            None => return None,
+            Some(default) => default,
+        };
+        match default {
+            Override::Inherit => {
+                let ty = &self.ty;
+                Some(quote_spanned!(ty.span()=> <#ty as ::core::default::Default>::default()))
+            }
+            Override::Explicit(path) => Some(quote!( #path() )),
+        }
+    }
+
     pub fn to_cbor_key_expr(&self) -> TokenStream {
         self.rename
             .as_ref()
@@ -143,6 +1034,7 @@ impl Field {
 
 #[derive(FromVariant)]
 #[darling(attributes(cbor))]
+#[darling(and_then = "Self::validate")]
 pub struct Variant {
     pub ident: Ident,
     pub discriminant: Option<Expr>,
@@ -151,6 +1043,9 @@ pub struct Variant {
     #[darling(rename = "rename")]
     pub rename: Option<Key>,
 
+    #[darling(rename = "key")]
+    pub key: Option<u64>,
+
     #[darling(rename = "as_array")]
     pub as_array: Flag,
 
@@ -166,11 +1061,77 @@ pub struct Variant {
     #[darling(rename = "allow_unknown")]
     pub allow_unknown: Flag,
 
+    #[darling(rename = "deny_unknown_fields")]
+    pub deny_unknown_fields: Flag,
+
     #[darling(rename = "missing")]
     pub missing: Flag,
+
+    /// Fallback for any unrecognized variant, see the `Decode` and `Encode` derives.
+    #[darling(rename = "unknown")]
+    pub unknown: Flag,
 }
 
 impl Variant {
+    fn validate(mut self) -> Result<Self> {
+        if let Some(key) = self.key {
+            if self.rename.is_some() {
+                return Err(Error::custom("Cannot set rename and key").with_span(&self.ident));
+            }
+            self.rename = Some(Key::Integer(key));
+        }
+
+        if self.deny_unknown_fields.is_present() {
+            validate_deny_unknown_fields(
+                &self.deny_unknown_fields,
+                &self.allow_unknown,
+                &self.fields.fields,
+            )?;
+        }
+
+        Ok(self)
+    }
+
+    /// Whether the variant is a unit variant encoded as its bare key or discriminant (unless the
+    /// enum is internally tagged).
+    fn is_bare_unit(&self) -> bool {
+        self.fields.is_unit() && !self.as_struct.is_present()
+    }
+
+    /// Value the variant is encoded as when it is a bare unit variant, unless it has a discriminant
+    /// other than an integer literal.
+    fn unit_value(&self) -> Option<oasis_cbor_value::Value> {
+        match self.discriminant {
+            Some(_) => self.discriminant_value(),
+            None => Some(self.to_cbor_key()),
+        }
+    }
+
+    /// Value of the discriminant, if it is an integer literal.
+    fn discriminant_value(&self) -> Option<oasis_cbor_value::Value> {
+        let (negative, lit) = match self.discriminant.as_ref()? {
+            Expr::Lit(lit) => (false, lit),
+            Expr::Unary(syn::ExprUnary {
+                op: syn::UnOp::Neg(_),
+                expr,
+                ..
+            }) => match expr.as_ref() {
+                Expr::Lit(lit) => (true, lit),
+                _ => return None,
+            },
+            _ => return None,
+        };
+        let n = match &lit.lit {
+            Lit::Int(n) => n.base10_parse::<u64>().ok()?,
+            _ => return None,
+        };
+        if negative && n > 0 {
+            Some(oasis_cbor_value::Value::Negative(-i128::from(n)))
+        } else {
+            Some(oasis_cbor_value::Value::Unsigned(n))
+        }
+    }
+
     pub fn to_cbor_key_expr(&self) -> TokenStream {
         self.rename
             .as_ref()
@@ -181,4 +1142,15 @@ impl Variant {
                 quote!( __cbor::values::IntoCborValue::into_cbor_value(#ident) )
             })
     }
+
+    pub fn to_cbor_key(&self) -> oasis_cbor_value::Value {
+        self.rename
+            .as_ref()
+            .map(Key::to_cbor_key)
+            .unwrap_or_else(|| {
+                // No explicit rename, use identifier name.
+                let ident = self.ident.to_string();
+                ident.into_cbor_value()
+            })
+    }
 }
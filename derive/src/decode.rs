@@ -16,8 +16,55 @@ pub fn derive(input: DeriveInput) -> TokenStream {
         Err(e) => return e.write_errors(),
     };
 
+    // Types with lifetime parameters may borrow from the encoded data.
+    let flavor = Flavor::new(dec.generics.lifetimes().next().is_some());
+
     let (dec_impl, include_dec_default) = match dec.data.as_ref() {
+        darling::ast::Data::Enum(_) if flavor.borrowed => {
+            dec.ident
+                .span()
+                .unwrap()
+                .error("cannot derive decoder for enum with lifetime parameters".to_string())
+                .emit();
+            return quote!();
+        }
         darling::ast::Data::Enum(variants) => (derive_enum(&dec, variants), false),
+        darling::ast::Data::Struct(fields) if dec.as_null.is_present() => {
+            (derive_null_struct(fields, &flavor), true)
+        }
+        darling::ast::Data::Struct(fields) if dec.accept_array_or_map.is_present() => {
+            // Dispatch on the major type of the encoding, so that both the positional and the keyed
+            // form of the struct are accepted.
+            let value_ty = &flavor.value_ty;
+            let inner_array = derive_struct(
+                &dec.ident,
+                false,
+                true,
+                dec.allow_unknown.is_present(),
+                fields.clone(),
+                quote!(Self),
+                &flavor,
+            );
+            let inner_map = derive_struct(
+                &dec.ident,
+                false,
+                false,
+                dec.allow_unknown.is_present(),
+                fields,
+                quote!(Self),
+                &flavor,
+            );
+            (
+                quote! {
+                    if let #value_ty::Array(_) = value {
+                        Ok({ #inner_array })
+                    } else {
+                        Ok({ #inner_map })
+                    }
+                },
+                true,
+            )
+        }
         darling::ast::Data::Struct(fields) => {
             let inner = derive_struct(
                 &dec.ident,
@@ -26,24 +73,111 @@ pub fn derive(input: DeriveInput) -> TokenStream {
                 dec.allow_unknown.is_present(),
                 fields,
                 quote!(Self),
+                &flavor,
             );
             (quote!(Ok({ #inner })), true)
         }
     };
 
-    let dec_default_impl =
-        if (include_dec_default && !dec.no_default.is_present()) || dec.with_default.is_present() {
-            quote! {
-                fn try_default() -> ::std::result::Result<Self, __cbor::DecodeError> {
-                    Ok(Default::default())
-                }
+    // Strip the semantic tag, if any, before decoding the inner value.
+    let dec_impl = match dec.semantic_tag {
+        Some(tag) => quote! {
+            let value = __cbor::macros::strip_cbor_tag(value, #tag)?;
+            #dec_impl
+        },
+        None => dec_impl,
+    };
+
+    let try_default_fn = if flavor.borrowed {
+        quote!(try_default_borrowed)
+    } else {
+        quote!(try_default)
+    };
+    let include_dec_default =
+        (include_dec_default && !dec.no_default.is_present()) || dec.with_default.is_present();
+    let dec_default_impl = if include_dec_default {
+        quote! {
+            fn #try_default_fn() -> ::core::result::Result<Self, __cbor::DecodeError> {
+                Ok(Default::default())
             }
-        } else {
-            quote!()
-        };
+        }
+    } else {
+        quote!()
+    };
 
+    // Fields decoded via a custom function or skipped altogether do not need to be decodable,
+    // while fields falling back to the default value of their type need one.
+    let decode_bound = if flavor.borrowed {
+        quote!(__cbor::DecodeBorrowed<'__de>)
+    } else {
+        quote!(__cbor::Decode)
+    };
+    let mut bounded_types = Vec::new();
+    for (_, field) in dec.coded_fields() {
+        if !field.skip.is_present() && field.deserialize_with.is_none() {
+            bounded_types.push((&field.ty, decode_bound.clone()));
+        }
+        if field.uses_type_default() {
+            bounded_types.push((&field.ty, quote!(::core::default::Default)));
+        }
+    }
+    let custom_bound = dec.bound.as_ref().and_then(|bound| bound.decode.as_ref());
+    let mut generics = match custom_bound {
+        Some(predicates) => util::replace_bounds(&dec.generics, predicates),
+        None => util::add_bounds(&dec.generics, bounded_types),
+    };
     let dec_ty_ident = &dec.ident;
-    let (imp, ty, wher) = dec.generics.split_for_impl();
+    if include_dec_default && custom_bound.is_none() && dec.generics.type_params().next().is_some()
+    {
+        // Whether the type has a default value depends on its type parameters.
+        let (_, ty, _) = dec.generics.split_for_impl();
+        generics
+            .make_where_clause()
+            .predicates
+            .push(syn::parse_quote!(#dec_ty_ident #ty: ::core::default::Default));
+    }
+    let (imp, ty, wher) = generics.split_for_impl();
+
+    if flavor.borrowed {
+        // Introduce a lifetime for the encoded data which outlives all lifetime parameters.
+        let mut generics = generics.clone();
+        let lifetimes = dec.generics.lifetimes().map(|l| &l.lifetime);
+        generics
+            .params
+            .insert(0, syn::parse_quote!('__de: #(#lifetimes)+*));
+        let (imp, _, _) = generics.split_for_impl();
+
+        return util::wrap_in_const(quote! {
+            use #cbor_crate as __cbor;
+
+            #[automatically_derived]
+            impl #imp __cbor::DecodeBorrowed<'__de> for #dec_ty_ident #ty #wher {
+                #dec_default_impl
+
+                fn try_from_cbor_value_borrowed(value: __cbor::ValueRef<'__de>) -> ::core::result::Result<Self, __cbor::DecodeError> {
+                    #dec_impl
+                }
+            }
+        });
+    }
+
+    let dec_in_place_impl = match derive_struct_in_place(&dec) {
+        Some(inner) => {
+            let inner = match dec.semantic_tag {
+                Some(tag) => quote! {
+                    let value = __cbor::macros::strip_cbor_tag(value, #tag)?;
+                    #inner
+                },
+                None => inner,
+            };
+            quote! {
+                fn decode_in_place(&mut self, value: __cbor::Value) -> ::core::result::Result<(), __cbor::DecodeError> {
+                    #inner
+                }
+            }
+        }
+        None => quote!(),
+    };
 
     util::wrap_in_const(quote! {
         use #cbor_crate as __cbor;
@@ -52,18 +186,114 @@ pub fn derive(input: DeriveInput) -> TokenStream {
         impl #imp __cbor::Decode for #dec_ty_ident #ty #wher {
             #dec_default_impl
 
-            fn try_from_cbor_value(value: __cbor::Value) -> ::std::result::Result<Self, __cbor::DecodeError> {
+            fn try_from_cbor_value(value: __cbor::Value) -> ::core::result::Result<Self, __cbor::DecodeError> {
                 #dec_impl
             }
+
+            #dec_in_place_impl
         }
     })
 }
 
-fn field_decode_fn(field: &Field) -> TokenStream {
+/// Paths used by the generated decoder, which differ in case it borrows from the encoded data.
+struct Flavor {
+    borrowed: bool,
+    /// Type of the CBOR value being decoded.
+    value_ty: TokenStream,
+    /// Function decoding from a CBOR value.
+    decode_fn: TokenStream,
+    /// Function decoding from a CBOR value, using the default for null/undefined values.
+    decode_default_fn: TokenStream,
+}
+
+impl Flavor {
+    fn new(borrowed: bool) -> Self {
+        if borrowed {
+            Self {
+                borrowed,
+                value_ty: quote!(__cbor::ValueRef),
+                decode_fn: quote!(__cbor::DecodeBorrowed::try_from_cbor_value_borrowed),
+                decode_default_fn: quote!(
+                    __cbor::DecodeBorrowed::try_from_cbor_value_borrowed_default
+                ),
+            }
+        } else {
+            Self {
+                borrowed,
+                value_ty: quote!(__cbor::Value),
+                decode_fn: quote!(__cbor::Decode::try_from_cbor_value),
+                decode_default_fn: quote!(__cbor::Decode::try_from_cbor_value_default),
+            }
+        }
+    }
+}
+
+fn field_decode_fn(field: &Field, flavor: &Flavor) -> TokenStream {
+    let decode_fn = &flavor.decode_default_fn;
     if let Some(custom_decode_fn) = &field.deserialize_with {
-        quote!((|v| __cbor::Decode::try_from_cbor_value_default(v).and_then(#custom_decode_fn)))
+        quote!((|v| #decode_fn(v).and_then(#custom_decode_fn)))
     } else {
-        quote!(__cbor::Decode::try_from_cbor_value_default)
+        decode_fn.clone()
+    }
+}
+
+/// Name of a map key as used in the path reported by `DecodeError::in_field`.
+fn key_path_segment(key: oasis_cbor_value::Value) -> String {
+    match key {
+        oasis_cbor_value::Value::TextString(name) => name,
+        oasis_cbor_value::Value::Unsigned(n) => n.to_string(),
+        key => format!("{:?}", key),
+    }
+}
+
+/// Major types of the keys of map-encoded fields, used to tell unknown keys from keys of an
+/// unexpected type.
+fn key_types_expr<'a>(fields: impl IntoIterator<Item = &'a &'a Field>) -> TokenStream {
+    let (mut integer, mut text) = (false, false);
+    for field in fields {
+        if field.skip.is_present() || field.is_flattened() {
+            continue;
+        }
+        match field.to_cbor_key() {
+            oasis_cbor_value::Value::Unsigned(_) => integer = true,
+            _ => text = true,
+        }
+    }
+    let mut types = Vec::new();
+    if integer {
+        // Negative integers do not match any field, but are still keys of the same kind.
+        types.push(quote!(__cbor::MajorType::Unsigned));
+        types.push(quote!(__cbor::MajorType::Negative));
+    }
+    if text {
+        types.push(quote!(__cbor::MajorType::TextString));
+    }
+    quote!(&[#(#types),*])
+}
+
+fn field_skip_value(field: &Field) -> TokenStream {
+    field
+        .to_default_expr()
+        .unwrap_or_else(|| quote_spanned!(field.ty.span()=> ::core::default::Default::default()))
+}
+
+/// Decodes a struct without encoded fields from null, using default values for all its fields.
+fn derive_null_struct(fields: darling::ast::Fields<&Field>, flavor: &Flavor) -> TokenStream {
+    let value_ty = &flavor.value_ty;
+    let field_values = fields.iter().map(|f| field_skip_value(f));
+    let construct = match fields.style {
+        darling::ast::Style::Struct => {
+            let field_idents = fields.iter().map(|f| f.ident.as_ref().unwrap());
+            quote!(Self { #(#field_idents: #field_values),* })
+        }
+        darling::ast::Style::Tuple => quote!(Self(#(#field_values),*)),
+        darling::ast::Style::Unit => quote!(Self),
+    };
+    quote! {
+        match value {
+            #value_ty::Simple(__cbor::SimpleValue::NullValue | __cbor::SimpleValue::Undefined) => Ok(#construct),
+            _ => Err(__cbor::DecodeError::UnexpectedType),
+        }
     }
 }
 
@@ -74,21 +304,65 @@ fn derive_struct(
     allow_unknown: bool,
     fields: darling::ast::Fields<&Field>,
     self_ty: TokenStream,
+    flavor: &Flavor,
 ) -> TokenStream {
+    let value_ty = &flavor.value_ty;
+
     if transparent {
-        // Transparently forward the implementation to the underlying type. This is only valid for
-        // newtype structs.
-        let decode_fn = quote_spanned!(ident.span()=> __cbor::Decode::try_from_cbor_value_default);
+        // Transparently forward the implementation to the underlying type (or the custom decoding
+        // function, if any). This is only valid for newtype structs.
+        let decode_fn = field_decode_fn(fields.fields[0], flavor);
+        let decode_fn = quote_spanned!(ident.span()=> #decode_fn);
         quote!(Self(#decode_fn(value)?))
     } else {
         // Process all fields and decode the structure as a map or array.
         let as_array = fields.is_tuple() || fields.is_newtype() || as_array;
+        let is_unit = fields.is_unit();
+        // Skipped fields have no corresponding array element.
+        let element_count = fields.iter().filter(|f| !f.skip.is_present()).count();
+        let key_types = if as_array {
+            quote!(&[])
+        } else {
+            key_types_expr(fields.iter())
+        };
+
+        // Split off the entries of an embedded or catch-all field (if any) before processing the
+        // fields.
+        let embedded = fields
+            .iter()
+            .find(|f| f.is_flattened() && !f.skip.is_present());
+        let extract_embedded = match embedded {
+            Some(field) if as_array => {
+                let attr = if field.embed.is_present() {
+                    "embed"
+                } else {
+                    "flatten_rest"
+                };
+                field
+                    .ident
+                    .span()
+                    .unwrap()
+                    .error(format!("cannot use {} attribute in arrays", attr))
+                    .emit();
+                return quote!({});
+            }
+            Some(_) => {
+                let keys = fields
+                    .iter()
+                    .filter(|f| !f.is_flattened() && !f.skip.is_present())
+                    .map(|f| f.to_cbor_key_expr());
+                quote! {
+                    let (value, embedded) = __cbor::macros::split_cbor_map(value, __cbor::macros::vec![#(#keys),*])?;
+                }
+            }
+            None => quote!(),
+        };
 
         let (extract_value, field_map_items): (_, Vec<_>) = if as_array {
             // Fields represented as an array.
             let extract_value = quote! {
                 match value {
-                    __cbor::Value::Array(array) => array,
+                    #value_ty::Array(array) => array,
                     _ => return Err(__cbor::DecodeError::UnexpectedType),
                 }
             };
@@ -106,12 +380,32 @@ fn derive_struct(
                         }),
                     };
 
+                    let name = i.to_string();
                     let field_value = if field.skip.is_present() {
-                        // If the field should be skipped, always use Default::default() as value.
-                        quote_spanned!(field_ty.span()=> ::std::default::Default::default())
+                        // If the field should be skipped, always use the default value.
+                        field_skip_value(field)
                     } else {
-                        let decode_fn = field_decode_fn(&field);
-                        quote!(#decode_fn(it.next().ok_or(__cbor::DecodeError::MissingField)?)?)
+                        let decode_fn = field_decode_fn(field, flavor);
+                        match field.to_default_expr() {
+                            Some(default) => quote! {
+                                match it.next() {
+                                    Some(v) => #decode_fn(v).map_err(|e| e.in_field(#name))?,
+                                    None => #default,
+                                }
+                            },
+                            // A missing optional field decodes as undefined, which is the same as a
+                            // null value except for nested options.
+                            None if field.optional.is_present() => quote! {
+                                #decode_fn(it.next().unwrap_or(#value_ty::Simple(__cbor::SimpleValue::Undefined)))
+                                    .map_err(|e| e.in_field(#name))?
+                            },
+                            None => quote! {
+                                it.next()
+                                    .ok_or(__cbor::DecodeError::MissingField)
+                                    .and_then(#decode_fn)
+                                    .map_err(|e| e.in_field(#name))?
+                            },
+                        }
                     };
 
                     quote! { #field_ident: #field_value }
@@ -121,13 +415,13 @@ fn derive_struct(
             (extract_value, field_map_items)
         } else if fields.is_unit() {
             // This is a unit struct with no fields.
-            (quote! {Vec::<()>::new()}, vec![])
+            (quote! {__cbor::macros::Vec::<()>::new()}, vec![])
         } else {
             // Field represented as a map.
             let extract_value = quote! {
                 match value {
                     // Sort map entries by CBOR keys.
-                    __cbor::Value::Map(mut map) => { map.sort(); map },
+                    #value_ty::Map(mut map) => { map.sort(); map },
                     _ => return Err(__cbor::DecodeError::UnexpectedType),
                 }
             };
@@ -142,20 +436,36 @@ fn derive_struct(
                     let field_ident = field.ident.as_ref().unwrap();
                     let field_ty = &field.ty;
                     let key = field.to_cbor_key_expr();
+                    let name = key_path_segment(field.to_cbor_key());
 
                     let field_value = if field.skip.is_present() {
-                        // If the field should be skipped, always use Default::default() as value.
-                        quote_spanned!(field_ty.span()=> ::std::default::Default::default())
+                        // If the field should be skipped, always use the default value.
+                        field_skip_value(field)
+                    } else if field.is_flattened() {
+                        // Embedded and catch-all fields are decoded from all the remaining entries.
+                        let decode_fn = &flavor.decode_fn;
+                        let decode_fn = quote_spanned!(field_ty.span()=> #decode_fn);
+                        quote!(#decode_fn(embedded)?)
                     } else {
-                        let decode_fn = field_decode_fn(&field);
+                        let decode_fn = field_decode_fn(field, flavor);
                         let destruct_fn = quote_spanned!(field_ty.span()=>
                             __cbor::macros::destructure_cbor_map_peek_value_strict);
-                        let field_value = quote!({
-                            let v: Option<__cbor::Value> = #destruct_fn(&mut it, #key)?;
-                            #decode_fn(v.unwrap_or(__cbor::Value::Simple(__cbor::SimpleValue::NullValue)))?
-                        });
-
-                        field_value
+                        match field.to_default_expr() {
+                            // Only use the default value when the key is absent.
+                            Some(default) => quote!({
+                                let v: Option<#value_ty> = #destruct_fn(&mut it, #key, #allow_unknown, #key_types)?;
+                                match v {
+                                    Some(v) => #decode_fn(v).map_err(|e| e.in_field(#name))?,
+                                    None => #default,
+                                }
+                            }),
+                            // A missing key decodes as undefined, see above.
+                            None => quote!({
+                                let v: Option<#value_ty> = #destruct_fn(&mut it, #key, #allow_unknown, #key_types)?;
+                                #decode_fn(v.unwrap_or(#value_ty::Simple(__cbor::SimpleValue::Undefined)))
+                                    .map_err(|e| e.in_field(#name))?
+                            }),
+                        }
                     };
 
                     quote! { #field_ident: #field_value }
@@ -167,15 +477,28 @@ fn derive_struct(
 
         let handle_unknown_fields = if allow_unknown {
             quote!()
-        } else {
+        } else if as_array {
+            // Extra array elements are reported by their index.
+            let index = element_count as u64;
             quote! {
                 if it.next().is_some() {
-                    return Err(__cbor::DecodeError::UnknownField);
+                    let key = __cbor::Value::Unsigned(#index);
+                    return Err(__cbor::DecodeError::UnknownField { key: Some(key) });
+                }
+            }
+        } else if is_unit {
+            quote!()
+        } else {
+            quote! {
+                if let Some((key, _)) = it.next() {
+                    let key = __cbor::macros::DecodableValue::into_value(key);
+                    return Err(__cbor::macros::unknown_cbor_map_key(key, #key_types));
                 }
             }
         };
 
         quote! {
+            #extract_embedded
             let fields = #extract_value;
             let mut it = fields.into_iter().peekable();
 
@@ -190,31 +513,116 @@ fn derive_struct(
     }
 }
 
-fn derive_enum(dec: &Codable, variants: Vec<&Variant>) -> TokenStream {
-    // Make sure the transparent attribute cannot be used on an enum.
+/// Decodes a struct into an existing instance, decoding each field in place so that allocations
+/// of its fields are reused. Returns `None` for structs where this is not supported, which then
+/// use the default implementation replacing the whole instance.
+fn derive_struct_in_place(dec: &Codable) -> Option<TokenStream> {
+    let fields = match dec.data.as_ref() {
+        darling::ast::Data::Struct(fields) => fields,
+        darling::ast::Data::Enum(_) => return None,
+    };
+    if dec.as_null.is_present() {
+        return None;
+    }
     if dec.transparent.is_present() {
-        dec.ident
-            .span()
-            .unwrap()
-            .error("cannot use transparent attribute on an enum".to_string())
-            .emit();
-        return quote!({});
+        let field = fields.fields[0];
+        if field.deserialize_with.is_some() {
+            return None;
+        }
+        let decode_fn = quote_spanned!(dec.ident.span()=> __cbor::Decode::decode_in_place_default);
+        return Some(quote!(#decode_fn(&mut self.0, value)));
     }
-
-    // Make sure decoding of untagged enums is not supported.
-    if dec.untagged.is_present() {
-        dec.ident
-            .span()
-            .unwrap()
-            .error("cannot derive decoder for untagged enum".to_string())
-            .emit();
-        return quote!({});
+    if dec.as_array.is_present()
+        || dec.accept_array_or_map.is_present()
+        || fields.style != darling::ast::Style::Struct
+        || fields.iter().any(|f| f.is_flattened())
+    {
+        return None;
     }
 
+    // Sort struct fields by their CBOR keys to make destructure_cbor_map_peek_value_strict work.
+    let mut fields = fields.fields.clone();
+    fields.sort_by(|a, b| a.to_cbor_key().partial_cmp(&b.to_cbor_key()).unwrap());
+    let allow_unknown = dec.allow_unknown.is_present();
+    let key_types = key_types_expr(&fields);
+
+    let decode_fields = fields.iter().map(|field| {
+        let field_ident = field.ident.as_ref().unwrap();
+        let field_ty = &field.ty;
+        if field.skip.is_present() {
+            // If the field should be skipped, always use the default value.
+            let default = field_skip_value(field);
+            return quote!(self.#field_ident = #default;);
+        }
+
+        let key = field.to_cbor_key_expr();
+        let name = key_path_segment(field.to_cbor_key());
+        let destruct_fn =
+            quote_spanned!(field_ty.span()=> __cbor::macros::destructure_cbor_map_peek_value_strict);
+        let decode = match &field.deserialize_with {
+            // Fields decoded using a custom function are replaced.
+            Some(custom_decode_fn) => quote! {
+                self.#field_ident = __cbor::Decode::try_from_cbor_value_default(v)
+                    .and_then(#custom_decode_fn)
+                    .map_err(|e| e.in_field(#name))?
+            },
+            None => {
+                let decode_fn = quote_spanned!(field_ty.span()=> __cbor::Decode::decode_in_place_default);
+                quote!(#decode_fn(&mut self.#field_ident, v).map_err(|e| e.in_field(#name))?)
+            }
+        };
+        match field.to_default_expr() {
+            // Only use the default value when the key is absent.
+            Some(default) => quote!({
+                let v: Option<__cbor::Value> = #destruct_fn(&mut it, #key, #allow_unknown, #key_types)?;
+                match v {
+                    Some(v) => #decode,
+                    None => self.#field_ident = #default,
+                }
+            }),
+            None => quote!({
+                let v: Option<__cbor::Value> = #destruct_fn(&mut it, #key, #allow_unknown, #key_types)?;
+                let v = v.unwrap_or(__cbor::Value::Simple(__cbor::SimpleValue::Undefined));
+                #decode;
+            }),
+        }
+    });
+
+    let handle_unknown_fields = if allow_unknown {
+        quote!()
+    } else {
+        quote! {
+            if let Some((key, _)) = it.next() {
+                return Err(__cbor::macros::unknown_cbor_map_key(key, #key_types));
+            }
+        }
+    };
+
+    Some(quote! {
+        let fields = match value {
+            // Sort map entries by CBOR keys.
+            __cbor::Value::Map(mut map) => { map.sort(); map },
+            _ => return Err(__cbor::DecodeError::UnexpectedType),
+        };
+        let mut it = fields.into_iter().peekable();
+
+        #(#decode_fields)*
+
+        #handle_unknown_fields
+
+        Ok(())
+    })
+}
+
+fn derive_enum(dec: &Codable, variants: Vec<&Variant>) -> TokenStream {
     if variants.is_empty() {
         return quote! { Self };
     }
 
+    if dec.untagged.is_present() {
+        return derive_untagged_enum(variants);
+    }
+
     // Generate decoders for all unit variants.
     let unit_decoders = variants.iter().filter_map(|variant| {
         if !variant.fields.is_unit() || variant.as_struct.is_present() || dec.tag.is_some() {
@@ -245,6 +653,39 @@ fn derive_enum(dec: &Codable, variants: Vec<&Variant>) -> TokenStream {
         })
     });
 
+    // Unit variants encoded as their key also decode from a single-entry map of their key to null
+    // or an empty map, as variants without fields are sometimes encoded that way. The decoders
+    // operate on references to the key and value of the entry.
+    let unit_map_decoders: Vec<_> = variants
+        .iter()
+        .filter_map(|variant| {
+            if !variant.fields.is_unit() || variant.as_struct.is_present() || dec.tag.is_some() {
+                return None;
+            }
+            if variant.skip.is_present() || variant.embed.is_present() {
+                return None;
+            }
+            if variant.discriminant.is_some() || dec.repr.is_some() {
+                // Integer discriminants are only ever decoded from bare integers.
+                return None;
+            }
+
+            let variant_ident = &variant.ident;
+            let key = variant.to_cbor_key_expr();
+            let name = key_path_segment(variant.to_cbor_key());
+
+            Some(quote! {
+                if *key == #key {
+                    return match value {
+                        __cbor::Value::Simple(__cbor::SimpleValue::NullValue) => Ok(Self::#variant_ident),
+                        __cbor::Value::Map(map) if map.is_empty() => Ok(Self::#variant_ident),
+                        _ => Err(__cbor::DecodeError::UnexpectedType.in_field(#name)),
+                    };
+                }
+            })
+        })
+        .collect();
+
     // Generate decoders for all non-unit variants.
     let mut have_missing_variant = false;
     let non_unit_decoders: Vec<_> = variants
@@ -259,15 +700,26 @@ fn derive_enum(dec: &Codable, variants: Vec<&Variant>) -> TokenStream {
             if variant.embed.is_present() {
                 return None;
             }
+            if variant.unknown.is_present() && variant.fields.is_newtype() {
+                // The fallback variant captures the whole value instead.
+                return None;
+            }
 
             let variant_ident = &variant.ident;
             let key = variant.to_cbor_key_expr();
+            let name = key_path_segment(variant.to_cbor_key());
 
             let decoder = if variant.fields.is_newtype() {
                 // Newtype variants map the key directly to the inner value as if transparent was used.
                 let decode_fn =
                     quote_spanned!(variant.ident.span()=> __cbor::Decode::try_from_cbor_value_default);
-                quote!(Self::#variant_ident(#decode_fn(value)?))
+                // Fields of internally tagged variants are not nested under the variant key, so the
+                // key is only added to the path for other variants.
+                if dec.tag.is_some() {
+                    quote!(Self::#variant_ident(#decode_fn(value)?))
+                } else {
+                    quote!(Self::#variant_ident(#decode_fn(value).map_err(|e| e.in_field(#name))?))
+                }
             } else {
                 if dec.tag.is_some() && (variant.as_array.is_present() || variant.fields.is_tuple()) {
                     variant
@@ -287,8 +739,19 @@ fn derive_enum(dec: &Codable, variants: Vec<&Variant>) -> TokenStream {
                     variant.allow_unknown.is_present(),
                     variant.fields.as_ref(),
                     quote!(Self::#variant_ident),
+                    &Flavor::new(false),
                 );
-                quote!({ #inner })
+                if dec.tag.is_some() {
+                    quote!({ #inner })
+                } else {
+                    quote!({
+                        #[allow(clippy::redundant_closure_call)]
+                        let result = (|| -> ::core::result::Result<Self, __cbor::DecodeError> {
+                            Ok({ #inner })
+                        })();
+                        result.map_err(|e| e.in_field(#name))?
+                    })
+                }
             };
 
             if variant.missing.is_present() {
@@ -320,7 +783,7 @@ fn derive_enum(dec: &Codable, variants: Vec<&Variant>) -> TokenStream {
         .collect();
 
     // Generate decoders for all embedded variants.
-    let embedded_decoders: Vec<_> = variants
+    let embedded_variants: Vec<_> = variants
         .iter()
         .filter_map(|variant| {
             if variant.skip.is_present() {
@@ -353,37 +816,91 @@ fn derive_enum(dec: &Codable, variants: Vec<&Variant>) -> TokenStream {
             let variant_ident = &variant.ident;
             let decode_fn =
                 quote_spanned!(variant.ident.span()=> __cbor::Decode::try_from_cbor_value_default);
-
-            // TODO: Can we get rid of clone?
-            Some(quote! {
-                if let Ok(result) = #decode_fn(value.clone()) {
-                    return Ok(Self::#variant_ident(result));
-                }
-            })
+            Some((variant_ident, decode_fn))
         })
         .collect();
+    // Each embedded variant decodes its own copy of the value so that failed attempts leave the
+    // value intact for the following ones, unless the value is not needed after the last one.
+    let embedded_decoders = |move_last: bool| -> Vec<_> {
+        let last = embedded_variants.len().checked_sub(1).filter(|_| move_last);
+        embedded_variants
+            .iter()
+            .enumerate()
+            .map(|(i, (variant_ident, decode_fn))| {
+                let value = if Some(i) == last {
+                    quote!(value)
+                } else {
+                    quote!(value.clone())
+                };
+                quote! {
+                    if let Ok(result) = #decode_fn(#value) {
+                        return Ok(Self::#variant_ident(result));
+                    }
+                }
+            })
+            .collect()
+    };
+
+    // Route any unrecognized value into the fallback variant, if any.
+    let unknown_variant = variants.iter().find(|v| v.unknown.is_present());
+    let fallback = |key: TokenStream| match unknown_variant {
+        Some(variant) if variant.fields.is_newtype() => {
+            let variant_ident = &variant.ident;
+            let decode_fn =
+                quote_spanned!(variant.ident.span()=> __cbor::Decode::try_from_cbor_value_default);
+            quote!(Ok(Self::#variant_ident(#decode_fn(value)?)))
+        }
+        Some(variant) => {
+            let variant_ident = &variant.ident;
+            quote!(Ok(Self::#variant_ident))
+        }
+        None if dec.repr.is_some() => quote! {
+            match value {
+                __cbor::Value::Unsigned(discriminant) => {
+                    Err(__cbor::DecodeError::UnknownVariant { discriminant })
+                }
+                _ => Err(__cbor::DecodeError::UnexpectedType),
+            }
+        },
+        None => quote!(Err(__cbor::DecodeError::UnknownField { key: Some(#key) })),
+    };
+    let captures_unknown = unknown_variant.map_or(false, |v| v.fields.is_newtype());
 
     // Handle internally tagged enums.
     if let Some(tag) = &dec.tag {
+        let tagged_fallback = fallback(quote!(key));
         let tag = tag.to_cbor_key_expr();
 
+        // Restore the tag so that the fallback variant captures the original map.
+        let restore_tag = if captures_unknown {
+            quote! {
+                let mut map = match value {
+                    __cbor::Value::Map(map) => map,
+                    _ => unreachable!(),
+                };
+                if let Some(index) = index {
+                    map.insert(index, (#tag, key));
+                }
+                let value = __cbor::Value::Map(map);
+            }
+        } else {
+            quote!()
+        };
+
         return quote! {
             match value {
                 __cbor::Value::Map(mut map) => {
-                    let key = if let Some((index, _)) = map
-                        .iter()
-                        .enumerate()
-                        .find(|(_, v)| v.0 == #tag)
-                    {
-                        map.remove(index).1
-                    } else {
-                        __cbor::Value::Simple(__cbor::SimpleValue::Undefined)
+                    let index = map.iter().position(|v| v.0 == #tag);
+                    let key = match index {
+                        Some(index) => map.remove(index).1,
+                        None => __cbor::Value::Simple(__cbor::SimpleValue::Undefined),
                     };
                     let value = __cbor::Value::Map(map);
 
                     #(#non_unit_decoders)*
 
-                    Err(__cbor::DecodeError::UnknownField)
+                    #restore_tag
+                    #tagged_fallback
                 },
                 _ => Err(__cbor::DecodeError::UnexpectedType)
             }
@@ -391,44 +908,223 @@ fn derive_enum(dec: &Codable, variants: Vec<&Variant>) -> TokenStream {
     }
 
     // In case there are no non-unit decoders, just omit the match.
+    let value_fallback = fallback(quote!(value));
     if non_unit_decoders.is_empty() {
+        let unit_map_decoders = if unit_map_decoders.is_empty() {
+            quote!()
+        } else {
+            quote! {
+                if let __cbor::Value::Map(map) = &value {
+                    if let [(key, value)] = map.as_slice() {
+                        #(#unit_map_decoders)*
+                    }
+                }
+            }
+        };
+
+        let embedded_decoders = embedded_decoders(false);
         quote! {
+            #unit_map_decoders
             #(#unit_decoders)*
             #(#embedded_decoders)*
 
-            Err(__cbor::DecodeError::UnknownField)
+            #value_fallback
         }
     } else {
-        let embedded_decoders_map = if !embedded_decoders.is_empty() {
+        // Re-assemble the map for embedded variants and the fallback variant.
+        // The key is still needed to report an unknown variant unless the fallback variant captures
+        // the map.
+        let embedded_decoders_map = if captures_unknown {
+            let embedded_decoders = embedded_decoders(false);
             quote! {
-                let value = __cbor::Value::Map(vec![(key, value)]);
+                let value = __cbor::Value::Map(__cbor::macros::vec![(key, value)]);
+                #(#embedded_decoders)*
+            }
+        } else if !embedded_variants.is_empty() {
+            // Only the key is needed afterwards.
+            let embedded_decoders = embedded_decoders(true);
+            quote! {
+                let value = __cbor::Value::Map(__cbor::macros::vec![(key.clone(), value)]);
                 #(#embedded_decoders)*
             }
         } else {
             quote!()
         };
+        let key_fallback = fallback(quote!(key));
+        let unit_map_decoders = if unit_map_decoders.is_empty() {
+            quote!()
+        } else {
+            quote! {
+                {
+                    let (key, value) = (&key, &value);
+                    #(#unit_map_decoders)*
+                }
+            }
+        };
 
+        let embedded_decoders = embedded_decoders(false);
         quote! {
             match value {
                 __cbor::Value::Map(mut map) => {
                     if map.len() != 1 {
-                        return Err(__cbor::DecodeError::UnknownField);
+                        return Err(__cbor::DecodeError::UnknownField { key: None });
                     }
 
                     let (key, value) = map.pop().unwrap();
 
+                    #unit_map_decoders
                     #(#non_unit_decoders)*
                     #embedded_decoders_map
 
-                    Err(__cbor::DecodeError::UnknownField)
+                    #key_fallback
                 },
                 _ => {
                     #(#unit_decoders)*
                     #(#embedded_decoders)*
 
-                    Err(__cbor::DecodeError::UnknownField)
+                    #value_fallback
                 }
             }
         }
     }
 }
+
+/// Attempt at decoding a variant of an untagged enum.
+enum Attempt {
+    /// Compare the value against the given key or discriminant of a unit variant.
+    Unit(TokenStream),
+    /// Decode the value with the given decoder, after checking its shape (if possible).
+    Decode(Option<TokenStream>, TokenStream),
+}
+
+/// Derives the decoder for an untagged enum, which attempts to decode each variant in order.
+fn derive_untagged_enum(variants: Vec<&Variant>) -> TokenStream {
+    let mut fallback = None;
+    let attempts: Vec<_> = variants
+        .iter()
+        .filter_map(|variant| {
+            if variant.skip.is_present() {
+                return None;
+            }
+
+            let variant_ident = &variant.ident;
+            let decode_fn =
+                quote_spanned!(variant.ident.span()=> __cbor::Decode::try_from_cbor_value_default);
+
+            if variant.unknown.is_present() {
+                // The fallback variant is used when no other variant matches.
+                fallback = Some(if variant.fields.is_newtype() {
+                    quote!(Ok(Self::#variant_ident(#decode_fn(value)?)))
+                } else {
+                    quote!(Ok(Self::#variant_ident))
+                });
+                return None;
+            }
+
+            let attempt = if variant.fields.is_unit() && !variant.as_struct.is_present() {
+                // Unit variants are encoded as their key or discriminant.
+                let discriminant = match variant.discriminant {
+                    Some(ref expr) => {
+                        let encoder_fn =
+                            quote_spanned!(variant.ident.span()=> __cbor::Encode::into_cbor_value);
+                        quote!(#encoder_fn(#expr))
+                    }
+                    None => variant.to_cbor_key_expr(),
+                };
+                Attempt::Unit(discriminant)
+            } else if variant.fields.is_newtype() {
+                Attempt::Decode(None, quote!(Ok(Self::#variant_ident(#decode_fn(value)?))))
+            } else {
+                let inner = derive_struct(
+                    &variant.ident,
+                    false,
+                    variant.as_array.is_present(),
+                    variant.allow_unknown.is_present(),
+                    variant.fields.as_ref(),
+                    quote!(Self::#variant_ident),
+                    &Flavor::new(false),
+                );
+                // Reject values of the wrong shape without decoding them, and map-encoded ones
+                // with unknown keys when those cause an error anyway.
+                let check = if variant.fields.is_unit() {
+                    None
+                } else if variant.fields.is_tuple() || variant.as_array.is_present() {
+                    Some(quote! {
+                        match value {
+                            __cbor::Value::Array(_) => Ok(()),
+                            _ => Err(__cbor::DecodeError::UnexpectedType),
+                        }
+                    })
+                } else if variant.allow_unknown.is_present()
+                    || variant.fields.iter().any(|f| f.is_flattened())
+                {
+                    Some(quote! {
+                        match value {
+                            __cbor::Value::Map(_) => Ok(()),
+                            _ => Err(__cbor::DecodeError::UnexpectedType),
+                        }
+                    })
+                } else {
+                    let keys = variant
+                        .fields
+                        .iter()
+                        .filter(|f| !f.skip.is_present())
+                        .map(|f| f.to_cbor_key_expr());
+                    let key_types = key_types_expr(&variant.fields.iter().collect::<Vec<_>>());
+                    Some(quote! {
+                        __cbor::macros::check_cbor_map_keys(&value, &[#(#keys),*], #key_types)
+                    })
+                };
+                Attempt::Decode(check, quote!(Ok({ #inner })))
+            };
+            Some((variant_ident.clone(), attempt))
+        })
+        .collect();
+
+    // Each attempt decodes its own copy of the value so that failed attempts leave the value
+    // intact for the following ones, except for the last one if there is no fallback variant.
+    let last = attempts.len().checked_sub(1).filter(|_| fallback.is_none());
+    let attempts: Vec<_> = attempts
+        .into_iter()
+        .enumerate()
+        .map(|(i, (variant_ident, attempt))| {
+            let name = variant_ident.to_string();
+            match attempt {
+            Attempt::Unit(discriminant) => quote! {
+                if value == #discriminant {
+                    return Ok(Self::#variant_ident);
+                }
+                errors.push((#name, __cbor::DecodeError::UnexpectedType));
+            },
+            Attempt::Decode(check, decoder) => {
+                let value = if Some(i) == last {
+                    quote!(value)
+                } else {
+                    quote!(value.clone())
+                };
+                let check = check.unwrap_or_else(|| quote!(Ok(())));
+                quote! {
+                    #[allow(clippy::redundant_closure_call)]
+                    let result = (#check).and_then(|_| {
+                        (|value: __cbor::Value| -> ::core::result::Result<Self, __cbor::DecodeError> {
+                            #decoder
+                        })(#value)
+                    });
+                    match result {
+                        Ok(v) => return Ok(v),
+                        Err(e) => errors.push((#name, e)),
+                    }
+                }
+            }
+        }})
+        .collect();
+    let fallback =
+        fallback.unwrap_or_else(|| quote!(Err(__cbor::DecodeError::NoMatchingVariant { errors })));
+
+    quote! {
+        let mut errors = __cbor::macros::Vec::new();
+        #(#attempts)*
+
+        #fallback
+    }
+}
@@ -1,4 +1,5 @@
 use darling::FromDeriveInput;
+use oasis_cbor_value::writer::{encoded_len, header_len};
 use proc_macro2::TokenStream;
 use quote::{quote, quote_spanned};
 use syn::{spanned::Spanned, DeriveInput, Ident, Index, Member};
@@ -10,18 +11,12 @@ use crate::{
 
 struct DeriveResult {
     enc_impl: TokenStream,
+    enc_ref_impl: TokenStream,
+    len_impl: TokenStream,
+    map_len_impl: TokenStream,
     encode_as_map: bool,
 }
 
-impl DeriveResult {
-    fn empty() -> Self {
-        Self {
-            enc_impl: quote!({}),
-            encode_as_map: false,
-        }
-    }
-}
-
 /// Derives the `Encode` trait.
 pub fn derive(input: DeriveInput) -> TokenStream {
     let cbor_crate = util::cbor_crate_identifier();
@@ -32,6 +27,14 @@ pub fn derive(input: DeriveInput) -> TokenStream {
 
     let derived = match enc.data.as_ref() {
         darling::ast::Data::Enum(variants) => derive_enum(&enc, variants),
+        // Structs without encoded fields may encode as null instead of an empty map.
+        darling::ast::Data::Struct(_) if enc.as_null.is_present() => DeriveResult {
+            enc_impl: quote! { __cbor::Value::Simple(__cbor::SimpleValue::NullValue) },
+            enc_ref_impl: quote! { __cbor::Value::Simple(__cbor::SimpleValue::NullValue) },
+            len_impl: quote!(1),
+            map_len_impl: quote!(0),
+            encode_as_map: false,
+        },
         darling::ast::Data::Struct(fields) => derive_struct(
             &enc.ident,
             enc.transparent.is_present(),
@@ -42,16 +45,73 @@ pub fn derive(input: DeriveInput) -> TokenStream {
         ),
     };
 
+    // Fields encoded via a custom function or skipped altogether do not need to be encodable.
+    // Embedded fields and variants, as well as newtype variants of internally tagged enums, must
+    // encode as maps.
+    let mut bounded_types = Vec::new();
+    for (variant, field) in enc.coded_fields() {
+        if field.skip.is_present() {
+            continue;
+        }
+        if field.serialize_with.is_none() {
+            let as_map = field.is_flattened()
+                || variant.map_or(false, |v| {
+                    v.embed.is_present() || (enc.tag.is_some() && v.fields.is_newtype())
+                });
+            let bound = if as_map {
+                quote!(__cbor::EncodeAsMap)
+            } else {
+                quote!(__cbor::Encode)
+            };
+            bounded_types.push((&field.ty, bound));
+        }
+        if field.skip_serializing_if_default.is_present() {
+            // The field is compared against its default value.
+            bounded_types.push((
+                &field.ty,
+                quote!(::core::cmp::PartialEq + ::core::default::Default),
+            ));
+        }
+    }
+    let generics = match enc.bound.as_ref().and_then(|bound| bound.encode.as_ref()) {
+        Some(predicates) => util::replace_bounds(&enc.generics, predicates),
+        None => util::add_bounds(&enc.generics, bounded_types),
+    };
+
     let enc_ty_ident = &enc.ident;
-    let (imp, ty, wher) = enc.generics.split_for_impl();
+    let (imp, ty, wher) = generics.split_for_impl();
     let enc_impl = derived.enc_impl;
+    let enc_ref_impl = derived.enc_ref_impl;
+    let len_impl = derived.len_impl;
+    let map_len_impl = derived.map_len_impl;
+
+    // Wrap the encoded value in a semantic tag, if configured.
+    let (enc_impl, enc_ref_impl, len_impl) = match enc.semantic_tag {
+        Some(tag) => {
+            let tag_len = header_len(tag);
+            (
+                quote! {
+                    __cbor::Value::Tag(#tag, __cbor::macros::Box::new({ #enc_impl }))
+                },
+                quote! {
+                    __cbor::Value::Tag(#tag, __cbor::macros::Box::new({ #enc_ref_impl }))
+                },
+                quote!( #tag_len + { #len_impl } ),
+            )
+        }
+        None => (enc_impl, enc_ref_impl, len_impl),
+    };
 
     // Implement the EncodeAsMap marker trait in case the type is known to encode as a map. This
     // allows operations to only operate on such types.
-    let encode_as_map = if derived.encode_as_map {
+    let encode_as_map = if derived.encode_as_map && enc.semantic_tag.is_none() {
         quote! {
             #[automatically_derived]
-            impl #imp __cbor::EncodeAsMap for #enc_ty_ident #ty #wher {}
+            impl #imp __cbor::EncodeAsMap for #enc_ty_ident #ty #wher {
+                fn cbor_map_len(&self) -> usize {
+                    #map_len_impl
+                }
+            }
         }
     } else {
         quote!()
@@ -65,6 +125,14 @@ pub fn derive(input: DeriveInput) -> TokenStream {
             fn into_cbor_value(self) -> __cbor::Value {
                 #enc_impl
             }
+
+            fn to_cbor_value(&self) -> __cbor::Value {
+                #enc_ref_impl
+            }
+
+            fn encoded_len(&self) -> usize {
+                #len_impl
+            }
         }
 
         #encode_as_map
@@ -82,107 +150,247 @@ fn derive_struct(
     if fields.is_unit() && !unit_as_struct {
         return DeriveResult {
             enc_impl: quote! { __cbor::Value::Simple(__cbor::SimpleValue::NullValue) },
+            enc_ref_impl: quote! { __cbor::Value::Simple(__cbor::SimpleValue::NullValue) },
+            len_impl: quote!(1),
+            map_len_impl: quote!(0),
             encode_as_map: false,
         };
     }
 
     if transparent {
-        // Transparently forward the implementation to the underlying type. This is only valid for
-        // newtype structs.
-        if !fields.is_newtype() {
-            ident
-                .span()
-                .unwrap()
-                .error("transparent attribute can only be used for newtype structs".to_string())
-                .emit();
-            return DeriveResult::empty();
-        }
-
+        // Transparently forward the implementation to the underlying type (or the result of the
+        // custom encoding function, if any). This is only valid for newtype structs.
         let encode_fn = quote_spanned!(ident.span()=> __cbor::Encode::into_cbor_value);
+        let encode_ref_fn = quote_spanned!(ident.span()=> __cbor::Encode::to_cbor_value);
+        let len_fn = quote_spanned!(ident.span()=> __cbor::Encode::encoded_len);
+        let (enc_impl, enc_ref_impl, len_impl) = match &fields.fields[0].serialize_with {
+            Some(custom_encode_fn) => (
+                quote!(#encode_fn(#custom_encode_fn(&self.0))),
+                quote!(#encode_fn(#custom_encode_fn(&self.0))),
+                quote!(#len_fn(&#custom_encode_fn(&self.0))),
+            ),
+            None => (
+                quote!(#encode_fn(self.0)),
+                quote!(#encode_ref_fn(&self.0)),
+                quote!(#len_fn(&self.0)),
+            ),
+        };
 
         DeriveResult {
-            enc_impl: quote!(#encode_fn(self.0)),
+            enc_impl,
+            enc_ref_impl,
+            len_impl,
+            map_len_impl: quote!(0),
             encode_as_map: false, // We cannot be sure that the inner type encodes as map.
         }
     } else {
         // Process all fields and encode the structure as a map or array.
         let as_array = fields.is_tuple() || fields.is_newtype() || as_array;
 
-        let field_map_items: Vec<_> = fields
-            .iter()
-            .enumerate()
-            .map(|(i, field)| {
-                if field.skip.is_present() {
-                    // Skip serializing this field.
-                    return quote!();
-                }
+        let mut field_map_items = Vec::new();
+        let mut field_ref_map_items = Vec::new();
+        let mut field_len_items = Vec::new();
+        let mut field_count_items = Vec::new();
+        let mut trim_items = Vec::new();
+        let mut len_trim_items = Vec::new();
+        for (i, field) in fields.iter().enumerate() {
+            if field.skip.is_present() {
+                // Skip serializing this field.
+                continue;
+            }
 
-                let field_ty = &field.ty;
+            let field_ty = &field.ty;
 
-                let field_binding = match field_bindings {
-                    Some(ref field_bindings) => {
-                        let field_ident = &field_bindings[i];
-                        quote!( #field_ident )
-                    }
-                    None => field
+            // When encoding by reference or computing the encoded length, fields are only
+            // available by reference.
+            let (field_binding, field_ref) = match field_bindings {
+                Some(ref field_bindings) => {
+                    let field_ident = &field_bindings[i];
+                    (quote!( #field_ident ), quote!( #field_ident ))
+                }
+                None => {
+                    let member = field
                         .ident
                         .as_ref()
-                        .map(|f| quote!( self.#f ))
+                        .map(|f| quote!( #f ))
                         .unwrap_or_else(|| {
                             let index = syn::Index::from(i);
-                            quote!( self.#index )
-                        }),
-                };
+                            quote!( #index )
+                        });
+                    (quote!( self.#member ), quote!( &self.#member ))
+                }
+            };
 
-                let field_value = if let Some(custom_encode_fn) = &field.serialize_with {
-                    quote_spanned!(field_ty.span()=> __cbor::Encode::into_cbor_value(#custom_encode_fn(&#field_binding)))
-                } else {
-                    quote_spanned!(field_ty.span()=> __cbor::Encode::into_cbor_value(#field_binding))
-                };
+            let (field_value, field_ref_value, field_len) = if let Some(custom_encode_fn) =
+                &field.serialize_with
+            {
+                (
+                    quote_spanned!(field_ty.span()=> __cbor::Encode::into_cbor_value(#custom_encode_fn(&#field_binding))),
+                    quote_spanned!(field_ty.span()=> __cbor::Encode::into_cbor_value(#custom_encode_fn(#field_ref))),
+                    quote_spanned!(field_ty.span()=> __cbor::Encode::encoded_len(&#custom_encode_fn(#field_ref))),
+                )
+            } else {
+                (
+                    quote_spanned!(field_ty.span()=> __cbor::Encode::into_cbor_value(#field_binding)),
+                    quote_spanned!(field_ty.span()=> __cbor::Encode::to_cbor_value(#field_ref)),
+                    quote_spanned!(field_ty.span()=> __cbor::Encode::encoded_len(#field_ref)),
+                )
+            };
 
+            if field.is_flattened() {
+                // Hoist the entries of the embedded map into the parent map.
                 if as_array {
-                    // Output the fields as a CBOR array.
-                    if field.skip_serializing_if.is_some() {
-                        field
-                            .ident
-                            .span()
-                            .unwrap()
-                            .error("cannot use skip_serializing_if attribute in arrays".to_string())
-                            .emit();
-                        return quote!({});
-                    }
+                    let attr = if field.embed.is_present() {
+                        "embed"
+                    } else {
+                        "flatten_rest"
+                    };
+                    field
+                        .ident
+                        .span()
+                        .unwrap()
+                        .error(format!("cannot use {} attribute in arrays", attr))
+                        .emit();
+                    field_map_items.push(quote!({}));
+                    field_ref_map_items.push(quote!({}));
+                    continue;
+                }
 
-                    quote! { fields.push(#field_value); }
-                } else {
-                    // Output the fields as a CBOR map.
-                    let key = field.to_cbor_key_expr();
-
-                    if field.optional.is_present() {
-                        // If the field is optional then we can omit it when it is equal to the
-                        // null value.
-                        match &field.skip_serializing_if {
-                            None => {
-                                quote! {
-                                    if !__cbor::Encode::is_empty(&#field_binding) {
-                                        fields.push((#key, #field_value));
-                                    }
-                                }
+                let encode_fn =
+                    quote_spanned!(field_ty.span()=> __cbor::EncodeAsMap::into_cbor_map);
+                let encode_ref_fn =
+                    quote_spanned!(field_ty.span()=> __cbor::EncodeAsMap::to_cbor_map);
+                let map_len_fn =
+                    quote_spanned!(field_ty.span()=> __cbor::EncodeAsMap::cbor_map_len);
+                if field.flatten_rest.is_present() {
+                    // Named fields take precedence over entries of the catch-all field with the
+                    // same key, as such entries would not decode into the catch-all field either.
+                    let keys: Vec<_> = fields
+                        .iter()
+                        .filter(|f| !f.is_flattened() && !f.skip.is_present())
+                        .map(|f| f.to_cbor_key_expr())
+                        .collect();
+                    let keys_len_fn =
+                        quote_spanned!(field_ty.span()=> __cbor::EncodeAsMap::cbor_map_keys_len);
+                    let dropped = quote! {
+                        let (dropped_entries, dropped_len) =
+                            #keys_len_fn(#field_ref, &[#(#keys),*]);
+                    };
+                    field_map_items.push(quote! {{
+                        let keys = [#(#keys),*];
+                        fields.extend(#encode_fn(#field_binding).into_iter().filter(|(k, _)| !keys.contains(k)));
+                    }});
+                    field_ref_map_items.push(quote! {{
+                        let keys = [#(#keys),*];
+                        fields.extend(#encode_ref_fn(#field_ref).into_iter().filter(|(k, _)| !keys.contains(k)));
+                    }});
+                    field_len_items.push(quote! {{
+                        #dropped
+                        let map_len = #map_len_fn(#field_ref);
+                        entries += map_len - dropped_entries;
+                        len += #field_len - __cbor::writer::header_len(map_len as u64) - dropped_len;
+                    }});
+                    field_count_items.push(quote! {{
+                        #dropped
+                        entries += #map_len_fn(#field_ref) - dropped_entries;
+                    }});
+                    continue;
+                }
+                field_map_items.push(quote! { fields.extend(#encode_fn(#field_binding)); });
+                field_ref_map_items.push(quote! { fields.extend(#encode_ref_fn(#field_ref)); });
+                // The embedded map header is not part of the parent map.
+                field_len_items.push(quote! {
+                    entries += #map_len_fn(#field_ref);
+                    len += #field_len - __cbor::writer::header_len(#map_len_fn(#field_ref) as u64);
+                });
+                field_count_items.push(quote! { entries += #map_len_fn(#field_ref); });
+                continue;
+            }
+
+            if as_array {
+                // Output the fields as a CBOR array. As elements are identified by their position,
+                // omittable fields (which all come last) are only omitted from the end of the array.
+                let position = field_len_items.len();
+                let skip_conditions = skip_condition(field, &quote!( &#field_binding ))
+                    .zip(skip_condition(field, &field_ref));
+                match skip_conditions {
+                    Some((skip_condition, len_skip_condition)) => {
+                        trim_items.push(quote! {
+                            if elements == #position + 1 && #skip_condition {
+                                elements -= 1;
                             }
-                            Some(skip_serializing_if) => {
-                                quote! {
-                                    if !#skip_serializing_if(&#field_binding) {
-                                        fields.push((#key, #field_value));
-                                    }
-                                }
+                        });
+                        len_trim_items.push(quote! {
+                            if elements == #position + 1 && #len_skip_condition {
+                                elements -= 1;
                             }
-                        }
-                    } else {
+                        });
+                        field_map_items.push(quote! {
+                            if #position < elements {
+                                fields.push(#field_value);
+                            }
+                        });
+                        field_ref_map_items.push(quote! {
+                            if #position < elements {
+                                fields.push(#field_ref_value);
+                            }
+                        });
+                        field_len_items.push(quote! {
+                            if #position < elements {
+                                len += #field_len;
+                            }
+                        });
+                    }
+                    None => {
+                        field_map_items.push(quote! { fields.push(#field_value); });
+                        field_ref_map_items.push(quote! { fields.push(#field_ref_value); });
+                        field_len_items.push(quote! { len += #field_len; });
+                    }
+                }
+            } else {
+                // Output the fields as a CBOR map.
+                let key = field.to_cbor_key_expr();
+                let key_len = encoded_len(&field.to_cbor_key());
+
+                let skip_conditions = skip_condition(field, &quote!( &#field_binding ))
+                    .zip(skip_condition(field, &field_ref));
+                match skip_conditions {
+                    Some((skip_condition, len_skip_condition)) => {
+                        field_map_items.push(quote! {
+                            if !#skip_condition {
+                                fields.push((#key, #field_value));
+                            }
+                        });
+                        field_ref_map_items.push(quote! {
+                            if !#len_skip_condition {
+                                fields.push((#key, #field_ref_value));
+                            }
+                        });
+                        field_len_items.push(quote! {
+                            if !#len_skip_condition {
+                                entries += 1;
+                                len += #key_len + #field_len;
+                            }
+                        });
+                        field_count_items.push(quote! {
+                            if !#len_skip_condition {
+                                entries += 1;
+                            }
+                        });
+                    }
+                    None => {
                         // Otherwise always include it.
-                        quote! { fields.push((#key, #field_value)); }
+                        field_map_items.push(quote! { fields.push((#key, #field_value)); });
+                        field_ref_map_items.push(quote! { fields.push((#key, #field_ref_value)); });
+                        field_len_items.push(quote! {
+                            entries += 1;
+                            len += #key_len + #field_len;
+                        });
+                        field_count_items.push(quote! { entries += 1; });
                     }
                 }
-            })
-            .collect();
+            }
+        }
 
         let value_ty = if as_array {
             quote! { __cbor::Value::Array(fields) }
@@ -192,32 +400,112 @@ fn derive_struct(
 
         let num_fields = field_map_items.len();
 
+        if !trim_items.is_empty() {
+            // Determine the number of array elements by dropping trailing omitted fields, starting
+            // from the last one.
+            trim_items.reverse();
+            len_trim_items.reverse();
+            let num_elements = field_len_items.len();
+            return DeriveResult {
+                enc_impl: quote! {
+                    let mut elements = #num_elements;
+                    #(#trim_items)*
+                    let mut fields = __cbor::macros::Vec::with_capacity(elements);
+                    #(#field_map_items)*
+
+                    #value_ty
+                },
+                enc_ref_impl: quote! {
+                    let mut elements = #num_elements;
+                    #(#len_trim_items)*
+                    let mut fields = __cbor::macros::Vec::with_capacity(elements);
+                    #(#field_ref_map_items)*
+
+                    #value_ty
+                },
+                len_impl: quote! {
+                    let mut elements = #num_elements;
+                    #(#len_trim_items)*
+                    let mut len = __cbor::writer::header_len(elements as u64);
+                    #(#field_len_items)*
+                    len
+                },
+                map_len_impl: quote!(0),
+                encode_as_map: false,
+            };
+        }
+
+        let len_impl = if as_array {
+            // The number of array elements is known in advance.
+            let header_len = header_len(field_len_items.len() as u64);
+            quote! {
+                let mut len = #header_len;
+                #(#field_len_items)*
+                len
+            }
+        } else {
+            quote! {
+                let mut entries = 0;
+                let mut len = 0;
+                #(#field_len_items)*
+                __cbor::writer::header_len(entries as u64) + len
+            }
+        };
+
         DeriveResult {
             enc_impl: quote! {
-                let mut fields = ::std::vec::Vec::with_capacity(#num_fields);
+                let mut fields = __cbor::macros::Vec::with_capacity(#num_fields);
                 #(#field_map_items)*
 
                 #value_ty
             },
+            enc_ref_impl: quote! {
+                let mut fields = __cbor::macros::Vec::with_capacity(#num_fields);
+                #(#field_ref_map_items)*
+
+                #value_ty
+            },
+            len_impl,
+            map_len_impl: quote! {
+                let mut entries = 0;
+                #(#field_count_items)*
+                entries
+            },
             encode_as_map: !as_array,
         }
     }
 }
 
-fn derive_enum(enc: &Codable, variants: Vec<&Variant>) -> DeriveResult {
-    // Make sure the transparent attribute cannot be used on an enum.
-    if enc.transparent.is_present() {
-        enc.ident
-            .span()
-            .unwrap()
-            .error("cannot use transparent attribute on an enum".to_string())
-            .emit();
-        return DeriveResult::empty();
+/// Condition under which a map field is omitted from the encoding, given a reference to the field.
+fn skip_condition(field: &Field, field_ref: &TokenStream) -> Option<TokenStream> {
+    let field_ty = &field.ty;
+
+    if let Some(skip_serializing_if) = &field.skip_serializing_if {
+        // Omit the field when the predicate holds.
+        Some(quote!( #skip_serializing_if(#field_ref) ))
+    } else if field.skip_serializing_if_default.is_present() {
+        // Omit the field when it is equal to its default value.
+        Some(quote_spanned! {field_ty.span()=>
+            ::core::cmp::PartialEq::eq(#field_ref, &<#field_ty as ::core::default::Default>::default())
+        })
+    } else if field.optional.is_present() {
+        // If the field is optional then we can omit it when it is empty. Fields which would encode
+        // as null are always omitted, as a missing key decodes the same as a null value.
+        Some(
+            quote!( (__cbor::Encode::is_empty(#field_ref) || __cbor::Encode::is_null(#field_ref)) ),
+        )
+    } else {
+        None
     }
+}
 
+fn derive_enum(enc: &Codable, variants: Vec<&Variant>) -> DeriveResult {
     if variants.is_empty() {
         return DeriveResult {
             enc_impl: quote! { __cbor::Value::Simple(__cbor::SimpleValue::NullValue) },
+            enc_ref_impl: quote! { __cbor::Value::Simple(__cbor::SimpleValue::NullValue) },
+            len_impl: quote!(1),
+            map_len_impl: quote!(0),
             encode_as_map: false,
         };
     }
@@ -240,107 +528,217 @@ fn derive_enum(enc: &Codable, variants: Vec<&Variant>) -> DeriveResult {
             })
         } else {
             // Regular tagged enum where the tag is stored as a map key.
-            quote!(__cbor::Value::Map(vec![(#key, #inner)]))
+            quote!(__cbor::Value::Map(__cbor::macros::vec![(#key, #inner)]))
         }
     };
 
-    let (match_arms, maybe_encode_as_map): (Vec<_>, Vec<_>) = variants
-        .iter()
-        .map(|variant| {
-            let variant_ident = &variant.ident;
-            let key = variant.to_cbor_key_expr();
+    // Same as maybe_wrap_map, but for the encoded length and the number of map entries given the
+    // encoded length of the inner value and the number of its map entries.
+    let maybe_wrap_len = |key_len: usize, inner_len, inner_map_len| {
+        if enc.untagged.is_present() {
+            (quote!( #inner_len ), quote!(0))
+        } else if let Some(tag) = &enc.tag {
+            let tag_len = encoded_len(&tag.to_cbor_key());
+
+            (
+                quote!({
+                    let entries = #inner_map_len;
+                    __cbor::writer::header_len(entries as u64 + 1) + #inner_len
+                        - __cbor::writer::header_len(entries as u64)
+                        + #tag_len
+                        + #key_len
+                }),
+                quote!( 1 + #inner_map_len ),
+            )
+        } else {
+            // A single entry map always has a single byte header.
+            (quote!( 1 + #key_len + #inner_len ), quote!(1))
+        }
+    };
 
-            let encode_fn = if enc.tag.is_some() {
-                quote_spanned!(variant.ident.span()=> __cbor::EncodeAsMap::into_cbor_value_map)
+    let mut match_arms = Vec::new();
+    let mut ref_match_arms = Vec::new();
+    let mut len_match_arms = Vec::new();
+    let mut map_len_match_arms = Vec::new();
+    let mut maybe_encode_as_map = Vec::new();
+    for variant in variants {
+        let variant_ident = &variant.ident;
+        let key = variant.to_cbor_key_expr();
+        let key_len = encoded_len(&variant.to_cbor_key());
+
+        let encode_fn = if enc.tag.is_some() {
+            quote_spanned!(variant.ident.span()=> __cbor::EncodeAsMap::into_cbor_value_map)
+        } else {
+            quote_spanned!(variant.ident.span()=> __cbor::Encode::into_cbor_value)
+        };
+        // Map entries are taken by reference, as maps are rewrapped by maybe_wrap_map anyway.
+        let encode_ref = |inner| {
+            if enc.tag.is_some() {
+                quote_spanned!(variant.ident.span()=> __cbor::Value::Map(__cbor::EncodeAsMap::to_cbor_map(#inner)))
             } else {
-                quote_spanned!(variant.ident.span()=> __cbor::Encode::into_cbor_value)
-            };
+                quote_spanned!(variant.ident.span()=> __cbor::Encode::to_cbor_value(#inner))
+            }
+        };
+        let len_fn = quote_spanned!(variant.ident.span()=> __cbor::Encode::encoded_len);
+        let map_len_fn = quote_spanned!(variant.ident.span()=> __cbor::EncodeAsMap::cbor_map_len);
+
+        if variant.skip.is_present() {
+            // If we need to skip serializing this variant, serialize into undefined.
+            match_arms.push(quote! { Self::#variant_ident { .. } => __cbor::Value::Simple(__cbor::SimpleValue::Undefined), });
+            ref_match_arms.push(quote! { Self::#variant_ident { .. } => __cbor::Value::Simple(__cbor::SimpleValue::Undefined), });
+            len_match_arms.push(quote! { Self::#variant_ident { .. } => 1, });
+            map_len_match_arms.push(quote! { Self::#variant_ident { .. } => 0, });
+            maybe_encode_as_map.push(true);
+            continue;
+        }
 
-            if variant.skip.is_present() {
-                // If we need to skip serializing this variant, serialize into undefined.
-                return (quote! { Self::#variant_ident { .. } => __cbor::Value::Simple(__cbor::SimpleValue::Undefined), }, true);
+        if variant.unknown.is_present() && variant.fields.is_newtype() {
+            // The fallback variant holds the entire encoded value, so serialize it unchanged.
+            let encode_fn = quote_spanned!(variant.ident.span()=> __cbor::Encode::into_cbor_value);
+            let encode_ref_fn =
+                quote_spanned!(variant.ident.span()=> __cbor::Encode::to_cbor_value);
+            match_arms.push(quote! { Self::#variant_ident(inner) => #encode_fn(inner), });
+            ref_match_arms.push(quote! { Self::#variant_ident(inner) => #encode_ref_fn(inner), });
+            len_match_arms.push(quote! { Self::#variant_ident(inner) => #len_fn(inner), });
+            map_len_match_arms.push(quote! { Self::#variant_ident(..) => 0, });
+            maybe_encode_as_map.push(false);
+            continue;
+        }
+
+        if variant.embed.is_present() {
+            // If we need to embed this variant, just serialize the embedded enum directly.
+            if !variant.fields.is_newtype() {
+                variant
+                    .ident
+                    .span()
+                    .unwrap()
+                    .error("cannot use embed attribute on non-newtype variant".to_string())
+                    .emit();
+                maybe_encode_as_map.push(false);
+                continue;
             }
+            if enc.tag.is_some() {
+                variant
+                    .ident
+                    .span()
+                    .unwrap()
+                    .error("cannot use embed attribute on internally tagged enum".to_string())
+                    .emit();
+                maybe_encode_as_map.push(false);
+                continue;
+            }
+            let inner_ref = encode_ref(quote!(inner));
+            match_arms.push(quote! { Self::#variant_ident(inner) => #encode_fn(inner), });
+            ref_match_arms.push(quote! { Self::#variant_ident(inner) => #inner_ref, });
+            len_match_arms.push(quote! { Self::#variant_ident(inner) => #len_fn(inner), });
+            map_len_match_arms.push(quote! { Self::#variant_ident(inner) => #map_len_fn(inner), });
+            maybe_encode_as_map.push(true);
+            continue;
+        }
 
-            if variant.embed.is_present() {
-                // If we need to embed this variant, just serialize the embedded enum directly.
-                if !variant.fields.is_newtype() {
-                    variant.ident.span().unwrap().error("cannot use embed attribute on non-newtype variant".to_string()).emit();
-                    return (quote!(), false);
+        if variant.fields.is_unit() && !variant.as_struct.is_present() && enc.tag.is_none() {
+            // For unit variants, just return the CBOR-encoded key or the discriminant if any.
+            match variant.discriminant {
+                Some(ref expr) => {
+                    let inner = quote!(#encode_fn(#expr));
+                    match_arms.push(quote! { Self::#variant_ident => #inner, });
+                    ref_match_arms.push(quote! { Self::#variant_ident => #inner, });
+                    len_match_arms.push(quote! { Self::#variant_ident => #len_fn(&#expr), });
                 }
-                if enc.tag.is_some() {
-                    variant.ident.span().unwrap().error("cannot use embed attribute on internally tagged enum".to_string()).emit();
-                    return (quote!(), false);
+                None => {
+                    match_arms.push(quote! { Self::#variant_ident => #key, });
+                    ref_match_arms.push(quote! { Self::#variant_ident => #key, });
+                    len_match_arms.push(quote! { Self::#variant_ident => #key_len, });
                 }
-                // TODO: It would be great if this somehow ensured that there was no overlap etc.
-                return (quote! { Self::#variant_ident(inner) => #encode_fn(inner), }, true);
             }
-
-            if variant.fields.is_unit() && !variant.as_struct.is_present() && enc.tag.is_none() {
-                // For unit variants, just return the CBOR-encoded key or the discriminant if any.
-                match variant.discriminant {
-                    Some(ref expr) => {
-                        let inner = quote!(#encode_fn(#expr));
-                        (quote! { Self::#variant_ident => #inner, }, false)
-                    }
-                    None => (quote! { Self::#variant_ident => #key, }, false),
+            map_len_match_arms.push(quote! { Self::#variant_ident => 0, });
+            maybe_encode_as_map.push(false);
+        } else {
+            // For others, encode as a map.
+            if variant.fields.is_newtype() {
+                // Newtype variants map the key directly to the inner value as if transparent was used.
+                let inner = quote!(#encode_fn(inner));
+                let ref_wrapper = maybe_wrap_map(key.clone(), encode_ref(quote!(inner)));
+                let wrapper = maybe_wrap_map(key, inner);
+                let (len_wrapper, map_len_wrapper) =
+                    maybe_wrap_len(key_len, quote!(#len_fn(inner)), quote!(#map_len_fn(inner)));
+
+                match_arms.push(quote! { Self::#variant_ident(inner) => #wrapper, });
+                ref_match_arms.push(quote! { Self::#variant_ident(inner) => #ref_wrapper, });
+                len_match_arms.push(quote! { Self::#variant_ident(inner) => #len_wrapper, });
+                if enc.tag.is_some() {
+                    map_len_match_arms
+                        .push(quote! { Self::#variant_ident(inner) => #map_len_wrapper, });
+                } else {
+                    map_len_match_arms
+                        .push(quote! { Self::#variant_ident(..) => #map_len_wrapper, });
                 }
+                maybe_encode_as_map.push(true);
             } else {
-                // For others, encode as a map.
-                if variant.fields.is_newtype() {
-                    // Newtype variants map the key directly to the inner value as if transparent was used.
-                    let inner = quote!(#encode_fn(inner));
-                    let wrapper = maybe_wrap_map(key, inner);
-
-                    (quote! { Self::#variant_ident(inner) => #wrapper, }, true)
-                } else {
-                    // Generate field bindings as we need to destructure the enum variant.
-                    let (bindings, idents): (Vec<_>, Vec<_>) = variant
-                        .fields
-                        .as_ref()
-                        .iter()
-                        .enumerate()
-                        .map(|(i, field)| {
-                            let pat = match field.ident {
-                                Some(ref ident) => Member::Named(ident.clone()),
-                                None => Member::Unnamed(Index {
-                                    index: i as u32,
-                                    span: variant_ident.span(),
-                                }),
-                            };
-                            let ident = Ident::new(&format!("__a{}", i), variant_ident.span());
-                            let binding = quote!( #pat: #ident, );
-
-                            (binding, ident)
-                        })
-                        .unzip();
-
-                    if enc.tag.is_some() && (variant.as_array.is_present() || variant.fields.is_tuple()) {
-                        variant.ident.span().unwrap().error("cannot encode variant as array in internally tagged enums".to_string()).emit();
-                        return (quote!(), false);
-                    }
-
-                    // Derive encoder and wrap it in a map.
-                    let derived = derive_struct(
-                        &variant.ident,
-                        false,
-                        variant.as_array.is_present(),
-                        variant.as_struct.is_present(),
-                        variant.fields.as_ref(),
-                        Some(idents),
-                    );
-                    let inner = derived.enc_impl;
-                    let wrapper = maybe_wrap_map(key, quote!( {#inner} ));
-
-                    (
-                        quote! {
-                            Self::#variant_ident { #(#bindings)* } => #wrapper,
-                        },
-                        true,
-                    )
+                // Generate field bindings as we need to destructure the enum variant.
+                let (bindings, idents): (Vec<_>, Vec<_>) = variant
+                    .fields
+                    .as_ref()
+                    .iter()
+                    .enumerate()
+                    .map(|(i, field)| {
+                        let pat = match field.ident {
+                            Some(ref ident) => Member::Named(ident.clone()),
+                            None => Member::Unnamed(Index {
+                                index: i as u32,
+                                span: variant_ident.span(),
+                            }),
+                        };
+                        let ident = Ident::new(&format!("__a{}", i), variant_ident.span());
+                        let binding = quote!( #pat: #ident, );
+
+                        (binding, ident)
+                    })
+                    .unzip();
+
+                if enc.tag.is_some() && (variant.as_array.is_present() || variant.fields.is_tuple())
+                {
+                    variant
+                        .ident
+                        .span()
+                        .unwrap()
+                        .error(
+                            "cannot encode variant as array in internally tagged enums".to_string(),
+                        )
+                        .emit();
+                    maybe_encode_as_map.push(false);
+                    continue;
                 }
+
+                // Derive encoder and wrap it in a map.
+                let derived = derive_struct(
+                    &variant.ident,
+                    false,
+                    variant.as_array.is_present(),
+                    variant.as_struct.is_present(),
+                    variant.fields.as_ref(),
+                    Some(idents),
+                );
+                let inner = derived.enc_impl;
+                let inner_ref = derived.enc_ref_impl;
+                let ref_wrapper = maybe_wrap_map(key.clone(), quote!( {#inner_ref} ));
+                let wrapper = maybe_wrap_map(key, quote!( {#inner} ));
+                let inner_len = derived.len_impl;
+                let inner_map_len = derived.map_len_impl;
+                let (len_wrapper, map_len_wrapper) =
+                    maybe_wrap_len(key_len, quote!( {#inner_len} ), quote!( {#inner_map_len} ));
+
+                match_arms.push(quote! { Self::#variant_ident { #(#bindings)* } => #wrapper, });
+                ref_match_arms
+                    .push(quote! { Self::#variant_ident { #(#bindings)* } => #ref_wrapper, });
+                len_match_arms
+                    .push(quote! { Self::#variant_ident { #(#bindings)* } => #len_wrapper, });
+                map_len_match_arms
+                    .push(quote! { Self::#variant_ident { #(#bindings)* } => #map_len_wrapper, });
+                maybe_encode_as_map.push(true);
             }
-        })
-        .unzip();
+        }
+    }
 
     // Check if all variants encode as a map.
     let all_encode_as_map = !enc.untagged.is_present() && maybe_encode_as_map.iter().all(|x| *x);
@@ -351,6 +749,21 @@ fn derive_enum(enc: &Codable, variants: Vec<&Variant>) -> DeriveResult {
                 #(#match_arms)*
             }
         },
+        enc_ref_impl: quote! {
+            match self {
+                #(#ref_match_arms)*
+            }
+        },
+        len_impl: quote! {
+            match self {
+                #(#len_match_arms)*
+            }
+        },
+        map_len_impl: quote! {
+            match self {
+                #(#map_len_match_arms)*
+            }
+        },
         encode_as_map: all_encode_as_map,
     }
 }
@@ -9,6 +9,49 @@ mod util;
 use proc_macro::TokenStream;
 
 /// Derives the `Decode` trait.
+///
+/// A missing key of a `#[cbor(optional)]` field decodes the same as an explicit null value, which
+/// is `None` for an `Option`. See the `Encode` derive for details.
+///
+/// The exception are nested options like `Option<Option<T>>`, which distinguish a field that is
+/// absent (`None`) from one that is present but explicitly null (`Some(None)`), while any other
+/// value decodes as `Some(Some(v))`. Such fields should be marked `#[cbor(optional)]` so that
+/// `None` omits the key, as it is otherwise encoded as undefined.
+///
+/// Decoding a struct (or struct variant) fails with `DecodeError::UnknownField` when the encoding
+/// contains a key which does not match any field, or extra elements for array-encoded structs.
+/// Keys of a type which none of the field keys have (e.g. an integer key for a struct with only
+/// text keys) fail with `DecodeError::UnexpectedKeyType` instead, where integer keys include
+/// negative ones. `#[cbor(allow_unknown)]` ignores such keys of any type instead, and a
+/// `flatten_rest` field collects them as long as its own key type can represent them. When
+/// encoding, entries of a `flatten_rest` field with the key of a named field are dropped, so the
+/// named field always takes precedence. Finally, `#[cbor(deny_unknown_fields)]` states the
+/// default strict behavior explicitly and cannot be combined with `allow_unknown` or a
+/// `flatten_rest` field.
+///
+/// A struct with named fields marked with `#[cbor(accept_array_or_map)]` decodes from both its
+/// map form and the positional array form used with `as_array`, e.g. when migrating a type from
+/// one to the other. The major type of the encoding decides: an array is decoded positionally in
+/// field declaration order, and anything else as a map. Encoding always uses the map form. The
+/// attribute cannot be combined with `transparent`, `as_array`, `as_null` or flattened fields.
+///
+/// Unit variants of enums which are neither untagged nor internally tagged are encoded as their
+/// bare key (see the `Encode` derive), but also decode from a single-entry map of their key to
+/// null or to an empty map, e.g. `{"instantiate": null}` or `{"instantiate": {}}` for a variant
+/// `Instantiate` with `rename_all = "snake_case"`. This does not apply to variants with an explicit
+/// discriminant or enums with `repr`, which are only decoded from bare integers.
+///
+/// A variant marked with `#[cbor(unknown)]` is the fallback for encodings which match no other
+/// variant, e.g. variants added in a later version of the enum. A unit fallback variant just drops
+/// the encoded value, while a newtype fallback variant (typically holding a `Value`) captures the
+/// entire encoded enum value: the key or discriminant of unit variants, the whole single-entry map
+/// for variants encoded as maps and the whole map including the tag for internally tagged enums.
+/// Only one variant can be the fallback, and it cannot be combined with `skip`, `embed` or
+/// `missing`.
+///
+/// For map-encoded structs and transparent newtypes, `Decode::decode_in_place` decodes each field
+/// in place, so e.g. the capacity of collection fields is reused. Fields using a custom decoding
+/// function are replaced, and so are other types (e.g. enums and array-encoded structs) as a whole.
 #[proc_macro_derive(Decode, attributes(cbor))]
 pub fn decode_derive(input: TokenStream) -> TokenStream {
     let input = syn::parse_macro_input!(input as syn::DeriveInput);
@@ -16,6 +59,59 @@ pub fn decode_derive(input: TokenStream) -> TokenStream {
 }
 
 /// Derives the `Encode` trait.
+///
+/// Fields marked with `#[cbor(optional)]` are encoded by key presence: the key is omitted when the
+/// field is empty (e.g. `None`, zero or an empty string) or would otherwise encode as null, so an
+/// optional field is never encoded as an explicit null value. When decoding, both a missing key
+/// and a null value yield the empty value, while any other value yields e.g. `Some`. Since a
+/// missing key must decode the same as null, `optional` cannot be combined with `default`. Nested
+/// options are the exception, where `Some(None)` is encoded as an explicit null (see the `Decode`
+/// derive).
+///
+/// Structs marked with `#[cbor(as_array)]` (as well as tuple structs and variants) encode their
+/// fields positionally as array elements, without keys. As elements are identified by their
+/// position, omittable fields (`optional`, `default` or `skip_serializing_if*`) must come after
+/// all required fields and are only omitted from the end of the array: an omittable field followed
+/// by an encoded one is encoded as is, e.g. `None` as null. When decoding, a shorter array leaves
+/// the missing trailing fields empty or at their default value.
+///
+/// Keys of map-encoded fields must be unique after applying `rename`, `rename_all` and `key`, and
+/// so must the keys of enum variants (unless the enum is untagged), otherwise the derive fails.
+/// Fields of internally tagged enum variants cannot use the tag key either.
+///
+/// Unit variants of enums which are not internally tagged encode as their bare key, which is the
+/// canonical form among those accepted by the `Decode` derive. Unit variants with an explicit
+/// discriminant (e.g. `A = 1`) encode as that discriminant instead, which must not collide with
+/// other keys either. As embedded variants are only attempted after unit variants, in order, no
+/// two of them may embed the same type, nor may they embed a string or integer type when unit
+/// variants encode as one. The `missing` attribute is only allowed in internally tagged enums, as
+/// other enums never lack a key.
+///
+/// A newtype variant marked with `#[cbor(unknown)]` encodes the value it captured unchanged, so
+/// an unrecognized variant of any kind survives decoding and re-encoding (see the `Decode`
+/// derive). A unit fallback variant has nothing to re-encode and encodes as its key like any other
+/// unit variant.
+///
+/// Fields marked with `#[cbor(skip)]` never appear in the encoding: they are left out when
+/// encoding, and a key for them is an unknown field when decoding. They are set to the default
+/// of their type, or to the result of the function given via `default = "..."`, in which case the
+/// type does not need to implement `Default`. As skipped fields are not encoded, attributes which
+/// only affect the encoding (like `rename`, `optional` or `with`) cannot be set on them.
+///
+/// `PhantomData` fields are always skipped and their type parameters are not required to be
+/// encodable. A struct without encoded fields encodes as an empty map, or as null when marked
+/// with `#[cbor(as_null)]`.
+///
+/// A newtype struct marked with `#[cbor(transparent)]` encodes exactly as its field, including any
+/// custom encoding configured on the field (e.g. via `with`). When combined with
+/// `#[cbor(semantic_tag = N)]`, the tag wraps that encoding and decoding requires both.
+///
+/// For generic types, each type parameter used in an encoded field is required to implement the
+/// derived trait. A container attribute like `#[cbor(bound = "T::Id: Encode")]` replaces all the
+/// inferred where clause predicates (for both derives). This includes the `Default` bound needed
+/// for decoding from null, unless the bound includes it or `no_default` is set. The predicates can
+/// also be given per derive, e.g. `#[cbor(bound(encode = "T::Id: Encode", decode = "..."))]`, in
+/// which case a derive without them keeps its inferred bounds.
 #[proc_macro_derive(Encode, attributes(cbor))]
 pub fn encode_derive(input: TokenStream) -> TokenStream {
     let input = syn::parse_macro_input!(input as syn::DeriveInput);
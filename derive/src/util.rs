@@ -1,7 +1,7 @@
 use proc_macro2::{Span, TokenStream};
 use proc_macro_crate::{crate_name, FoundCrate};
 use quote::quote;
-use syn::Ident;
+use syn::{visit::Visit, Generics, Ident, Type, WherePredicate};
 
 pub fn wrap_in_const(tokens: TokenStream) -> TokenStream {
     quote! {
@@ -28,3 +28,69 @@ pub fn cbor_crate_identifier() -> TokenStream {
         Err(_) => panic!("oasis-cbor should be imported in `Cargo.toml`"),
     }
 }
+
+/// Add the given bounds to the where clause of the generics for each type parameter used in the
+/// corresponding type, so that a derived impl only applies when the fields implement the derived
+/// trait. Parameters only used within `PhantomData` are not bounded.
+pub fn add_bounds<'a>(
+    generics: &Generics,
+    bounded_types: impl IntoIterator<Item = (&'a Type, TokenStream)>,
+) -> Generics {
+    let params: Vec<&Ident> = generics.type_params().map(|p| &p.ident).collect();
+    let mut predicates: Vec<syn::WherePredicate> = Vec::new();
+    for (ty, bound) in bounded_types {
+        let mut collector = TypeParamCollector {
+            params: &params,
+            used: Vec::new(),
+        };
+        collector.visit_type(ty);
+        for param in collector.used {
+            let predicate = syn::parse_quote!(#param: #bound);
+            if !predicates.contains(&predicate) {
+                predicates.push(predicate);
+            }
+        }
+    }
+
+    let mut generics = generics.clone();
+    generics.make_where_clause().predicates.extend(predicates);
+    generics
+}
+
+/// Add the given predicates to the where clause of the generics instead of any inferred bounds.
+pub fn replace_bounds(generics: &Generics, predicates: &[WherePredicate]) -> Generics {
+    let mut generics = generics.clone();
+    generics
+        .make_where_clause()
+        .predicates
+        .extend(predicates.iter().cloned());
+    generics
+}
+
+/// Collects the type parameters used in a type, skipping those within `PhantomData`.
+struct TypeParamCollector<'a> {
+    params: &'a [&'a Ident],
+    used: Vec<&'a Ident>,
+}
+
+impl<'ast> Visit<'ast> for TypeParamCollector<'_> {
+    fn visit_path(&mut self, path: &'ast syn::Path) {
+        if path
+            .segments
+            .last()
+            .map_or(false, |s| s.ident == "PhantomData")
+        {
+            return;
+        }
+        // Both `T` and associated types like `T::Assoc` require a bound on `T`.
+        if path.leading_colon.is_none() {
+            let first = &path.segments[0].ident;
+            if let Some(&param) = self.params.iter().find(|&&p| first == p) {
+                if !self.used.contains(&param) {
+                    self.used.push(param);
+                }
+            }
+        }
+        syn::visit::visit_path(self, path);
+    }
+}
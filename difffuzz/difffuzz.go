@@ -7,16 +7,129 @@ package difffuzz
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"unsafe"
+
+	"github.com/oasisprotocol/oasis-core/go/common/cbor"
 )
 
-func CborFromSlice(data []byte) error {
+// ErrInvalidUTF8 is the error returned when the Rust implementation rejects a text string which
+// is not valid UTF-8.
+var ErrInvalidUTF8 = errors.New("invalid UTF-8 in text string")
+
+// CborFromSlice decodes the given data using the Rust implementation and returns the canonical
+// encoding of the decoded value.
+func CborFromSlice(data []byte) ([]byte, error) {
+	ptr, len := input(data)
+	var (
+		offset     C.size_t
+		encoded    *C.uchar
+		encodedLen C.size_t
+	)
+	result := C.cbor_from_slice(ptr, len, &offset, &encoded, &encodedLen)
+	return takeEncoded(result, offset, encoded, encodedLen)
+}
+
+// CborRoundtrip decodes the given canonically encoded data using the Rust implementation and
+// returns the encoding of the decoded value.
+func CborRoundtrip(data []byte) ([]byte, error) {
+	ptr, len := input(data)
+	var (
+		offset     C.size_t
+		encoded    *C.uchar
+		encodedLen C.size_t
+	)
+	result := C.cbor_roundtrip(ptr, len, &offset, &encoded, &encodedLen)
+	return takeEncoded(result, offset, encoded, encodedLen)
+}
+
+// CborDecodeRecord decodes the given canonically encoded data into the record type of the Rust
+// implementation, whose decoder is generated by the derive macros, and returns the encoding of the
+// decoded record.
+func CborDecodeRecord(data []byte) ([]byte, error) {
+	ptr, len := input(data)
+	var (
+		offset     C.size_t
+		encoded    *C.uchar
+		encodedLen C.size_t
+	)
+	result := C.cbor_decode_record(ptr, len, &offset, &encoded, &encodedLen)
+	return takeEncoded(result, offset, encoded, encodedLen)
+}
+
+// RoundtripRust decodes the given data using the Rust implementation and returns the canonical
+// encoding of the decoded value, as produced by the Rust encoder. Unlike CborFromSlice it also
+// accepts empty data, which is rejected as a decoding error at offset 0.
+func RoundtripRust(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("error during decoding at offset 0")
+	}
+	return CborFromSlice(data)
+}
+
+// EncodeValueRust returns the canonical encoding of the given value as produced by the Rust
+// encoder. The value is first encoded in Go and then decoded and re-encoded in Rust, so the
+// result can be compared against the Go encoding of the same value. The two are expected to
+// differ in float precision, as Rust always uses double precision, and in map key order when
+// keys have different major types.
+func EncodeValueRust(v interface{}) ([]byte, error) {
+	return RoundtripRust(cbor.Marshal(v))
+}
+
+// emptyInput is passed in place of empty data, as Rust requires a non-null pointer even for an
+// empty slice.
+var emptyInput C.uchar
+
+// input returns the pointer and length to pass the given data to the Rust implementation, which
+// rejects empty data as a decoding error at offset 0.
+func input(data []byte) (*C.uchar, C.size_t) {
+	if len(data) == 0 {
+		return &emptyInput, 0
+	}
+	return (*C.uchar)(unsafe.Pointer(&data[0])), C.size_t(len(data))
+}
+
+// takeEncoded converts the result of a Rust decode and re-encode call, copying and freeing the
+// encoding on success.
+func takeEncoded(result C.size_t, offset C.size_t, encoded *C.uchar, encodedLen C.size_t) ([]byte, error) {
+	switch result {
+	case 0:
+	case 2:
+		return nil, fmt.Errorf("error during re-encoding")
+	case 3:
+		return nil, fmt.Errorf("%w at offset %d", ErrInvalidUTF8, offset)
+	default:
+		return nil, fmt.Errorf("error during decoding at offset %d", offset)
+	}
+	defer C.cbor_free(encoded, encodedLen)
+
+	return C.GoBytes(unsafe.Pointer(encoded), C.int(encodedLen)), nil
+}
+
+// nonCanonicalReasons describes the reasons returned by cbor_verify_canonical.
+var nonCanonicalReasons = map[C.size_t]string{
+	1: "non-minimal integer or length encoding",
+	2: "map keys not in canonical order",
+	3: "indefinite-length item",
+	4: "unsupported simple or floating point value",
+	5: "trailing data",
+	6: "malformed data",
+}
+
+// VerifyCanonical checks whether the given data is a single CBOR item in canonical form, as
+// required by the strict decoding mode of the Rust implementation.
+func VerifyCanonical(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("not canonical: %s at offset 0", nonCanonicalReasons[6])
+	}
+
 	ptr := (*C.uchar)(unsafe.Pointer(&data[0]))
 	len := C.size_t(len(data))
-	result := C.cbor_from_slice(ptr, len)
+	var offset C.size_t
+	result := C.cbor_verify_canonical(ptr, len, &offset)
 	if result != 0 {
-		return fmt.Errorf("error during decoding")
+		return fmt.Errorf("not canonical: %s at offset %d", nonCanonicalReasons[result], offset)
 	}
 
 	return nil
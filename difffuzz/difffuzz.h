@@ -1,2 +1,6 @@
 
-extern size_t cbor_from_slice(unsigned char *data, size_t len);
+extern size_t cbor_from_slice(unsigned char *data, size_t len, size_t *offset, unsigned char **encoded, size_t *encoded_len);
+extern size_t cbor_roundtrip(unsigned char *data, size_t len, size_t *offset, unsigned char **encoded, size_t *encoded_len);
+extern size_t cbor_decode_record(unsigned char *data, size_t len, size_t *offset, unsigned char **encoded, size_t *encoded_len);
+extern void cbor_free(unsigned char *data, size_t len);
+extern size_t cbor_verify_canonical(unsigned char *data, size_t len, size_t *offset);
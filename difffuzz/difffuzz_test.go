@@ -1,7 +1,15 @@
 package difffuzz
 
 import (
+	"bytes"
+	"errors"
+	"math"
+	"math/bits"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/require"
 
@@ -9,22 +17,254 @@ import (
 )
 
 func TestDecodingFromRust(t *testing.T) {
-	err := CborFromSlice([]byte{0x81, 0x18, 0x2a})
+	encoded, err := CborFromSlice([]byte{0x81, 0x18, 0x2a})
 	require.NoError(t, err)
+	require.Equal(t, []byte{0x81, 0x18, 0x2a}, encoded)
 
-	err = CborFromSlice([]byte{0xde, 0xad, 0xbe, 0xef})
+	encoded, err = CborFromSlice([]byte{0x9F, 0x18, 0x01, 0xFF})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x81, 0x01}, encoded, "decoded values should be re-encoded canonically")
+
+	_, err = CborFromSlice([]byte{0xde, 0xad, 0xbe, 0xef})
 	require.Error(t, err)
+
+	_, err = CborFromSlice([]byte{0x18, 0x2a, 0x00})
+	require.EqualError(t, err, "error during decoding at offset 2", "trailing data should be rejected")
+
+	_, err = CborFromSlice(deeplyNested(10_000))
+	require.Error(t, err, "deeply nested data should be rejected")
+
+	_, err = CborFromSlice([]byte{0xF9, 0x3E, 0x00})
+	require.NoError(t, err, "half precision floats should be accepted")
+
+	_, err = CborFromSlice([]byte{0x7F, 0x61, 0x61, 0x62, 0x62, 0x63, 0xFF})
+	require.NoError(t, err, "chunked text strings should be accepted")
+
+	_, err = CborFromSlice([]byte{0x7F, 0x61, 0x61, 0x41, 0x62, 0xFF})
+	require.EqualError(t, err, "error during decoding at offset 3", "byte string chunks in text strings should be rejected")
+
+	encoded, err = CborFromSlice([]byte{0xA2, 0xEC, 0x00, 0xED, 0x00})
+	require.NoError(t, err, "unassigned simple values should be accepted")
+	require.Equal(t, []byte{0xA2, 0xEC, 0x00, 0xED, 0x00}, encoded, "unassigned simple values should be preserved")
+
+	_, err = CborFromSlice([]byte{0xF8, 0x18})
+	require.EqualError(t, err, "error during decoding at offset 0", "reserved simple values should be rejected")
+
+	for _, data := range invalidUTF8 {
+		_, err = CborFromSlice(data)
+		require.ErrorIs(t, err, ErrInvalidUTF8, "data: %X", data)
+	}
+	_, err = CborFromSlice([]byte{0x82, 0x61, 0x61, 0x62, 0xC0, 0xAF})
+	require.EqualError(t, err, "invalid UTF-8 in text string at offset 3")
+}
+
+// invalidUTF8 are encodings of text strings which are not valid UTF-8, at the edges where UTF-8
+// decoders are known to differ.
+var invalidUTF8 = [][]byte{
+	// Overlong encodings of "/" in two, three and four bytes.
+	{0x62, 0xC0, 0xAF},
+	{0x63, 0xE0, 0x80, 0xAF},
+	{0x64, 0xF0, 0x80, 0x80, 0xAF},
+	// Overlong encoding of NUL, as used by modified UTF-8.
+	{0x62, 0xC0, 0x80},
+	// Lone high and low surrogates (U+D800 and U+DFFF), and a surrogate pair as used by CESU-8.
+	{0x63, 0xED, 0xA0, 0x80},
+	{0x63, 0xED, 0xBF, 0xBF},
+	{0x66, 0xED, 0xA0, 0xBD, 0xED, 0xB8, 0x80},
+	// Code point above U+10FFFF, truncated sequence and unexpected continuation byte.
+	{0x64, 0xF4, 0x90, 0x80, 0x80},
+	{0x62, 0xE2, 0x82},
+	{0x61, 0x80},
+	// Invalid chunk of a chunked text string.
+	{0x7F, 0x61, 0x61, 0x62, 0xED, 0xA0, 0xFF},
+	// Invalid text string as a map key.
+	{0xA1, 0x62, 0xC0, 0xAF, 0x00},
+}
+
+func TestRoundtripInRust(t *testing.T) {
+	data := cbor.Marshal(newRoundtripValue(math.MaxUint64, math.MinInt64, "foo", []byte{0x00, 0xFF}))
+	encoded, err := CborRoundtrip(data)
+	require.NoError(t, err)
+	require.Equal(t, data, encoded)
+
+	_, err = CborRoundtrip([]byte{0x81, 0x18, 0x01})
+	require.EqualError(t, err, "error during decoding at offset 1", "non-canonical data should be rejected")
+
+	_, err = CborRoundtrip([]byte{})
+	require.EqualError(t, err, "error during decoding at offset 0", "empty data should be rejected")
+}
+
+func TestVerifyCanonical(t *testing.T) {
+	require.NoError(t, VerifyCanonical([]byte{0x81, 0x18, 0x2a}))
+	require.NoError(t, VerifyCanonical(cbor.Marshal(map[string]uint64{"a": 1, "bb": 2, "c": 3})))
+	require.NoError(t, VerifyCanonical([]byte{0xFB, 0x3F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}))
+
+	for _, tc := range []struct {
+		data []byte
+		err  string
+	}{
+		{[]byte{0x18, 0x01}, "not canonical: non-minimal integer or length encoding at offset 0"},
+		{[]byte{0x82, 0x00, 0x59, 0x00, 0x01, 0x00}, "not canonical: non-minimal integer or length encoding at offset 2"},
+		{[]byte{0xA2, 0x62, 0x62, 0x62, 0x00, 0x61, 0x61, 0x00}, "not canonical: map keys not in canonical order at offset 5"},
+		{[]byte{0xA2, 0x61, 0x61, 0x00, 0x61, 0x61, 0x00}, "not canonical: map keys not in canonical order at offset 4"},
+		{[]byte{0x9F, 0x01, 0xFF}, "not canonical: indefinite-length item at offset 0"},
+		{[]byte{0xA1, 0x61, 0x61, 0x7F, 0x61, 0x62, 0xFF}, "not canonical: indefinite-length item at offset 3"},
+		{[]byte{0xF9, 0x3E, 0x00}, "not canonical: unsupported simple or floating point value at offset 0"},
+		{[]byte{0xFB, 0x7F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}, "not canonical: unsupported simple or floating point value at offset 0"},
+		{[]byte{0x18, 0x2a, 0x00}, "not canonical: trailing data at offset 2"},
+		{[]byte{0x82, 0x01}, "not canonical: malformed data at offset 2"},
+		{[]byte{}, "not canonical: malformed data at offset 0"},
+	} {
+		require.EqualError(t, VerifyCanonical(tc.data), tc.err, "data: %X", tc.data)
+	}
+}
+
+func TestCanonicalEncodingParity(t *testing.T) {
+	// Integers at the boundaries of each encoding width must be encoded identically.
+	for _, v := range []interface{}{
+		uint64(23), uint64(24), uint64(math.MaxUint8), uint64(math.MaxUint8 + 1),
+		uint64(math.MaxUint16), uint64(math.MaxUint16 + 1),
+		uint64(math.MaxUint32), uint64(math.MaxUint32 + 1), uint64(math.MaxUint64),
+		int64(-24), int64(-25), int64(-1 << 32), int64(-1<<32 - 1), int64(math.MinInt64),
+	} {
+		goEncoded := cbor.Marshal(v)
+		rustEncoded, err := EncodeValueRust(v)
+		require.NoError(t, err, "value: %v", v)
+		require.Equal(t, goEncoded, rustEncoded, "value: %v", v)
+	}
+
+	// Negative integers beyond the range of int64 can be decoded and re-encoded in Rust.
+	for _, data := range [][]byte{
+		{0x3B, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x3B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+	} {
+		encoded, err := RoundtripRust(data)
+		require.NoError(t, err, "data: %X", data)
+		require.Equal(t, data, encoded)
+	}
+
+	// Non-canonical encodings are re-encoded in their shortest form.
+	encoded, err := RoundtripRust([]byte{0x1B, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00})
+	require.NoError(t, err)
+	require.Equal(t, cbor.Marshal(uint64(math.MaxUint32+1)), encoded)
+
+	// Map keys are sorted by their encoding in both versions.
+	v := map[string]uint64{"b": 1, "aa": 2, "a": 3, "": 4}
+	encoded, err = EncodeValueRust(v)
+	require.NoError(t, err)
+	require.Equal(t, cbor.Marshal(v), encoded)
+
+	_, err = RoundtripRust(nil)
+	require.EqualError(t, err, "error during decoding at offset 0", "empty data should be rejected")
+}
+
+// deeplyNested returns an encoding of the given number of nested one-element arrays.
+func deeplyNested(depth int) []byte {
+	data := bytes.Repeat([]byte{0x81}, depth)
+	return append(data, 0x00)
+}
+
+// anyValue returns whether the given predicate holds for the given decoded value or any value
+// nested in it.
+func anyValue(v reflect.Value, pred func(reflect.Value) bool) bool {
+	if pred(v) {
+		return true
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		return !v.IsNil() && anyValue(v.Elem(), pred)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if anyValue(v.Index(i), pred) {
+				return true
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if anyValue(iter.Key(), pred) || anyValue(iter.Value(), pred) {
+				return true
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if anyValue(v.Field(i), pred) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isFloat returns whether the given decoded value is a floating point value.
+func isFloat(v reflect.Value) bool {
+	return v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64
+}
+
+// hasMixedKeyTypes returns whether the given decoded value is a map with keys of different major
+// types.
+func hasMixedKeyTypes(v reflect.Value) bool {
+	if v.Kind() != reflect.Map {
+		return false
+	}
+	var majorTypes uint8
+	iter := v.MapRange()
+	for iter.Next() {
+		majorTypes |= 1 << (cbor.Marshal(iter.Key().Interface())[0] >> 5)
+	}
+	return bits.OnesCount8(majorTypes) > 1
 }
 
 func FuzzDifferential(f *testing.F) {
 	// Seed corpus.
 	f.Add([]byte{0x81, 0x18, 0x2a})
 	f.Add([]byte{0x18, 0x2a})
+	f.Add([]byte{0x18, 0x2a, 0x00})
 	f.Add([]byte{0xA1, 0x63, 0x66, 0x6F, 0x6F, 0x0A})
 	f.Add([]byte{0xA2, 0x65, 0x62, 0x79, 0x74, 0x65, 0x73, 0x41, 0x01, 0x63, 0x66, 0x6F, 0x6F, 0x18, 0x2A})
+	f.Add(deeplyNested(100))
+	// Half precision floats: {"a": 1.5, "b": 5.960464477539063e-8, "c": -Infinity, "d": NaN}.
+	f.Add([]byte{0xA4, 0x61, 0x61, 0xF9, 0x3E, 0x00, 0x61, 0x62, 0xF9, 0x00, 0x01, 0x61, 0x63, 0xF9, 0xFC, 0x00, 0x61, 0x64, 0xF9, 0x7E, 0x00})
+	// Mixed precision floats: {"a": 1.0, "b": 100000.0, "c": 1.1}.
+	f.Add([]byte{0xA3, 0x61, 0x61, 0xF9, 0x3C, 0x00, 0x61, 0x62, 0xFA, 0x47, 0xC3, 0x50, 0x00, 0x61, 0x63, 0xFB, 0x3F, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A})
+	// Keys of different major types, which are sorted differently: {1000: 0, "a": 0} and
+	// {-808464433: -17, true: -17}.
+	f.Add([]byte{0xA2, 0x19, 0x03, 0xE8, 0x00, 0x61, 0x61, 0x00})
+	f.Add([]byte{0xA2, 0x3A, 0x30, 0x30, 0x30, 0x30, 0xF5, 0x30})
+	// Double precision float: {"a": 1.5}.
+	f.Add([]byte{0xA1, 0x61, 0x61, 0xFB, 0x3F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	// Indefinite-length containers: [1, [2]] and {"a": 1}.
+	f.Add([]byte{0x9F, 0x01, 0x9F, 0x02, 0xFF, 0xFF})
+	f.Add([]byte{0xBF, 0x61, 0x61, 0x01, 0xFF})
+	// Chunked strings: h'010203' and "abc".
+	f.Add([]byte{0x5F, 0x41, 0x01, 0x42, 0x02, 0x03, 0xFF})
+	f.Add([]byte{0x7F, 0x61, 0x61, 0x62, 0x62, 0x63, 0xFF})
+	// Text strings which are not valid UTF-8, both on their own and as map keys and values.
+	for _, data := range invalidUTF8 {
+		f.Add(data)
+		f.Add(append([]byte{0xA1, 0x61, 0x61}, data...))
+	}
 
 	// Fuzzing.
 	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+
+		// Make sure both versions agree on which text strings are valid UTF-8. Go decodes into an
+		// untyped value here, as decoding into a map skips validation of non-map data.
+		var generic interface{}
+		goErr := cbor.Unmarshal(data, &generic)
+		_, rustErr := CborFromSlice(data)
+		if errors.Is(rustErr, ErrInvalidUTF8) && goErr == nil {
+			t.Logf("data: %X", data)
+			panic("invalid UTF-8 rejected in Rust but accepted in Go")
+		}
+		if goErr != nil && strings.Contains(goErr.Error(), "invalid UTF-8") && rustErr == nil {
+			t.Logf("data: %X", data)
+			panic("invalid UTF-8 rejected in Go but accepted in Rust")
+		}
+
 		var output map[interface{}]interface{}
 		err := cbor.Unmarshal(data, &output)
 		if err != nil {
@@ -32,10 +272,238 @@ func FuzzDifferential(f *testing.F) {
 		}
 
 		// If decoding succeeded, make sure it also succeeds in the Rust version.
-		err = CborFromSlice(data)
+		rustEncoded, err := CborFromSlice(data)
 		if err != nil {
 			t.Logf("data: %X", data)
-			panic("decoding passed in Go but failed in Rust")
+			panic("decoding passed in Go but failed in Rust: " + err.Error())
+		}
+
+		// Make sure both versions decoded the same value. As the canonical encodings differ in float
+		// precision and map key order, the Rust encoding is normalized by re-encoding it in Go.
+		var rustOutput map[interface{}]interface{}
+		if err = cbor.Unmarshal(rustEncoded, &rustOutput); err != nil {
+			t.Logf("data: %X, rust: %X", data, rustEncoded)
+			panic("Rust encoding of the decoded value cannot be decoded in Go: " + err.Error())
+		}
+		goEncoded := cbor.Marshal(output)
+		if !bytes.Equal(goEncoded, cbor.Marshal(rustOutput)) {
+			t.Logf("data: %X, go: %X, rust: %X", data, goEncoded, rustEncoded)
+			panic("decoded values differ between Go and Rust")
+		}
+
+		// If the data is canonical, make sure the Go encoding of the decoded value is canonical too.
+		// Values with floats are skipped, as Go encodes them in the shortest precision which
+		// represents them exactly, while they are only canonical in double precision in Rust. So are
+		// maps with keys of different major types, as Go sorts keys by the length of their encodings
+		// first, while Rust sorts them by their major type first.
+		decoded := reflect.ValueOf(output)
+		if VerifyCanonical(data) != nil || anyValue(decoded, isFloat) || anyValue(decoded, hasMixedKeyTypes) {
+			return
+		}
+		if err = VerifyCanonical(goEncoded); err != nil {
+			t.Logf("data: %X, encoded: %X", data, goEncoded)
+			panic("canonical data re-encoded in Go is not canonical in Rust: " + err.Error())
+		}
+	})
+}
+
+// roundtripValue is the typed value encoded in Go by FuzzRoundtrip.
+//
+// Floats are not included as Rust always encodes them with double precision while Go uses the
+// shortest precision that preserves the value, and all keys of each map have the same major type
+// as Rust sorts keys by major type first. Both are expected differences between the two canonical
+// encodings.
+type roundtripValue struct {
+	Unsigned uint64            `json:"u"`
+	Signed   int64             `json:"signed"`
+	Text     string            `json:"t"`
+	Bytes    []byte            `json:"bytes"`
+	Map      map[uint64]string `json:"map,omitempty"`
+	Nested   [][]int64         `json:"nested"`
+	Inner    *roundtripValue   `json:"inner,omitempty"`
+}
+
+// newRoundtripValue derives a roundtripValue from the given fuzzer inputs, so that integers of all
+// widths end up in map keys and nested arrays.
+func newRoundtripValue(u uint64, i int64, s string, b []byte) *roundtripValue {
+	v := &roundtripValue{
+		Unsigned: u,
+		Signed:   i,
+		Text:     s,
+		Bytes:    b,
+		Map:      make(map[uint64]string),
+	}
+	for idx, x := range b {
+		v.Map[u>>(x%64)] = strconv.Itoa(idx)
+		v.Nested = append(v.Nested, []int64{i >> (x % 64), -int64(x)})
+	}
+	if len(b) > 1 {
+		// Halve the inputs on each level to keep the nesting depth within the decoder limits.
+		v.Inner = newRoundtripValue(u>>8, i>>8, halve(s), b[:len(b)/2])
+	}
+	return v
+}
+
+// halve returns the first half of the runes in the given string.
+func halve(s string) string {
+	runes := []rune(s)
+	return string(runes[:len(runes)/2])
+}
+
+func FuzzRoundtrip(f *testing.F) {
+	// Seed corpus.
+	f.Add(uint64(0), int64(0), "", []byte{})
+	f.Add(uint64(23), int64(-24), "a", []byte{0x01})
+	f.Add(uint64(math.MaxUint64), int64(math.MinInt64), "foo", []byte{0x00, 0x08, 0x10, 0x20, 0x3F})
+	f.Add(uint64(math.MaxUint32), int64(math.MaxInt64), "bar", bytes.Repeat([]byte{0x07}, 30))
+	f.Add(uint64(1<<32), int64(-1<<31), "ünïcödé", []byte{0xFF, 0x80, 0x40})
+
+	// Fuzzing.
+	f.Fuzz(func(t *testing.T, u uint64, i int64, s string, b []byte) {
+		if !utf8.ValidString(s) {
+			// Go does not validate text strings on encoding.
+			return
+		}
+		encoded := cbor.Marshal(newRoundtripValue(u, i, s, b))
+
+		// Make sure the Rust version decodes the Go encoding and re-encodes it identically.
+		rustEncoded, err := CborRoundtrip(encoded)
+		if err != nil {
+			t.Logf("encoded: %X", encoded)
+			panic("Go encoding cannot be decoded in Rust: " + err.Error())
+		}
+		if !bytes.Equal(encoded, rustEncoded) {
+			t.Logf("go: %X, rust: %X", encoded, rustEncoded)
+			panic("Rust re-encoding differs from Go encoding")
+		}
+	})
+}
+
+// fuzzRecord mirrors the record type decoded by CborDecodeRecord in Rust, whose decoder is
+// generated by the derive macros.
+//
+// Go has no enums, so the status is a plain integer and the action has one optional field per
+// variant. Such values are only valid in Rust with a known status and exactly one action variant.
+type fuzzRecord struct {
+	Nonce    uint64      `cbor:"1,keyasint"`
+	Fee      *uint64     `cbor:"2,keyasint,omitempty"`
+	Memo     string      `cbor:"3,keyasint,omitempty"`
+	Sender   []byte      `cbor:"4,keyasint,omitempty"`
+	Status   uint8       `cbor:"5,keyasint"`
+	Action   *fuzzAction `cbor:"6,keyasint,omitempty"`
+	Children []fuzzChild `cbor:"7,keyasint,omitempty"`
+}
+
+type fuzzAction struct {
+	Transfer *fuzzTransfer `json:"transfer,omitempty"`
+	Burn     *uint64       `json:"burn,omitempty"`
+}
+
+type fuzzTransfer struct {
+	To     []byte `json:"to,omitempty"`
+	Amount uint64 `json:"amount"`
+}
+
+type fuzzChild struct {
+	_      struct{} `cbor:",toarray"`
+	ID     uint64
+	Weight int64
+}
+
+// valid returns whether the record corresponds to a value of the Rust record type.
+func (r *fuzzRecord) valid() bool {
+	if r.Status > 1 {
+		return false
+	}
+	if r.Action != nil && (r.Action.Transfer == nil) == (r.Action.Burn == nil) {
+		return false
+	}
+	return true
+}
+
+func TestDecodingRecordFromRust(t *testing.T) {
+	fee, amount := uint64(0), uint64(math.MaxUint64)
+	for _, record := range []fuzzRecord{
+		{},
+		{Nonce: 1, Fee: &fee, Memo: "memo", Sender: []byte{0xFF}, Status: 1},
+		{Action: &fuzzAction{Transfer: &fuzzTransfer{To: []byte{0x01}, Amount: 10}}},
+		{Action: &fuzzAction{Burn: &amount}, Children: []fuzzChild{{ID: 1, Weight: math.MinInt64}, {}}},
+	} {
+		data := cbor.Marshal(record)
+		encoded, err := CborDecodeRecord(data)
+		require.NoError(t, err, "data: %X", data)
+		require.Equal(t, data, encoded, "records should be re-encoded identically")
+	}
+
+	for _, data := range [][]byte{
+		// Unknown status and an action without any variant.
+		cbor.Marshal(fuzzRecord{Status: 2}),
+		cbor.Marshal(fuzzRecord{Action: &fuzzAction{}}),
+		// Unknown key.
+		{0xA1, 0x08, 0x00},
+		// Non-canonical encoding of the nonce.
+		{0xA1, 0x01, 0x18, 0x01},
+		// Empty data.
+		{},
+	} {
+		_, err := CborDecodeRecord(data)
+		require.Error(t, err, "data: %X", data)
+	}
+}
+
+func FuzzDerived(f *testing.F) {
+	// Seed corpus.
+	fee, amount := uint64(1), uint64(1<<32)
+	f.Add(cbor.Marshal(fuzzRecord{}))
+	f.Add(cbor.Marshal(fuzzRecord{Nonce: math.MaxUint64, Fee: &fee, Memo: "ünïcödé", Sender: []byte{0x00}, Status: 1}))
+	f.Add(cbor.Marshal(fuzzRecord{Action: &fuzzAction{Transfer: &fuzzTransfer{To: []byte{0x01}, Amount: 10}}}))
+	f.Add(cbor.Marshal(fuzzRecord{Action: &fuzzAction{Burn: &amount}, Children: []fuzzChild{{ID: 1, Weight: -1}}}))
+	f.Add(cbor.Marshal(fuzzRecord{Status: 2}))
+	f.Add(cbor.Marshal(fuzzRecord{Action: &fuzzAction{Transfer: &fuzzTransfer{}, Burn: &amount}}))
+	for _, data := range invalidUTF8 {
+		f.Add(append([]byte{0xA1, 0x03}, data...))
+	}
+
+	// Fuzzing.
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+
+		var record fuzzRecord
+		goErr := cbor.Unmarshal(data, &record)
+		rustEncoded, rustErr := CborDecodeRecord(data)
+
+		// If decoding succeeded in Rust, it must also succeed in Go and yield the same record. Go may
+		// still end up with an invalid record, e.g. as it leaves an action variant with a null value
+		// unset.
+		if rustErr == nil {
+			if goErr != nil {
+				t.Logf("data: %X", data)
+				panic("decoding passed in Rust but failed in Go: " + goErr.Error())
+			}
+			goEncoded := cbor.Marshal(record)
+			if record.valid() && !bytes.Equal(goEncoded, rustEncoded) {
+				t.Logf("data: %X, go: %X, rust: %X", data, goEncoded, rustEncoded)
+				panic("decoded records differ between Go and Rust")
+			}
+		}
+		if goErr != nil || !record.valid() {
+			return
+		}
+
+		// Make sure the Rust version decodes the Go encoding of any valid record and re-encodes it
+		// identically. The data itself is not used here as Go is more lenient, e.g. it matches
+		// field names case-insensitively and accepts non-canonical data.
+		goEncoded := cbor.Marshal(record)
+		rustEncoded, err := CborDecodeRecord(goEncoded)
+		if err != nil {
+			t.Logf("data: %X, go: %X", data, goEncoded)
+			panic("Go encoding cannot be decoded in Rust: " + err.Error())
+		}
+		if !bytes.Equal(goEncoded, rustEncoded) {
+			t.Logf("go: %X, rust: %X", goEncoded, rustEncoded)
+			panic("Rust re-encoding differs from Go encoding")
 		}
 	})
 }
@@ -1,16 +1,221 @@
 //! Rust part of the differential fuzzer.
 
+/// Decodes the given data, returning zero on success. The canonical encoding of the decoded value
+/// is stored into `encoded` and `encoded_len` and must be freed using `cbor_free`. On decoding
+/// failure, one is returned and the byte offset of the failing item (if known) is stored into
+/// `offset`. In case the decoded value cannot be re-encoded, two is returned. Text strings which
+/// are not valid UTF-8 are reported separately by returning three.
 #[no_mangle]
-pub extern "C" fn cbor_from_slice(data: *const u8, len: usize) -> usize {
+pub extern "C" fn cbor_from_slice(
+    data: *const u8,
+    len: usize,
+    offset: *mut usize,
+    encoded: *mut *mut u8,
+    encoded_len: *mut usize,
+) -> usize {
     let data = unsafe {
         std::slice::from_raw_parts(data, len)
     };
 
-    let value: Result<oasis_cbor::Value, _> = oasis_cbor::from_slice_non_strict(data);
-    if value.is_ok() {
-        0
-    } else {
-        1
+    reencode(data, &Default::default(), offset, encoded, encoded_len)
+}
+
+/// Same as `cbor_from_slice`, but rejects data which is not canonically encoded.
+#[no_mangle]
+pub extern "C" fn cbor_roundtrip(
+    data: *const u8,
+    len: usize,
+    offset: *mut usize,
+    encoded: *mut *mut u8,
+    encoded_len: *mut usize,
+) -> usize {
+    let data = unsafe {
+        std::slice::from_raw_parts(data, len)
+    };
+
+    let options = oasis_cbor::DecodeOptions {
+        canonical: true,
+        ..Default::default()
+    };
+    reencode(data, &options, offset, encoded, encoded_len)
+}
+
+fn reencode(
+    data: &[u8],
+    options: &oasis_cbor::DecodeOptions,
+    offset: *mut usize,
+    encoded: *mut *mut u8,
+    encoded_len: *mut usize,
+) -> usize {
+    let value: Result<oasis_cbor::Value, _> = oasis_cbor::from_slice_with(data, options);
+    match value {
+        Ok(value) => {
+            // Use the writer directly as `to_vec` panics on values it cannot encode.
+            let mut buffer = vec![];
+            if oasis_cbor::writer::write(value, &mut buffer).is_err() {
+                return 2;
+            }
+            store_encoded(buffer, encoded, encoded_len)
+        }
+        Err(e) => decode_error(e, offset),
+    }
+}
+
+/// Stores the given encoding into `encoded` and `encoded_len`, returning zero.
+fn store_encoded(buffer: Vec<u8>, encoded: *mut *mut u8, encoded_len: *mut usize) -> usize {
+    let buffer = buffer.into_boxed_slice();
+    unsafe {
+        *encoded_len = buffer.len();
+        *encoded = Box::into_raw(buffer) as *mut u8;
+    }
+    0
+}
+
+/// Stores the byte offset of the failing item (if known) into `offset` and returns the result
+/// code for the given decoding error.
+fn decode_error(e: oasis_cbor::DecodeError, offset: *mut usize) -> usize {
+    if let Some(failed_at) = e.offset() {
+        unsafe { *offset = failed_at };
+    }
+    match e {
+        oasis_cbor::DecodeError::InvalidUtf8 { .. } => 3,
+        _ => 1,
+    }
+}
+
+/// Frees an encoding previously returned by `cbor_from_slice`, `cbor_roundtrip` or
+/// `cbor_decode_record`.
+#[no_mangle]
+pub extern "C" fn cbor_free(data: *mut u8, len: usize) {
+    drop(unsafe { Box::from_raw(std::ptr::slice_from_raw_parts_mut(data, len)) });
+}
+
+/// Reasons for data not being in canonical form, as reported by `cbor_verify_canonical`.
+#[repr(usize)]
+enum NonCanonical {
+    NonMinimalEncoding = 1,
+    UnsortedMapKeys = 2,
+    IndefiniteLength = 3,
+    UnsupportedValue = 4,
+    TrailingData = 5,
+    Malformed = 6,
+}
+
+/// Checks whether the given data is in canonical form, returning zero if it is. Otherwise one of
+/// the `NonCanonical` reasons is returned and the byte offset of the offending item is stored into
+/// `offset`.
+#[no_mangle]
+pub extern "C" fn cbor_verify_canonical(data: *const u8, len: usize, offset: *mut usize) -> usize {
+    let data = unsafe {
+        std::slice::from_raw_parts(data, len)
+    };
+
+    let options = oasis_cbor::DecodeOptions {
+        canonical: true,
+        ..Default::default()
+    };
+    let err = match oasis_cbor::reader::read_with_options(data, &options) {
+        Ok(_) => return 0,
+        Err(err) => err,
+    };
+    unsafe { *offset = err.offset() };
+
+    use oasis_cbor::reader::DecoderError;
+    let reason = match err {
+        DecoderError::NonMinimalCborEncoding { .. } => NonCanonical::NonMinimalEncoding,
+        DecoderError::OutOfOrderKey { .. } | DecoderError::DuplicateMapKey { .. } => {
+            NonCanonical::UnsortedMapKeys
+        }
+        DecoderError::IndefiniteLength { .. } => NonCanonical::IndefiniteLength,
+        DecoderError::UnsupportedSimpleValue { .. }
+        | DecoderError::UnsupportedFloatingPointValue { .. } => NonCanonical::UnsupportedValue,
+        DecoderError::ExtraneousData { .. } => NonCanonical::TrailingData,
+        _ => NonCanonical::Malformed,
+    };
+    reason as usize
+}
+
+/// Status of a `Record`, encoded as its discriminant.
+#[derive(Debug, PartialEq, oasis_cbor::Encode, oasis_cbor::Decode)]
+#[cbor(with_default)]
+enum Status {
+    Active = 0,
+    Frozen = 1,
+}
+
+impl Default for Status {
+    fn default() -> Self {
+        Self::Active
+    }
+}
+
+/// Action of a `Record`, encoded as a single-entry map keyed by the variant name.
+#[derive(Debug, PartialEq, oasis_cbor::Encode, oasis_cbor::Decode)]
+enum Action {
+    #[cbor(rename = "transfer")]
+    Transfer {
+        #[cbor(optional)]
+        to: Vec<u8>,
+        amount: u64,
+    },
+    #[cbor(rename = "burn")]
+    Burn(u64),
+}
+
+/// Child of a `Record`, encoded as an array.
+#[derive(Debug, Default, PartialEq, oasis_cbor::Encode, oasis_cbor::Decode)]
+#[cbor(as_array)]
+struct Child {
+    id: u64,
+    weight: i64,
+}
+
+/// Typed value decoded by `cbor_decode_record`, mirrored by `fuzzRecord` on the Go side. It covers
+/// the derive-generated code paths for integer keys, optional fields, unit enums encoded as their
+/// discriminants, enums with fields and array-encoded structs.
+///
+/// Byte strings are optional as Go encodes nil slices as null, while Rust encodes empty vectors
+/// as empty byte strings.
+#[derive(Debug, Default, PartialEq, oasis_cbor::Encode, oasis_cbor::Decode)]
+struct Record {
+    #[cbor(rename = 1)]
+    nonce: u64,
+    #[cbor(rename = 2, optional)]
+    fee: Option<u64>,
+    #[cbor(rename = 3, optional)]
+    memo: String,
+    #[cbor(rename = 4, optional)]
+    sender: Vec<u8>,
+    #[cbor(rename = 5)]
+    status: Status,
+    #[cbor(rename = 6, optional)]
+    action: Option<Action>,
+    #[cbor(rename = 7, optional)]
+    children: Vec<Child>,
+}
+
+/// Decodes the given canonically encoded data into a `Record`, returning zero on success. The
+/// encoding of the decoded record is stored into `encoded` and `encoded_len` and must be freed
+/// using `cbor_free`. Failures are reported the same as by `cbor_from_slice`.
+#[no_mangle]
+pub extern "C" fn cbor_decode_record(
+    data: *const u8,
+    len: usize,
+    offset: *mut usize,
+    encoded: *mut *mut u8,
+    encoded_len: *mut usize,
+) -> usize {
+    let data = unsafe {
+        std::slice::from_raw_parts(data, len)
+    };
+
+    let options = oasis_cbor::DecodeOptions {
+        canonical: true,
+        ..Default::default()
+    };
+    match oasis_cbor::from_slice_with::<Record>(data, &options) {
+        Ok(record) => store_encoded(oasis_cbor::to_vec(record), encoded, encoded_len),
+        Err(e) => decode_error(e, offset),
     }
 }
 
@@ -30,4 +235,134 @@ mod test {
             oasis_cbor::reader::read_nested_non_strict(tc, Some(64)).unwrap();
         }
     }
+
+    #[test]
+    fn test_from_slice() {
+        let tcs: Vec<(&[u8], &[u8])> = vec![
+            (&[0x81, 0x18, 0x2A], &[0x81, 0x18, 0x2A]),
+            (&[0x1A, 0xFF, 0xFF, 0xFF, 0xFF], &[0x1A, 0xFF, 0xFF, 0xFF, 0xFF]),
+            // Non-canonical data is re-encoded canonically.
+            (&[0x81, 0x18, 0x01], &[0x81, 0x01]),
+            (&[0xA2, 0x02, 0x00, 0x01, 0x00], &[0xA2, 0x01, 0x00, 0x02, 0x00]),
+            (&[0x9F, 0x01, 0xFF], &[0x81, 0x01]),
+        ];
+
+        for (data, expected) in tcs {
+            let (mut offset, mut encoded, mut encoded_len) = (0, std::ptr::null_mut(), 0);
+            let result = super::cbor_from_slice(
+                data.as_ptr(),
+                data.len(),
+                &mut offset,
+                &mut encoded,
+                &mut encoded_len,
+            );
+            assert_eq!(result, 0);
+            assert_eq!(unsafe { std::slice::from_raw_parts(encoded, encoded_len) }, expected);
+            super::cbor_free(encoded, encoded_len);
+        }
+    }
+
+    #[test]
+    fn test_roundtrip() {
+        let tcs: Vec<(&[u8], usize)> = vec![
+            (&[0x81, 0x18, 0x2A], 0),
+            (&[0xA2, 0x01, 0x00, 0x02, 0x00], 0),
+            (&[0x81, 0x18, 0x01], 1),
+            (&[0xA2, 0x02, 0x00, 0x01, 0x00], 1),
+            (&[0x9F, 0x01, 0xFF], 1),
+            // Overlong encoding of "/" and a lone surrogate (U+D800).
+            (&[0x62, 0xC0, 0xAF], 3),
+            (&[0x81, 0x63, 0xED, 0xA0, 0x80], 3),
+        ];
+
+        for (data, expected) in tcs {
+            let (mut offset, mut encoded, mut encoded_len) = (0, std::ptr::null_mut(), 0);
+            let result = super::cbor_roundtrip(
+                data.as_ptr(),
+                data.len(),
+                &mut offset,
+                &mut encoded,
+                &mut encoded_len,
+            );
+            assert_eq!(result, expected, "data: {:X?}", data);
+            if result == 0 {
+                assert_eq!(unsafe { std::slice::from_raw_parts(encoded, encoded_len) }, data);
+                super::cbor_free(encoded, encoded_len);
+            }
+        }
+    }
+
+    #[test]
+    fn test_decode_record() {
+        let record = super::Record {
+            nonce: 1,
+            fee: Some(0),
+            memo: "memo".to_owned(),
+            sender: vec![0xFF],
+            status: super::Status::Frozen,
+            action: Some(super::Action::Transfer {
+                to: vec![],
+                amount: 10,
+            }),
+            children: vec![super::Child { id: 2, weight: -3 }],
+        };
+        let record = oasis_cbor::to_vec(record);
+
+        let tcs: Vec<(&[u8], usize)> = vec![
+            (&record, 0),
+            // The default record.
+            (&[0xA2, 0x01, 0x00, 0x05, 0x00], 0),
+            // {1: 0, 5: 1, 6: {"burn": 7}}
+            (&[0xA3, 0x01, 0x00, 0x05, 0x01, 0x06, 0xA1, 0x64, 0x62, 0x75, 0x72, 0x6E, 0x07], 0),
+            // Non-canonical encoding of {1: 1}.
+            (&[0xA1, 0x01, 0x18, 0x01], 1),
+            // Unknown key, unknown status and an action with more than one entry.
+            (&[0xA1, 0x08, 0x00], 1),
+            (&[0xA1, 0x05, 0x02], 1),
+            (&[0xA1, 0x06, 0xA2, 0x64, 0x62, 0x75, 0x72, 0x6E, 0x07, 0x68, 0x74, 0x72, 0x61, 0x6E, 0x73, 0x66, 0x65, 0x72, 0xA0], 1),
+            // Child with a missing element.
+            (&[0xA1, 0x07, 0x81, 0x81, 0x00], 1),
+            // Memo which is not valid UTF-8.
+            (&[0xA1, 0x03, 0x62, 0xC0, 0xAF], 3),
+        ];
+
+        for (data, expected) in tcs {
+            let (mut offset, mut encoded, mut encoded_len) = (0, std::ptr::null_mut(), 0);
+            let result = super::cbor_decode_record(
+                data.as_ptr(),
+                data.len(),
+                &mut offset,
+                &mut encoded,
+                &mut encoded_len,
+            );
+            assert_eq!(result, expected, "data: {:X?}", data);
+            if result == 0 {
+                assert_eq!(unsafe { std::slice::from_raw_parts(encoded, encoded_len) }, data);
+                super::cbor_free(encoded, encoded_len);
+            }
+        }
+    }
+
+    #[test]
+    fn test_verify_canonical() {
+        let tcs: Vec<(&[u8], usize, usize)> = vec![
+            (&[0x81, 0x18, 0x2A], 0, 0),
+            (&[0x81, 0x18, 0x01], 1, 1),
+            (&[0xA2, 0x02, 0x00, 0x01, 0x00], 2, 3),
+            (&[0xA2, 0x01, 0x00, 0x01, 0x00], 2, 3),
+            (&[0x81, 0x9F, 0xFF], 3, 1),
+            (&[0xF9, 0x3C, 0x00], 4, 0),
+            (&[0x01, 0x02], 5, 1),
+            (&[0x81, 0x1C], 6, 1),
+        ];
+
+        for (data, reason, offset) in tcs {
+            let mut failed_at = 0;
+            assert_eq!(
+                super::cbor_verify_canonical(data.as_ptr(), data.len(), &mut failed_at),
+                reason
+            );
+            assert_eq!(failed_at, offset);
+        }
+    }
 }
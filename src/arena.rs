@@ -0,0 +1,283 @@
+//! Arena for decoding many short-lived messages which borrow from their encoding.
+use alloc::{
+    alloc::{AllocError, Allocator, Layout},
+    vec,
+    vec::Vec,
+};
+use core::{cell::RefCell, ptr, ptr::NonNull};
+
+use crate::{reader, ContainerAlloc, DecodeBorrowed, DecodeError, DecodeOptions};
+
+/// Size of the first chunk allocated by an arena without an explicit capacity.
+const MIN_CHUNK_SIZE: usize = 4096;
+
+/// Bump allocator holding copies of encoded messages, so that values decoded from them can borrow
+/// their byte and text strings instead of allocating them.
+///
+/// This is useful when the encoded messages live in a buffer which is reused (e.g. for reading
+/// from the network), while the decoded messages must live a bit longer, e.g. until the end of a
+/// batch. All decoded values borrow from the arena, so [`Arena::reset`] can only be called once
+/// they are gone, after which the memory is reused for the next batch.
+///
+/// Each message is first copied into the arena (one `memcpy` of its encoding). Decoding then
+/// builds the same intermediate `ValueRef` representation as
+/// [`from_slice_borrowed`](crate::from_slice_borrowed), but allocates its arrays, maps and tagged
+/// values from the arena too. Their memory is only released on reset, so once the arena has grown
+/// to fit a batch, decoding further batches does not allocate any memory for the messages, other
+/// than what the decoded types allocate themselves (e.g. owned strings).
+///
+/// ```
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(Debug, Default, oasis_cbor::Encode, oasis_cbor::Decode)]
+/// struct Message<'a> {
+///     sender: &'a str,
+///     nonce: u64,
+/// }
+///
+/// # fn main() {
+/// let batch: Vec<Vec<u8>> = (0..3)
+///     .map(|i| oasis_cbor::to_vec(Message { sender: "alice", nonce: i }))
+///     .collect();
+///
+/// let mut arena = oasis_cbor::Arena::new();
+/// for _ in 0..2 {
+///     let messages = batch
+///         .iter()
+///         .map(|enc| arena.decode::<Message<'_>>(enc))
+///         .collect::<Result<Vec<_>, _>>()
+///         .unwrap();
+///     assert_eq!(messages[2].sender, "alice");
+///     drop(messages);
+///
+///     arena.reset();
+/// }
+/// # }
+/// ```
+pub struct Arena {
+    /// Chunks of memory holding the copied data. The data of a chunk never exceeds its capacity,
+    /// so the chunks are never reallocated and references to their contents stay valid until the
+    /// arena is reset or dropped.
+    chunks: RefCell<Vec<Vec<u8>>>,
+    options: DecodeOptions,
+}
+
+impl Arena {
+    /// Create a new empty arena.
+    ///
+    /// The arena requires canonical encoding, same as `from_slice_borrowed`.
+    pub fn new() -> Self {
+        Self::with_capacity(0)
+    }
+
+    /// Create a new arena which can hold the given number of bytes before allocating more memory.
+    pub fn with_capacity(capacity: usize) -> Self {
+        Self::with_options(
+            capacity,
+            DecodeOptions {
+                canonical: true,
+                ..Default::default()
+            },
+        )
+    }
+
+    /// Create a new arena with the given initial capacity, using the given decoding options.
+    pub fn with_options(capacity: usize, options: DecodeOptions) -> Self {
+        let chunks = if capacity > 0 {
+            vec![Vec::with_capacity(capacity)]
+        } else {
+            Vec::new()
+        };
+        Self {
+            chunks: RefCell::new(chunks),
+            options,
+        }
+    }
+
+    /// Decode the given CBOR-encoded data into the given type, borrowing from a copy of the data
+    /// held by the arena.
+    ///
+    /// The data is copied even if decoding fails, and only released when the arena is reset, as
+    /// are the arrays, maps and tagged values read from it.
+    pub fn decode<'a, T>(&'a self, data: &[u8]) -> Result<T, DecodeError>
+    where
+        T: DecodeBorrowed<'a>,
+    {
+        let value = reader::read_borrowed_with_options_in(
+            self.alloc(data),
+            &self.options,
+            ContainerAlloc::new(self),
+        )?;
+        T::try_from_cbor_value_borrowed_default(value)
+    }
+
+    /// Copy the given data into the arena, returning the copy.
+    pub fn alloc(&self, data: &[u8]) -> &[u8] {
+        let mut chunks = self.chunks.borrow_mut();
+        let chunk = chunk_for(&mut chunks, Layout::for_value(data));
+        let start = chunk.len();
+        // The data fits into the remaining capacity, so this does not reallocate the chunk.
+        chunk.extend_from_slice(data);
+        // SAFETY: The copy is never moved or modified, as the chunk is never reallocated, and data
+        // is only ever appended after it. The chunk is only cleared or freed via `reset` (which
+        // requires exclusive access, so no references returned here can be alive) or when the
+        // arena is dropped, so the copy lives at least as long as the borrow of the arena.
+        unsafe { core::slice::from_raw_parts(chunk.as_ptr().add(start), data.len()) }
+    }
+
+    /// Number of bytes currently held by the arena, including the memory allocated for decoded
+    /// values and any padding for their alignment.
+    pub fn allocated(&self) -> usize {
+        self.chunks.borrow().iter().map(Vec::len).sum()
+    }
+
+    /// Release all data held by the arena, keeping its memory for reuse.
+    ///
+    /// In case the arena had to grow since the last reset, its chunks are merged into a single
+    /// one large enough for all of them, so that the next batch of the same size fits without
+    /// allocating.
+    pub fn reset(&mut self) {
+        let chunks = self.chunks.get_mut();
+        if chunks.len() > 1 {
+            let capacity = chunks.iter().map(Vec::capacity).sum();
+            *chunks = vec![Vec::with_capacity(capacity)];
+        } else if let Some(chunk) = chunks.first_mut() {
+            chunk.clear();
+        }
+    }
+}
+
+// SAFETY: Allocated memory is never moved or handed out twice, as it is only ever appended to a
+// chunk which is never reallocated. It stays valid until the arena is reset or dropped, both of
+// which require that no borrows of the arena (and thus no users of the memory) are alive.
+unsafe impl Allocator for Arena {
+    fn allocate(&self, layout: Layout) -> Result<NonNull<[u8]>, AllocError> {
+        let mut chunks = self.chunks.borrow_mut();
+        let chunk = chunk_for(&mut chunks, layout);
+        let start = chunk.len();
+        // The memory fits into the remaining capacity, so this does not reallocate the chunk.
+        chunk.resize(start + layout.size(), 0);
+        let data = unsafe { chunk.as_mut_ptr().add(start) };
+        NonNull::new(ptr::slice_from_raw_parts_mut(data, layout.size())).ok_or(AllocError)
+    }
+
+    unsafe fn deallocate(&self, _ptr: NonNull<u8>, _layout: Layout) {
+        // Memory is only released when the arena is reset.
+    }
+}
+
+/// Return the chunk to allocate memory of the given layout from, with any padding needed for its
+/// alignment already added, adding a new chunk in case the memory does not fit into the last one.
+fn chunk_for(chunks: &mut Vec<Vec<u8>>, layout: Layout) -> &mut Vec<u8> {
+    let fits = chunks
+        .last()
+        .map(|chunk| chunk.capacity() - chunk.len() >= padding(chunk, layout) + layout.size())
+        .unwrap_or(false);
+    if !fits {
+        // Grow geometrically, so that the number of chunks stays small. The start of the chunk may
+        // need to be padded as well.
+        let last_capacity = chunks.last().map(Vec::capacity).unwrap_or(0);
+        let capacity = (layout.size() + layout.align() - 1)
+            .max(last_capacity.saturating_mul(2))
+            .max(MIN_CHUNK_SIZE);
+        chunks.push(Vec::with_capacity(capacity));
+    }
+
+    let chunk = chunks.last_mut().unwrap();
+    chunk.resize(chunk.len() + padding(chunk, layout), 0);
+    chunk
+}
+
+/// Number of bytes to skip at the end of the given chunk to align memory of the given layout.
+fn padding(chunk: &[u8], layout: Layout) -> usize {
+    let end = chunk.as_ptr() as usize + chunk.len();
+    end.wrapping_neg() & (layout.align() - 1)
+}
+
+impl Default for Arena {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use super::*;
+    use crate::ValueRef;
+
+    #[test]
+    fn test_alloc() {
+        let arena = Arena::with_capacity(8);
+        let a = arena.alloc(&[1, 2, 3]);
+        let b = arena.alloc(&[4, 5, 6, 7, 8]);
+        // Does not fit into the first chunk.
+        let c = arena.alloc(&[9; 10]);
+        assert_eq!(a, &[1, 2, 3]);
+        assert_eq!(b, &[4, 5, 6, 7, 8]);
+        assert_eq!(c, &[9; 10]);
+        assert_eq!(arena.allocated(), 18);
+        assert_eq!(arena.chunks.borrow().len(), 2);
+    }
+
+    #[test]
+    fn test_reset() {
+        let mut arena = Arena::with_capacity(8);
+        arena.alloc(&[0; 8]);
+        arena.alloc(&[0; 100]);
+        let capacity: usize = arena.chunks.borrow().iter().map(Vec::capacity).sum();
+
+        // The chunks are merged so that the same data fits into a single one.
+        arena.reset();
+        assert_eq!(arena.allocated(), 0);
+        assert_eq!(arena.chunks.borrow().len(), 1);
+        assert!(arena.chunks.borrow()[0].capacity() >= capacity);
+        let ptr = arena.alloc(&[0; 8]).as_ptr();
+        arena.alloc(&[0; 100]);
+        assert_eq!(arena.chunks.borrow().len(), 1);
+
+        // Resetting again reuses the same memory.
+        arena.reset();
+        assert_eq!(arena.alloc(&[1; 8]).as_ptr(), ptr);
+    }
+
+    #[test]
+    fn test_allocate() {
+        let arena = Arena::with_capacity(64);
+        arena.alloc(&[1]);
+        // Allocations are aligned, and come from the same chunk while they fit.
+        let mut items = Vec::with_capacity_in(4, &arena);
+        items.extend([1u64, 2, 3, 4]);
+        assert_eq!(items.as_ptr() as usize % core::mem::align_of::<u64>(), 0);
+        assert_eq!(arena.chunks.borrow().len(), 1);
+        assert!(arena.allocated() > 4 * 8);
+        assert_eq!(items, [1, 2, 3, 4]);
+
+        // Containers of decoded values are allocated from the arena as well.
+        let allocated = arena.allocated();
+        let value: ValueRef<'_> = arena.decode(&[0x82, 0x01, 0x02]).unwrap();
+        assert!(matches!(value, ValueRef::Array(items) if items.len() == 2));
+        assert!(arena.allocated() >= allocated + 3 + 2 * core::mem::size_of::<ValueRef<'_>>());
+    }
+
+    #[test]
+    fn test_decode() {
+        let mut arena = Arena::new();
+        let mut buffer = vec![0x63, 0x66, 0x6F, 0x6F]; // "foo"
+        let foo: &str = arena.decode(&buffer).unwrap();
+        // The input buffer may be reused while the decoded value is alive.
+        buffer.copy_from_slice(&[0x63, 0x62, 0x61, 0x72]); // "bar"
+        let bar: &str = arena.decode(&buffer).unwrap();
+        assert_eq!((foo, bar), ("foo", "bar"));
+        assert_eq!(arena.allocated(), 8);
+
+        // Decoding is canonical by default.
+        let res: Result<&str, _> = arena.decode(&[0x78, 0x03, 0x66, 0x6F, 0x6F]);
+        assert!(matches!(res, Err(DecodeError::NonCanonical { .. })));
+        arena.reset();
+
+        let arena = Arena::with_options(0, DecodeOptions::default());
+        let foo: &str = arena.decode(&[0x78, 0x03, 0x66, 0x6F, 0x6F]).unwrap();
+        assert_eq!(foo, "foo");
+    }
+}
@@ -0,0 +1,302 @@
+//! Arbitrary-precision integers encoded as CBOR bignums (RFC 8949 section 3.4.3).
+//!
+//! A [`Bignum`] holds an integer of any size in sign-magnitude form. Like `i128`, it encodes as a
+//! plain CBOR integer when it fits into one and as a positive (tag 2) or negative (tag 3) bignum
+//! otherwise. It serves as the intermediate representation for other large integer types, e.g.
+//! via `#[cbor(with = "...")]` helpers converting from and to it:
+//!
+//! ```
+//! # // Derived code refers to the crate root, which may be this doctest.
+//! # pub use oasis_cbor::*;
+//! #
+//! /// Amount of base units as a big-endian unsigned integer.
+//! #[derive(Debug, Default, PartialEq)]
+//! struct Amount(Vec<u8>);
+//!
+//! mod amount_as_bignum {
+//!     use oasis_cbor::{bignum::Bignum, DecodeError};
+//!
+//!     pub fn encode(amount: &super::Amount) -> Bignum {
+//!         Bignum::new(false, amount.0.clone())
+//!     }
+//!
+//!     pub fn decode(value: Bignum) -> Result<super::Amount, DecodeError> {
+//!         match value.into_parts() {
+//!             (false, magnitude) => Ok(super::Amount(magnitude)),
+//!             (true, _) => Err(DecodeError::UnexpectedType),
+//!         }
+//!     }
+//! }
+//!
+//! #[derive(Debug, Default, PartialEq, oasis_cbor::Encode, oasis_cbor::Decode)]
+//! struct Transfer {
+//!     #[cbor(with = "amount_as_bignum")]
+//!     amount: Amount,
+//! }
+//!
+//! # fn main() {
+//! let transfer = Transfer {
+//!     amount: Amount(vec![0x01; 20]),
+//! };
+//! let enc = oasis_cbor::to_vec(transfer);
+//! let dec: Transfer = oasis_cbor::from_slice(&enc).unwrap();
+//! assert_eq!(dec.amount, Amount(vec![0x01; 20]));
+//! # }
+//! ```
+//!
+//! With the `num-bigint` feature, `BigInt` and `BigUint` from the `num-bigint` crate are encoded
+//! and decoded the same way.
+use alloc::{boxed::Box, vec::Vec};
+use core::convert::TryFrom;
+
+#[cfg(feature = "num-bigint")]
+use num_bigint::{BigInt, BigUint, Sign};
+
+use crate::{
+    decode::{Decode, TAG_NEGATIVE_BIGNUM, TAG_POSITIVE_BIGNUM},
+    encode::Encode,
+    writer::header_len,
+    DecodeError, Value,
+};
+
+/// An integer of arbitrary size in sign-magnitude form.
+#[derive(Clone, Debug, Default, PartialEq, Eq, Hash)]
+pub struct Bignum {
+    negative: bool,
+    /// Big-endian magnitude without leading zero bytes, empty for zero.
+    magnitude: Vec<u8>,
+}
+
+impl Bignum {
+    /// Create a new integer from its sign and big-endian magnitude.
+    ///
+    /// Leading zero bytes of the magnitude are ignored, and zero is never negative.
+    pub fn new(negative: bool, mut magnitude: Vec<u8>) -> Self {
+        let leading_zeros = magnitude.iter().take_while(|b| **b == 0).count();
+        magnitude.drain(..leading_zeros);
+        Self {
+            negative: negative && !magnitude.is_empty(),
+            magnitude,
+        }
+    }
+
+    /// Whether the integer is negative.
+    pub fn is_negative(&self) -> bool {
+        self.negative
+    }
+
+    /// Big-endian magnitude of the integer without leading zero bytes (empty for zero).
+    pub fn magnitude(&self) -> &[u8] {
+        &self.magnitude
+    }
+
+    /// Split the integer into its sign and big-endian magnitude, as accepted by [`Bignum::new`].
+    pub fn into_parts(self) -> (bool, Vec<u8>) {
+        (self.negative, self.magnitude)
+    }
+
+    /// Magnitude of the integer, if it fits into an `u128`.
+    fn magnitude_u128(&self) -> Option<u128> {
+        const SIZE: usize = core::mem::size_of::<u128>();
+        if self.magnitude.len() > SIZE {
+            return None;
+        }
+        let mut data = [0u8; SIZE];
+        data[SIZE - self.magnitude.len()..].copy_from_slice(&self.magnitude);
+        Some(u128::from_be_bytes(data))
+    }
+
+    /// The integer, if it fits into an `i128`.
+    #[cfg(feature = "num-bigint")]
+    fn to_i128(&self) -> Option<i128> {
+        let magnitude = self.magnitude_u128()?;
+        if self.negative {
+            // Negative integers go one further than positive ones.
+            i128::try_from(magnitude - 1).ok().map(|n| -1 - n)
+        } else {
+            i128::try_from(magnitude).ok()
+        }
+    }
+
+    /// Argument of the plain CBOR integer the value is encoded as, if it fits into one.
+    fn plain_integer(&self) -> Option<u64> {
+        let magnitude = self.magnitude_u128()?;
+        // Negative integers encode -1 - n.
+        let n = if self.negative {
+            magnitude - 1
+        } else {
+            magnitude
+        };
+        u64::try_from(n).ok()
+    }
+}
+
+impl From<u128> for Bignum {
+    fn from(value: u128) -> Self {
+        Self::new(false, value.to_be_bytes().to_vec())
+    }
+}
+
+impl From<i128> for Bignum {
+    fn from(value: i128) -> Self {
+        Self::new(value < 0, value.unsigned_abs().to_be_bytes().to_vec())
+    }
+}
+
+/// Subtract one from the given non-zero big-endian magnitude, removing a leading zero byte if one
+/// results.
+fn decrement(mut magnitude: Vec<u8>) -> Vec<u8> {
+    for byte in magnitude.iter_mut().rev() {
+        let (result, borrow) = byte.overflowing_sub(1);
+        *byte = result;
+        if !borrow {
+            break;
+        }
+    }
+    if magnitude.first() == Some(&0) {
+        magnitude.remove(0);
+    }
+    magnitude
+}
+
+/// Add one to the given big-endian magnitude, growing it by a byte if needed.
+fn increment(mut magnitude: Vec<u8>) -> Vec<u8> {
+    for byte in magnitude.iter_mut().rev() {
+        let (result, carry) = byte.overflowing_add(1);
+        *byte = result;
+        if !carry {
+            return magnitude;
+        }
+    }
+    magnitude.insert(0, 1);
+    magnitude
+}
+
+impl Encode for Bignum {
+    fn is_empty(&self) -> bool {
+        self.magnitude.is_empty()
+    }
+
+    fn into_cbor_value(self) -> Value {
+        // Use a plain integer when it fits, otherwise a bignum (tag 2 or 3).
+        match (self.plain_integer(), self.negative) {
+            (Some(n), false) => Value::Unsigned(n),
+            (Some(n), true) => Value::Negative(-1 - i128::from(n)),
+            (None, false) => Value::Tag(
+                TAG_POSITIVE_BIGNUM,
+                Box::new(Value::ByteString(self.magnitude)),
+            ),
+            (None, true) => Value::Tag(
+                TAG_NEGATIVE_BIGNUM,
+                Box::new(Value::ByteString(decrement(self.magnitude))),
+            ),
+        }
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        self.clone().into_cbor_value()
+    }
+
+    fn encoded_len(&self) -> usize {
+        if let Some(n) = self.plain_integer() {
+            return header_len(n);
+        }
+        // Subtracting one only shortens the magnitude of a negative bignum if it is a power of 256.
+        let shortened =
+            self.negative && self.magnitude[0] == 1 && self.magnitude[1..].iter().all(|b| *b == 0);
+        let len = self.magnitude.len() - shortened as usize;
+        // Bignum tags (2 and 3) always have a single byte header.
+        1 + header_len(len as u64) + len
+    }
+}
+
+impl Decode for Bignum {
+    fn try_default() -> Result<Self, DecodeError> {
+        Ok(Default::default())
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        // Leading zero bytes in bignums are only rejected by canonical decoding, which already
+        // happens when reading the encoded data.
+        match value {
+            Value::Unsigned(v) => Ok(Self::from(u128::from(v))),
+            Value::Negative(v) => Ok(Self::from(v)),
+            Value::Tag(TAG_POSITIVE_BIGNUM, v) => match *v {
+                Value::ByteString(magnitude) => Ok(Self::new(false, magnitude)),
+                _ => Err(DecodeError::UnexpectedType),
+            },
+            Value::Tag(TAG_NEGATIVE_BIGNUM, v) => match *v {
+                // Negative bignums encode -1 - n.
+                Value::ByteString(n) => Ok(Self::new(true, increment(n))),
+                _ => Err(DecodeError::UnexpectedType),
+            },
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+#[cfg(feature = "num-bigint")]
+impl Encode for BigUint {
+    fn is_empty(&self) -> bool {
+        self.bits() == 0
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        Bignum::new(false, self.to_bytes_be()).into_cbor_value()
+    }
+
+    fn encoded_len(&self) -> usize {
+        Bignum::new(false, self.to_bytes_be()).encoded_len()
+    }
+}
+
+#[cfg(feature = "num-bigint")]
+impl Decode for BigUint {
+    fn try_default() -> Result<Self, DecodeError> {
+        Ok(Default::default())
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        let value = Bignum::try_from_cbor_value(value)?;
+        if value.is_negative() {
+            return Err(DecodeError::IntegerOverflow {
+                value: value.to_i128(),
+                target: "BigUint",
+            });
+        }
+        Ok(BigUint::from_bytes_be(value.magnitude()))
+    }
+}
+
+#[cfg(feature = "num-bigint")]
+impl Encode for BigInt {
+    fn is_empty(&self) -> bool {
+        self.bits() == 0
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        let (sign, magnitude) = self.to_bytes_be();
+        Bignum::new(sign == Sign::Minus, magnitude).into_cbor_value()
+    }
+
+    fn encoded_len(&self) -> usize {
+        let (sign, magnitude) = self.to_bytes_be();
+        Bignum::new(sign == Sign::Minus, magnitude).encoded_len()
+    }
+}
+
+#[cfg(feature = "num-bigint")]
+impl Decode for BigInt {
+    fn try_default() -> Result<Self, DecodeError> {
+        Ok(Default::default())
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        let (negative, magnitude) = Bignum::try_from_cbor_value(value)?.into_parts();
+        let sign = if negative { Sign::Minus } else { Sign::Plus };
+        Ok(BigInt::from_biguint(
+            sign,
+            BigUint::from_bytes_be(&magnitude),
+        ))
+    }
+}
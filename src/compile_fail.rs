@@ -0,0 +1,474 @@
+//! Derive attribute combinations which must be rejected at compile time.
+//!
+//! Each example below is compiled as a doctest that is expected to fail. For reference, the
+//! following valid use of the same attributes compiles:
+//!
+//! ```
+//! # // Derived code refers to the crate root, which may be this doctest.
+//! # pub use oasis_cbor::*;
+//! #
+//! #[derive(Default, oasis_cbor::Encode, oasis_cbor::Decode)]
+//! #[cbor(transparent, semantic_tag = 42)]
+//! struct Newtype(#[cbor(serialize_with = "encode", deserialize_with = "decode")] u64);
+//!
+//! fn encode(value: &u64) -> String {
+//!     value.to_string()
+//! }
+//!
+//! fn decode(value: String) -> Result<u64, oasis_cbor::DecodeError> {
+//!     value.parse().map_err(|_| oasis_cbor::DecodeError::UnexpectedType)
+//! }
+//! # fn main() {}
+//! ```
+
+/// The transparent attribute cannot be used on tuple structs with multiple fields.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode)]
+/// #[cbor(transparent)]
+/// struct Pair(u64, u64);
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Decode)]
+/// #[cbor(transparent)]
+/// struct Pair(u64, u64);
+/// # fn main() {}
+/// ```
+pub struct TransparentTuple;
+
+/// The transparent attribute cannot be used on structs with named fields, even a single one.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode)]
+/// #[cbor(transparent)]
+/// struct Named {
+///     foo: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Decode)]
+/// #[cbor(transparent)]
+/// struct Named {
+///     foo: u64,
+/// }
+/// # fn main() {}
+/// ```
+pub struct TransparentNamed;
+
+/// The transparent attribute cannot be used on unit structs.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(transparent)]
+/// struct Unit;
+/// # fn main() {}
+/// ```
+pub struct TransparentUnit;
+
+/// The transparent attribute cannot be used on enums.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode)]
+/// #[cbor(transparent)]
+/// enum Newtype {
+///     A(u64),
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Decode)]
+/// #[cbor(transparent)]
+/// enum Newtype {
+///     A(u64),
+/// }
+/// # fn main() {}
+/// ```
+pub struct TransparentEnum;
+
+/// The transparent attribute cannot be combined with as_array.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(transparent, as_array)]
+/// struct Newtype(u64);
+/// # fn main() {}
+/// ```
+pub struct TransparentAsArray;
+
+/// The field of a transparent newtype cannot be skipped, optional or flattened.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(transparent)]
+/// struct Newtype(#[cbor(skip)] u64);
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(transparent)]
+/// struct Newtype(core::marker::PhantomData<u64>);
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(transparent)]
+/// struct Newtype(#[cbor(optional)] Option<u64>);
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(transparent)]
+/// struct Newtype(#[cbor(embed)] std::collections::BTreeMap<String, u64>);
+/// # fn main() {}
+/// ```
+pub struct TransparentFieldAttributes;
+
+/// Fields encoded as array elements can only be omitted from the end of the array.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(as_array)]
+/// struct Record {
+///     #[cbor(optional)]
+///     foo: Option<u64>,
+///     bar: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// struct Record(#[cbor(default)] u64, u64);
+/// # fn main() {}
+/// ```
+pub struct ArrayRequiredAfterOmittable;
+
+/// Skipped fields are never encoded, so attributes affecting their encoding cannot be set.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(Default, oasis_cbor::Encode, oasis_cbor::Decode)]
+/// struct Record {
+///     foo: u64,
+///     #[cbor(skip, rename = "baz")]
+///     bar: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(Default, oasis_cbor::Encode, oasis_cbor::Decode)]
+/// struct Record {
+///     foo: u64,
+///     #[cbor(skip, skip_serializing_if_default)]
+///     bar: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(Default, oasis_cbor::Encode, oasis_cbor::Decode)]
+/// struct Record {
+///     foo: u64,
+///     #[cbor(skip, with = "module")]
+///     bar: u64,
+/// }
+/// # fn main() {}
+/// ```
+pub struct SkipEncodingAttributes;
+
+/// Rejecting unknown fields conflicts with allowing them or collecting them via flatten_rest.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(Default, oasis_cbor::Decode)]
+/// #[cbor(deny_unknown_fields, allow_unknown)]
+/// struct Record {
+///     foo: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(Default, oasis_cbor::Decode)]
+/// #[cbor(deny_unknown_fields)]
+/// struct Record {
+///     foo: u64,
+///     #[cbor(flatten_rest)]
+///     rest: std::collections::BTreeMap<oasis_cbor::Value, oasis_cbor::Value>,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Decode)]
+/// enum Message {
+///     #[cbor(deny_unknown_fields)]
+///     Record {
+///         foo: u64,
+///         #[cbor(flatten_rest)]
+///         rest: std::collections::BTreeMap<oasis_cbor::Value, oasis_cbor::Value>,
+///     },
+/// }
+/// # fn main() {}
+/// ```
+pub struct DenyUnknownFieldsConflict;
+
+/// Accepting both the array and the map form is only supported for structs with named fields
+/// encoded as maps.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Decode)]
+/// #[cbor(accept_array_or_map)]
+/// struct Pair(u64, u64);
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Decode)]
+/// #[cbor(accept_array_or_map)]
+/// enum Message {
+///     A { foo: u64 },
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Decode)]
+/// #[cbor(accept_array_or_map, as_array)]
+/// struct Record {
+///     foo: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Decode)]
+/// #[cbor(accept_array_or_map)]
+/// struct Record {
+///     foo: u64,
+///     #[cbor(flatten_rest)]
+///     rest: std::collections::BTreeMap<oasis_cbor::Value, oasis_cbor::Value>,
+/// }
+/// # fn main() {}
+/// ```
+pub struct AcceptArrayOrMapConflict;
+
+/// Fields encoded as map entries (and enum variants) cannot resolve to the same key, whether via
+/// rename, rename_all or key.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// struct Record {
+///     foo: u64,
+///     #[cbor(rename = "foo")]
+///     bar: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(rename_all = "camelCase")]
+/// struct Record {
+///     foo_bar: u64,
+///     #[cbor(rename = "fooBar")]
+///     baz: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// struct Record {
+///     #[cbor(key = 1)]
+///     foo: u64,
+///     #[cbor(rename = 1)]
+///     bar: u64,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// enum Message {
+///     First,
+///     #[cbor(rename = "First")]
+///     Second,
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// #[cbor(tag = "kind")]
+/// enum Message {
+///     First { kind: u64 },
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// enum Status {
+///     Active = 1,
+///     #[cbor(key = 1)]
+///     Inactive,
+/// }
+/// # fn main() {}
+/// ```
+pub struct DuplicateKey;
+
+/// Variants of tagged enums must be distinguishable when decoding.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// enum Payload {
+///     #[cbor(embed)]
+///     Raw(Vec<u8>),
+///     #[cbor(embed)]
+///     Hash(Vec<u8>),
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// enum Level {
+///     Debug,
+///     #[cbor(embed)]
+///     Custom(String),
+/// }
+/// # fn main() {}
+/// ```
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode, oasis_cbor::Decode)]
+/// enum Message {
+///     #[cbor(missing)]
+///     First { foo: u64 },
+///     Second { bar: u64 },
+/// }
+/// # fn main() {}
+/// ```
+pub struct AmbiguousVariants;
+
+/// Bounds replacing the inferred ones must be valid where clause predicates.
+///
+/// ```compile_fail
+/// # // Derived code refers to the crate root, which may be this doctest.
+/// # pub use oasis_cbor::*;
+/// #
+/// #[derive(oasis_cbor::Encode)]
+/// #[cbor(bound = "T Encode")]
+/// struct Wrapper<T> {
+///     inner: T,
+/// }
+/// # fn main() {}
+/// ```
+pub struct InvalidBound;
@@ -1,13 +1,25 @@
 //! CBOR decoding.
+use alloc::{
+    borrow::Cow,
+    boxed::Box,
+    collections::{BTreeMap, BTreeSet},
+    rc::Rc,
+    string::String,
+    sync::Arc,
+    vec::Vec,
+};
+use core::{cmp::Ordering, convert::TryInto, marker::PhantomData, time::Duration};
+#[cfg(feature = "std")]
 use std::{
-    cmp::Ordering,
-    collections::{BTreeMap, BTreeSet, HashMap, HashSet},
-    convert::TryInto,
+    collections::{HashMap, HashSet},
+    hash::Hash,
+    net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4, SocketAddrV6},
+    time::{SystemTime, UNIX_EPOCH},
 };
 
 use impl_trait_for_tuples::impl_for_tuples;
 
-use crate::{DecodeError, SimpleValue, Value};
+use crate::{reader, DecodeError, DecodeOptions, SimpleValue, Value, ValueRef};
 
 /// Trait for types that can be decoded from CBOR.
 pub trait Decode {
@@ -24,6 +36,16 @@ pub trait Decode {
     where
         Self: Sized;
 
+    /// Whether null is a regular value of the type rather than the absence of a value, as for
+    /// `Option<T>`. An `Option` of such a type decodes null as `Some` and only undefined (e.g. a
+    /// missing map key) as `None`.
+    fn is_nullable() -> bool
+    where
+        Self: Sized,
+    {
+        false
+    }
+
     /// Try to decode from a given CBOR value, calling `try_default` in case the value is null or
     /// undefined.
     fn try_from_cbor_value_default(value: Value) -> Result<Self, DecodeError>
@@ -37,9 +59,172 @@ pub trait Decode {
             _ => Self::try_from_cbor_value(value),
         }
     }
+
+    /// Try to decode from a given CBOR value into an existing instance, reusing its allocations
+    /// (e.g. the capacity of collections) where possible.
+    ///
+    /// The default implementation replaces the instance with a newly decoded one. On error, the
+    /// instance may be left partially updated.
+    fn decode_in_place(&mut self, value: Value) -> Result<(), DecodeError>
+    where
+        Self: Sized,
+    {
+        *self = Self::try_from_cbor_value(value)?;
+        Ok(())
+    }
+
+    /// Try to decode from a given CBOR value into an existing instance, calling `try_default` in
+    /// case the value is null or undefined.
+    fn decode_in_place_default(&mut self, value: Value) -> Result<(), DecodeError>
+    where
+        Self: Sized,
+    {
+        match value {
+            Value::Simple(SimpleValue::NullValue | SimpleValue::Undefined) => {
+                *self = Self::try_default()?;
+                Ok(())
+            }
+            _ => self.decode_in_place(value),
+        }
+    }
+}
+
+/// Trait for types that can be decoded from CBOR, possibly borrowing from the encoded data.
+///
+/// This is implemented for all types implementing `Decode`. Additionally, `&[u8]` and `&str`
+/// borrow directly from the encoded data. This requires them to be encoded as a single
+/// definite-length string, so chunked strings (only accepted in non-strict mode) result in an
+/// `UnexpectedType` error. Use `Cow<[u8]>` and `Cow<str>` instead to borrow when possible and
+/// fall back to an owned copy for chunked strings.
+pub trait DecodeBorrowed<'de>: Sized {
+    /// Try to decode from a missing/null/undefined value.
+    fn try_default_borrowed() -> Result<Self, DecodeError> {
+        Err(DecodeError::MissingField)
+    }
+
+    /// Try to decode from a given borrowed CBOR value.
+    fn try_from_cbor_value_borrowed(value: ValueRef<'de>) -> Result<Self, DecodeError>;
+
+    /// Try to decode from a given borrowed CBOR value, calling `try_default_borrowed` in case the
+    /// value is null or undefined.
+    fn try_from_cbor_value_borrowed_default(value: ValueRef<'de>) -> Result<Self, DecodeError> {
+        match value {
+            ValueRef::Simple(SimpleValue::NullValue | SimpleValue::Undefined) => {
+                Self::try_default_borrowed()
+            }
+            _ => Self::try_from_cbor_value_borrowed(value),
+        }
+    }
+}
+
+impl<'de, T: Decode> DecodeBorrowed<'de> for T {
+    fn try_default_borrowed() -> Result<Self, DecodeError> {
+        T::try_default()
+    }
+
+    fn try_from_cbor_value_borrowed(value: ValueRef<'de>) -> Result<Self, DecodeError> {
+        T::try_from_cbor_value(value.into_owned())
+    }
+
+    fn try_from_cbor_value_borrowed_default(value: ValueRef<'de>) -> Result<Self, DecodeError> {
+        T::try_from_cbor_value_default(value.into_owned())
+    }
+}
+
+impl<'de: 'a, 'a> DecodeBorrowed<'de> for &'a [u8] {
+    fn try_default_borrowed() -> Result<Self, DecodeError> {
+        Ok(&[])
+    }
+
+    fn try_from_cbor_value_borrowed(value: ValueRef<'de>) -> Result<Self, DecodeError> {
+        match value {
+            ValueRef::ByteString(Cow::Borrowed(v)) => Ok(v),
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+impl<'de: 'a, 'a> DecodeBorrowed<'de> for &'a str {
+    fn try_default_borrowed() -> Result<Self, DecodeError> {
+        Ok("")
+    }
+
+    fn try_from_cbor_value_borrowed(value: ValueRef<'de>) -> Result<Self, DecodeError> {
+        match value {
+            ValueRef::TextString(Cow::Borrowed(v)) => Ok(v),
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+impl<'de: 'a, 'a> DecodeBorrowed<'de> for Cow<'a, [u8]> {
+    fn try_default_borrowed() -> Result<Self, DecodeError> {
+        Ok(Cow::Borrowed(&[]))
+    }
+
+    fn try_from_cbor_value_borrowed(value: ValueRef<'de>) -> Result<Self, DecodeError> {
+        match value {
+            ValueRef::ByteString(v) => Ok(v),
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+impl<'de: 'a, 'a> DecodeBorrowed<'de> for Cow<'a, str> {
+    fn try_default_borrowed() -> Result<Self, DecodeError> {
+        Ok(Cow::Borrowed(""))
+    }
+
+    fn try_from_cbor_value_borrowed(value: ValueRef<'de>) -> Result<Self, DecodeError> {
+        match value {
+            ValueRef::TextString(v) => Ok(v),
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+impl<'de> DecodeBorrowed<'de> for ValueRef<'de> {
+    fn try_default_borrowed() -> Result<Self, DecodeError> {
+        Ok(ValueRef::Simple(SimpleValue::NullValue))
+    }
+
+    fn try_from_cbor_value_borrowed(value: ValueRef<'de>) -> Result<Self, DecodeError> {
+        Ok(value)
+    }
 }
 
-#[impl_for_tuples(1, 10)]
+/// Trait for decoding already parsed CBOR values into typed values.
+///
+/// This allows parsing a message into a `Value` once, inspecting it (e.g. to determine its type)
+/// and then decoding it into the concrete type, without serializing it back into bytes.
+pub trait DecodeInto {
+    /// Decode into the given type.
+    ///
+    /// This is the same as calling `decode_into_with` with canonical decoding enabled, so that the
+    /// same values are accepted as by `from_slice`. Use `from_value` to skip the checks instead.
+    fn decode_into<T: Decode>(&self) -> Result<T, DecodeError> {
+        self.decode_into_with(&DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        })
+    }
+
+    /// Decode into the given type using the given decoding options.
+    ///
+    /// The value is first checked against the options, the same as its encoding would be checked
+    /// by `from_slice_with` (see `reader::validate_with_options`).
+    fn decode_into_with<T: Decode>(&self, options: &DecodeOptions) -> Result<T, DecodeError>;
+}
+
+impl DecodeInto for Value {
+    fn decode_into_with<T: Decode>(&self, options: &DecodeOptions) -> Result<T, DecodeError> {
+        reader::validate_with_options(self, options)?;
+        T::try_from_cbor_value_default(self.clone())
+    }
+}
+
+/// Tuples decode from arrays with exactly as many elements as the tuple.
+#[impl_for_tuples(1, 12)]
 impl Decode for Tuple {
     fn try_default() -> Result<Self, DecodeError> {
         Ok((for_tuples!( #( Tuple::try_default()? ),* )))
@@ -47,14 +232,29 @@ impl Decode for Tuple {
 
     fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
         match value {
-            Value::Array(mut values) => {
-                Ok((for_tuples!( #( Tuple::try_from_cbor_value(values.remove(0))? ),* )))
+            Value::Array(values) if values.len() != for_tuples!( #( 1 )+* ) => {
+                Err(DecodeError::LengthMismatch {
+                    expected: for_tuples!( #( 1 )+* ),
+                    got: values.len(),
+                })
+            }
+            Value::Array(values) => {
+                let mut values = values.into_iter();
+                Ok((for_tuples!( #( Tuple::try_from_cbor_value(values.next().unwrap())? ),* )))
             }
             _ => Err(DecodeError::UnexpectedType),
         }
     }
 }
 
+/// Error for an integer which does not fit into the target type.
+fn integer_overflow(value: i128, target: &'static str) -> DecodeError {
+    DecodeError::IntegerOverflow {
+        value: Some(value),
+        target,
+    }
+}
+
 macro_rules! impl_uint {
     ($name:ty) => {
         impl Decode for $name {
@@ -64,9 +264,10 @@ macro_rules! impl_uint {
 
             fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
                 match value {
-                    Value::Unsigned(v) => {
-                        v.try_into().map_err(|_| DecodeError::UnexpectedIntegerSize)
-                    }
+                    Value::Unsigned(v) => v
+                        .try_into()
+                        .map_err(|_| integer_overflow(v.into(), stringify!($name))),
+                    Value::Negative(v) => Err(integer_overflow(v, stringify!($name))),
                     _ => Err(DecodeError::UnexpectedType),
                 }
             }
@@ -83,12 +284,12 @@ macro_rules! impl_int {
 
             fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
                 match value {
-                    Value::Unsigned(v) => {
-                        v.try_into().map_err(|_| DecodeError::UnexpectedIntegerSize)
-                    }
-                    Value::Negative(v) => {
-                        v.try_into().map_err(|_| DecodeError::UnexpectedIntegerSize)
-                    }
+                    Value::Unsigned(v) => v
+                        .try_into()
+                        .map_err(|_| integer_overflow(v.into(), stringify!($name))),
+                    Value::Negative(v) => v
+                        .try_into()
+                        .map_err(|_| integer_overflow(v, stringify!($name))),
                     _ => Err(DecodeError::UnexpectedType),
                 }
             }
@@ -105,6 +306,42 @@ impl_int!(i16);
 impl_int!(i32);
 impl_int!(i64);
 
+/// Tag number for positive bignums (RFC 8949 section 3.4.3).
+pub(crate) const TAG_POSITIVE_BIGNUM: u64 = 2;
+/// Tag number for negative bignums (RFC 8949 section 3.4.3).
+pub(crate) const TAG_NEGATIVE_BIGNUM: u64 = 3;
+
+#[cfg(feature = "std")]
+/// Tag number for standard date/time strings (RFC 8949 section 3.4.1).
+pub(crate) const TAG_DATE_TIME_STRING: u64 = 0;
+#[cfg(feature = "std")]
+/// Tag number for epoch-based date/time (RFC 8949 section 3.4.2).
+pub(crate) const TAG_EPOCH_DATE_TIME: u64 = 1;
+
+/// Decode the magnitude of a bignum from its big-endian byte representation, for decoding into
+/// the given target type.
+fn decode_bignum_magnitude(value: Value, target: &'static str) -> Result<u128, DecodeError> {
+    match value {
+        Value::ByteString(v) => {
+            // Ignore any leading zero bytes as they do not affect the magnitude.
+            let leading_zeros = v.iter().take_while(|b| **b == 0).count();
+            let v = &v[leading_zeros..];
+
+            const SIZE: usize = core::mem::size_of::<u128>();
+            if v.len() > SIZE {
+                return Err(DecodeError::IntegerOverflow {
+                    value: None,
+                    target,
+                });
+            }
+            let mut data = [0u8; SIZE];
+            data[SIZE - v.len()..].copy_from_slice(v);
+            Ok(u128::from_be_bytes(data))
+        }
+        _ => Err(DecodeError::UnexpectedType),
+    }
+}
+
 impl Decode for u128 {
     fn try_default() -> Result<Self, DecodeError> {
         Ok(Default::default())
@@ -113,7 +350,7 @@ impl Decode for u128 {
     fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
         match value {
             Value::ByteString(v) => {
-                const SIZE: usize = std::mem::size_of::<u128>();
+                const SIZE: usize = core::mem::size_of::<u128>();
 
                 match v.len().cmp(&SIZE) {
                     Ordering::Greater => {
@@ -133,6 +370,82 @@ impl Decode for u128 {
                     }
                 }
             }
+            Value::Unsigned(v) => Ok(v.into()),
+            Value::Tag(TAG_POSITIVE_BIGNUM, v) => decode_bignum_magnitude(*v, "u128"),
+            Value::Negative(v) => Err(integer_overflow(v, "u128")),
+            Value::Tag(TAG_NEGATIVE_BIGNUM, v) => {
+                // Negative bignums encode -1 - n.
+                let n: Option<i128> = decode_bignum_magnitude(*v, "u128")?.try_into().ok();
+                let value = n.map(|n| -1 - n);
+                Err(DecodeError::IntegerOverflow {
+                    value,
+                    target: "u128",
+                })
+            }
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+impl Decode for i128 {
+    fn try_default() -> Result<Self, DecodeError> {
+        Ok(Default::default())
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        match value {
+            Value::Unsigned(v) => Ok(v.into()),
+            Value::Negative(v) => Ok(v),
+            Value::Tag(TAG_POSITIVE_BIGNUM, v) => decode_bignum_magnitude(*v, "i128")?
+                .try_into()
+                .map_err(|_| DecodeError::IntegerOverflow {
+                    value: None,
+                    target: "i128",
+                }),
+            Value::Tag(TAG_NEGATIVE_BIGNUM, v) => {
+                // Negative bignums encode -1 - n.
+                let n: i128 = decode_bignum_magnitude(*v, "i128")?
+                    .try_into()
+                    .map_err(|_| DecodeError::IntegerOverflow {
+                        value: None,
+                        target: "i128",
+                    })?;
+                Ok(-1 - n)
+            }
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+impl Decode for f64 {
+    fn try_default() -> Result<Self, DecodeError> {
+        Ok(Default::default())
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        match value {
+            Value::Float(v) => Ok(v),
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+impl Decode for f32 {
+    fn try_default() -> Result<Self, DecodeError> {
+        Ok(Default::default())
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        match value {
+            Value::Float(v) => {
+                // Only accept values that can be represented without loss of precision.
+                let narrowed = v as f32;
+                if f64::from(narrowed) == v || v.is_nan() {
+                    Ok(narrowed)
+                } else {
+                    Err(DecodeError::UnexpectedType)
+                }
+            }
             _ => Err(DecodeError::UnexpectedType),
         }
     }
@@ -163,6 +476,18 @@ impl Decode for String {
             _ => Err(DecodeError::UnexpectedType),
         }
     }
+
+    fn decode_in_place(&mut self, value: Value) -> Result<(), DecodeError> {
+        // Copy the text string into the existing buffer to keep its allocation.
+        match value {
+            Value::TextString(v) => {
+                self.clear();
+                self.push_str(&v);
+                Ok(())
+            }
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
 }
 
 impl Decode for char {
@@ -191,6 +516,34 @@ impl<T: Decode> Decode for Vec<T> {
             _ => Err(DecodeError::UnexpectedType),
         }
     }
+
+    default fn decode_in_place(&mut self, value: Value) -> Result<(), DecodeError> {
+        match value {
+            Value::Array(v) => {
+                // Decode into the existing elements first, so their allocations are reused too.
+                self.truncate(v.len());
+                let mut items = v.into_iter();
+                for (item, value) in self.iter_mut().zip(&mut items) {
+                    item.decode_in_place(value)?;
+                }
+                for value in items {
+                    self.push(T::try_from_cbor_value(value)?);
+                }
+                Ok(())
+            }
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+
+    default fn decode_in_place_default(&mut self, value: Value) -> Result<(), DecodeError> {
+        match value {
+            Value::Simple(SimpleValue::NullValue | SimpleValue::Undefined) => {
+                self.clear();
+                Ok(())
+            }
+            _ => self.decode_in_place(value),
+        }
+    }
 }
 
 impl Decode for Vec<u8> {
@@ -200,6 +553,18 @@ impl Decode for Vec<u8> {
             _ => Err(DecodeError::UnexpectedType),
         }
     }
+
+    fn decode_in_place(&mut self, value: Value) -> Result<(), DecodeError> {
+        // Copy the byte string into the existing buffer to keep its allocation.
+        match value {
+            Value::ByteString(v) => {
+                self.clear();
+                self.extend_from_slice(&v);
+                Ok(())
+            }
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
 }
 
 impl<T: Decode, const N: usize> Decode for [T; N] {
@@ -209,6 +574,10 @@ impl<T: Decode, const N: usize> Decode for [T; N] {
 
     default fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
         match value {
+            Value::Array(v) if v.len() != N => Err(DecodeError::LengthMismatch {
+                expected: N,
+                got: v.len(),
+            }),
             Value::Array(v) => v
                 .into_iter()
                 .map(T::try_from_cbor_value)
@@ -227,12 +596,22 @@ impl<const N: usize> Decode for [u8; N] {
 
     fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
         match value {
-            Value::ByteString(v) => v.try_into().map_err(|_| DecodeError::UnexpectedType),
+            Value::ByteString(v) => {
+                v.try_into()
+                    .map_err(|v: Vec<u8>| DecodeError::LengthMismatch {
+                        expected: N,
+                        got: v.len(),
+                    })
+            }
             _ => Err(DecodeError::UnexpectedType),
         }
     }
 }
 
+/// Options decode null as `None`. Nested options (e.g. `Option<Option<T>>`) instead distinguish an
+/// absent value from an explicit null: undefined (which is also what the derived decoders use
+/// for a missing map key or array element) decodes as `None`, null as `Some(None)` and any other
+/// value as `Some(Some(v))`.
 impl<T: Decode> Decode for Option<T> {
     fn try_default() -> Result<Self, DecodeError> {
         Ok(Default::default())
@@ -240,10 +619,79 @@ impl<T: Decode> Decode for Option<T> {
 
     fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
         match value {
-            Value::Simple(SimpleValue::NullValue) => Ok(None),
+            Value::Simple(SimpleValue::NullValue) if !T::is_nullable() => Ok(None),
+            Value::Simple(SimpleValue::Undefined) if T::is_nullable() => Ok(None),
             _ => Ok(Some(T::try_from_cbor_value(value)?)),
         }
     }
+
+    fn try_from_cbor_value_default(value: Value) -> Result<Self, DecodeError> {
+        match value {
+            Value::Simple(SimpleValue::NullValue) if T::is_nullable() => {
+                Self::try_from_cbor_value(value)
+            }
+            Value::Simple(SimpleValue::NullValue | SimpleValue::Undefined) => Self::try_default(),
+            _ => Self::try_from_cbor_value(value),
+        }
+    }
+
+    fn is_nullable() -> bool {
+        true
+    }
+
+    fn decode_in_place(&mut self, value: Value) -> Result<(), DecodeError> {
+        match (self, value) {
+            (this, Value::Simple(SimpleValue::NullValue)) if !T::is_nullable() => *this = None,
+            (this, Value::Simple(SimpleValue::Undefined)) if T::is_nullable() => *this = None,
+            (Some(inner), value) => inner.decode_in_place(value)?,
+            (this, value) => *this = Some(T::try_from_cbor_value(value)?),
+        }
+        Ok(())
+    }
+
+    fn decode_in_place_default(&mut self, value: Value) -> Result<(), DecodeError> {
+        match value {
+            Value::Simple(SimpleValue::NullValue) if T::is_nullable() => {
+                self.decode_in_place(value)
+            }
+            Value::Simple(SimpleValue::NullValue | SimpleValue::Undefined) => {
+                *self = Self::try_default()?;
+                Ok(())
+            }
+            _ => self.decode_in_place(value),
+        }
+    }
+}
+
+macro_rules! impl_pointer {
+    ($name:ident) => {
+        impl<T: Decode> Decode for $name<T> {
+            fn try_default() -> Result<Self, DecodeError> {
+                T::try_default().map($name::new)
+            }
+
+            fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+                T::try_from_cbor_value(value).map($name::new)
+            }
+        }
+    };
+}
+
+impl_pointer!(Rc);
+impl_pointer!(Arc);
+
+impl<T: Decode> Decode for Box<T> {
+    fn try_default() -> Result<Self, DecodeError> {
+        T::try_default().map(Box::new)
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        T::try_from_cbor_value(value).map(Box::new)
+    }
+
+    fn decode_in_place(&mut self, value: Value) -> Result<(), DecodeError> {
+        (**self).decode_in_place(value)
+    }
 }
 
 impl Decode for Value {
@@ -282,13 +730,44 @@ impl<T: Decode + Ord> Decode for BTreeSet<T> {
 
     fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
         match value {
+            // Duplicate elements are merged, see `unique_set` for rejecting them.
             Value::Array(v) => v.into_iter().map(T::try_from_cbor_value).collect(),
             _ => Err(DecodeError::UnexpectedType),
         }
     }
 }
 
-impl<K: Decode + Eq + std::hash::Hash, V: Decode> Decode for HashMap<K, V> {
+/// Decode a `BTreeSet` whose elements must be in canonical order, i.e. sorted by their encodings
+/// as done when encoding it, for use via `#[cbor(deserialize_with = "...")]`. Unlike decoding it
+/// directly, which accepts the elements in any order, this ensures that each set has a single
+/// valid encoding. Elements out of order fail with `DecodeError::UnsortedSetElements`.
+pub fn sorted_btree_set<T: Decode + Ord>(elements: Vec<Value>) -> Result<BTreeSet<T>, DecodeError> {
+    match elements.windows(2).find(|pair| pair[0] >= pair[1]) {
+        Some(pair) if pair[0] == pair[1] => Err(DecodeError::DuplicateSetElement),
+        Some(_) => Err(DecodeError::UnsortedSetElements),
+        None => BTreeSet::try_from_cbor_value(Value::Array(elements)),
+    }
+}
+
+/// Decode a set (e.g. a `BTreeSet` or `HashSet`) whose elements must be unique, for use via
+/// `#[cbor(deserialize_with = "...")]`. Unlike decoding it directly, which merges duplicate
+/// elements the same in strict and non-strict mode, this fails with
+/// `DecodeError::DuplicateSetElement` if any elements decode to the same value.
+pub fn unique_set<S>(elements: Vec<Value>) -> Result<S, DecodeError>
+where
+    S: Decode,
+    for<'a> &'a S: IntoIterator,
+{
+    let len = elements.len();
+    let set = S::try_from_cbor_value(Value::Array(elements))?;
+    if (&set).into_iter().count() != len {
+        return Err(DecodeError::DuplicateSetElement);
+    }
+    Ok(set)
+}
+
+#[cfg(feature = "std")]
+impl<K: Decode + Eq + Hash, V: Decode> Decode for HashMap<K, V> {
     fn try_default() -> Result<Self, DecodeError> {
         Ok(Default::default())
     }
@@ -305,21 +784,52 @@ impl<K: Decode + Eq + std::hash::Hash, V: Decode> Decode for HashMap<K, V> {
             _ => Err(DecodeError::UnexpectedType),
         }
     }
+
+    fn decode_in_place(&mut self, value: Value) -> Result<(), DecodeError> {
+        match value {
+            Value::Map(v) => {
+                self.clear();
+                self.reserve(v.len());
+                for (k, v) in v {
+                    self.insert(K::try_from_cbor_value(k)?, V::try_from_cbor_value(v)?);
+                }
+                Ok(())
+            }
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
 }
 
-impl<T: Decode + Eq + std::hash::Hash> Decode for HashSet<T> {
+#[cfg(feature = "std")]
+impl<T: Decode + Eq + Hash> Decode for HashSet<T> {
     fn try_default() -> Result<Self, DecodeError> {
         Ok(Default::default())
     }
 
     fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
         match value {
+            // Duplicate elements are merged, see `unique_set` for rejecting them.
             Value::Array(v) => v.into_iter().map(T::try_from_cbor_value).collect(),
             _ => Err(DecodeError::UnexpectedType),
         }
     }
+
+    fn decode_in_place(&mut self, value: Value) -> Result<(), DecodeError> {
+        match value {
+            Value::Array(v) => {
+                self.clear();
+                self.reserve(v.len());
+                for item in v {
+                    self.insert(T::try_from_cbor_value(item)?);
+                }
+                Ok(())
+            }
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
 }
 
+/// The unit type decodes from null or undefined, matching its encoding.
 impl Decode for () {
     fn try_default() -> Result<Self, DecodeError> {
         Ok(())
@@ -333,3 +843,255 @@ impl Decode for () {
         }
     }
 }
+
+impl<T: ?Sized> Decode for PhantomData<T> {
+    fn try_default() -> Result<Self, DecodeError> {
+        Ok(PhantomData)
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        <()>::try_from_cbor_value(value).map(|_| PhantomData)
+    }
+}
+
+#[cfg(feature = "std")]
+/// Construct the time at the given number of seconds and nanoseconds after the Unix epoch.
+fn epoch_time(secs: i128, nanos: u32) -> Result<SystemTime, DecodeError> {
+    let offset = secs
+        .unsigned_abs()
+        .try_into()
+        .map(Duration::from_secs)
+        .map_err(|_| DecodeError::TimestampOutOfRange)?;
+    let time = if secs < 0 {
+        UNIX_EPOCH.checked_sub(offset)
+    } else {
+        UNIX_EPOCH.checked_add(offset)
+    };
+    time.and_then(|t| t.checked_add(Duration::from_nanos(nanos.into())))
+        .ok_or(DecodeError::TimestampOutOfRange)
+}
+
+#[cfg(feature = "std")]
+/// Parse a standard date/time string (RFC 3339), e.g. `2013-03-21T20:04:00.5+01:00`.
+///
+/// Fractions of a second beyond nanosecond precision are truncated and leap seconds are folded
+/// into the following second.
+fn parse_date_time(s: &str) -> Result<SystemTime, DecodeError> {
+    /// Parse a fixed-width decimal number.
+    fn number(s: &[u8]) -> Result<i64, DecodeError> {
+        s.iter().try_fold(0, |n, &c| match c {
+            b'0'..=b'9' => Ok(n * 10 + i64::from(c - b'0')),
+            _ => Err(DecodeError::InvalidTimestamp),
+        })
+    }
+    /// Check that the given byte is the expected separator.
+    fn separator(c: u8, expected: &[u8]) -> Result<(), DecodeError> {
+        if expected.contains(&c) {
+            Ok(())
+        } else {
+            Err(DecodeError::InvalidTimestamp)
+        }
+    }
+
+    let s = s.as_bytes();
+    if s.len() < 20 {
+        return Err(DecodeError::InvalidTimestamp);
+    }
+    let (year, month, day) = (number(&s[0..4])?, number(&s[5..7])?, number(&s[8..10])?);
+    let (hour, minute, second) = (
+        number(&s[11..13])?,
+        number(&s[14..16])?,
+        number(&s[17..19])?,
+    );
+    separator(s[4], b"-")?;
+    separator(s[7], b"-")?;
+    separator(s[10], b"Tt")?;
+    separator(s[13], b":")?;
+    separator(s[16], b":")?;
+
+    let leap_year = year % 4 == 0 && (year % 100 != 0 || year % 400 == 0);
+    let days_in_month = match month {
+        2 if leap_year => 29,
+        2 => 28,
+        4 | 6 | 9 | 11 => 30,
+        _ => 31,
+    };
+    if !(1..=12).contains(&month)
+        || !(1..=days_in_month).contains(&day)
+        || hour > 23
+        || minute > 59
+        || second > 60
+    {
+        return Err(DecodeError::InvalidTimestamp);
+    }
+
+    // Optional fraction of a second.
+    let mut rest = &s[19..];
+    let mut nanos = 0;
+    if rest[0] == b'.' {
+        let digits = rest[1..].iter().take_while(|c| c.is_ascii_digit()).count();
+        if digits == 0 {
+            return Err(DecodeError::InvalidTimestamp);
+        }
+        let fraction = &rest[1..1 + digits.min(9)];
+        nanos = number(fraction)? as u32 * 10u32.pow(9 - fraction.len() as u32);
+        rest = &rest[1 + digits..];
+    }
+
+    // Time zone offset.
+    let offset = match rest {
+        [b'Z' | b'z'] => 0,
+        [sign @ (b'+' | b'-'), h1, h2, b':', m1, m2] => {
+            let (hours, minutes) = (number(&[*h1, *h2])?, number(&[*m1, *m2])?);
+            if hours > 23 || minutes > 59 {
+                return Err(DecodeError::InvalidTimestamp);
+            }
+            let offset = hours * 3600 + minutes * 60;
+            if *sign == b'-' {
+                -offset
+            } else {
+                offset
+            }
+        }
+        _ => return Err(DecodeError::InvalidTimestamp),
+    };
+
+    // Days since the Unix epoch in the proleptic Gregorian calendar.
+    let (y, m) = if month <= 2 {
+        (year - 1, month + 9)
+    } else {
+        (year, month - 3)
+    };
+    let era = y.div_euclid(400);
+    let year_of_era = y.rem_euclid(400);
+    let day_of_year = (153 * m + 2) / 5 + day - 1;
+    let day_of_era = year_of_era * 365 + year_of_era / 4 - year_of_era / 100 + day_of_year;
+    let days = era * 146097 + day_of_era - 719468;
+
+    let secs = days * 86400 + hour * 3600 + minute * 60 + second - offset;
+    epoch_time(secs.into(), nanos)
+}
+
+#[cfg(feature = "std")]
+impl Decode for SystemTime {
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        match value {
+            Value::Tag(TAG_DATE_TIME_STRING, v) => match *v {
+                Value::TextString(s) => parse_date_time(&s),
+                _ => Err(DecodeError::UnexpectedType),
+            },
+            Value::Tag(TAG_EPOCH_DATE_TIME, v) => match *v {
+                Value::Unsigned(secs) => epoch_time(secs.into(), 0),
+                Value::Negative(secs) => epoch_time(secs, 0),
+                Value::Float(secs) if !secs.is_finite() => Err(DecodeError::InvalidTimestamp),
+                Value::Float(secs) if secs.abs() >= u64::MAX as f64 => {
+                    Err(DecodeError::TimestampOutOfRange)
+                }
+                Value::Float(secs) => {
+                    let whole = secs.floor();
+                    let nanos = ((secs - whole) * 1e9).round() as u32;
+                    // Rounding may carry over into the next second.
+                    epoch_time(
+                        whole as i128 + i128::from(nanos / 1_000_000_000),
+                        nanos % 1_000_000_000,
+                    )
+                }
+                _ => Err(DecodeError::UnexpectedType),
+            },
+            Value::Tag(tag, _) => Err(DecodeError::UnexpectedTag {
+                expected: TAG_EPOCH_DATE_TIME,
+                got: Some(tag),
+            }),
+            _ => Err(DecodeError::UnexpectedTag {
+                expected: TAG_EPOCH_DATE_TIME,
+                got: None,
+            }),
+        }
+    }
+}
+
+impl Decode for Duration {
+    fn try_default() -> Result<Self, DecodeError> {
+        Ok(Default::default())
+    }
+
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        let mut map = match value {
+            Value::Map(map) => map,
+            _ => return Err(DecodeError::UnexpectedType),
+        };
+        map.sort();
+
+        let mut secs = None;
+        let mut nanos = None;
+        for (key, value) in map {
+            let field = match key {
+                Value::TextString(ref name) if name == "secs" => &mut secs,
+                Value::TextString(ref name) if name == "nanos" => &mut nanos,
+                key => return Err(DecodeError::UnknownField { key: Some(key) }),
+            };
+            *field = Some(value);
+        }
+        let secs = u64::try_from_cbor_value(secs.ok_or(DecodeError::MissingField)?)
+            .map_err(|e| e.in_field("secs"))?;
+        let nanos = u32::try_from_cbor_value(nanos.ok_or(DecodeError::MissingField)?)
+            .map_err(|e| e.in_field("nanos"))?;
+        if nanos >= 1_000_000_000 {
+            return Err(integer_overflow(nanos.into(), "Duration").in_field("nanos"));
+        }
+        Ok(Duration::new(secs, nanos))
+    }
+}
+
+/// IP addresses decode from byte strings of exactly 4 (IPv4) or 16 (IPv6) octets.
+#[cfg(feature = "std")]
+impl Decode for Ipv4Addr {
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        <[u8; 4]>::try_from_cbor_value(value).map(Ipv4Addr::from)
+    }
+}
+
+#[cfg(feature = "std")]
+impl Decode for Ipv6Addr {
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        <[u8; 16]>::try_from_cbor_value(value).map(Ipv6Addr::from)
+    }
+}
+
+#[cfg(feature = "std")]
+impl Decode for IpAddr {
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        match value {
+            Value::ByteString(ref v) if v.len() == 4 => {
+                Ipv4Addr::try_from_cbor_value(value).map(IpAddr::V4)
+            }
+            Value::ByteString(_) => Ipv6Addr::try_from_cbor_value(value).map(IpAddr::V6),
+            _ => Err(DecodeError::UnexpectedType),
+        }
+    }
+}
+
+/// Socket addresses decode from an `[addr, port]` array.
+#[cfg(feature = "std")]
+impl Decode for SocketAddr {
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        let (ip, port) = <(IpAddr, u16)>::try_from_cbor_value(value)?;
+        Ok(SocketAddr::new(ip, port))
+    }
+}
+
+#[cfg(feature = "std")]
+impl Decode for SocketAddrV4 {
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        let (ip, port) = <(Ipv4Addr, u16)>::try_from_cbor_value(value)?;
+        Ok(SocketAddrV4::new(ip, port))
+    }
+}
+
+#[cfg(feature = "std")]
+impl Decode for SocketAddrV6 {
+    fn try_from_cbor_value(value: Value) -> Result<Self, DecodeError> {
+        let (ip, port) = <(Ipv6Addr, u16)>::try_from_cbor_value(value)?;
+        Ok(SocketAddrV6::new(ip, port, 0, 0))
+    }
+}
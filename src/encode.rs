@@ -1,9 +1,31 @@
 //! CBOR encoding.
-use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
+use alloc::{
+    borrow::Cow,
+    boxed::Box,
+    collections::{BTreeMap, BTreeSet},
+    rc::Rc,
+    string::{String, ToString},
+    sync::Arc,
+    vec,
+    vec::Vec,
+};
+use core::{marker::PhantomData, time::Duration};
+#[cfg(feature = "std")]
+use std::{
+    collections::{HashMap, HashSet},
+    net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4, SocketAddrV6},
+    time::{SystemTime, UNIX_EPOCH},
+};
 
 use impl_trait_for_tuples::impl_for_tuples;
 
-use crate::{SimpleValue, Value};
+#[cfg(feature = "std")]
+use crate::decode::TAG_EPOCH_DATE_TIME;
+use crate::{
+    decode::{TAG_NEGATIVE_BIGNUM, TAG_POSITIVE_BIGNUM},
+    writer::{self, header_len},
+    SimpleValue, Value,
+};
 
 /// Trait for types that can be encoded into CBOR.
 pub trait Encode {
@@ -12,12 +34,48 @@ pub trait Encode {
         false
     }
 
-    /// Encode the type into a CBOR Value.
-    fn into_cbor_value(self) -> Value;
+    /// Whether the value is encoded as a CBOR null or undefined value which decodes the same as a
+    /// missing value. Optional fields are omitted in that case.
+    fn is_null(&self) -> bool {
+        false
+    }
+
+    /// Whether null is a regular value of the type rather than the absence of a value, as for
+    /// `Option<T>`. An `Option` of such a type encodes `None` as undefined to keep it distinct.
+    fn is_nullable() -> bool
+    where
+        Self: Sized,
+    {
+        false
+    }
+
+    /// Encode the type into a CBOR Value. The default implementation encodes the value by
+    /// reference, implementations may avoid copying the owned parts of the value instead.
+    fn into_cbor_value(self) -> Value
+    where
+        Self: Sized,
+    {
+        self.to_cbor_value()
+    }
+
+    /// Encode the type into a CBOR Value without consuming it.
+    fn to_cbor_value(&self) -> Value;
+
+    /// Length (in bytes) of the canonical CBOR encoding of the value. Implementations should
+    /// compute it without actually encoding the value, the default implementation encodes it.
+    fn encoded_len(&self) -> usize {
+        writer::encoded_len(&self.to_cbor_value())
+    }
 }
 
 /// Trait for types that always encode as CBOR maps.
 pub trait EncodeAsMap: Encode {
+    /// Number of entries in the CBOR Map the value encodes into. The default implementation
+    /// encodes the value to count them.
+    fn cbor_map_len(&self) -> usize {
+        self.to_cbor_map().len()
+    }
+
     /// Encode the type into a CBOR Map.
     fn into_cbor_value_map(self) -> Value
     where
@@ -36,9 +94,48 @@ pub trait EncodeAsMap: Encode {
             _ => vec![],
         }
     }
+
+    /// Encode the type into a CBOR Map without consuming it, returning the map items.
+    fn to_cbor_map(&self) -> Vec<(Value, Value)> {
+        match self.to_cbor_value() {
+            Value::Map(items) => items,
+            _ => vec![],
+        }
+    }
+
+    /// Number of entries with any of the given keys and their encoded length (in bytes). Such
+    /// entries are dropped when the map is the `flatten_rest` field of a struct with fields of
+    /// those keys. The default implementation assumes that there are none.
+    fn cbor_map_keys_len(&self, _keys: &[Value]) -> (usize, usize) {
+        (0, 0)
+    }
+}
+
+/// Number of entries of a map with any of the given keys and their encoded length (in bytes).
+fn entries_with_keys_len<'a, K, V>(
+    entries: impl Iterator<Item = (&'a K, &'a V)>,
+    keys: &[Value],
+) -> (usize, usize)
+where
+    K: Encode + 'a,
+    V: Encode + 'a,
+{
+    if keys.is_empty() {
+        return (0, 0);
+    }
+    let key_lens: Vec<usize> = keys.iter().map(writer::encoded_len).collect();
+    entries
+        .filter(|(k, _)| {
+            // Only materialize keys which could match based on their length.
+            key_lens.contains(&k.encoded_len()) && keys.contains(&k.to_cbor_value())
+        })
+        .fold((0, 0), |(entries, len), (k, v)| {
+            (entries + 1, len + k.encoded_len() + v.encoded_len())
+        })
 }
 
-#[impl_for_tuples(1, 10)]
+/// Tuples encode as fixed-length arrays of their elements.
+#[impl_for_tuples(1, 12)]
 impl Encode for Tuple {
     fn is_empty(&self) -> bool {
         for_tuples!( #( Tuple.is_empty() )&* );
@@ -50,6 +147,18 @@ impl Encode for Tuple {
         for_tuples!( #( values.push(Tuple.into_cbor_value()); )* );
         Value::Array(values)
     }
+
+    #[allow(clippy::vec_init_then_push)]
+    fn to_cbor_value(&self) -> Value {
+        let mut values = vec![];
+        for_tuples!( #( values.push(Tuple.to_cbor_value()); )* );
+        Value::Array(values)
+    }
+
+    fn encoded_len(&self) -> usize {
+        // Tuples have at most 12 elements so the array header is always a single byte.
+        1 + for_tuples!( #( Tuple.encoded_len() )+* )
+    }
 }
 
 macro_rules! impl_uint {
@@ -59,18 +168,12 @@ macro_rules! impl_uint {
                 *self == 0
             }
 
-            fn into_cbor_value(self) -> Value {
-                Value::Unsigned(self as u64)
+            fn to_cbor_value(&self) -> Value {
+                Value::Unsigned(*self as u64)
             }
-        }
 
-        impl Encode for &$name {
-            fn is_empty(&self) -> bool {
-                **self == 0
-            }
-
-            fn into_cbor_value(self) -> Value {
-                Encode::into_cbor_value(*self)
+            fn encoded_len(&self) -> usize {
+                header_len(*self as u64)
             }
         }
     };
@@ -83,18 +186,15 @@ macro_rules! impl_int {
                 *self == 0
             }
 
-            fn into_cbor_value(self) -> Value {
-                Value::integer(self as i64)
+            fn to_cbor_value(&self) -> Value {
+                Value::integer(*self as i64)
             }
-        }
 
-        impl Encode for &$name {
-            fn is_empty(&self) -> bool {
-                **self == 0
-            }
-
-            fn into_cbor_value(self) -> Value {
-                Encode::into_cbor_value(*self)
+            fn encoded_len(&self) -> usize {
+                match *self as i64 {
+                    v @ 0.. => header_len(v as u64),
+                    v => header_len((-1 - v) as u64),
+                }
             }
         }
     };
@@ -109,38 +209,97 @@ impl_int!(i16);
 impl_int!(i32);
 impl_int!(i64);
 
+/// Unsigned 128-bit integers encode as untagged big-endian byte strings without leading zeros,
+/// unlike `i128` which uses the minimal integer or bignum form. This is the established encoding
+/// of quantities in Oasis Core and must be kept for compatibility. Use
+/// [`Bignum`](crate::bignum::Bignum) (e.g. via `#[cbor(with = "...")]`) for the minimal form.
+/// Decoding accepts all of these forms.
 impl Encode for u128 {
     fn is_empty(&self) -> bool {
         *self == 0
     }
 
-    fn into_cbor_value(self) -> Value {
+    fn to_cbor_value(&self) -> Value {
         Value::ByteString(self.to_be_bytes()[self.leading_zeros() as usize / 8..].to_vec())
     }
+
+    fn encoded_len(&self) -> usize {
+        // Byte strings of at most 16 bytes always have a single byte header.
+        1 + 16 - self.leading_zeros() as usize / 8
+    }
 }
 
-impl Encode for &u128 {
+impl Encode for i128 {
     fn is_empty(&self) -> bool {
-        **self == 0
+        *self == 0
     }
 
-    fn into_cbor_value(self) -> Value {
-        Encode::into_cbor_value(*self)
+    fn to_cbor_value(&self) -> Value {
+        /// Encode the given magnitude as a bignum with the given tag.
+        fn bignum(tag: u64, n: u128) -> Value {
+            let bytes = n.to_be_bytes()[n.leading_zeros() as usize / 8..].to_vec();
+            Value::Tag(tag, Box::new(Value::ByteString(bytes)))
+        }
+
+        // Use a plain integer when it fits, otherwise a bignum (tag 2 or 3).
+        match *self {
+            v @ 0..=0xFFFF_FFFF_FFFF_FFFF => Value::Unsigned(v as u64),
+            v @ -0x1_0000_0000_0000_0000..=-1 => Value::Negative(v),
+            v if v > 0 => bignum(TAG_POSITIVE_BIGNUM, v as u128),
+            v => bignum(TAG_NEGATIVE_BIGNUM, (-1 - v) as u128),
+        }
     }
+
+    fn encoded_len(&self) -> usize {
+        match *self {
+            0..=0xFFFF_FFFF_FFFF_FFFF => header_len(*self as u64),
+            -0x1_0000_0000_0000_0000..=-1 => header_len((-1 - *self) as u64),
+            // Bignum tags (2 and 3) always have a single byte header.
+            _ if *self > 0 => 1 + Encode::encoded_len(&(*self as u128)),
+            _ => 1 + Encode::encoded_len(&((-1 - *self) as u128)),
+        }
+    }
+}
+
+macro_rules! impl_float {
+    ($name:ty) => {
+        impl Encode for $name {
+            fn is_empty(&self) -> bool {
+                *self == 0.0
+            }
+
+            fn to_cbor_value(&self) -> Value {
+                Value::Float((*self).into())
+            }
+
+            fn encoded_len(&self) -> usize {
+                // Floats are encoded in double precision unless shrinking them is requested via
+                // the encoding options.
+                9
+            }
+        }
+    };
 }
 
+impl_float!(f32);
+impl_float!(f64);
+
 impl Encode for bool {
     fn is_empty(&self) -> bool {
         !*self
     }
 
-    fn into_cbor_value(self) -> Value {
-        if self {
+    fn to_cbor_value(&self) -> Value {
+        if *self {
             Value::Simple(SimpleValue::TrueValue)
         } else {
             Value::Simple(SimpleValue::FalseValue)
         }
     }
+
+    fn encoded_len(&self) -> usize {
+        1
+    }
 }
 
 impl Encode for String {
@@ -151,6 +310,14 @@ impl Encode for String {
     fn into_cbor_value(self) -> Value {
         Value::TextString(self)
     }
+
+    fn to_cbor_value(&self) -> Value {
+        Value::TextString(self.clone())
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64) + self.len()
+    }
 }
 
 impl Encode for &str {
@@ -158,18 +325,45 @@ impl Encode for &str {
         str::is_empty(self)
     }
 
+    fn to_cbor_value(&self) -> Value {
+        Value::TextString(self.to_string())
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64) + self.len()
+    }
+}
+
+impl Encode for Cow<'_, str> {
+    fn is_empty(&self) -> bool {
+        str::is_empty(self)
+    }
+
     fn into_cbor_value(self) -> Value {
+        Value::TextString(self.into_owned())
+    }
+
+    fn to_cbor_value(&self) -> Value {
         Value::TextString(self.to_string())
     }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64) + self.len()
+    }
 }
 
 impl Encode for char {
-    fn into_cbor_value(self) -> Value {
-        Value::Unsigned(self as u64)
+    fn to_cbor_value(&self) -> Value {
+        Value::Unsigned(*self as u64)
     }
+
     fn is_empty(&self) -> bool {
         *self == '\x00'
     }
+
+    fn encoded_len(&self) -> usize {
+        header_len(*self as u64)
+    }
 }
 
 impl<T: Encode> Encode for Vec<T> {
@@ -180,12 +374,46 @@ impl<T: Encode> Encode for Vec<T> {
     default fn into_cbor_value(self) -> Value {
         Value::Array(self.into_iter().map(Encode::into_cbor_value).collect())
     }
+
+    default fn to_cbor_value(&self) -> Value {
+        Value::Array(self.iter().map(Encode::to_cbor_value).collect())
+    }
+
+    default fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64) + self.iter().map(Encode::encoded_len).sum::<usize>()
+    }
 }
 
 impl Encode for Vec<u8> {
     fn into_cbor_value(self) -> Value {
         Value::ByteString(self)
     }
+
+    fn to_cbor_value(&self) -> Value {
+        Value::ByteString(self.clone())
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64) + self.len()
+    }
+}
+
+impl Encode for Cow<'_, [u8]> {
+    fn is_empty(&self) -> bool {
+        <[u8]>::is_empty(self)
+    }
+
+    fn into_cbor_value(self) -> Value {
+        Value::ByteString(self.into_owned())
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        Value::ByteString(self.to_vec())
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64) + self.len()
+    }
 }
 
 impl<T: Encode, const N: usize> Encode for [T; N] {
@@ -196,29 +424,154 @@ impl<T: Encode, const N: usize> Encode for [T; N] {
                 .collect(),
         )
     }
+
+    default fn to_cbor_value(&self) -> Value {
+        Value::Array(self.iter().map(Encode::to_cbor_value).collect())
+    }
+
+    default fn encoded_len(&self) -> usize {
+        header_len(N as u64) + self.iter().map(Encode::encoded_len).sum::<usize>()
+    }
 }
 
 impl<const N: usize> Encode for [u8; N] {
     fn into_cbor_value(self) -> Value {
         Value::ByteString(self.into())
     }
+
+    fn to_cbor_value(&self) -> Value {
+        Value::ByteString(self.to_vec())
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(N as u64) + N
+    }
 }
 
+/// Options encode `None` as null. Nested options (e.g. `Option<Option<T>>`) instead encode `None`
+/// as undefined and `Some(None)` as null, which is then significant and not omitted from optional
+/// fields. See `Decode` for the corresponding decoding.
 impl<T: Encode> Encode for Option<T> {
     fn is_empty(&self) -> bool {
         self.is_none()
     }
 
+    fn is_null(&self) -> bool {
+        match self {
+            Some(v) => !T::is_nullable() && Encode::is_null(v),
+            None => true,
+        }
+    }
+
+    fn is_nullable() -> bool {
+        true
+    }
+
     fn into_cbor_value(self) -> Value {
         match self {
             Some(v) => Encode::into_cbor_value(v),
+            None if T::is_nullable() => Value::Simple(SimpleValue::Undefined),
             None => Value::Simple(SimpleValue::NullValue),
         }
     }
+
+    fn to_cbor_value(&self) -> Value {
+        match self {
+            Some(v) => Encode::to_cbor_value(v),
+            None if T::is_nullable() => Value::Simple(SimpleValue::Undefined),
+            None => Value::Simple(SimpleValue::NullValue),
+        }
+    }
+
+    fn encoded_len(&self) -> usize {
+        match self {
+            Some(v) => Encode::encoded_len(v),
+            None => 1,
+        }
+    }
+}
+
+/// References encode as the referenced value, which is encoded by reference.
+impl<T: Encode> Encode for &T {
+    fn is_empty(&self) -> bool {
+        Encode::is_empty(*self)
+    }
+
+    fn is_null(&self) -> bool {
+        Encode::is_null(*self)
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        Encode::to_cbor_value(*self)
+    }
+
+    fn encoded_len(&self) -> usize {
+        Encode::encoded_len(*self)
+    }
 }
 
+impl<T: Encode> Encode for Box<T> {
+    fn is_empty(&self) -> bool {
+        Encode::is_empty(&**self)
+    }
+
+    fn is_null(&self) -> bool {
+        Encode::is_null(&**self)
+    }
+
+    fn into_cbor_value(self) -> Value {
+        Encode::into_cbor_value(*self)
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        Encode::to_cbor_value(&**self)
+    }
+
+    fn encoded_len(&self) -> usize {
+        Encode::encoded_len(&**self)
+    }
+}
+
+macro_rules! impl_shared {
+    ($name:ident) => {
+        /// Shared values encode as the inner value, which is only taken by value when this is
+        /// the only reference to it.
+        impl<T: Encode> Encode for $name<T> {
+            fn is_empty(&self) -> bool {
+                Encode::is_empty(&**self)
+            }
+
+            fn is_null(&self) -> bool {
+                Encode::is_null(&**self)
+            }
+
+            fn into_cbor_value(self) -> Value {
+                match $name::try_unwrap(self) {
+                    Ok(v) => Encode::into_cbor_value(v),
+                    Err(v) => Encode::to_cbor_value(&*v),
+                }
+            }
+
+            fn to_cbor_value(&self) -> Value {
+                Encode::to_cbor_value(&**self)
+            }
+
+            fn encoded_len(&self) -> usize {
+                Encode::encoded_len(&**self)
+            }
+        }
+    };
+}
+
+impl_shared!(Rc);
+impl_shared!(Arc);
+
 impl Encode for Value {
     fn is_empty(&self) -> bool {
+        Encode::is_null(self)
+    }
+
+    fn is_null(&self) -> bool {
         matches!(
             self,
             Value::Simple(SimpleValue::NullValue | SimpleValue::Undefined)
@@ -228,6 +581,14 @@ impl Encode for Value {
     fn into_cbor_value(self) -> Value {
         self
     }
+
+    fn to_cbor_value(&self) -> Value {
+        self.clone()
+    }
+
+    fn encoded_len(&self) -> usize {
+        writer::encoded_len(self)
+    }
 }
 
 impl<K: Encode, V: Encode> Encode for BTreeMap<K, V> {
@@ -242,9 +603,33 @@ impl<K: Encode, V: Encode> Encode for BTreeMap<K, V> {
                 .collect(),
         )
     }
+
+    fn to_cbor_value(&self) -> Value {
+        Value::Map(
+            self.iter()
+                .map(|(k, v)| (k.to_cbor_value(), v.to_cbor_value()))
+                .collect(),
+        )
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64)
+            + self
+                .iter()
+                .map(|(k, v)| k.encoded_len() + v.encoded_len())
+                .sum::<usize>()
+    }
 }
 
-impl<K: Encode, V: Encode> EncodeAsMap for BTreeMap<K, V> {}
+impl<K: Encode, V: Encode> EncodeAsMap for BTreeMap<K, V> {
+    fn cbor_map_len(&self) -> usize {
+        self.len()
+    }
+
+    fn cbor_map_keys_len(&self, keys: &[Value]) -> (usize, usize) {
+        entries_with_keys_len(self.iter(), keys)
+    }
+}
 
 impl<V: Encode> Encode for BTreeSet<V> {
     fn is_empty(&self) -> bool {
@@ -252,10 +637,24 @@ impl<V: Encode> Encode for BTreeSet<V> {
     }
 
     fn into_cbor_value(self) -> Value {
-        Value::Array(self.into_iter().map(Encode::into_cbor_value).collect())
+        // Sort the elements by their encoding, which need not match the order of the elements.
+        let mut values: Vec<_> = self.into_iter().map(Encode::into_cbor_value).collect();
+        values.sort();
+        Value::Array(values)
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        let mut values: Vec<_> = self.iter().map(Encode::to_cbor_value).collect();
+        values.sort();
+        Value::Array(values)
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64) + self.iter().map(Encode::encoded_len).sum::<usize>()
     }
 }
 
+#[cfg(feature = "std")]
 impl<K: Encode, V: Encode> Encode for HashMap<K, V> {
     fn is_empty(&self) -> bool {
         HashMap::is_empty(self)
@@ -268,26 +667,222 @@ impl<K: Encode, V: Encode> Encode for HashMap<K, V> {
                 .collect(),
         )
     }
+
+    fn to_cbor_value(&self) -> Value {
+        Value::Map(
+            self.iter()
+                .map(|(k, v)| (k.to_cbor_value(), v.to_cbor_value()))
+                .collect(),
+        )
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64)
+            + self
+                .iter()
+                .map(|(k, v)| k.encoded_len() + v.encoded_len())
+                .sum::<usize>()
+    }
 }
 
-impl<K: Encode, V: Encode> EncodeAsMap for HashMap<K, V> {}
+#[cfg(feature = "std")]
+impl<K: Encode, V: Encode> EncodeAsMap for HashMap<K, V> {
+    fn cbor_map_len(&self) -> usize {
+        self.len()
+    }
+
+    fn cbor_map_keys_len(&self, keys: &[Value]) -> (usize, usize) {
+        entries_with_keys_len(self.iter(), keys)
+    }
+}
 
+#[cfg(feature = "std")]
 impl<V: Encode> Encode for HashSet<V> {
     fn is_empty(&self) -> bool {
         HashSet::is_empty(self)
     }
 
     fn into_cbor_value(self) -> Value {
-        Value::Array(self.into_iter().map(Encode::into_cbor_value).collect())
+        // Sort the elements by their encoding as the iteration order is not deterministic.
+        let mut values: Vec<_> = self.into_iter().map(Encode::into_cbor_value).collect();
+        values.sort();
+        Value::Array(values)
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        let mut values: Vec<_> = self.iter().map(Encode::to_cbor_value).collect();
+        values.sort();
+        Value::Array(values)
+    }
+
+    fn encoded_len(&self) -> usize {
+        header_len(self.len() as u64) + self.iter().map(Encode::encoded_len).sum::<usize>()
     }
 }
 
+/// The unit type encodes as null (not as an empty array), the same as unit structs.
 impl Encode for () {
     fn is_empty(&self) -> bool {
         true
     }
 
-    fn into_cbor_value(self) -> Value {
+    fn is_null(&self) -> bool {
+        true
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        Value::Simple(SimpleValue::NullValue)
+    }
+
+    fn encoded_len(&self) -> usize {
+        1
+    }
+}
+
+impl<T: ?Sized> Encode for PhantomData<T> {
+    fn is_empty(&self) -> bool {
+        true
+    }
+
+    fn is_null(&self) -> bool {
+        true
+    }
+
+    fn to_cbor_value(&self) -> Value {
         Value::Simple(SimpleValue::NullValue)
     }
+
+    fn encoded_len(&self) -> usize {
+        1
+    }
+}
+
+#[cfg(feature = "std")]
+/// Split the given time into its distance from the Unix epoch and whether it is before the epoch.
+fn epoch_offset(time: &SystemTime) -> (Duration, bool) {
+    match time.duration_since(UNIX_EPOCH) {
+        Ok(offset) => (offset, false),
+        Err(e) => (e.duration(), true),
+    }
+}
+
+#[cfg(feature = "std")]
+impl Encode for SystemTime {
+    fn to_cbor_value(&self) -> Value {
+        // Use a number of seconds (tag 1), which is an integer for times at the start of a second
+        // and a float otherwise so that fractional seconds are kept.
+        let seconds = match epoch_offset(self) {
+            (offset, false) if offset.subsec_nanos() == 0 => Value::Unsigned(offset.as_secs()),
+            (offset, true) if offset.subsec_nanos() == 0 => {
+                Value::Negative(-i128::from(offset.as_secs()))
+            }
+            (offset, false) => Value::Float(offset.as_secs_f64()),
+            (offset, true) => Value::Float(-offset.as_secs_f64()),
+        };
+        Value::Tag(TAG_EPOCH_DATE_TIME, Box::new(seconds))
+    }
+
+    fn encoded_len(&self) -> usize {
+        // The epoch date/time tag (1) always has a single byte header, floats are always encoded
+        // in double precision.
+        match epoch_offset(self) {
+            (offset, _) if offset.subsec_nanos() != 0 => 1 + 9,
+            (offset, false) => 1 + header_len(offset.as_secs()),
+            (offset, true) => 1 + header_len(offset.as_secs() - 1),
+        }
+    }
+}
+
+impl Encode for Duration {
+    fn is_empty(&self) -> bool {
+        self.is_zero()
+    }
+
+    fn to_cbor_value(&self) -> Value {
+        // Same structure as used by serde.
+        Value::Map(vec![
+            ("secs".into(), Value::Unsigned(self.as_secs())),
+            ("nanos".into(), Value::Unsigned(self.subsec_nanos().into())),
+        ])
+    }
+
+    fn encoded_len(&self) -> usize {
+        // Keys "secs" and "nanos" take 5 and 6 bytes respectively.
+        header_len(2) + 5 + header_len(self.as_secs()) + 6 + header_len(self.subsec_nanos().into())
+    }
+}
+
+/// IP addresses encode as byte strings of their 4 or 16 octets.
+#[cfg(feature = "std")]
+impl Encode for Ipv4Addr {
+    fn to_cbor_value(&self) -> Value {
+        Encode::into_cbor_value(self.octets())
+    }
+
+    fn encoded_len(&self) -> usize {
+        1 + 4
+    }
+}
+
+#[cfg(feature = "std")]
+impl Encode for Ipv6Addr {
+    fn to_cbor_value(&self) -> Value {
+        Encode::into_cbor_value(self.octets())
+    }
+
+    fn encoded_len(&self) -> usize {
+        1 + 16
+    }
+}
+
+#[cfg(feature = "std")]
+impl Encode for IpAddr {
+    fn to_cbor_value(&self) -> Value {
+        match self {
+            IpAddr::V4(addr) => Encode::to_cbor_value(addr),
+            IpAddr::V6(addr) => Encode::to_cbor_value(addr),
+        }
+    }
+
+    fn encoded_len(&self) -> usize {
+        match self {
+            IpAddr::V4(addr) => Encode::encoded_len(addr),
+            IpAddr::V6(addr) => Encode::encoded_len(addr),
+        }
+    }
+}
+
+/// Socket addresses encode as an `[addr, port]` array. The flow information and scope ID of IPv6
+/// socket addresses are not encoded.
+#[cfg(feature = "std")]
+impl Encode for SocketAddr {
+    fn to_cbor_value(&self) -> Value {
+        Encode::into_cbor_value((self.ip(), self.port()))
+    }
+
+    fn encoded_len(&self) -> usize {
+        Encode::encoded_len(&(self.ip(), self.port()))
+    }
+}
+
+#[cfg(feature = "std")]
+impl Encode for SocketAddrV4 {
+    fn to_cbor_value(&self) -> Value {
+        Encode::into_cbor_value((*self.ip(), self.port()))
+    }
+
+    fn encoded_len(&self) -> usize {
+        Encode::encoded_len(&(*self.ip(), self.port()))
+    }
+}
+
+#[cfg(feature = "std")]
+impl Encode for SocketAddrV6 {
+    fn to_cbor_value(&self) -> Value {
+        Encode::into_cbor_value((*self.ip(), self.port()))
+    }
+
+    fn encoded_len(&self) -> usize {
+        Encode::encoded_len(&(*self.ip(), self.port()))
+    }
 }
@@ -1,66 +1,566 @@
 //! Convenience functions for dealing with CBOR encodings.
+//!
+//! The crate supports `no_std` environments with an allocator when built without the default
+//! `std` feature. This keeps encoding and decoding from byte slices and support for `alloc` types,
+//! but drops support for std-only types (e.g. `HashMap`, `SystemTime`, `IpAddr`) and the io-based
+//! streaming in the [`stream`] module.
+#![cfg_attr(not(feature = "std"), no_std)]
+#![feature(allocator_api)]
 #![feature(min_specialization)]
 #![feature(trait_alias)]
 
+extern crate alloc;
+
+pub mod arena;
+pub mod bignum;
+#[cfg(doctest)]
+mod compile_fail;
 pub mod decode;
 pub mod encode;
 #[doc(hidden)]
 pub mod macros;
 #[cfg(feature = "serde")]
 pub mod serde;
+#[cfg(feature = "std")]
+pub mod stream;
+#[cfg(feature = "std")]
+pub mod time;
+
+use alloc::{
+    borrow::ToOwned,
+    boxed::Box,
+    format,
+    string::{String, ToString},
+    vec,
+    vec::Vec,
+};
+use core::fmt;
 
 pub use oasis_cbor_derive::*; // Re-export the support proc-macros.
 pub use oasis_cbor_value::*;
-use thiserror::Error;
 
 // Re-export traits.
+#[cfg(feature = "std")]
+pub use crate::stream::{read_framed, read_framed_with, write_framed, Decoder, Encoder};
 pub use crate::{
-    decode::Decode,
+    arena::Arena,
+    decode::{Decode, DecodeBorrowed, DecodeInto},
     encode::{Encode, EncodeAsMap},
 };
 
-/// Maximum nesting level allowed when decoding from CBOR.
-const MAX_NESTING_LEVEL: i8 = 64;
-
 /// Error encountered during decoding.
-#[derive(Debug, Error)]
+#[derive(Debug)]
 pub enum DecodeError {
-    #[error("parsing failed")]
-    ParsingFailed,
-    #[error("unexpected type")]
+    /// The data ends in the middle of the item at the given offset, so it may decode successfully
+    /// once more data is available.
+    UnexpectedEof {
+        offset: usize,
+    },
+    /// The item at the given offset is not well-formed (or not supported), so no amount of further
+    /// data makes it decode.
+    Malformed {
+        offset: usize,
+        reason: &'static str,
+    },
     UnexpectedType,
-    #[error("missing field")]
     MissingField,
-    #[error("unknown field")]
-    UnknownField,
-    #[error("unexpected integer size")]
+    /// A map contains a key which does not match any field (or variant) of the target type. The
+    /// key is `None` if there is no single offending key, e.g. for an enum encoded as a map with
+    /// more than one entry.
+    UnknownField {
+        key: Option<Value>,
+    },
+    /// A map contains a key of a different type than the keys of all fields of the target type,
+    /// e.g. an integer key for a struct with text keys.
+    UnexpectedKeyType {
+        key: Value,
+    },
+    UnknownVariant {
+        discriminant: u64,
+    },
+    NoMatchingVariant {
+        errors: Vec<(&'static str, DecodeError)>,
+    },
+    DuplicateField,
+    LengthMismatch {
+        expected: usize,
+        got: usize,
+    },
     UnexpectedIntegerSize,
+    /// An integer does not fit into the target type. The value is `None` if it does not fit into
+    /// an `i128` either, e.g. for large bignums.
+    IntegerOverflow {
+        value: Option<i128>,
+        target: &'static str,
+    },
+    /// The item at the given offset is well-formed, but not in canonical form, e.g. it has an
+    /// indefinite length or is a float which is not in double precision.
+    NonCanonical {
+        offset: usize,
+    },
+    TrailingData {
+        offset: usize,
+    },
+    ItemTooLarge,
+    DepthLimitExceeded {
+        offset: usize,
+    },
+    /// Elements of a set decode to the same value, see [`decode::unique_set`].
+    DuplicateSetElement,
+    /// The elements of a set are not in canonical order, see [`decode::sorted_btree_set`].
+    UnsortedSetElements,
+    DuplicateMapKey {
+        offset: usize,
+    },
+    UnexpectedTag {
+        expected: u64,
+        got: Option<u64>,
+    },
+    InvalidTimestamp,
+    TimestampOutOfRange,
+    NonFiniteFloat {
+        offset: usize,
+    },
+    AllocationLimitExceeded {
+        offset: usize,
+    },
+    InvalidUtf8 {
+        offset: usize,
+    },
+    DisallowedTag {
+        tag: u64,
+        offset: usize,
+    },
+    #[cfg(feature = "std")]
+    Io(std::io::Error),
+    InField {
+        path: String,
+        source: Box<DecodeError>,
+    },
+}
+
+impl DecodeError {
+    /// Annotate the error with the name (or key) of the field being decoded when it occurred.
+    ///
+    /// Annotating an already annotated error prepends the name to its path, so that nested fields
+    /// result in paths like `header.nonce`.
+    pub fn in_field(self, name: &str) -> Self {
+        match self {
+            DecodeError::InField { path, source } => DecodeError::InField {
+                path: format!("{}.{}", name, path),
+                source,
+            },
+            source => DecodeError::InField {
+                path: name.to_owned(),
+                source: Box::new(source),
+            },
+        }
+    }
+
+    /// The underlying error, without the path of the field where it occurred.
+    pub fn root_cause(&self) -> &DecodeError {
+        match self {
+            DecodeError::InField { source, .. } => source,
+            e => e,
+        }
+    }
+
+    /// Byte offset of the failing item in the encoded data, if known.
+    ///
+    /// The offset is only known for errors encountered while parsing the encoded data, not for
+    /// errors encountered while converting the parsed data into the target type.
+    pub fn offset(&self) -> Option<usize> {
+        match *self {
+            DecodeError::UnexpectedEof { offset }
+            | DecodeError::Malformed { offset, .. }
+            | DecodeError::NonCanonical { offset }
+            | DecodeError::TrailingData { offset }
+            | DecodeError::DepthLimitExceeded { offset }
+            | DecodeError::DuplicateMapKey { offset }
+            | DecodeError::NonFiniteFloat { offset }
+            | DecodeError::AllocationLimitExceeded { offset }
+            | DecodeError::InvalidUtf8 { offset }
+            | DecodeError::DisallowedTag { offset, .. } => Some(offset),
+            DecodeError::InField { ref source, .. } => source.offset(),
+            _ => None,
+        }
+    }
+}
+
+impl fmt::Display for DecodeError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            DecodeError::UnexpectedEof { offset } => {
+                write!(f, "unexpected end of input in item at offset {}", offset)
+            }
+            DecodeError::Malformed { offset, reason } => {
+                write!(f, "malformed item at offset {}: {}", offset, reason)
+            }
+            DecodeError::UnexpectedType => f.write_str("unexpected type"),
+            DecodeError::MissingField => f.write_str("missing field"),
+            DecodeError::UnknownField { key: Some(key) } => {
+                f.write_str("unknown field ")?;
+                format_key(f, key)
+            }
+            DecodeError::UnknownField { key: None } => f.write_str("unknown field"),
+            DecodeError::UnexpectedKeyType { key } => {
+                f.write_str("unexpected key type of key ")?;
+                format_key(f, key)
+            }
+            DecodeError::UnknownVariant { discriminant } => {
+                write!(f, "unknown variant (discriminant {})", discriminant)
+            }
+            DecodeError::NoMatchingVariant { errors } => {
+                write!(f, "no matching variant ({})", format_variant_errors(errors))
+            }
+            DecodeError::DuplicateField => f.write_str("duplicate field"),
+            DecodeError::LengthMismatch { expected, got } => {
+                write!(f, "length mismatch (expected {}, got {})", expected, got)
+            }
+            DecodeError::UnexpectedIntegerSize => f.write_str("unexpected integer size"),
+            DecodeError::IntegerOverflow {
+                value: Some(value),
+                target,
+            } => write!(f, "integer {} out of range for {}", value, target),
+            DecodeError::IntegerOverflow {
+                value: None,
+                target,
+            } => write!(f, "integer out of range for {}", target),
+            DecodeError::NonCanonical { offset } => {
+                write!(f, "non-canonical encoding at offset {}", offset)
+            }
+            DecodeError::TrailingData { offset } => write!(f, "trailing data at offset {}", offset),
+            DecodeError::ItemTooLarge => f.write_str("item too large"),
+            DecodeError::DepthLimitExceeded { offset } => {
+                write!(f, "depth limit exceeded at offset {}", offset)
+            }
+            DecodeError::DuplicateSetElement => f.write_str("duplicate set element"),
+            DecodeError::UnsortedSetElements => f.write_str("unsorted set elements"),
+            DecodeError::DuplicateMapKey { offset } => {
+                write!(f, "duplicate map key at offset {}", offset)
+            }
+            DecodeError::UnexpectedTag { expected, got } => {
+                write!(f, "unexpected tag (expected {}, got {:?})", expected, got)
+            }
+            DecodeError::InvalidTimestamp => f.write_str("invalid timestamp"),
+            DecodeError::TimestampOutOfRange => f.write_str("timestamp out of range"),
+            DecodeError::NonFiniteFloat { offset } => {
+                write!(f, "non-finite float at offset {}", offset)
+            }
+            DecodeError::AllocationLimitExceeded { offset } => {
+                write!(f, "allocation limit exceeded at offset {}", offset)
+            }
+            DecodeError::InvalidUtf8 { offset } => {
+                write!(f, "invalid UTF-8 in text string at offset {}", offset)
+            }
+            DecodeError::DisallowedTag { tag, offset } => {
+                write!(f, "disallowed tag {} at offset {}", tag, offset)
+            }
+            #[cfg(feature = "std")]
+            DecodeError::Io(e) => write!(f, "I/O error: {}", e),
+            DecodeError::InField { path, source } => write!(f, "{}: {}", path, source),
+        }
+    }
+}
+
+// The error trait is only available in std, so in no_std builds the errors just implement
+// `Display` and `Debug`.
+#[cfg(feature = "std")]
+impl std::error::Error for DecodeError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        match self {
+            DecodeError::Io(e) => Some(e),
+            DecodeError::InField { source, .. } => Some(source),
+            _ => None,
+        }
+    }
+}
+
+#[cfg(feature = "std")]
+impl From<std::io::Error> for DecodeError {
+    fn from(e: std::io::Error) -> Self {
+        DecodeError::Io(e)
+    }
+}
+
+/// Error encountered during encoding.
+#[derive(Debug)]
+pub enum EncodeError {
+    NoOpenContainer,
+    IncompleteMapEntry,
+    DepthLimitExceeded,
+    DuplicateMapKey,
+    NonFiniteFloat,
+    LengthMismatch {
+        expected: usize,
+        got: usize,
+    },
+    #[cfg(feature = "std")]
+    Io(std::io::Error),
+}
+
+impl fmt::Display for EncodeError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            EncodeError::NoOpenContainer => f.write_str("no open container"),
+            EncodeError::IncompleteMapEntry => f.write_str("incomplete map entry"),
+            EncodeError::DepthLimitExceeded => f.write_str("depth limit exceeded"),
+            EncodeError::DuplicateMapKey => f.write_str("duplicate map key"),
+            EncodeError::NonFiniteFloat => f.write_str("non-finite float"),
+            EncodeError::LengthMismatch { expected, got } => {
+                write!(f, "length mismatch (expected {}, got {})", expected, got)
+            }
+            #[cfg(feature = "std")]
+            EncodeError::Io(e) => write!(f, "I/O error: {}", e),
+        }
+    }
+}
+
+#[cfg(feature = "std")]
+impl std::error::Error for EncodeError {
+    fn source(&self) -> Option<&(dyn std::error::Error + 'static)> {
+        match self {
+            EncodeError::Io(e) => Some(e),
+            _ => None,
+        }
+    }
+}
+
+#[cfg(feature = "std")]
+impl From<std::io::Error> for EncodeError {
+    fn from(e: std::io::Error) -> Self {
+        EncodeError::Io(e)
+    }
+}
+
+impl From<writer::EncoderError> for EncodeError {
+    fn from(e: writer::EncoderError) -> Self {
+        match e {
+            writer::EncoderError::TooMuchNesting => EncodeError::DepthLimitExceeded,
+            writer::EncoderError::DuplicateMapKey => EncodeError::DuplicateMapKey,
+            writer::EncoderError::NonFiniteFloat => EncodeError::NonFiniteFloat,
+        }
+    }
+}
+
+/// Format the errors of all attempted variants, for use in `DecodeError::NoMatchingVariant`.
+fn format_variant_errors(errors: &[(&'static str, DecodeError)]) -> String {
+    errors
+        .iter()
+        .map(|(variant, e)| format!("{}: {}", variant, e))
+        .collect::<Vec<_>>()
+        .join(", ")
+}
+
+/// Format a map key for use in `DecodeError::UnknownField` and `DecodeError::UnexpectedKeyType`.
+fn format_key(f: &mut fmt::Formatter<'_>, key: &Value) -> fmt::Result {
+    match key {
+        Value::TextString(name) => write!(f, "{:?}", name),
+        Value::Unsigned(n) => write!(f, "{}", n),
+        key => write!(f, "{:?}", key),
+    }
 }
 
 impl From<reader::DecoderError> for DecodeError {
-    fn from(_e: reader::DecoderError) -> Self {
-        DecodeError::ParsingFailed
+    fn from(e: reader::DecoderError) -> Self {
+        match e {
+            // Well-formed items which are only rejected because they are not in canonical form.
+            reader::DecoderError::NonMinimalCborEncoding { offset }
+            | reader::DecoderError::OutOfOrderKey { offset }
+            | reader::DecoderError::IndefiniteLength { offset }
+            | reader::DecoderError::UnsupportedFloatingPointValue { offset } => {
+                DecodeError::NonCanonical { offset }
+            }
+            reader::DecoderError::ExtraneousData { offset } => DecodeError::TrailingData { offset },
+            reader::DecoderError::TooMuchNesting { offset } => {
+                DecodeError::DepthLimitExceeded { offset }
+            }
+            reader::DecoderError::DuplicateMapKey { offset } => {
+                DecodeError::DuplicateMapKey { offset }
+            }
+            reader::DecoderError::NonFiniteFloat { offset } => {
+                DecodeError::NonFiniteFloat { offset }
+            }
+            reader::DecoderError::AllocationLimitExceeded { offset } => {
+                DecodeError::AllocationLimitExceeded { offset }
+            }
+            reader::DecoderError::InvalidUtf8 { offset } => DecodeError::InvalidUtf8 { offset },
+            reader::DecoderError::DisallowedTag { tag, offset } => {
+                DecodeError::DisallowedTag { tag, offset }
+            }
+            reader::DecoderError::IncompleteCborData { offset } => {
+                DecodeError::UnexpectedEof { offset }
+            }
+            reader::DecoderError::UnsupportedMajorType { offset } => DecodeError::Malformed {
+                offset,
+                reason: "unsupported major type",
+            },
+            reader::DecoderError::UnknownAdditionalInfo { offset } => DecodeError::Malformed {
+                offset,
+                reason: "unknown additional information",
+            },
+            reader::DecoderError::InvalidStringChunk { offset } => DecodeError::Malformed {
+                offset,
+                reason: "invalid string chunk",
+            },
+            // Only raised for the two-byte encoding of simple values below 32, which is not
+            // well-formed (RFC 8949 section 3.3), as all other simple values are accepted.
+            reader::DecoderError::UnsupportedSimpleValue { offset } => DecodeError::Malformed {
+                offset,
+                reason: "unsupported simple value",
+            },
+        }
     }
 }
 
 /// Convert CBOR-encoded data into the given type.
+///
+/// This is the same as calling `from_slice_with` with canonical decoding enabled.
 pub fn from_slice<T>(data: &[u8]) -> Result<T, DecodeError>
 where
     T: Decode,
 {
-    let value = reader::read_nested(data, Some(MAX_NESTING_LEVEL))?;
-    T::try_from_cbor_value_default(value)
+    from_slice_with(
+        data,
+        &DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        },
+    )
 }
 
 /// Convert CBOR-encoded data into the given type using non-strict decoding.
+///
+/// This is the same as calling `from_slice_with` with the default options.
 pub fn from_slice_non_strict<T>(data: &[u8]) -> Result<T, DecodeError>
 where
     T: Decode,
 {
-    let value = reader::read_nested_non_strict(data, Some(MAX_NESTING_LEVEL))?;
+    from_slice_with(data, &DecodeOptions::default())
+}
+
+/// Convert CBOR-encoded data into the given type using the given decoding options.
+///
+/// Any data after the first CBOR item results in a `DecodeError::TrailingData` error.
+pub fn from_slice_with<T>(data: &[u8], options: &DecodeOptions) -> Result<T, DecodeError>
+where
+    T: Decode,
+{
+    let value = reader::read_with_options(data, options)?;
     T::try_from_cbor_value_default(value)
 }
 
+/// Decode CBOR-encoded data into an existing instance of the given type, reusing its allocations
+/// where possible (see `Decode::decode_in_place`).
+///
+/// This is the same as calling `from_slice_in_place_with` with canonical decoding enabled.
+pub fn from_slice_in_place<T>(data: &[u8], value: &mut T) -> Result<(), DecodeError>
+where
+    T: Decode,
+{
+    from_slice_in_place_with(
+        data,
+        value,
+        &DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        },
+    )
+}
+
+/// Decode CBOR-encoded data into an existing instance of the given type using the given decoding
+/// options. On error, the instance may be left partially updated.
+///
+/// Note that the data is still parsed into an intermediate `Value` first, so this only saves the
+/// allocations of the instance, e.g. byte and text strings are copied into its existing buffers.
+///
+/// Any data after the first CBOR item results in a `DecodeError::TrailingData` error.
+pub fn from_slice_in_place_with<T>(
+    data: &[u8],
+    value: &mut T,
+    options: &DecodeOptions,
+) -> Result<(), DecodeError>
+where
+    T: Decode,
+{
+    let decoded = reader::read_with_options(data, options)?;
+    value.decode_in_place_default(decoded)
+}
+
+/// Convert the first CBOR-encoded item in the given data into the given type, returning it
+/// together with the remaining (unconsumed) data.
+///
+/// The item consumes exactly `data.len() - remaining.len()` bytes, the same amount a `Decoder`
+/// advances its position by, so callers embedding CBOR in a larger format can advance their own
+/// cursor by it.
+pub fn from_slice_prefix<T>(data: &[u8]) -> Result<(T, &[u8]), DecodeError>
+where
+    T: Decode,
+{
+    let (value, remaining) = reader::read_prefix_with_options(
+        data,
+        &DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        },
+    )?;
+    Ok((T::try_from_cbor_value_default(value)?, remaining))
+}
+
+/// Convert a CBOR sequence (RFC 8742), i.e. zero or more back-to-back CBOR-encoded items, into a
+/// vector of the given type.
+///
+/// Each item is decoded canonically, the same as by `from_slice`. Decoding stops cleanly at the end
+/// of the data, so an incomplete trailing item results in an error. Errors encountered while
+/// converting an item are annotated with its index.
+pub fn decode_seq<T>(data: &[u8]) -> Result<Vec<T>, DecodeError>
+where
+    T: Decode,
+{
+    reader::read_seq_with_options(
+        data,
+        &DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        },
+    )?
+    .into_iter()
+    .enumerate()
+    .map(|(i, value)| T::try_from_cbor_value_default(value).map_err(|e| e.in_field(&i.to_string())))
+    .collect()
+}
+
+/// Convert CBOR-encoded data into the given type, borrowing from the data where possible.
+///
+/// This is the same as calling `from_slice_borrowed_with` with canonical decoding enabled.
+pub fn from_slice_borrowed<'de, T>(data: &'de [u8]) -> Result<T, DecodeError>
+where
+    T: DecodeBorrowed<'de>,
+{
+    from_slice_borrowed_with(
+        data,
+        &DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        },
+    )
+}
+
+/// Convert CBOR-encoded data into the given type using the given decoding options, borrowing from
+/// the data where possible.
+///
+/// Any data after the first CBOR item results in a `DecodeError::TrailingData` error.
+pub fn from_slice_borrowed_with<'de, T>(
+    data: &'de [u8],
+    options: &DecodeOptions,
+) -> Result<T, DecodeError>
+where
+    T: DecodeBorrowed<'de>,
+{
+    let value = reader::read_borrowed_with_options(data, options)?;
+    T::try_from_cbor_value_borrowed_default(value)
+}
+
 /// Convert high-level CBOR representation into the given type.
 ///
 /// This is the same as calling `T::try_from_cbor_value(value)`.
@@ -71,16 +571,110 @@ where
     T::try_from_cbor_value_default(value)
 }
 
+/// Render CBOR-encoded data in diagnostic notation (RFC 8949, Section 8), e.g. `{"foo": [42]}`.
+///
+/// This is meant for debugging, so the data does not need to be canonical. Any data after the
+/// first CBOR item results in a `DecodeError::TrailingData` error.
+pub fn to_diagnostic(data: &[u8]) -> Result<String, DecodeError> {
+    Ok(diagnostic::to_diagnostic(data)?)
+}
+
+/// Walk CBOR-encoded data, invoking the given visitor for each token instead of building an
+/// intermediate `Value`.
+///
+/// This is the same as calling `visitor::visit`. The data does not need to be canonical. Any data
+/// after the first CBOR item results in an error (`DecodeError::TrailingData` for visitors using
+/// `DecodeError` as their error type).
+pub fn decode_with_visitor<V>(data: &[u8], visitor: &mut V) -> Result<(), V::Error>
+where
+    V: Visitor,
+{
+    visitor::visit(data, visitor)
+}
+
 /// Convert the given type into its CBOR-encoded representation.
+///
+/// This is the same as calling `encode_into` with a fresh buffer, except that errors cause a
+/// panic.
 pub fn to_vec<T>(value: T) -> Vec<u8>
 where
     T: Encode,
 {
     let mut data = vec![];
-    writer::write(value.into_cbor_value(), &mut data).unwrap();
+    encode_into(value, &mut data).unwrap();
+    data
+}
+
+/// Convert the given type into its CBOR-encoded representation, appending it to the given buffer.
+///
+/// This allows callers to reuse the same output buffer across many encodings. Note that the value
+/// is still converted into an intermediate `Value` first, so this only saves the allocation of
+/// the output. In case of an error (e.g. a map with duplicate keys) the buffer is left unchanged.
+pub fn encode_into<T>(value: T, buffer: &mut Vec<u8>) -> Result<(), EncodeError>
+where
+    T: Encode,
+{
+    let len = buffer.len();
+    buffer.reserve(value.encoded_len());
+    writer::write(value.into_cbor_value(), buffer).map_err(|e| {
+        buffer.truncate(len);
+        e.into()
+    })
+}
+
+/// Convert the given type into its CBOR-encoded representation using the given encoding options.
+///
+/// Unlike `to_vec`, errors from the options (e.g. a non-finite float when `reject_non_finite` is
+/// set) are returned instead of causing a panic.
+pub fn to_vec_with<T>(value: T, options: &EncodeOptions) -> Result<Vec<u8>, EncodeError>
+where
+    T: Encode,
+{
+    let mut data = Vec::with_capacity(value.encoded_len());
+    writer::write_with_options(value.into_cbor_value(), &mut data, options)?;
+    Ok(data)
+}
+
+/// Convert the given items into a CBOR sequence (RFC 8742), i.e. their back-to-back CBOR-encoded
+/// representations without any framing.
+///
+/// As there is no framing, the encoding of more items can later be appended to the result.
+pub fn encode_seq<I>(items: I) -> Vec<u8>
+where
+    I: IntoIterator,
+    I::Item: Encode,
+{
+    let mut data = vec![];
+    for item in items {
+        encode_into(item, &mut data).unwrap();
+    }
     data
 }
 
+/// Convert the given serde-serializable type into its CBOR-encoded representation.
+///
+/// This is the same as calling `serde::to_vec`. See the [`serde`] module for differences from the
+/// representation produced by `to_vec`.
+#[cfg(feature = "serde")]
+pub fn to_vec_serde<T>(value: &T) -> Result<Vec<u8>, serde::Error>
+where
+    T: ?Sized + ::serde::Serialize,
+{
+    serde::to_vec(value)
+}
+
+/// Convert CBOR-encoded data into the given serde-deserializable type.
+///
+/// This is the same as calling `serde::from_slice`. See the [`serde`] module for differences from
+/// the representation expected by `from_slice`.
+#[cfg(feature = "serde")]
+pub fn from_slice_serde<T>(data: &[u8]) -> Result<T, serde::Error>
+where
+    T: ::serde::de::DeserializeOwned,
+{
+    serde::from_slice(data)
+}
+
 /// Convert the given type into its high-level CBOR representation.
 ///
 /// This is the same as calling `value.into_cbor_value()`.
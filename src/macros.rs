@@ -1,28 +1,196 @@
-use std::{cmp::Ordering, iter::Peekable};
+// Re-export alloc items used by the derive macros, as the deriving crate may be no_std.
+use alloc::alloc::{Allocator, Global};
+pub use alloc::{boxed::Box, vec, vec::Vec};
+use core::{cmp::Ordering, iter::Peekable};
 
-use crate::{values::Value, DecodeError};
+use crate::{
+    values::{ContainerAlloc, MajorType, Value, ValueRef},
+    DecodeError,
+};
+
+/// Value type which the Decode derive macro can decode from. This trait is an internal detail of
+/// the Decode derive macro, but has public visibility so that users of the macro can use it.
+pub trait DecodableValue: Sized + Ord + From<Value> {
+    /// Allocator of the map items.
+    type Alloc: Allocator + Clone;
+
+    /// Return the map items in case the value is a map.
+    fn into_map(self) -> Option<Vec<(Self, Self), Self::Alloc>>;
+
+    /// Construct a map value from the given items.
+    fn from_map(map: Vec<(Self, Self), Self::Alloc>) -> Self;
+
+    /// Return the tag and the inner value in case the value is tagged.
+    fn into_tagged(self) -> Option<(u64, Self)>;
+
+    /// Convert into an owned value.
+    fn into_value(self) -> Value;
+}
+
+impl DecodableValue for Value {
+    type Alloc = Global;
+
+    fn into_map(self) -> Option<Vec<(Self, Self)>> {
+        match self {
+            Value::Map(map) => Some(map),
+            _ => None,
+        }
+    }
+
+    fn from_map(map: Vec<(Self, Self)>) -> Self {
+        Value::Map(map)
+    }
+
+    fn into_tagged(self) -> Option<(u64, Self)> {
+        match self {
+            Value::Tag(tag, inner) => Some((tag, *inner)),
+            _ => None,
+        }
+    }
+
+    fn into_value(self) -> Value {
+        self
+    }
+}
+
+impl<'a> DecodableValue for ValueRef<'a> {
+    type Alloc = ContainerAlloc<'a>;
+
+    fn into_map(self) -> Option<Vec<(Self, Self), Self::Alloc>> {
+        match self {
+            ValueRef::Map(map) => Some(map),
+            _ => None,
+        }
+    }
+
+    fn from_map(map: Vec<(Self, Self), Self::Alloc>) -> Self {
+        ValueRef::Map(map)
+    }
+
+    fn into_tagged(self) -> Option<(u64, Self)> {
+        match self {
+            ValueRef::Tag(tag, inner) => Some((tag, *inner)),
+            _ => None,
+        }
+    }
+
+    fn into_value(self) -> Value {
+        self.into_owned()
+    }
+}
 
 /// This function is an internal detail of the Decode derive macro, but has public visibility so
 /// that users of the macro can use it.
-pub fn destructure_cbor_map_peek_value_strict(
-    it: &mut Peekable<std::vec::IntoIter<(Value, Value)>>,
+pub fn destructure_cbor_map_peek_value_strict<V: DecodableValue>(
+    it: &mut Peekable<alloc::vec::IntoIter<(V, V), V::Alloc>>,
     needle: Value,
-) -> Result<Option<Value>, DecodeError> {
-    match it.peek() {
-        None => Ok(None),
-        Some(item) => {
-            let key: &Value = &item.0;
-            match key.cmp(&needle) {
-                Ordering::Less => {
-                    // Reject unexpected fields.
-                    Err(DecodeError::UnknownField)
+    allow_unknown: bool,
+    key_types: &[MajorType],
+) -> Result<Option<V>, DecodeError> {
+    let needle = V::from(needle);
+    while let Some(item) = it.peek() {
+        let key: &V = &item.0;
+        match key.cmp(&needle) {
+            Ordering::Less => {
+                // Skip or reject unexpected fields.
+                let key = it.next().unwrap().0;
+                if !allow_unknown {
+                    return Err(unknown_cbor_map_key(key.into_value(), key_types));
                 }
-                Ordering::Equal => {
-                    let value: Value = it.next().unwrap().1;
-                    Ok(Some(value))
-                }
-                Ordering::Greater => Ok(None),
             }
+            Ordering::Equal => {
+                let value: V = it.next().unwrap().1;
+                return Ok(Some(value));
+            }
+            Ordering::Greater => return Ok(None),
+        }
+    }
+    Ok(None)
+}
+
+/// Error for a map key which does not match any field, given the major types of the field keys.
+/// Keys of another major type are reported as `UnexpectedKeyType`, unless there are no field keys
+/// to compare against.
+///
+/// This function is an internal detail of the Decode derive macro, but has public visibility so
+/// that users of the macro can use it.
+pub fn unknown_cbor_map_key(key: Value, key_types: &[MajorType]) -> DecodeError {
+    let key_type = key.type_label();
+    if key_types.is_empty() || key_types.iter().any(|t| *t as u8 == key_type) {
+        DecodeError::UnknownField { key: Some(key) }
+    } else {
+        DecodeError::UnexpectedKeyType { key }
+    }
+}
+
+/// Check that the given value is a map with only the given keys, returning the error which
+/// decoding it into a struct with fields of those keys fails with otherwise. This rejects such
+/// variants of untagged enums without decoding a copy of the value.
+///
+/// This function is an internal detail of the Decode derive macro, but has public visibility so
+/// that users of the macro can use it.
+pub fn check_cbor_map_keys(
+    value: &Value,
+    keys: &[Value],
+    key_types: &[MajorType],
+) -> Result<(), DecodeError> {
+    match value {
+        Value::Map(map) => match map
+            .iter()
+            .map(|(k, _)| k)
+            .filter(|k| !keys.contains(k))
+            .min()
+        {
+            Some(key) => Err(unknown_cbor_map_key(key.clone(), key_types)),
+            None => Ok(()),
+        },
+        _ => Err(DecodeError::UnexpectedType),
+    }
+}
+
+/// This function is an internal detail of the Decode derive macro, but has public visibility so
+/// that users of the macro can use it.
+pub fn split_cbor_map<V: DecodableValue>(
+    value: V,
+    keys: Vec<Value>,
+) -> Result<(V, V), DecodeError> {
+    let map = value.into_map().ok_or(DecodeError::UnexpectedType)?;
+    let keys: Vec<V> = keys.into_iter().map(V::from).collect();
+
+    let mut own = Vec::new_in(map.allocator().clone());
+    let mut rest = Vec::new_in(map.allocator().clone());
+    for item in map {
+        if keys.contains(&item.0) {
+            own.push(item);
+        } else {
+            rest.push(item);
         }
     }
+    // Reject keys which are present multiple times as that indicates a collision with a key of
+    // the embedded type.
+    if own
+        .iter()
+        .enumerate()
+        .any(|(i, (k, _))| own[..i].iter().any(|(other, _)| other == k))
+    {
+        return Err(DecodeError::DuplicateField);
+    }
+
+    Ok((V::from_map(own), V::from_map(rest)))
+}
+
+/// This function is an internal detail of the Decode derive macro, but has public visibility so
+/// that users of the macro can use it.
+pub fn strip_cbor_tag<V: DecodableValue>(value: V, expected: u64) -> Result<V, DecodeError> {
+    match value.into_tagged() {
+        Some((tag, inner)) if tag == expected => Ok(inner),
+        Some((tag, _)) => Err(DecodeError::UnexpectedTag {
+            expected,
+            got: Some(tag),
+        }),
+        None => Err(DecodeError::UnexpectedTag {
+            expected,
+            got: None,
+        }),
+    }
 }
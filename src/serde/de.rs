@@ -25,7 +25,8 @@ impl<'de> de::Deserializer<'de> for Deserializer {
     {
         let value = match self.0 {
             Value::Unsigned(n) => visitor.visit_u64(n),
-            Value::Negative(n) => visitor.visit_i64(n as i64),
+            Value::Negative(n) if n >= i64::MIN.into() => visitor.visit_i64(n as i64),
+            Value::Negative(n) => visitor.visit_i128(n),
             Value::ByteString(bytes) => visitor.visit_byte_buf(bytes),
             Value::TextString(s) => visitor.visit_string(s),
             Value::Array(_) => self.deserialize_seq(visitor),
@@ -36,7 +37,11 @@ impl<'de> de::Deserializer<'de> for Deserializer {
                 SimpleValue::TrueValue => visitor.visit_bool(true),
                 SimpleValue::NullValue => visitor.visit_unit(),
                 SimpleValue::Undefined => visitor.visit_unit(),
+                SimpleValue::Unassigned(_) => {
+                    Err(Error::UnsupportedType("unassigned simple value"))
+                }
             },
+            Value::Float(v) => visitor.visit_f64(v),
         };
         value
     }
@@ -59,18 +64,20 @@ impl<'de> de::Deserializer<'de> for Deserializer {
         visitor.visit_u128(n)
     }
 
-    fn deserialize_f32<V>(self, _visitor: V) -> Result<V::Value, Self::Error>
+    fn deserialize_f32<V>(self, visitor: V) -> Result<V::Value, Self::Error>
     where
         V: Visitor<'de>,
     {
-        Err(Error::UnsupportedType("f32"))
+        let v = f32::try_from_cbor_value(self.0).map_err(Error::from)?;
+        visitor.visit_f32(v)
     }
 
-    fn deserialize_f64<V>(self, _visitor: V) -> Result<V::Value, Self::Error>
+    fn deserialize_f64<V>(self, visitor: V) -> Result<V::Value, Self::Error>
     where
         V: Visitor<'de>,
     {
-        Err(Error::UnsupportedType("f64"))
+        let v = f64::try_from_cbor_value(self.0).map_err(Error::from)?;
+        visitor.visit_f64(v)
     }
 
     fn deserialize_char<V>(self, visitor: V) -> Result<V::Value, Self::Error>
@@ -48,7 +48,8 @@ impl de::Error for Error {
 pub(crate) fn unexpected(v: &Value) -> de::Unexpected {
     match v {
         Value::Unsigned(n) => de::Unexpected::Unsigned(*n),
-        Value::Negative(n) => de::Unexpected::Signed(*n as i64),
+        Value::Negative(n) if *n >= i64::MIN.into() => de::Unexpected::Signed(*n as i64),
+        Value::Negative(_) => de::Unexpected::Other("negative integer"),
         Value::ByteString(s) => de::Unexpected::Bytes(s),
         Value::TextString(s) => de::Unexpected::Str(s),
         Value::Array(_) => de::Unexpected::Seq,
@@ -59,6 +60,8 @@ pub(crate) fn unexpected(v: &Value) -> de::Unexpected {
             SimpleValue::TrueValue => de::Unexpected::Bool(true),
             SimpleValue::NullValue => de::Unexpected::Other("null"),
             SimpleValue::Undefined => de::Unexpected::Other("undefined"),
+            SimpleValue::Unassigned(_) => de::Unexpected::Other("simple value"),
         },
+        Value::Float(f) => de::Unexpected::Float(*f),
     }
 }
@@ -3,9 +3,24 @@
 //! this module only implements converts between native rust types and `Value`. The
 //! conversion between `Value` and bytes is handled by the `oasis-cbor` library.
 //!
+//! The representation follows the one produced by `#[derive(Encode)]` (from core `oasis-cbor`):
+//! structs are encoded as maps keyed by field name (sorted canonically on output), unit variants
+//! as the variant name and other variants as a single-entry map from the variant name to the
+//! variant's fields.
+//!
 //! NOTE: CBOR encoding is not strictly defined for non-primitive types. For any given type T,
 //! serializations produced by `#[derive(Encode)]` (from core `oasis-cbor`) and those produced
-//! by `#[derive(Deserialize)]` (from this module) are NOT GUARANTEED TO BE COMPATIBLE.
+//! by `#[derive(Serialize)]` (via this module) are NOT GUARANTEED TO BE COMPATIBLE. Known
+//! differences are:
+//!
+//! * Byte vectors and slices are encoded as arrays of integers, unless wrapped using
+//!   `serde_bytes` in which case they are encoded as byte strings.
+//! * Variants are always identified by name, while `#[derive(Encode)]` uses the discriminant
+//!   when one is given explicitly. Attributes of the native derive (e.g. `rename`, `optional`,
+//!   `embed`) are not visible to serde and serde's own attributes are not visible to the
+//!   native derive.
+//! * CBOR tags are not supported.
+//!
 //! See notes in the test suite for examples of incompatibilities.
 
 mod de;
@@ -22,7 +37,7 @@ pub fn from_slice<T>(data: &[u8]) -> Result<T, Error>
 where
     T: serde::de::DeserializeOwned,
 {
-    let value = reader::read_nested(data, Some(crate::MAX_NESTING_LEVEL)).map_err(Error::from)?;
+    let value = reader::read_nested(data, Some(reader::DEFAULT_MAX_DEPTH)).map_err(Error::from)?;
     from_value(value)
 }
 
@@ -42,18 +42,12 @@ impl<'a> ser::Serializer for &'a mut Serializer {
         fn serialize_u32(u32);
         fn serialize_u64(u64);
         fn serialize_u128(u128);
+        fn serialize_f32(f32);
+        fn serialize_f64(f64);
         fn serialize_char(char);
         fn serialize_str(&str);
     }
 
-    fn serialize_f32(self, _v: f32) -> Result<Self::Ok, Self::Error> {
-        Err(Self::Error::UnsupportedType("f32"))
-    }
-
-    fn serialize_f64(self, _v: f64) -> Result<Self::Ok, Self::Error> {
-        Err(Self::Error::UnsupportedType("f64"))
-    }
-
     fn serialize_bytes(self, v: &[u8]) -> Result<Self::Ok, Self::Error> {
         Ok(Value::ByteString(v.to_owned()))
     }
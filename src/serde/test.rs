@@ -97,31 +97,46 @@ fn test_simple_types() {
 }
 
 #[test]
-fn test_float() {
-    // Floats are not supported; make sure we enforce that at the serde layer already.
+fn test_out_of_range_integers() {
+    // Negative integers beyond i64 must not be truncated.
+    let min = Value::Negative(i64::MIN.into());
+    assert_eq!(crate::serde::from_value::<i64>(min).unwrap(), i64::MIN);
+    let below_min = Value::Negative(i128::from(i64::MIN) - 1);
+    assert!(crate::serde::from_value::<i64>(below_min.clone()).is_err());
+    assert_eq!(
+        crate::serde::from_value::<i128>(below_min).unwrap(),
+        i128::from(i64::MIN) - 1
+    );
 
-    // Encoding.
-    let err = crate::serde::to_value(&1.0)
-        .err()
-        .expect("encoding f32 should fail");
-    assert!(
-        matches!(err, crate::serde::Error::UnsupportedType(_)),
-        "f32 should be marked as unsupported"
+    assert!(crate::serde::from_value::<u8>(Value::Unsigned(256)).is_err());
+    assert!(crate::serde::from_value::<u64>(Value::Negative(-1)).is_err());
+}
+
+#[test]
+fn test_float() {
+    assert_compat_roundtrip(1.5f64, Value::Float(1.5));
+    assert_compat_roundtrip(-0.1f32, Value::Float(f64::from(-0.1f32)));
+    assert_compat_roundtrip(
+        vec![0.0f64, f64::INFINITY],
+        Value::Array(vec![Value::Float(0.0), Value::Float(f64::INFINITY)]),
     );
 
-    // Decoding.
+    // Floats which do not fit into an f32 without loss of precision are rejected.
+    assert!(crate::serde::from_value::<f32>(Value::Float(0.1)).is_err());
+
+    // Half precision is not canonical, so it is rejected when decoding bytes.
     let one = [0xf9, 0x3c, 0x00]; // CBOR encoding for float(1.0)
     let err = crate::serde::from_slice::<f32>(&one)
         .err()
-        .expect("decoding f32 should fail");
+        .expect("decoding a half precision float should fail");
     assert!(
         matches!(
             err,
             crate::serde::Error::ByteDecoder(
-                crate::reader::DecoderError::UnsupportedFloatingPointValue
+                crate::reader::DecoderError::UnsupportedFloatingPointValue { offset: 0 }
             )
         ),
-        "f32 should be marked as unsupported, but error was {:?}",
+        "half precision should be rejected, but error was {:?}",
         err
     );
 }
@@ -352,3 +367,38 @@ mod structs {
         assert_compat_roundtrip(v, Value::Simple(SimpleValue::NullValue));
     }
 }
+
+#[test]
+fn test_crate_level_functions() {
+    #[derive(Debug, Eq, PartialEq, Serialize, Deserialize, Encode, Decode, Clone, Default)]
+    struct Inner {
+        #[serde(with = "serde_bytes")]
+        data: Vec<u8>,
+        map: std::collections::BTreeMap<u64, String>,
+    }
+
+    #[derive(Debug, Eq, PartialEq, Serialize, Deserialize, Encode, Decode, Clone)]
+    enum E {
+        Unit,
+        Wrapped(Inner),
+        Fields { foo: u64, inner: Inner },
+    }
+
+    let inner = Inner {
+        data: vec![1, 2, 3],
+        map: [(1, "one".to_owned()), (24, "twenty-four".to_owned())].into(),
+    };
+    for v in [
+        E::Unit,
+        E::Wrapped(inner.clone()),
+        E::Fields { foo: 42, inner },
+    ] {
+        // Encodings produced through serde match the native ones.
+        let bytes = crate::to_vec_serde(&v).unwrap();
+        assert_eq!(bytes, crate::to_vec(v.clone()));
+        let reconstructed: E = crate::from_slice_serde(&bytes).unwrap();
+        assert_eq!(reconstructed, v);
+        let reconstructed: E = crate::from_slice(&bytes).unwrap();
+        assert_eq!(reconstructed, v);
+    }
+}
@@ -0,0 +1,733 @@
+//! Streaming CBOR encoding and decoding.
+use std::io::{self, Read, Write};
+
+use crate::{
+    encode_into, from_slice_with, reader, values::Constants, writer, Decode, DecodeError,
+    DecodeOptions, Encode, EncodeError, MajorType,
+};
+
+/// Default maximum size (in bytes) of a single item decoded by a [`Decoder`].
+pub const DEFAULT_MAX_ITEM_SIZE: usize = 16 * 1024 * 1024;
+
+/// Size of the smallest read performed on the underlying reader.
+const MIN_READ_SIZE: usize = 4096;
+
+/// Decoder that decodes a sequence of CBOR items from an underlying reader.
+///
+/// Bytes are pulled from the reader lazily and buffered internally until a complete item is
+/// available, so the reader may return partial data on each read. The amount of buffered data is
+/// bounded by the configured maximum item size, regardless of any lengths declared in the data.
+pub struct Decoder<R: Read> {
+    reader: R,
+    buffer: Vec<u8>,
+    options: DecodeOptions,
+    max_item_size: usize,
+    position: usize,
+}
+
+impl<R: Read> Decoder<R> {
+    /// Create a new decoder reading from the given reader.
+    ///
+    /// The decoder requires canonical encoding, same as `from_slice`.
+    pub fn new(reader: R) -> Self {
+        Self::with_options(
+            reader,
+            DecodeOptions {
+                canonical: true,
+                ..Default::default()
+            },
+        )
+    }
+
+    /// Create a new decoder reading from the given reader using the given decoding options.
+    pub fn with_options(reader: R, options: DecodeOptions) -> Self {
+        Self {
+            reader,
+            buffer: Vec::new(),
+            options,
+            max_item_size: DEFAULT_MAX_ITEM_SIZE,
+            position: 0,
+        }
+    }
+
+    /// Set the maximum size (in bytes) of a single decoded item.
+    pub fn with_max_item_size(mut self, max_item_size: usize) -> Self {
+        self.max_item_size = max_item_size;
+        self
+    }
+
+    /// Return the number of bytes consumed by the items decoded or skipped so far.
+    ///
+    /// Data buffered from the reader but not yet part of a complete item is not counted, so this
+    /// is the offset of the next item within the sequence. It only advances once an item has been
+    /// read in full, also when converting it into the target type fails afterwards.
+    pub fn position(&self) -> usize {
+        self.position
+    }
+
+    /// Decode the next item from the underlying reader.
+    ///
+    /// In case the reader reaches end of file before a complete item has been read, a
+    /// `DecodeError::Io` error with kind `UnexpectedEof` is returned. Offsets reported in errors
+    /// are relative to the start of the item.
+    pub fn decode<T>(&mut self) -> Result<T, DecodeError>
+    where
+        T: Decode,
+    {
+        loop {
+            match reader::read_prefix_with_options(&self.buffer, &self.options) {
+                Ok((value, remaining)) => {
+                    self.consume(self.buffer.len() - remaining.len());
+                    return T::try_from_cbor_value_default(value);
+                }
+                Err(reader::DecoderError::IncompleteCborData { .. }) => self.fill_buffer()?,
+                Err(e) => return Err(e.into()),
+            }
+        }
+    }
+
+    /// Return the major type of the next item without consuming it.
+    pub fn peek_type(&mut self) -> Result<MajorType, DecodeError> {
+        while self.buffer.is_empty() {
+            self.fill_buffer()?;
+        }
+        Ok(MajorType::from_initial_byte(self.buffer[0]))
+    }
+
+    /// Skip over the next item, including any nested items, without decoding it.
+    ///
+    /// Only the structure of the item is checked, see `reader::skip_prefix_with_options`. The item
+    /// is still buffered in full, so it is subject to the maximum item size.
+    pub fn skip_item(&mut self) -> Result<(), DecodeError> {
+        loop {
+            match reader::skip_prefix_with_options(&self.buffer, &self.options) {
+                Ok(remaining) => {
+                    self.consume(self.buffer.len() - remaining.len());
+                    return Ok(());
+                }
+                Err(reader::DecoderError::IncompleteCborData { .. }) => self.fill_buffer()?,
+                Err(e) => return Err(e.into()),
+            }
+        }
+    }
+
+    /// Remove the given number of bytes of a complete item from the internal buffer.
+    fn consume(&mut self, consumed: usize) {
+        self.buffer.drain(..consumed);
+        self.position += consumed;
+    }
+
+    /// Read more data from the underlying reader into the internal buffer.
+    fn fill_buffer(&mut self) -> Result<(), DecodeError> {
+        if self.buffer.len() >= self.max_item_size {
+            return Err(DecodeError::ItemTooLarge);
+        }
+
+        // Grow reads geometrically to avoid re-parsing the buffered data too often.
+        let read_size = self
+            .buffer
+            .len()
+            .max(MIN_READ_SIZE)
+            .min(self.max_item_size - self.buffer.len());
+        let start = self.buffer.len();
+        self.buffer.resize(start + read_size, 0);
+
+        let result = loop {
+            match self.reader.read(&mut self.buffer[start..]) {
+                Err(e) if e.kind() == io::ErrorKind::Interrupted => continue,
+                result => break result,
+            }
+        };
+        match result {
+            Ok(n) => {
+                self.buffer.truncate(start + n);
+                if n == 0 {
+                    return Err(DecodeError::Io(io::ErrorKind::UnexpectedEof.into()));
+                }
+                Ok(())
+            }
+            Err(e) => {
+                self.buffer.truncate(start);
+                Err(DecodeError::Io(e))
+            }
+        }
+    }
+}
+
+/// Kind of an open indefinite-length container.
+enum Container {
+    Array,
+    Map { items: usize },
+}
+
+/// Encoder that writes a sequence of CBOR items to an underlying writer.
+///
+/// Besides complete items, the encoder can emit indefinite-length arrays and maps whose items are
+/// pushed one by one, which is useful when the number of items is not known up front. Note that
+/// indefinite-length items are not canonical, so they can only be decoded using non-strict
+/// decoding. When the number of items is known, `encode_iter` streams a canonical definite-length
+/// array instead.
+///
+/// Items are encoded into an internal buffer which is reused across items, so encoding many items
+/// does not allocate a fresh buffer for each of them.
+pub struct Encoder<W: Write> {
+    writer: W,
+    buffer: Vec<u8>,
+    containers: Vec<Container>,
+}
+
+impl<W: Write> Encoder<W> {
+    /// Create a new encoder writing to the given writer.
+    pub fn new(writer: W) -> Self {
+        Self {
+            writer,
+            buffer: Vec::new(),
+            containers: Vec::new(),
+        }
+    }
+
+    /// Encode the next item. Inside a map, keys and values are pushed alternately.
+    pub fn push<T>(&mut self, value: T) -> Result<(), EncodeError>
+    where
+        T: Encode,
+    {
+        self.count_item();
+        self.buffer.clear();
+        encode_into(value, &mut self.buffer)?;
+        self.writer.write_all(&self.buffer)?;
+        Ok(())
+    }
+
+    /// Encode the next entry of a map.
+    pub fn push_entry<K, V>(&mut self, key: K, value: V) -> Result<(), EncodeError>
+    where
+        K: Encode,
+        V: Encode,
+    {
+        self.push(key)?;
+        self.push(value)
+    }
+
+    /// Encode a definite-length array of the given length, whose elements are encoded one by one
+    /// as they are produced by the given iterator. This avoids collecting the elements first.
+    ///
+    /// The iterator must produce exactly `len` elements, otherwise an
+    /// [`EncodeError::LengthMismatch`] is returned. In that case the array has already been
+    /// partially written. An iterator producing too many elements is only advanced once past the
+    /// expected length, and the extra element is not written.
+    pub fn encode_iter<I>(&mut self, len: usize, items: I) -> Result<(), EncodeError>
+    where
+        I: IntoIterator,
+        I::Item: Encode,
+    {
+        self.count_item();
+        self.buffer.clear();
+        writer::write_header(MajorType::Array, len as u64, &mut self.buffer);
+        self.writer.write_all(&self.buffer)?;
+
+        let mut items = items.into_iter();
+        for got in 0..len {
+            let item = items
+                .next()
+                .ok_or(EncodeError::LengthMismatch { expected: len, got })?;
+            self.buffer.clear();
+            encode_into(item, &mut self.buffer)?;
+            self.writer.write_all(&self.buffer)?;
+        }
+        if items.next().is_some() {
+            return Err(EncodeError::LengthMismatch {
+                expected: len,
+                got: len + 1,
+            });
+        }
+        Ok(())
+    }
+
+    /// Begin an indefinite-length array. Must be terminated by calling `end`.
+    pub fn begin_array(&mut self) -> Result<(), EncodeError> {
+        self.begin(4, Container::Array)
+    }
+
+    /// Begin an indefinite-length map. Must be terminated by calling `end`.
+    pub fn begin_map(&mut self) -> Result<(), EncodeError> {
+        self.begin(5, Container::Map { items: 0 })
+    }
+
+    /// End the innermost open indefinite-length container.
+    pub fn end(&mut self) -> Result<(), EncodeError> {
+        match self.containers.last() {
+            None => return Err(EncodeError::NoOpenContainer),
+            Some(Container::Map { items }) if items % 2 != 0 => {
+                return Err(EncodeError::IncompleteMapEntry)
+            }
+            Some(_) => {}
+        }
+        self.writer.write_all(&[Constants::BREAK])?;
+        self.containers.pop();
+        Ok(())
+    }
+
+    /// Return the underlying writer.
+    pub fn into_inner(self) -> W {
+        self.writer
+    }
+
+    fn begin(&mut self, major_type: u8, container: Container) -> Result<(), EncodeError> {
+        self.count_item();
+        self.writer
+            .write_all(&[(major_type << Constants::MAJOR_TYPE_BIT_SHIFT)
+                | Constants::ADDITIONAL_INFORMATION_INDEFINITE])?;
+        self.containers.push(container);
+        Ok(())
+    }
+
+    fn count_item(&mut self) {
+        if let Some(Container::Map { items }) = self.containers.last_mut() {
+            *items += 1;
+        }
+    }
+}
+
+/// Encode the given value as a single length-delimited frame: the length of its encoding (as a
+/// CBOR unsigned integer) followed by the encoding itself.
+///
+/// Unlike a plain CBOR sequence, this allows readers to find frame boundaries without parsing the
+/// items, see [`read_framed`].
+pub fn write_framed<W, T>(mut writer: W, value: T) -> Result<(), EncodeError>
+where
+    W: Write,
+    T: Encode,
+{
+    let mut data = Vec::new();
+    encode_into(value, &mut data)?;
+    let mut header = Vec::with_capacity(9);
+    writer::write_uint(data.len() as u64, &mut header);
+    writer.write_all(&header)?;
+    writer.write_all(&data)?;
+    Ok(())
+}
+
+/// Decode a single length-delimited frame written by [`write_framed`] into the given type.
+///
+/// This is the same as calling `read_framed_with` with canonical decoding enabled and a maximum
+/// frame size of [`DEFAULT_MAX_ITEM_SIZE`].
+pub fn read_framed<R, T>(reader: R) -> Result<T, DecodeError>
+where
+    R: Read,
+    T: Decode,
+{
+    read_framed_with(
+        reader,
+        &DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        },
+        DEFAULT_MAX_ITEM_SIZE,
+    )
+}
+
+/// Decode a single length-delimited frame written by [`write_framed`] into the given type using
+/// the given decoding options.
+///
+/// Frames larger than `max_frame_size` bytes are rejected with `DecodeError::ItemTooLarge` before
+/// their content is read, so at most that much is buffered. The content must be exactly one item,
+/// otherwise a `DecodeError::TrailingData` error is returned, or a `DecodeError::Malformed` one if
+/// the item extends past the end of the frame. Offsets reported in errors are
+/// relative to the start of the content. In case the reader reaches end of file before the frame
+/// is complete, a `DecodeError::Io` error with kind `UnexpectedEof` is returned.
+pub fn read_framed_with<R, T>(
+    mut reader: R,
+    options: &DecodeOptions,
+    max_frame_size: usize,
+) -> Result<T, DecodeError>
+where
+    R: Read,
+    T: Decode,
+{
+    let mut header = [0u8; 9];
+    reader.read_exact(&mut header[..1])?;
+    if MajorType::from_initial_byte(header[0]) != MajorType::Unsigned {
+        return Err(DecodeError::UnexpectedType);
+    }
+    let header_len = match header[0] & Constants::ADDITIONAL_INFORMATION_MASK {
+        Constants::ADDITIONAL_INFORMATION_1_BYTE => 2,
+        Constants::ADDITIONAL_INFORMATION_2_BYTES => 3,
+        Constants::ADDITIONAL_INFORMATION_4_BYTES => 5,
+        Constants::ADDITIONAL_INFORMATION_8_BYTES => 9,
+        // Either the length is inline or the header is malformed, which reading it reports.
+        _ => 1,
+    };
+    reader.read_exact(&mut header[1..header_len])?;
+    let frame_size =
+        u64::try_from_cbor_value(reader::read_with_options(&header[..header_len], options)?)?;
+    if frame_size > max_frame_size as u64 {
+        return Err(DecodeError::ItemTooLarge);
+    }
+
+    let mut data = vec![0u8; frame_size as usize];
+    reader.read_exact(&mut data)?;
+    // The frame is complete, so more data cannot complete an item truncated by it.
+    from_slice_with(&data, options).map_err(|e| match e {
+        DecodeError::UnexpectedEof { offset } => DecodeError::Malformed {
+            offset,
+            reason: "item extends past the end of its frame",
+        },
+        e => e,
+    })
+}
+
+#[cfg(test)]
+mod test {
+    use std::io::{self, Read};
+
+    use super::*;
+    use crate::Value;
+
+    /// Reader that returns at most one byte on each read.
+    struct ByteReader<'a>(&'a [u8]);
+
+    impl Read for ByteReader<'_> {
+        fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+            if self.0.is_empty() || buf.is_empty() {
+                return Ok(0);
+            }
+            buf[0] = self.0[0];
+            self.0 = &self.0[1..];
+            Ok(1)
+        }
+    }
+
+    #[test]
+    fn test_decode_sequence() {
+        let data = vec![
+            0x18, 0x2A, // unsigned(42)
+            0x82, 0x61, 0x61, 0x61, 0x62, // ["a", "b"]
+        ];
+        for reader in [
+            Box::new(ByteReader(&data)) as Box<dyn Read>,
+            Box::new(&data[..]) as Box<dyn Read>,
+        ] {
+            let mut decoder = Decoder::new(reader);
+            assert_eq!(decoder.decode::<u64>().unwrap(), 42);
+            assert_eq!(
+                decoder.decode::<Vec<String>>().unwrap(),
+                vec!["a".to_owned(), "b".to_owned()]
+            );
+            assert!(matches!(
+                decoder.decode::<u64>(),
+                Err(DecodeError::Io(e)) if e.kind() == io::ErrorKind::UnexpectedEof
+            ));
+        }
+    }
+
+    #[test]
+    fn test_decode_truncated() {
+        let data = vec![0x82, 0x01];
+        let mut decoder = Decoder::new(ByteReader(&data));
+        assert!(matches!(
+            decoder.decode::<Vec<u64>>(),
+            Err(DecodeError::Io(e)) if e.kind() == io::ErrorKind::UnexpectedEof
+        ));
+    }
+
+    #[test]
+    fn test_peek_and_skip() {
+        let data = vec![
+            0x82, 0x01, 0xA1, 0x61, 0x61, 0xC1, 0x02, // [1, {"a": 1(2)}]
+            0xBF, 0x61, 0x62, 0x9F, 0xF6, 0xFF, 0xFF, // {_ "b": [_ null]}
+            0x7F, 0x61, 0x63, 0xFF, // (_ "c")
+            0x18, 0x2A, // unsigned(42)
+        ];
+        let mut decoder = Decoder::with_options(ByteReader(&data), DecodeOptions::default());
+        assert_eq!(decoder.peek_type().unwrap(), MajorType::Array);
+        assert_eq!(decoder.peek_type().unwrap(), MajorType::Array);
+        decoder.skip_item().unwrap();
+        assert_eq!(decoder.peek_type().unwrap(), MajorType::Map);
+        decoder.skip_item().unwrap();
+        assert_eq!(decoder.peek_type().unwrap(), MajorType::TextString);
+        decoder.skip_item().unwrap();
+        assert_eq!(decoder.peek_type().unwrap(), MajorType::Unsigned);
+        assert_eq!(decoder.decode::<u64>().unwrap(), 42);
+        assert!(matches!(
+            decoder.peek_type(),
+            Err(DecodeError::Io(e)) if e.kind() == io::ErrorKind::UnexpectedEof
+        ));
+        assert!(matches!(
+            decoder.skip_item(),
+            Err(DecodeError::Io(e)) if e.kind() == io::ErrorKind::UnexpectedEof
+        ));
+
+        // Indefinite-length items are rejected when decoding canonically.
+        let mut decoder = Decoder::new(&data[7..]);
+        assert_eq!(decoder.peek_type().unwrap(), MajorType::Map);
+        assert!(matches!(
+            decoder.skip_item(),
+            Err(DecodeError::NonCanonical { offset: 0 })
+        ));
+    }
+
+    #[test]
+    fn test_decode_position() {
+        let data = vec![
+            0x82, 0x01, 0xA1, 0x61, 0x61, 0xC1, 0x02, // [1, {"a": 1(2)}]
+            0xBF, 0x61, 0x62, 0x9F, 0xF6, 0xFF, 0xFF, // {_ "b": [_ null]}
+            0x7F, 0x61, 0x63, 0xFF, // (_ "c")
+            0x18, 0x2A, // unsigned(42)
+            0x00, 0x00, 0x01, // non-CBOR trailer
+        ];
+        for reader in [
+            Box::new(ByteReader(&data)) as Box<dyn Read>,
+            Box::new(&data[..]) as Box<dyn Read>,
+        ] {
+            let mut decoder = Decoder::with_options(reader, DecodeOptions::default());
+            assert_eq!(decoder.position(), 0);
+            decoder.peek_type().unwrap();
+            assert_eq!(decoder.position(), 0, "peeking should not consume");
+            decoder.decode::<Value>().unwrap();
+            assert_eq!(decoder.position(), 7);
+            decoder.skip_item().unwrap();
+            assert_eq!(decoder.position(), 14);
+            // Converting into the wrong type still consumes the item.
+            assert!(decoder.decode::<u64>().is_err());
+            assert_eq!(decoder.position(), 18);
+            assert_eq!(decoder.decode::<u64>().unwrap(), 42);
+            assert_eq!(decoder.position(), 20);
+            assert_eq!(&data[decoder.position()..], &[0x00, 0x00, 0x01]);
+        }
+
+        // Decoding from a slice consumes the same amount for canonical items.
+        let (_, remaining) = crate::from_slice_prefix::<Value>(&data).unwrap();
+        assert_eq!(data.len() - remaining.len(), 7);
+        let (_, remaining) = crate::from_slice_prefix::<u64>(&data[18..]).unwrap();
+        assert_eq!(remaining, &[0x00, 0x00, 0x01]);
+
+        // Incomplete items do not advance the position.
+        let mut decoder = Decoder::new(ByteReader(&data[..5]));
+        assert!(matches!(
+            decoder.decode::<Value>(),
+            Err(DecodeError::Io(e)) if e.kind() == io::ErrorKind::UnexpectedEof
+        ));
+        assert_eq!(decoder.position(), 0);
+    }
+
+    #[test]
+    fn test_encode_indefinite_length() {
+        let mut encoder = Encoder::new(Vec::new());
+        encoder.begin_array().unwrap();
+        encoder.push(1u64).unwrap();
+        encoder.begin_map().unwrap();
+        encoder.push_entry("a", vec![2u64]).unwrap();
+        encoder.push("b").unwrap();
+        encoder.begin_array().unwrap();
+        encoder.end().unwrap();
+        encoder.end().unwrap();
+        encoder.end().unwrap();
+        encoder.push(3u64).unwrap();
+        let data = encoder.into_inner();
+        assert_eq!(
+            data,
+            vec![
+                0x9F, // array(*)
+                0x01, // unsigned(1)
+                0xBF, // map(*)
+                0x61, 0x61, // "a"
+                0x81, 0x02, // [2]
+                0x61, 0x62, // "b"
+                0x9F, // array(*)
+                0xFF, // break
+                0xFF, // break
+                0xFF, // break
+                0x03, // unsigned(3)
+            ]
+        );
+
+        let mut decoder = Decoder::with_options(&data[..], DecodeOptions::default());
+        let value = decoder.decode::<Value>().unwrap();
+        assert_eq!(
+            value,
+            Value::Array(vec![
+                Value::Unsigned(1),
+                Value::Map(vec![
+                    ("a".into(), Value::Array(vec![Value::Unsigned(2)])),
+                    ("b".into(), Value::Array(vec![])),
+                ]),
+            ])
+        );
+        assert_eq!(decoder.decode::<u64>().unwrap(), 3);
+
+        // Indefinite-length items are rejected when decoding canonically.
+        assert!(matches!(
+            Decoder::new(&data[..]).decode::<Value>(),
+            Err(DecodeError::NonCanonical { offset: 0 })
+        ));
+    }
+
+    #[test]
+    fn test_encode_indefinite_length_errors() {
+        let mut encoder = Encoder::new(Vec::new());
+        assert!(matches!(encoder.end(), Err(EncodeError::NoOpenContainer)));
+
+        encoder.begin_map().unwrap();
+        encoder.push("a").unwrap();
+        assert!(matches!(
+            encoder.end(),
+            Err(EncodeError::IncompleteMapEntry)
+        ));
+        encoder.push(1u64).unwrap();
+        encoder.end().unwrap();
+        assert!(matches!(encoder.end(), Err(EncodeError::NoOpenContainer)));
+    }
+
+    #[test]
+    fn test_encode_into_buffer() {
+        let mut data = vec![0xFF];
+        let mut encoder = Encoder::new(&mut data);
+        encoder.push(1u64).unwrap();
+        encoder.push(vec!["a"]).unwrap();
+        encoder.push(1000u64).unwrap();
+        drop(encoder);
+        assert_eq!(
+            data,
+            vec![
+                0xFF, // existing data
+                0x01, // unsigned(1)
+                0x81, 0x61, 0x61, // ["a"]
+                0x19, 0x03, 0xE8, // unsigned(1000)
+            ]
+        );
+    }
+
+    #[test]
+    fn test_encode_iter() {
+        let mut encoder = Encoder::new(Vec::new());
+        encoder.encode_iter(1000, 0..1000u64).unwrap();
+        encoder.begin_map().unwrap();
+        encoder.push("a").unwrap();
+        encoder.encode_iter(2, ["b", "c"]).unwrap();
+        encoder.end().unwrap();
+        let data = encoder.into_inner();
+        let expected = crate::to_vec((0..1000u64).collect::<Vec<_>>());
+        assert_eq!(data[..expected.len()], expected);
+        assert_eq!(
+            data[expected.len()..],
+            [
+                0xBF, // map(*)
+                0x61, 0x61, // "a"
+                0x82, 0x61, 0x62, 0x61, 0x63, // ["b", "c"]
+                0xFF, // break
+            ]
+        );
+
+        let mut decoder = Decoder::new(&data[..]);
+        let dec: Vec<u64> = decoder.decode().unwrap();
+        assert_eq!(dec, (0..1000).collect::<Vec<_>>());
+
+        // The iterator must produce exactly the given number of elements.
+        let mut encoder = Encoder::new(Vec::new());
+        assert!(matches!(
+            encoder.encode_iter(3, [1u64, 2]),
+            Err(EncodeError::LengthMismatch {
+                expected: 3,
+                got: 2
+            })
+        ));
+        assert_eq!(encoder.into_inner(), vec![0x83, 0x01, 0x02]);
+
+        let mut encoder = Encoder::new(Vec::new());
+        assert!(matches!(
+            encoder.encode_iter(1, 1u64..),
+            Err(EncodeError::LengthMismatch {
+                expected: 1,
+                got: 2
+            })
+        ));
+        assert_eq!(encoder.into_inner(), vec![0x81, 0x01]);
+    }
+
+    #[test]
+    fn test_decode_max_item_size() {
+        // Byte string with a huge declared length, followed by an endless stream of data.
+        let header = vec![0x5B, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00];
+        let mut decoder =
+            Decoder::new((&header[..]).chain(io::repeat(0))).with_max_item_size(1 << 20);
+        assert!(matches!(
+            decoder.decode::<Vec<u8>>(),
+            Err(DecodeError::ItemTooLarge)
+        ));
+
+        // Items that fit within the limit can still be decoded.
+        let data = [0x43, 0x01, 0x02, 0x03];
+        let mut decoder = Decoder::new(&data[..]).with_max_item_size(4);
+        assert_eq!(decoder.decode::<Vec<u8>>().unwrap(), vec![0x01, 0x02, 0x03]);
+    }
+
+    #[test]
+    fn test_framed() {
+        let mut data = Vec::new();
+        write_framed(&mut data, 42u64).unwrap();
+        write_framed(&mut data, vec!["a"; 30]).unwrap();
+        write_framed(&mut data, ()).unwrap();
+        assert_eq!(&data[..3], &[0x02, 0x18, 0x2A]); // 2, unsigned(42)
+        assert_eq!(&data[3..7], &[0x18, 0x3E, 0x98, 0x1E]); // 62, array(30)
+        assert_eq!(data.len(), 3 + 64 + 2);
+
+        let mut reader = ByteReader(&data);
+        assert_eq!(read_framed::<_, u64>(&mut reader).unwrap(), 42);
+        assert_eq!(
+            read_framed::<_, Vec<String>>(&mut reader).unwrap(),
+            vec!["a".to_owned(); 30]
+        );
+        read_framed::<_, ()>(&mut reader).unwrap();
+        assert!(matches!(
+            read_framed::<_, u64>(&mut reader),
+            Err(DecodeError::Io(e)) if e.kind() == io::ErrorKind::UnexpectedEof
+        ));
+    }
+
+    #[test]
+    fn test_framed_errors() {
+        let options = DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        };
+        let cases = vec![
+            // The length prefix must be an unsigned integer.
+            (vec![0x41, 0x00], "unexpected type"),
+            (
+                vec![0x1C],
+                "malformed item at offset 0: unknown additional information",
+            ),
+            // Non-minimal length prefixes are not canonical.
+            (vec![0x18, 0x01, 0x00], "non-canonical encoding at offset 0"),
+            // Frames larger than the maximum are rejected before reading their content.
+            (
+                vec![0x1B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF],
+                "item too large",
+            ),
+            (vec![0x05, 0x44, 0x01, 0x02, 0x03, 0x04], "item too large"),
+            // The content must be exactly one item.
+            (vec![0x02, 0x01, 0x02], "trailing data at offset 1"),
+            (
+                vec![0x02, 0x82, 0x01],
+                "malformed item at offset 2: item extends past the end of its frame",
+            ),
+        ];
+        for (data, expected) in cases {
+            let err = read_framed_with::<_, Value>(ByteReader(&data), &options, 4).unwrap_err();
+            assert_eq!(err.to_string(), expected, "data: {:02x?}", data);
+        }
+
+        // Truncated prefix and content.
+        for data in [vec![0x19, 0x01], vec![0x03, 0x82, 0x01]] {
+            assert!(matches!(
+                read_framed_with::<_, Value>(ByteReader(&data), &options, 4),
+                Err(DecodeError::Io(e)) if e.kind() == io::ErrorKind::UnexpectedEof
+            ));
+        }
+
+        // Frames that fit within the limit can still be decoded.
+        let data = [0x04, 0x43, 0x01, 0x02, 0x03];
+        let value: Vec<u8> = read_framed_with(&data[..], &options, 4).unwrap();
+        assert_eq!(value, vec![0x01, 0x02, 0x03]);
+    }
+}
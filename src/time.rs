@@ -0,0 +1,47 @@
+//! Explicit encodings of [`SystemTime`](std::time::SystemTime).
+//!
+//! A `SystemTime` encodes as a number of seconds since the Unix epoch (tag 1) by default, which
+//! is an integer for times at the start of a second and a float otherwise. The [`epoch_float`]
+//! helpers produce the same encoding, for stating it explicitly via `#[cbor(with = "...")]`:
+//!
+//! ```
+//! # // Derived code refers to the crate root, which may be this doctest.
+//! # pub use oasis_cbor::*;
+//! #
+//! use std::time::{Duration, SystemTime, UNIX_EPOCH};
+//!
+//! #[derive(Debug, PartialEq, oasis_cbor::Encode, oasis_cbor::Decode)]
+//! #[cbor(no_default)]
+//! struct Event {
+//!     #[cbor(with = "oasis_cbor::time::epoch_float")]
+//!     at: SystemTime,
+//! }
+//!
+//! # fn main() {
+//! let event = Event {
+//!     at: UNIX_EPOCH + Duration::from_millis(1500),
+//! };
+//! let enc = oasis_cbor::to_vec(event);
+//! let dec: Event = oasis_cbor::from_slice(&enc).unwrap();
+//! assert_eq!(dec.at, UNIX_EPOCH + Duration::from_millis(1500));
+//! # }
+//! ```
+/// Encoding of a `SystemTime` as a number of seconds since the Unix epoch (tag 1) which is a
+/// float when the time is not at the start of a second.
+///
+/// Note that a double precision float only represents recent times to about a microsecond.
+pub mod epoch_float {
+    use std::time::SystemTime;
+
+    use crate::{Decode, DecodeError, Encode, Value};
+
+    /// Encode the given time, the same as its default encoding.
+    pub fn encode(time: &SystemTime) -> Value {
+        time.to_cbor_value()
+    }
+
+    /// Decode a time, accepting any encoding that `SystemTime` decodes from.
+    pub fn decode(value: Value) -> Result<SystemTime, DecodeError> {
+        SystemTime::try_from_cbor_value(value)
+    }
+}
@@ -1,6 +1,9 @@
 extern crate alloc;
 
-use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
+use std::{
+    borrow::Cow,
+    collections::{BTreeMap, BTreeSet, HashMap, HashSet},
+};
 
 use oasis_cbor as cbor;
 
@@ -46,6 +49,15 @@ impl Default for C {
     }
 }
 
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+enum SignedDiscriminant {
+    MinusOne = -1,
+    One = 1,
+    // Encoded as its key, which must not collide with the discriminants.
+    #[cbor(key = 2)]
+    Other,
+}
+
 #[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
 enum D {
     One,
@@ -86,12 +98,40 @@ struct WithOptional {
 #[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
 struct Unit;
 
-#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode)]
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
 #[cbor(untagged)]
 enum Untagged {
     First { a: u64, b: u64 },
 }
 
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(untagged)]
+enum UntaggedUnion {
+    Nothing,
+    Small(u8),
+    Large(u64),
+    Text(String),
+    Pair(u64, String),
+    // Missing fields decode as null, so the variant with fewer fields must come first.
+    Single { a: u64 },
+    Object { a: u64, b: u64 },
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(untagged)]
+enum UntaggedNested {
+    Leaf(u64),
+    // Both variants decode the inner value before reaching their distinguishing key.
+    Left {
+        inner: Box<UntaggedNested>,
+        left: bool,
+    },
+    Right {
+        inner: Box<UntaggedNested>,
+        right: bool,
+    },
+}
+
 #[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
 #[cbor(as_array)]
 struct AsArray {
@@ -99,6 +139,32 @@ struct AsArray {
     bytes: Vec<u8>,
 }
 
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(as_array)]
+struct AsArrayWithTail {
+    foo: u64,
+    #[cbor(default)]
+    bar: u64,
+    #[cbor(optional)]
+    baz: Option<u64>,
+    #[cbor(skip_serializing_if_default)]
+    qux: String,
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+enum VariantWithTail {
+    Tuple(u64, #[cbor(optional)] Option<u64>),
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(accept_array_or_map)]
+struct ArrayOrMap {
+    foo: u64,
+    bytes: Vec<u8>,
+    #[cbor(optional)]
+    baz: Option<u64>,
+}
+
 #[derive(Debug, Default, Clone, Eq, PartialEq)] // No cbor::{Encode, Decode}!
 struct CustomType(String);
 
@@ -121,6 +187,26 @@ struct CustomEncodeDecode {
     foo: CustomType,
 }
 
+mod custom_type_as_bytes {
+    use super::*;
+
+    pub fn encode(value: &CustomType) -> Vec<u8> {
+        value.0.as_bytes().to_vec()
+    }
+
+    pub fn decode(value: Vec<u8>) -> Result<CustomType, cbor::DecodeError> {
+        String::from_utf8(value)
+            .map(CustomType)
+            .map_err(|_| cbor::DecodeError::UnexpectedType)
+    }
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct CustomEncodeDecodeWith {
+    #[cbor(with = "custom_type_as_bytes")]
+    foo: CustomType,
+}
+
 #[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
 #[cbor(as_array)]
 struct CustomEncodeDecodeArray {
@@ -183,6 +269,23 @@ enum SkipVariantsAndFields {
     Second { a: u64 },
 }
 
+#[derive(Debug, Clone, Eq, PartialEq)]
+struct Checksum(u32);
+
+fn unknown_checksum() -> Checksum {
+    Checksum(u32::MAX)
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(no_default)]
+struct SkipCachedFields {
+    data: Vec<u8>,
+    #[cbor(skip)]
+    len: usize,
+    #[cbor(skip, default = "unknown_checksum")]
+    checksum: Checksum,
+}
+
 #[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
 enum UnitEnumVariantAsStruct {
     #[cbor(rename = "one", as_struct)]
@@ -191,6 +294,21 @@ enum UnitEnumVariantAsStruct {
     Two {},
 }
 
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(rename_all = "snake_case")]
+enum UnitOnlyAction {
+    Instantiate,
+    Upgrade,
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(rename_all = "snake_case")]
+enum MixedAction {
+    Instantiate,
+    Call { method: String },
+    Upgrade(u64),
+}
+
 #[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
 enum EmbedParent {
     A(String),
@@ -233,6 +351,214 @@ enum InternallyTaggedNoMissing {
     V2(Order),
 }
 
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+enum VersionedNew {
+    A,
+    B(u64),
+    C { x: u64 },
+    D,
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+enum VersionedOld {
+    A,
+    B(u64),
+    #[cbor(unknown)]
+    Unknown(cbor::Value),
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+enum VersionedOldUnit {
+    A,
+    B(u64),
+    #[cbor(unknown)]
+    Unknown,
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Decode, cbor::Encode)]
+#[cbor(tag = "v")]
+enum VersionedInternallyTagged {
+    #[cbor(rename = 1)]
+    V1 { bar: u64 },
+
+    #[cbor(unknown)]
+    Unknown(cbor::Value),
+}
+
+#[derive(Debug, Clone, Copy, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(repr = "int")]
+enum Status {
+    Pending,
+    Active,
+    #[cbor(key = 30)]
+    Failed,
+    Retired,
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(repr = "int")]
+enum StatusWithUnknown {
+    Pending,
+    #[cbor(unknown)]
+    Unknown(cbor::Value),
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(semantic_tag = 1234)]
+struct SemanticallyTagged {
+    foo: u64,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(transparent, semantic_tag = 42)]
+struct SemanticallyTaggedNewtype(Vec<u8>);
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(transparent)]
+struct TransparentCustom(
+    #[cbor(
+        serialize_with = "CustomType::as_str",
+        deserialize_with = "decode_custom_type"
+    )]
+    CustomType,
+);
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(transparent, semantic_tag = 42)]
+struct SemanticallyTaggedCustomNewtype(#[cbor(with = "custom_type_as_bytes")] CustomType);
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(transparent, semantic_tag = 7)]
+struct NestedSemanticallyTaggedNewtype(SemanticallyTaggedCustomNewtype);
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(rename_all = "camelCase")]
+struct RenameAll {
+    first_field: u64,
+    #[cbor(rename = "explicit")]
+    second_field: u64,
+    third: u64,
+}
+
+#[derive(Debug, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(rename_all = "kebab-case")]
+enum RenameAllEnum {
+    FirstVariant,
+    SecondVariant { inner_field: u64 },
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct IntegerKeys {
+    #[cbor(key = 24)]
+    version: u64,
+    #[cbor(key = 1)]
+    body: String,
+    #[cbor(key = 0)]
+    kind: u64,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(allow_mixed_keys)]
+struct MixedKeys {
+    #[cbor(key = 1)]
+    id: u64,
+    name: String,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct EmbedHeader {
+    version: u16,
+    #[cbor(optional)]
+    nonce: u64,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct EmbedMessage {
+    #[cbor(embed)]
+    header: EmbedHeader,
+    body: String,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct EmbedCollision {
+    #[cbor(embed)]
+    header: EmbedHeader,
+    version: u16,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct WithRest {
+    id: u64,
+    #[cbor(optional)]
+    name: String,
+    #[cbor(flatten_rest)]
+    rest: BTreeMap<cbor::Value, cbor::Value>,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(no_default)]
+struct NoTryDefault {
+    foo: u64,
+}
+
+fn default_count() -> u64 {
+    10
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct WithDefaults {
+    #[cbor(default)]
+    inner: NoTryDefault,
+    #[cbor(default = "default_count")]
+    count: u64,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct SkipIfDefault {
+    id: u64,
+    #[cbor(skip_serializing_if_default)]
+    items: Vec<u64>,
+    #[cbor(skip_serializing_if_default)]
+    inner: NoTryDefault,
+    #[cbor(skip_serializing_if = "Option::is_none")]
+    note: Option<String>,
+}
+
+#[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+struct WithOptionalPresence {
+    #[cbor(optional)]
+    count: Option<u64>,
+    #[cbor(optional)]
+    value: Option<cbor::Value>,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode)]
+struct OwnedMessage {
+    name: String,
+    data: Vec<u8>,
+    #[cbor(optional)]
+    count: u64,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Decode)]
+struct BorrowedMessage<'a> {
+    name: &'a str,
+    data: &'a [u8],
+    #[cbor(optional)]
+    count: u64,
+}
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Decode)]
+struct BorrowedTuple<'a, 'b>(&'a str, BorrowedMessage<'b>);
+
+#[derive(Debug, Default, Clone, Eq, PartialEq, cbor::Encode, cbor::Decode)]
+struct CowMessage<'a> {
+    name: Cow<'a, str>,
+    data: Cow<'a, [u8]>,
+    #[cbor(optional)]
+    count: u64,
+}
+
 #[test]
 fn test_round_trip_complex() {
     let a = A {
@@ -312,6 +638,22 @@ fn test_enum_unit_discriminant() {
     }
 }
 
+#[test]
+fn test_enum_signed_discriminant() {
+    let tcs = vec![
+        (SignedDiscriminant::MinusOne, vec![0x20]),
+        (SignedDiscriminant::One, vec![0x01]),
+        (SignedDiscriminant::Other, vec![0x02]),
+    ];
+    for tc in tcs {
+        let enc = cbor::to_vec(tc.0.clone());
+        assert_eq!(enc, tc.1);
+        let dec: SignedDiscriminant =
+            cbor::from_slice(&enc).expect("serialization should round-trip");
+        assert_eq!(dec, tc.0, "serialization should round-trip");
+    }
+}
+
 #[test]
 fn test_enum() {
     let tcs = vec![
@@ -452,6 +794,137 @@ fn test_missing_field() {
     )
 }
 
+/// Replace the value under the given path of string keys in a CBOR map.
+fn replace_cbor_value(value: &mut cbor::Value, path: &[&str], replacement: cbor::Value) {
+    match (value, path) {
+        (value, []) => *value = replacement,
+        (cbor::Value::Map(map), [key, rest @ ..]) => {
+            let (_, value) = map
+                .iter_mut()
+                .find(|(k, _)| *k == cbor::Value::TextString(key.to_string()))
+                .unwrap();
+            replace_cbor_value(value, rest, replacement)
+        }
+        _ => panic!("path does not exist"),
+    }
+}
+
+#[test]
+fn test_error_path() {
+    // Nested fields.
+    let mut value = cbor::to_value(A::default());
+    replace_cbor_value(&mut value, &["nested", "foo"], "x".into());
+    let err = cbor::from_value::<A>(value).unwrap_err();
+    assert!(matches!(
+        err.root_cause(),
+        cbor::DecodeError::UnexpectedType
+    ));
+    assert!(matches!(err, cbor::DecodeError::InField { ref path, .. } if path == "nested.foo"));
+    assert_eq!(err.to_string(), "nested.foo: unexpected type");
+    assert_eq!(err.offset(), None);
+
+    // Renamed fields use their key.
+    let mut value = cbor::to_value(A::default());
+    replace_cbor_value(&mut value, &["different"], 1u64.into());
+    let err = cbor::from_value::<A>(value).unwrap_err();
+    assert_eq!(err.to_string(), "different: unexpected type");
+
+    // Enum variants.
+    let mut value = cbor::to_value(D::Four {
+        foo: 1,
+        bar: "bar".to_owned(),
+        nested: B::default(),
+    });
+    replace_cbor_value(&mut value, &["four", "nested", "bytes"], 1u64.into());
+    let err = cbor::from_value::<D>(value).unwrap_err();
+    assert_eq!(err.to_string(), "four.nested.bytes: unexpected type");
+
+    let mut value = cbor::to_value(D::Two(1));
+    replace_cbor_value(&mut value, &["Two"], "x".into());
+    let err = cbor::from_value::<D>(value).unwrap_err();
+    assert_eq!(err.to_string(), "Two: unexpected type");
+
+    // Fields represented as an array use their index.
+    let err = cbor::from_slice::<E>(&cbor::to_vec((1u64, "foo"))).unwrap_err();
+    assert!(matches!(err.root_cause(), cbor::DecodeError::MissingField));
+    assert_eq!(err.to_string(), "2: missing field");
+
+    // Errors encountered while parsing carry the offset of the failing item.
+    let enc = vec![
+        // {"foo": 1 (truncated)
+        0xA1, // map(1)
+        0x63, // text(3)
+        0x66, 0x6F, 0x6F, // "foo"
+        0x19, 0x01, // unsigned(?)
+    ];
+    let err = cbor::from_slice::<A>(&enc).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::UnexpectedEof { offset: 5 }
+    ));
+    assert_eq!(
+        err.to_string(),
+        "unexpected end of input in item at offset 5"
+    );
+    assert_eq!(err.offset(), Some(5));
+}
+
+#[test]
+fn test_truncated_input() {
+    #[derive(Debug, Clone, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    struct Message {
+        nonce: u64,
+        sender: String,
+        payload: Vec<u8>,
+        tags: Vec<String>,
+    }
+
+    let msg = Message {
+        nonce: 1000,
+        sender: "alice".to_string(),
+        payload: vec![1, 2, 3],
+        tags: vec!["a".to_string(), "bc".to_string()],
+    };
+    let enc = cbor::to_vec(msg.clone());
+    let dec: Message = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, msg);
+
+    // Any proper prefix (including the empty one) is missing data, which may still arrive.
+    for len in 0..enc.len() {
+        let err = cbor::from_slice::<Message>(&enc[..len]).unwrap_err();
+        assert!(
+            matches!(err, cbor::DecodeError::UnexpectedEof { offset } if offset <= len),
+            "prefix of length {}: {:?}",
+            len,
+            err
+        );
+        assert!(matches!(
+            cbor::from_slice_prefix::<Message>(&enc[..len]),
+            Err(cbor::DecodeError::UnexpectedEof { .. })
+        ));
+    }
+
+    // Data which is not well-formed is malformed instead, no matter how much of it there is.
+    let mut garbage = enc.clone();
+    garbage[0] = 0xBC; // map with reserved additional information
+    for len in 1..=garbage.len() {
+        let err = cbor::from_slice::<Message>(&garbage[..len]).unwrap_err();
+        assert!(matches!(
+            err,
+            cbor::DecodeError::Malformed {
+                offset: 0,
+                reason: "unknown additional information"
+            }
+        ));
+        assert_eq!(err.offset(), Some(0));
+    }
+    let err = cbor::from_slice::<Message>(&garbage).unwrap_err();
+    assert_eq!(
+        err.to_string(),
+        "malformed item at offset 0: unknown additional information"
+    );
+}
+
 #[test]
 fn test_invalid_type() {
     let b_invalid_type = vec![
@@ -462,8 +935,12 @@ fn test_invalid_type() {
         0x64, // text(4)
         0x62, 0x6F, 0x6F, 0x6D, // "boom"
     ];
-    let res: Result<B, _> = cbor::from_slice(&b_invalid_type);
-    assert!(matches!(res, Err(cbor::DecodeError::UnexpectedType)));
+    let err = cbor::from_slice::<B>(&b_invalid_type).unwrap_err();
+    assert!(matches!(
+        err.root_cause(),
+        cbor::DecodeError::UnexpectedType
+    ));
+    assert_eq!(err.to_string(), "foo: unexpected type");
 }
 
 #[test]
@@ -480,7 +957,10 @@ fn test_field_reorder() {
         0x18, 0x2A, // unsigned(42)
     ];
     let res: Result<B, _> = cbor::from_slice(&b_reorder);
-    assert!(matches!(res, Err(cbor::DecodeError::ParsingFailed)));
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::NonCanonical { offset: 9 })
+    ));
 
     // Should work fine in non-strict mode.
     let res: B = cbor::from_slice_non_strict(&b_reorder).unwrap();
@@ -494,49 +974,249 @@ fn test_field_reorder() {
 }
 
 #[test]
-fn test_extra_fields() {
-    // Extra field at the end.
-    let b_extra = vec![
-        // {"foo": 10, "bytes": h'00', "bytesextra": true}
-        0xA3, // map(3)
+fn test_canonical_decoding() {
+    let b_non_minimal = vec![
+        // {"foo": 10, "bytes": h'01'}
+        0xA2, // map(2)
         0x63, // text(3)
         0x66, 0x6F, 0x6F, // "foo"
-        0x0A, // unsigned(10)
+        0x1B, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0A, // unsigned(10) using 8 bytes
         0x65, // text(5)
         0x62, 0x79, 0x74, 0x65, 0x73, // "bytes"
         0x41, // bytes(1)
-        0x00, // "\x00"
-        0x6A, // text(10)
-        0x62, 0x79, 0x74, 0x65, 0x73, 0x65, 0x78, 0x74, 0x72, 0x61, // "bytesextra"
-        0xF5, // primitive(21)
+        0x01, // "\x01"
     ];
-    let res: Result<B, _> = cbor::from_slice(&b_extra);
-    assert!(matches!(res, Err(cbor::DecodeError::UnknownField)));
+    let res: Result<B, _> = cbor::from_slice_with(
+        &b_non_minimal,
+        &cbor::DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        },
+    );
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::NonCanonical { offset: 5 })
+    ));
 
-    // Extra field in the middle.
-    let b_extra = vec![
-        // {"foo": 10, "fop": 10, "bytes": h'00'}
-        0xA3, // map(3)
-        0x63, // text(3)
-        0x66, 0x6F, 0x6F, // "foo"
-        0x0A, // unsigned(10)
-        0x63, // text(3)
-        0x66, 0x6F, 0x70, // "fop"
-        0x0A, // unsigned(10)
-        0x65, // text(5)
-        0x62, 0x79, 0x74, 0x65, 0x73, // "bytes"
-        0x41, // bytes(1)
-        0x00, // "\x00"
+    // Should work fine when canonical decoding is not required.
+    let res: B = cbor::from_slice_with(&b_non_minimal, &cbor::DecodeOptions::default()).unwrap();
+    assert_eq!(
+        res,
+        B {
+            foo: 10,
+            bytes: vec![0x01]
+        }
+    );
+}
+
+#[test]
+fn test_chunked_strings() {
+    let enc = vec![
+        // (_ h'01', h'0203')
+        0x5F, // bytes(*)
+        0x41, 0x01, // h'01'
+        0x42, 0x02, 0x03, // h'0203'
+        0xFF, // break
     ];
-    let res: Result<B, _> = cbor::from_slice(&b_extra);
-    assert!(matches!(res, Err(cbor::DecodeError::UnknownField)));
+    let dec: Vec<u8> = cbor::from_slice_non_strict(&enc).unwrap();
+    assert_eq!(dec, vec![0x01, 0x02, 0x03]);
+    let res = cbor::from_slice::<Vec<u8>>(&enc);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::NonCanonical { offset: 0 })
+    ));
 
-    // Extra field at the start.
-    let b_extra = vec![
-        // {"fon": 10, "foo": 10, "bytes": h'00'}
-        0xA3, // map(3)
-        0x63, // text(3)
-        0x66, 0x6F, 0x6E, // "fon"
+    let enc = vec![
+        // (_ "a", "bc")
+        0x7F, // text(*)
+        0x61, 0x61, // "a"
+        0x62, 0x62, 0x63, // "bc"
+        0xFF, // break
+    ];
+    let dec: String = cbor::from_slice_non_strict(&enc).unwrap();
+    assert_eq!(dec, "abc");
+}
+
+#[test]
+fn test_trailing_data() {
+    let data = vec![
+        0x18, 0x2A, // unsigned(42)
+        0x61, 0x61, // "a"
+    ];
+    let res: Result<u64, _> = cbor::from_slice(&data);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::TrailingData { offset: 2 })
+    ));
+    let res: Result<u64, _> = cbor::from_slice_non_strict(&data);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::TrailingData { offset: 2 })
+    ));
+
+    // Concatenated items can be decoded one by one.
+    let (first, remaining): (u64, _) = cbor::from_slice_prefix(&data).unwrap();
+    assert_eq!(first, 42);
+    assert_eq!(remaining, &[0x61, 0x61]);
+    let (second, remaining): (String, _) = cbor::from_slice_prefix(remaining).unwrap();
+    assert_eq!(second, "a");
+    assert!(remaining.is_empty());
+}
+
+#[test]
+fn test_depth_limit() {
+    // [[...[0]...]] nested 100 levels deep.
+    let mut data = vec![0x81; 100];
+    data.push(0x00);
+    let res: Result<cbor::Value, _> = cbor::from_slice(&data);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::DepthLimitExceeded { offset: 65 })
+    ));
+
+    let res: Result<cbor::Value, _> = cbor::from_slice_with(
+        &data,
+        &cbor::DecodeOptions {
+            max_depth: Some(100),
+            ..Default::default()
+        },
+    );
+    assert!(res.is_ok());
+}
+
+#[test]
+fn test_duplicate_map_keys() {
+    let b_duplicate = vec![
+        // {"foo": 10, "bytes": h'01', "foo": 11}
+        0xA3, // map(3)
+        0x63, // text(3)
+        0x66, 0x6F, 0x6F, // "foo"
+        0x0A, // unsigned(10)
+        0x65, // text(5)
+        0x62, 0x79, 0x74, 0x65, 0x73, // "bytes"
+        0x41, // bytes(1)
+        0x01, // "\x01"
+        0x63, // text(3)
+        0x66, 0x6F, 0x6F, // "foo"
+        0x0B, // unsigned(11)
+    ];
+    let options = cbor::DecodeOptions {
+        reject_duplicate_keys: true,
+        ..Default::default()
+    };
+    let res: Result<B, _> = cbor::from_slice_with(&b_duplicate, &options);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::DuplicateMapKey { offset: 14 })
+    ));
+    let res: Result<cbor::Value, _> = cbor::from_slice_with(&b_duplicate, &options);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::DuplicateMapKey { offset: 14 })
+    ));
+
+    let m_duplicate = vec![
+        // {1: 1, 1: 2}
+        0xA2, // map(2)
+        0x01, 0x01, // 1: 1
+        0x01, 0x02, // 1: 2
+    ];
+    let res: Result<BTreeMap<u64, u64>, _> = cbor::from_slice_with(&m_duplicate, &options);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::DuplicateMapKey { offset: 3 })
+    ));
+}
+
+#[test]
+fn test_float() {
+    let value = cbor::Value::Float(-1.5);
+    let enc = cbor::to_vec(value.clone());
+    assert_eq!(
+        enc,
+        vec![0xFB, 0xBF, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00] // float(-1.5)
+    );
+    let dec: cbor::Value = cbor::from_slice_non_strict(&enc).unwrap();
+    assert_eq!(dec, value);
+    let dec: f64 = cbor::from_slice_non_strict(&enc).unwrap();
+    assert_eq!(dec, -1.5);
+
+    // Half precision floats are widened.
+    let half = vec![0xF9, 0x3E, 0x00]; // float(1.5)
+    let dec: f64 = cbor::from_slice_non_strict(&half).unwrap();
+    assert_eq!(dec, 1.5);
+    let dec: f32 = cbor::from_slice_non_strict(&half).unwrap();
+    assert_eq!(dec, 1.5);
+
+    // Narrowing that would lose precision is rejected.
+    let enc = cbor::to_vec(1.1f64);
+    let res: Result<f32, _> = cbor::from_slice_non_strict(&enc);
+    assert!(matches!(res, Err(cbor::DecodeError::UnexpectedType)));
+
+    // Encoded floats round-trip in canonical mode, where only double precision is accepted.
+    let dec: f64 = cbor::from_slice(&cbor::to_vec(1.5f64)).unwrap();
+    assert_eq!(dec, 1.5);
+    let dec: f32 = cbor::from_slice(&cbor::to_vec(-0.1f32)).unwrap();
+    assert_eq!(dec, -0.1);
+    let dec: f64 = cbor::from_slice(&cbor::to_vec(f64::NAN)).unwrap();
+    assert!(dec.is_nan());
+    let res: Result<f64, _> = cbor::from_slice(&half);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::NonCanonical { offset: 0 })
+    ));
+}
+
+#[test]
+fn test_extra_fields() {
+    // Extra field at the end.
+    let b_extra = vec![
+        // {"foo": 10, "bytes": h'00', "bytesextra": true}
+        0xA3, // map(3)
+        0x63, // text(3)
+        0x66, 0x6F, 0x6F, // "foo"
+        0x0A, // unsigned(10)
+        0x65, // text(5)
+        0x62, 0x79, 0x74, 0x65, 0x73, // "bytes"
+        0x41, // bytes(1)
+        0x00, // "\x00"
+        0x6A, // text(10)
+        0x62, 0x79, 0x74, 0x65, 0x73, 0x65, 0x78, 0x74, 0x72, 0x61, // "bytesextra"
+        0xF5, // primitive(21)
+    ];
+    let res: Result<B, _> = cbor::from_slice(&b_extra);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnknownField { key: Some(cbor::Value::TextString(ref key)) }) if key == "bytesextra"
+    ));
+
+    // Extra field in the middle.
+    let b_extra = vec![
+        // {"foo": 10, "fop": 10, "bytes": h'00'}
+        0xA3, // map(3)
+        0x63, // text(3)
+        0x66, 0x6F, 0x6F, // "foo"
+        0x0A, // unsigned(10)
+        0x63, // text(3)
+        0x66, 0x6F, 0x70, // "fop"
+        0x0A, // unsigned(10)
+        0x65, // text(5)
+        0x62, 0x79, 0x74, 0x65, 0x73, // "bytes"
+        0x41, // bytes(1)
+        0x00, // "\x00"
+    ];
+    let res: Result<B, _> = cbor::from_slice(&b_extra);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnknownField { key: Some(cbor::Value::TextString(ref key)) }) if key == "fop"
+    ));
+
+    // Extra field at the start.
+    let b_extra = vec![
+        // {"fon": 10, "foo": 10, "bytes": h'00'}
+        0xA3, // map(3)
+        0x63, // text(3)
+        0x66, 0x6F, 0x6E, // "fon"
         0x0A, // unsigned(10)
         0x63, // text(3)
         0x66, 0x6F, 0x6F, // "foo"
@@ -547,7 +1227,10 @@ fn test_extra_fields() {
         0x00, // "\x00"
     ];
     let res: Result<B, _> = cbor::from_slice(&b_extra);
-    assert!(matches!(res, Err(cbor::DecodeError::UnknownField)));
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnknownField { key: Some(cbor::Value::TextString(ref key)) }) if key == "fon"
+    ));
 }
 
 #[test]
@@ -571,6 +1254,215 @@ fn test_extra_fields_allowed() {
     assert_eq!(res.bytes, vec![0x00]);
 }
 
+#[test]
+fn test_extra_fields_denied() {
+    #[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    #[cbor(deny_unknown_fields)]
+    struct Strict {
+        #[cbor(rename = 1)]
+        foo: u64,
+        #[cbor(rename = 2, optional)]
+        bar: Option<u64>,
+    }
+
+    #[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    #[cbor(as_array, deny_unknown_fields)]
+    struct ArrayRecord {
+        foo: u64,
+    }
+
+    #[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    #[cbor(as_array, deny_unknown_fields)]
+    struct SkipArrayRecord {
+        foo: u64,
+        #[cbor(skip)]
+        bar: u64,
+        baz: u64,
+    }
+
+    #[derive(Debug, PartialEq, cbor::Encode, cbor::Decode)]
+    enum StrictVariant {
+        #[cbor(deny_unknown_fields)]
+        Msg { foo: u64 },
+    }
+
+    #[derive(Debug, Default, PartialEq, cbor::Decode)]
+    #[cbor(deny_unknown_fields)]
+    struct StrictBorrowed<'a> {
+        name: &'a str,
+    }
+
+    let dec: Strict = cbor::from_slice(&[0xA1, 0x01, 0x0A]).unwrap();
+    assert_eq!(dec, Strict { foo: 10, bar: None });
+
+    // {1: 10, 3: 0}
+    let err = cbor::from_slice::<Strict>(&[0xA2, 0x01, 0x0A, 0x03, 0x00]).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::UnknownField {
+            key: Some(cbor::Value::Unsigned(3))
+        }
+    ));
+    assert_eq!(err.to_string(), "unknown field 3");
+
+    // Extra array elements are reported by their index.
+    let err = cbor::from_slice::<(u64,)>(&[0x82, 0x01, 0x02]).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::LengthMismatch { .. }));
+    let err = cbor::from_slice::<ArrayRecord>(&[0x82, 0x01, 0x02]).unwrap_err();
+    assert_eq!(err.to_string(), "unknown field 1");
+    // Skipped fields do not count towards the index.
+    let err = cbor::from_slice::<SkipArrayRecord>(&[0x83, 0x01, 0x02, 0x03]).unwrap_err();
+    assert_eq!(err.to_string(), "unknown field 2");
+
+    // {"Msg": {"bar": 1, "foo": 10}}
+    let err = cbor::from_slice::<StrictVariant>(&[
+        0xA1, 0x63, 0x4D, 0x73, 0x67, 0xA2, 0x63, 0x62, 0x61, 0x72, 0x01, 0x63, 0x66, 0x6F, 0x6F,
+        0x0A,
+    ])
+    .unwrap_err();
+    assert_eq!(err.to_string(), "Msg: unknown field \"bar\"");
+
+    // {"name": "x", "nick": "y"}
+    let err = cbor::from_slice_borrowed::<StrictBorrowed<'_>>(&[
+        0xA2, 0x64, 0x6E, 0x61, 0x6D, 0x65, 0x61, 0x78, 0x64, 0x6E, 0x69, 0x63, 0x6B, 0x61, 0x79,
+    ])
+    .unwrap_err();
+    assert_eq!(err.to_string(), "unknown field \"nick\"");
+}
+
+#[test]
+fn test_integer_width_boundaries() {
+    /// Encode the header of the given major type with the argument stored in the given number of
+    /// additional bytes (zero meaning that it is stored in the initial byte).
+    fn header(major_type: u8, arg: u64, width: usize) -> Vec<u8> {
+        let additional_info = match width {
+            0 => arg as u8,
+            1 => 24,
+            2 => 25,
+            4 => 26,
+            8 => 27,
+            _ => unreachable!(),
+        };
+        let mut enc = vec![major_type << 5 | additional_info];
+        enc.extend_from_slice(&arg.to_be_bytes()[8 - width..]);
+        enc
+    }
+
+    /// All widths which can hold the given argument, starting with the minimal one.
+    fn widths(arg: u64) -> Vec<usize> {
+        [0, 1, 2, 4, 8]
+            .iter()
+            .copied()
+            .filter(|&width| match width {
+                0 => arg < 24,
+                8 => true,
+                width => arg < 1 << (8 * width),
+            })
+            .collect()
+    }
+
+    fn check<T>(value: i128)
+    where
+        T: cbor::Encode
+            + cbor::Decode
+            + std::convert::TryFrom<i128>
+            + Copy
+            + std::fmt::Debug
+            + PartialEq,
+    {
+        let (major_type, arg) = if value < 0 {
+            (1, (-1 - value) as u64)
+        } else {
+            (0, value as u64)
+        };
+        let widths = widths(arg);
+
+        let v = match T::try_from(value) {
+            Ok(v) => v,
+            Err(_) => {
+                // Values which do not fit must be rejected at any width, reporting the value.
+                for &width in &widths {
+                    let err = cbor::from_slice_non_strict::<T>(&header(major_type, arg, width))
+                        .unwrap_err();
+                    assert!(
+                        matches!(
+                            err,
+                            cbor::DecodeError::IntegerOverflow { value: Some(v), target }
+                                if v == value && target == std::any::type_name::<T>()
+                        ),
+                        "decoding {} at width {} should fail, got {:?}",
+                        value,
+                        width,
+                        err
+                    );
+                }
+                return;
+            }
+        };
+
+        // Encoding must always use the minimal width.
+        assert_eq!(
+            cbor::to_vec(v),
+            header(major_type, arg, widths[0]),
+            "encoding of {} should be minimal",
+            value
+        );
+        for &width in &widths {
+            let enc = header(major_type, arg, width);
+            // Non-strict decoding must accept any width which can hold the value.
+            let dec: T = cbor::from_slice_non_strict(&enc).unwrap();
+            assert_eq!(
+                dec, v,
+                "decoding {} at width {} should succeed",
+                value, width
+            );
+            // Canonical decoding must only accept the minimal width.
+            let dec = cbor::from_slice::<T>(&enc);
+            if width == widths[0] {
+                assert_eq!(dec.unwrap(), v);
+            } else {
+                assert!(
+                    matches!(dec, Err(cbor::DecodeError::NonCanonical { offset: 0 })),
+                    "decoding {} at width {} should be non-canonical",
+                    value,
+                    width
+                );
+            }
+        }
+    }
+
+    let boundaries = [
+        0,
+        23,
+        24,
+        0xFF,
+        0x7F,
+        0x80,
+        0x100,
+        0x7FFF,
+        0x8000,
+        0xFFFF,
+        0x1_0000,
+        i32::MAX as i128,
+        i32::MAX as i128 + 1,
+        u32::MAX as i128,
+        u32::MAX as i128 + 1,
+        i64::MAX as i128,
+        i64::MAX as i128 + 1,
+        u64::MAX as i128,
+    ];
+    for value in boundaries.iter().flat_map(|&v| [v, -1 - v]) {
+        check::<u8>(value);
+        check::<u16>(value);
+        check::<u32>(value);
+        check::<u64>(value);
+        check::<i8>(value);
+        check::<i16>(value);
+        check::<i32>(value);
+        check::<i64>(value);
+    }
+}
+
 #[test]
 fn test_bigint() {
     let tcs = vec![
@@ -597,125 +1489,483 @@ fn test_bigint() {
 }
 
 #[test]
-fn test_unit_struct() {
-    let t1 = Unit;
-    let enc = cbor::to_vec(t1.clone());
-    assert_eq!(
-        enc,
-        vec![
-            0xf6, // null
-        ]
-    );
+fn test_bignum() {
+    // Plain integers and tagged bignums both decode into u128.
+    let tcs: Vec<(u128, Vec<u8>)> = vec![
+        (10, vec![0x0a]),
+        (
+            18446744073709551615,
+            vec![0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff],
+        ),
+        (
+            18446744073709551616,
+            vec![
+                0xc2, 0x49, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+            ],
+        ),
+    ];
+    for tc in tcs {
+        let dec: u128 = cbor::from_slice(&tc.1).expect("decoding should succeed");
+        assert_eq!(dec, tc.0);
+    }
 
-    let dec: Unit = cbor::from_slice(&enc).unwrap();
-    assert_eq!(dec, t1, "serialization should round-trip");
-}
+    let tcs: Vec<(i128, Vec<u8>)> = vec![
+        (0, vec![0x00]),
+        (-1, vec![0x20]),
+        (
+            18446744073709551615,
+            vec![0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff],
+        ),
+        (
+            -18446744073709551616,
+            vec![0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff],
+        ),
+        (
+            18446744073709551616,
+            vec![
+                0xc2, 0x49, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+            ],
+        ),
+        (
+            -18446744073709551617,
+            vec![
+                0xc3, 0x49, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+            ],
+        ),
+        (
+            i128::MAX,
+            vec![
+                0xc2, 0x50, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+                0xff, 0xff, 0xff, 0xff,
+            ],
+        ),
+        (
+            i128::MIN,
+            vec![
+                0xc3, 0x50, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+                0xff, 0xff, 0xff, 0xff,
+            ],
+        ),
+    ];
+    for tc in tcs {
+        let enc = cbor::to_vec(tc.0);
+        assert_eq!(enc, tc.1, "serialization should match");
 
-#[test]
-fn test_with_default() {
-    let dec: WithOptionalDefault = cbor::from_slice(&[0xA0]).unwrap();
-    assert_eq!(dec, WithOptionalDefault { bar: "".to_owned() });
+        let dec: i128 = cbor::from_slice(&enc).expect("decoding should succeed");
+        assert_eq!(dec, tc.0, "serialization should round-trip");
+    }
 
-    let dec: WithOptional = cbor::from_slice(&[0xA0]).unwrap();
-    assert_eq!(dec, WithOptional { bar: "".to_owned() });
-    let wo = WithOptional { bar: "".to_owned() };
-    let enc = cbor::to_vec(wo);
-    assert_eq!(enc, vec![0xA0]);
+    // Bignums that overflow 128 bits.
+    let too_large = vec![
+        0xc2, 0x51, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+        0x00, 0x00, 0x00, 0x00,
+    ];
+    let res: Result<u128, _> = cbor::from_slice(&too_large);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::IntegerOverflow {
+            value: None,
+            target: "u128"
+        })
+    ));
+    let res: Result<i128, _> = cbor::from_slice(&too_large);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::IntegerOverflow {
+            value: None,
+            target: "i128"
+        })
+    ));
+    let res: Result<i128, _> = cbor::from_slice(&cbor::to_vec(u128::MAX));
+    assert!(matches!(res, Err(cbor::DecodeError::UnexpectedType)));
+    let u128_max_bignum = vec![
+        0xc2, 0x50, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+        0xff, 0xff, 0xff,
+    ];
+    let dec: u128 = cbor::from_slice(&u128_max_bignum).unwrap();
+    assert_eq!(dec, u128::MAX);
+    let res: Result<i128, _> = cbor::from_slice(&u128_max_bignum);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::IntegerOverflow { value: None, .. })
+    ));
 
-    let wod = WithOptionalDefault { bar: "".to_owned() };
-    let enc = cbor::to_vec(wod);
-    assert_eq!(enc, vec![0xA0]);
+    // Negative values never fit into u128.
+    let res: Result<u128, _> = cbor::from_slice(&cbor::to_vec(-1i64));
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::IntegerOverflow {
+            value: Some(-1),
+            target: "u128"
+        })
+    ));
+    let res: Result<u128, _> = cbor::from_slice(&cbor::to_vec(-(1i128 << 64) - 1));
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::IntegerOverflow {
+            value: Some(v),
+            target: "u128"
+        }) if v == -(1i128 << 64) - 1
+    ));
 }
 
 #[test]
-fn test_enum_untagged() {
-    let untagged = Untagged::First { a: 10, b: 11 };
-    let enc = cbor::to_vec(untagged);
-    assert_eq!(
-        enc,
-        vec![
-            // {"a": 10, "b": 11}
-            0xA2, // map(2)
-            0x61, // text(1)
-            0x61, // "a"
-            0x0A, // unsigned(10)
-            0x61, // text(1)
-            0x62, // "b"
-            0x0B, // unsigned(11)
-        ]
-    );
-}
+fn test_bignum_arbitrary_precision() {
+    use cbor::bignum::Bignum;
 
-#[test]
-fn test_enum_internally_tagged() {
-    let it = InternallyTagged::V1 { bar: 42 };
-    let enc = cbor::to_vec(it.clone());
-    assert_eq!(
-        enc,
-        vec![
-            // {"v": 1, "bar": 42}
-            0xA2, // map(2)
-            0x61, // text(1)
-            0x76, // "v"
-            0x01, // unsigned(1)
-            0x63, // text(3)
-            0x62, 0x61, 0x72, // "bar"
-            0x18, 0x2A, // unsigned(42)
-        ],
-        "should encode as expected"
+    let tcs: Vec<(Bignum, Vec<u8>)> = vec![
+        (Bignum::default(), vec![0x00]),
+        (Bignum::new(true, vec![0x00]), vec![0x00]),
+        (Bignum::new(true, vec![0x01]), vec![0x20]),
+        (
+            Bignum::new(false, vec![0xff; 8]),
+            vec![0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff],
+        ),
+        (
+            Bignum::new(true, vec![0x01, 0, 0, 0, 0, 0, 0, 0, 0]),
+            vec![0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff],
+        ),
+        (
+            Bignum::new(false, vec![0x01, 0, 0, 0, 0, 0, 0, 0, 0]),
+            vec![0xc2, 0x49, 0x01, 0, 0, 0, 0, 0, 0, 0, 0],
+        ),
+        (
+            Bignum::new(true, vec![0x01, 0, 0, 0, 0, 0, 0, 0, 0x01]),
+            vec![0xc3, 0x49, 0x01, 0, 0, 0, 0, 0, 0, 0, 0],
+        ),
+        // -256^9 is -1 - (256^9 - 1), whose magnitude is a byte shorter.
+        (
+            Bignum::new(true, vec![0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0]),
+            vec![
+                0xc3, 0x49, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+            ],
+        ),
+        (
+            Bignum::new(false, vec![0x12; 24]),
+            [0xc2, 0x58, 0x18]
+                .iter()
+                .chain([0x12; 24].iter())
+                .copied()
+                .collect(),
+        ),
+        (
+            Bignum::new(true, vec![0x12; 24]),
+            [0xc3, 0x58, 0x18]
+                .iter()
+                .chain([0x12; 23].iter())
+                .chain([0x11].iter())
+                .copied()
+                .collect(),
+        ),
+    ];
+    for tc in tcs {
+        assert_eq!(cbor::Encode::encoded_len(&tc.0), tc.1.len());
+        let enc = cbor::to_vec(tc.0.clone());
+        assert_eq!(enc, tc.1, "serialization should match");
+
+        let dec: Bignum = cbor::from_slice(&enc).expect("decoding should succeed");
+        assert_eq!(dec, tc.0, "serialization should round-trip");
+    }
+
+    // Integers that fit into 128 bits encode the same as i128.
+    for v in [0, 1, -1, i128::MAX, i128::MIN, -(1 << 64), (1 << 64)] {
+        assert_eq!(cbor::to_vec(Bignum::from(v)), cbor::to_vec(v));
+        let dec: Bignum = cbor::from_slice(&cbor::to_vec(v)).unwrap();
+        assert_eq!(dec, Bignum::from(v));
+    }
+    assert_eq!(
+        cbor::to_vec(Bignum::from(u128::MAX)),
+        cbor::to_vec(Bignum::new(false, vec![0xff; 16]))
     );
 
-    let dec: InternallyTagged = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, it, "serialization should round-trip");
+    // Leading zero bytes are not minimal, so they are only accepted by non-strict decoding.
+    for (enc, expected) in [
+        (vec![0xc2, 0x42, 0x00, 0x01], Bignum::from(1i128)),
+        (vec![0xc3, 0x43, 0x00, 0x00, 0xff], Bignum::from(-256i128)),
+    ] {
+        let res: Result<Bignum, _> = cbor::from_slice(&enc);
+        assert!(matches!(
+            res,
+            Err(cbor::DecodeError::NonCanonical { offset: 1 })
+        ));
+        let dec: Bignum = cbor::from_slice_non_strict(&enc).unwrap();
+        assert_eq!(dec, expected);
+    }
+    let res: Result<Bignum, _> = cbor::from_slice(&cbor::to_vec("1"));
+    assert!(matches!(res, Err(cbor::DecodeError::UnexpectedType)));
+}
 
-    // With a missing tag.
-    let enc = vec![
-        // {"foo": 42}
-        0xA1, // map(1)
-        0x63, // text(3)
-        0x66, 0x6F, 0x6F, // "foo"
-        0x18, 0x2A, // unsigned(42)
+#[cfg(feature = "num-bigint")]
+#[test]
+fn test_bignum_num_bigint() {
+    use cbor::bignum::Bignum;
+    use num_bigint::{BigInt, BigUint, Sign};
+
+    #[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    struct Balance {
+        #[cbor(optional)]
+        total: BigUint,
+        delta: BigInt,
+    }
+
+    let magnitudes: Vec<Vec<u8>> = vec![
+        vec![],
+        vec![0x01],
+        vec![0xff; 8],
+        vec![0x01, 0, 0, 0, 0, 0, 0, 0, 0],
+        vec![0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0],
+        vec![0xab; 40],
     ];
-    let dec: InternallyTagged =
-        cbor::from_slice(&enc).expect("missing tag deserialization should work");
+    for magnitude in magnitudes {
+        let unsigned = BigUint::from_bytes_be(&magnitude);
+        let enc = cbor::to_vec(unsigned.clone());
+        assert_eq!(enc, cbor::to_vec(Bignum::new(false, magnitude.clone())));
+        assert_eq!(cbor::Encode::encoded_len(&unsigned), enc.len());
+        let dec: BigUint = cbor::from_slice(&enc).unwrap();
+        assert_eq!(dec, unsigned);
+
+        for sign in [Sign::Plus, Sign::Minus] {
+            let signed = BigInt::from_biguint(sign, unsigned.clone());
+            let enc = cbor::to_vec(signed.clone());
+            assert_eq!(
+                enc,
+                cbor::to_vec(Bignum::new(sign == Sign::Minus, magnitude.clone()))
+            );
+            assert_eq!(cbor::Encode::encoded_len(&signed), enc.len());
+            let dec: BigInt = cbor::from_slice(&enc).unwrap();
+            assert_eq!(dec, signed);
+        }
+    }
+
+    let balance = Balance {
+        total: BigUint::default(),
+        delta: BigInt::from(-1i64),
+    };
+    let enc = cbor::to_vec(balance);
+    // {"delta": -1}
+    assert_eq!(enc, vec![0xa1, 0x65, 0x64, 0x65, 0x6c, 0x74, 0x61, 0x20]);
+    let dec: Balance = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec.delta, BigInt::from(-1i64));
+
+    // Negative values never fit into BigUint.
+    let res: Result<BigUint, _> = cbor::from_slice(&cbor::to_vec(-5i64));
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::IntegerOverflow {
+            value: Some(-5),
+            target: "BigUint"
+        })
+    ));
+    let res: Result<BigUint, _> = cbor::from_slice(&cbor::to_vec(BigInt::from_biguint(
+        Sign::Minus,
+        BigUint::from_bytes_be(&[0xab; 40]),
+    )));
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::IntegerOverflow { value: None, .. })
+    ));
+}
+
+#[test]
+fn test_system_time() {
+    use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+    let tcs: Vec<(SystemTime, Vec<u8>)> = vec![
+        (
+            // 1(1363896240)
+            UNIX_EPOCH + Duration::from_secs(1363896240),
+            vec![0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0],
+        ),
+        (
+            // 1(1363896240.5)
+            UNIX_EPOCH + Duration::from_millis(1363896240500),
+            vec![0xc1, 0xfb, 0x41, 0xd4, 0x52, 0xd9, 0xec, 0x20, 0x00, 0x00],
+        ),
+        (
+            // 1(-1)
+            UNIX_EPOCH - Duration::from_secs(1),
+            vec![0xc1, 0x20],
+        ),
+        (
+            // 1(-1.5)
+            UNIX_EPOCH - Duration::from_millis(1500),
+            vec![0xc1, 0xfb, 0xbf, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+        ),
+    ];
+    for tc in tcs {
+        let enc = cbor::to_vec(tc.0);
+        assert_eq!(enc, tc.1, "serialization should match");
+        assert_eq!(cbor::Encode::encoded_len(&tc.0), enc.len());
+        assert_eq!(cbor::to_vec(cbor::time::epoch_float::encode(&tc.0)), enc);
+
+        let dec: SystemTime = cbor::from_slice(&enc).expect("decoding should succeed");
+        assert_eq!(dec, tc.0, "serialization should round-trip");
+    }
+
+    // Fractional seconds are kept up to the precision of a float.
+    let time = UNIX_EPOCH + Duration::from_nanos(1_363_896_240_123_456_789);
+    let enc = cbor::to_vec(time);
+    assert_eq!(cbor::Encode::encoded_len(&time), enc.len());
+    let dec: SystemTime = cbor::from_slice(&enc).expect("decoding should succeed");
+    let diff = dec.duration_since(time).unwrap_or_else(|e| e.duration());
+    assert!(diff < Duration::from_micros(1), "difference {:?}", diff);
+    let time = UNIX_EPOCH - Duration::from_nanos(1);
+    let dec: SystemTime = cbor::from_slice(&cbor::to_vec(time)).expect("decoding should succeed");
+    assert_eq!(dec, time);
+    let time = UNIX_EPOCH;
+    assert_eq!(cbor::to_vec(time), vec![0xc1, 0x00]);
+
+    // Standard date/time strings.
+    let tcs = vec![
+        (
+            "2013-03-21T20:04:00Z",
+            UNIX_EPOCH + Duration::from_secs(1363896240),
+        ),
+        (
+            "2013-03-21t21:04:00.5+01:00",
+            UNIX_EPOCH + Duration::from_millis(1363896240500),
+        ),
+        (
+            "1969-12-31T23:59:59.000000001234z",
+            UNIX_EPOCH - Duration::from_nanos(999999999),
+        ),
+        (
+            "2000-02-29T00:00:00-00:30",
+            UNIX_EPOCH + Duration::from_secs(951784200),
+        ),
+    ];
+    for tc in tcs {
+        let enc = cbor::to_vec(cbor::Value::Tag(0, Box::new(tc.0.into())));
+        let dec: SystemTime = cbor::from_slice(&enc).expect("decoding should succeed");
+        assert_eq!(dec, tc.1, "date/time string {} should decode", tc.0);
+    }
+    for invalid in [
+        "2013-03-21",
+        "2013-03-21T20:04:00",
+        "2013-03-21 20:04:00Z",
+        "2013-02-29T20:04:00Z",
+        "2013-03-21T24:04:00Z",
+        "2013-03-21T20:04:00.Z",
+        "2013-03-21T20:04:00+1:00",
+        "+013-03-21T20:04:00Z",
+    ] {
+        let enc = cbor::to_vec(cbor::Value::Tag(0, Box::new(invalid.into())));
+        let res: Result<SystemTime, _> = cbor::from_slice(&enc);
+        assert!(
+            matches!(res, Err(cbor::DecodeError::InvalidTimestamp)),
+            "date/time string {} should be rejected",
+            invalid
+        );
+    }
+
+    // Non-finite and out of range timestamps.
+    let res: Result<SystemTime, _> = cbor::from_slice_non_strict(&[0xc1, 0xf9, 0x7e, 0x00]);
+    assert!(matches!(res, Err(cbor::DecodeError::InvalidTimestamp)));
+    let res: Result<SystemTime, _> = cbor::from_slice(&cbor::to_vec(cbor::Value::Tag(
+        1,
+        Box::new(cbor::Value::Unsigned(u64::MAX)),
+    )));
+    assert!(matches!(res, Err(cbor::DecodeError::TimestampOutOfRange)));
+    let res: Result<SystemTime, _> = cbor::from_slice_non_strict(&cbor::to_vec(cbor::Value::Tag(
+        1,
+        Box::new(cbor::Value::Float(1e300)),
+    )));
+    assert!(matches!(res, Err(cbor::DecodeError::TimestampOutOfRange)));
+
+    // Timestamps must be tagged.
+    let res: Result<SystemTime, _> = cbor::from_slice(&[0x1a, 0x51, 0x4b, 0x67, 0xb0]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnexpectedTag {
+            expected: 1,
+            got: None
+        })
+    ));
+}
+
+#[test]
+fn test_duration() {
+    use std::time::Duration;
+
+    let d = Duration::new(5, 500);
+    let enc = cbor::to_vec(d);
     assert_eq!(
-        dec,
-        InternallyTagged::V0 { foo: 42 },
-        "deserialization should be correct"
+        enc,
+        vec![
+            // {"secs": 5, "nanos": 500}
+            0xA2, // map(2)
+            0x64, // text(4)
+            0x73, 0x65, 0x63, 0x73, // "secs"
+            0x05, // unsigned(5)
+            0x65, // text(5)
+            0x6E, 0x61, 0x6E, 0x6F, 0x73, // "nanos"
+            0x19, 0x01, 0xF4, // unsigned(500)
+        ]
     );
+    let dec: Duration = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, d, "serialization should round-trip");
 
-    // With a missing tag but without any variant with the missing attribute.
-    cbor::from_slice::<InternallyTaggedNoMissing>(&enc)
-        .expect_err("missing tag deserialization without any missing variant should fail");
+    let enc = cbor::to_vec(Duration::new(1, 0));
+    assert_eq!(&enc[..7], &[0xA2, 0x64, 0x73, 0x65, 0x63, 0x73, 0x01]);
+
+    #[derive(cbor::Encode)]
+    struct RawDuration {
+        secs: u64,
+        nanos: u64,
+    }
+    let enc = cbor::to_vec(RawDuration {
+        secs: 1,
+        nanos: 1_000_000_000,
+    });
+    let err = cbor::from_slice::<Duration>(&enc).unwrap_err();
+    assert!(matches!(
+        err.root_cause(),
+        cbor::DecodeError::IntegerOverflow {
+            value: Some(1_000_000_000),
+            target: "Duration"
+        }
+    ));
+    assert_eq!(
+        err.to_string(),
+        "nanos: integer 1000000000 out of range for Duration"
+    );
 }
 
 #[test]
-fn test_btree_map() {
-    let mut map = BTreeMap::new();
-    map.insert("a", 10);
-    map.insert("b", 11);
-    let enc = cbor::to_vec(map);
+fn test_unit_struct() {
+    let t1 = Unit;
+    let enc = cbor::to_vec(t1.clone());
     assert_eq!(
         enc,
         vec![
-            // {"a": 10, "b": 11}
-            0xA2, // map(2)
-            0x61, // text(1)
-            0x61, // "a"
-            0x0A, // unsigned(10)
-            0x61, // text(1)
-            0x62, // "b"
-            0x0B, // unsigned(11)
+            0xf6, // null
         ]
     );
+
+    let dec: Unit = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, t1, "serialization should round-trip");
 }
 
 #[test]
-fn test_hash_map() {
-    let mut map = HashMap::new();
-    map.insert("a", 10);
-    map.insert("b", 11);
-    let enc = cbor::to_vec(map);
+fn test_with_default() {
+    let dec: WithOptionalDefault = cbor::from_slice(&[0xA0]).unwrap();
+    assert_eq!(dec, WithOptionalDefault { bar: "".to_owned() });
+
+    let dec: WithOptional = cbor::from_slice(&[0xA0]).unwrap();
+    assert_eq!(dec, WithOptional { bar: "".to_owned() });
+    let wo = WithOptional { bar: "".to_owned() };
+    let enc = cbor::to_vec(wo);
+    assert_eq!(enc, vec![0xA0]);
+
+    let wod = WithOptionalDefault { bar: "".to_owned() };
+    let enc = cbor::to_vec(wod);
+    assert_eq!(enc, vec![0xA0]);
+}
+
+#[test]
+fn test_enum_untagged() {
+    let untagged = Untagged::First { a: 10, b: 11 };
+    let enc = cbor::to_vec(untagged.clone());
     assert_eq!(
         enc,
         vec![
@@ -729,436 +1979,3429 @@ fn test_hash_map() {
             0x0B, // unsigned(11)
         ]
     );
+    let dec: Untagged = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, untagged, "serialization should round-trip");
+
+    // Variants are attempted in declaration order.
+    for (value, enc) in [
+        (UntaggedUnion::Nothing, cbor::to_vec("Nothing")),
+        (UntaggedUnion::Small(1), vec![0x01]),
+        (UntaggedUnion::Large(0x100), vec![0x19, 0x01, 0x00]),
+        (UntaggedUnion::Text("x".to_owned()), vec![0x61, 0x78]),
+        (
+            UntaggedUnion::Pair(1, "x".to_owned()),
+            vec![0x82, 0x01, 0x61, 0x78],
+        ),
+        (
+            UntaggedUnion::Single { a: 1 },
+            vec![0xA1, 0x61, 0x61, 0x01], // {"a": 1}
+        ),
+        (
+            UntaggedUnion::Object { a: 1, b: 2 },
+            cbor::to_vec(Untagged::First { a: 1, b: 2 }),
+        ),
+    ] {
+        assert_eq!(
+            cbor::to_vec(value.clone()),
+            enc,
+            "should encode as expected"
+        );
+        let dec: UntaggedUnion = cbor::from_slice(&enc).expect("serialization should round-trip");
+        assert_eq!(dec, value, "serialization should round-trip");
+    }
+
+    // When no variant matches, all failures are reported.
+    let res = cbor::from_slice::<UntaggedUnion>(&[0xF5]);
+    match res {
+        Err(cbor::DecodeError::NoMatchingVariant { errors }) => {
+            let variants: Vec<_> = errors.iter().map(|(variant, _)| *variant).collect();
+            assert_eq!(
+                variants,
+                vec!["Nothing", "Small", "Large", "Text", "Pair", "Single", "Object"]
+            );
+        }
+        _ => panic!("unexpected result: {:?}", res),
+    }
+    let res = cbor::from_slice::<Untagged>(&[0xF5]);
+    assert_eq!(
+        res.unwrap_err().to_string(),
+        "no matching variant (First: unexpected type)"
+    );
 }
 
 #[test]
-fn test_as_array() {
-    let asa = AsArray {
-        foo: 10,
-        bytes: b"here".to_vec(),
+fn test_enum_untagged_nested() {
+    // Variants which cannot match are rejected without decoding the inner values, otherwise this
+    // would take an exponential number of attempts.
+    let mut nested = UntaggedNested::Leaf(1);
+    for i in 0..40 {
+        nested = if i % 3 == 0 {
+            UntaggedNested::Left {
+                inner: Box::new(nested),
+                left: true,
+            }
+        } else {
+            UntaggedNested::Right {
+                inner: Box::new(nested),
+                right: false,
+            }
+        };
+    }
+    let enc = cbor::to_vec(nested.clone());
+    let dec: UntaggedNested = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, nested, "serialization should round-trip");
+
+    // Failures are still reported for each variant.
+    let enc = cbor::to_vec(cbor::cbor_map! {"inner" => 1, "middle" => true});
+    let res = cbor::from_slice::<UntaggedNested>(&enc);
+    match res {
+        Err(cbor::DecodeError::NoMatchingVariant { errors }) => {
+            let errors: Vec<_> = errors.iter().map(|(v, e)| (*v, e.to_string())).collect();
+            assert_eq!(
+                errors,
+                vec![
+                    ("Leaf", "unexpected type".to_owned()),
+                    ("Left", "unknown field \"middle\"".to_owned()),
+                    ("Right", "unknown field \"middle\"".to_owned()),
+                ]
+            );
+        }
+        _ => panic!("unexpected result: {:?}", res),
+    }
+}
+
+#[test]
+fn test_rename_all() {
+    let ra = RenameAll {
+        first_field: 1,
+        second_field: 2,
+        third: 3,
     };
-    let enc = cbor::to_vec(asa);
+    let enc = cbor::to_vec(ra.clone());
     assert_eq!(
         enc,
         vec![
-            // [10, h'68657265']
-            0x82, // array(2)
-            0x0A, // unsigned(10)
-            0x44, // bytes(4)
-            0x68, 0x65, 0x72, 0x65, // "here"
+            // {"third": 3, "explicit": 2, "firstField": 1}
+            0xA3, // map(3)
+            0x65, // text(5)
+            0x74, 0x68, 0x69, 0x72, 0x64, // "third"
+            0x03, // unsigned(3)
+            0x68, // text(8)
+            0x65, 0x78, 0x70, 0x6C, 0x69, 0x63, 0x69, 0x74, // "explicit"
+            0x02, // unsigned(2)
+            0x6A, // text(10)
+            0x66, 0x69, 0x72, 0x73, 0x74, 0x46, 0x69, 0x65, 0x6C, 0x64, // "firstField"
+            0x01, // unsigned(1)
         ]
     );
-}
+    let dec: RenameAll = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, ra);
 
-#[test]
-fn test_encode_as_map() {
-    fn validate<T: cbor::EncodeAsMap>(_x: T) {}
-    validate(AlwaysEncodesAsMap::Two(12));
+    let e = RenameAllEnum::FirstVariant;
+    let enc = cbor::to_vec(e.clone());
+    assert_eq!(enc, cbor::to_vec("first-variant"));
+    let dec: RenameAllEnum = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, e);
+
+    // Rename rules are not applied to fields of enum variants.
+    let e = RenameAllEnum::SecondVariant { inner_field: 7 };
+    let enc = cbor::to_vec(e.clone());
+    let value: cbor::Value = cbor::from_slice(&enc).unwrap();
+    assert_eq!(
+        value,
+        cbor::Value::Map(vec![(
+            "second-variant".into(),
+            cbor::Value::Map(vec![("inner_field".into(), 7u64.into())])
+        )])
+    );
+    let dec: RenameAllEnum = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, e);
 }
 
 #[test]
-fn test_tuples() {
-    let t1 = (1u64, "two".to_string(), 3u64, 4u128);
-    let enc = cbor::to_vec(t1.clone());
+fn test_integer_keys() {
+    let ik = IntegerKeys {
+        version: 2,
+        body: "a".to_owned(),
+        kind: 3,
+    };
+    let enc = cbor::to_vec(ik.clone());
     assert_eq!(
         enc,
         vec![
-            // [1, "two", 3, h'04']
-            0x84, // array(4)
-            0x01, // unsigned(1)
-            0x63, // text(3)
-            0x74, 0x77, 0x6F, // "two"
+            // {0: 3, 1: "a", 24: 2}
+            0xA3, // map(3)
+            0x00, // unsigned(0)
             0x03, // unsigned(3)
-            0x41, // bytes(1)
-            0x04, // "\x04"
+            0x01, // unsigned(1)
+            0x61, 0x61, // "a"
+            0x18, 0x18, // unsigned(24)
+            0x02, // unsigned(2)
         ]
     );
+    let dec: IntegerKeys = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, ik);
 
-    let dec: (u64, String, u64, u128) = cbor::from_slice(&enc).unwrap();
-    assert_eq!(dec, t1, "serialization should round-trip");
+    let mk = MixedKeys {
+        id: 7,
+        name: "b".to_owned(),
+    };
+    let enc = cbor::to_vec(mk.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {1: 7, "name": "b"}
+            0xA2, // map(2)
+            0x01, // unsigned(1)
+            0x07, // unsigned(7)
+            0x64, // text(4)
+            0x6E, 0x61, 0x6D, 0x65, // "name"
+            0x61, 0x62, // "b"
+        ]
+    );
+    let dec: MixedKeys = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, mk);
 }
 
 #[test]
-fn test_non_string_keys() {
-    let nsk = NonStringKeys::One(10, 20);
-    let enc = cbor::to_vec(nsk.clone());
+fn test_embed_field() {
+    let msg = EmbedMessage {
+        header: EmbedHeader {
+            version: 1,
+            nonce: 2,
+        },
+        body: "x".to_owned(),
+    };
+    let enc = cbor::to_vec(msg.clone());
     assert_eq!(
         enc,
         vec![
-            // {1: [10, 20]}
-            0xA1, // map(1)
+            // {"body": "x", "nonce": 2, "version": 1}
+            0xA3, // map(3)
+            0x64, // text(4)
+            0x62, 0x6F, 0x64, 0x79, // "body"
+            0x61, 0x78, // "x"
+            0x65, // text(5)
+            0x6E, 0x6F, 0x6E, 0x63, 0x65, // "nonce"
+            0x02, // unsigned(2)
+            0x67, // text(7)
+            0x76, 0x65, 0x72, 0x73, 0x69, 0x6F, 0x6E, // "version"
             0x01, // unsigned(1)
-            0x82, // array(2)
-            0x0A, // unsigned(10)
-            0x14, // unsigned(20)
         ]
     );
+    let dec: EmbedMessage = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, msg, "serialization should round-trip");
 
-    let dec: NonStringKeys = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, nsk, "serialization should round-trip");
-}
+    // Omitted optional fields of the embedded struct.
+    let msg = EmbedMessage {
+        header: EmbedHeader {
+            version: 1,
+            nonce: 0,
+        },
+        body: "x".to_owned(),
+    };
+    let enc = cbor::to_vec(msg.clone());
+    let dec: EmbedMessage = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, msg, "serialization should round-trip");
 
-#[test]
-fn test_unit_encode_decode() {
-    let data = vec![0xf6]; // Null.
-    let _dec: () = cbor::from_slice(&data).expect("unit type can be decoded from CBOR null");
+    // Unknown fields are rejected by the embedded struct.
+    let enc = vec![
+        // {"a": 1, "body": "x", "version": 1}
+        0xA3, // map(3)
+        0x61, 0x61, // "a"
+        0x01, // unsigned(1)
+        0x64, // text(4)
+        0x62, 0x6F, 0x64, 0x79, // "body"
+        0x61, 0x78, // "x"
+        0x67, // text(7)
+        0x76, 0x65, 0x72, 0x73, 0x69, 0x6F, 0x6E, // "version"
+        0x01, // unsigned(1)
+    ];
+    let res = cbor::from_slice::<EmbedMessage>(&enc);
+    assert!(matches!(res, Err(cbor::DecodeError::UnknownField { .. })));
 
-    let data = vec![0xf7]; // Undefined.
-    let _dec: () = cbor::from_slice(&data).expect("unit type can be decoded from CBOR undefined");
+    // Colliding keys are rejected when decoding.
+    let enc = vec![
+        // {"version": 1, "version": 2}
+        0xA2, // map(2)
+        0x67, // text(7)
+        0x76, 0x65, 0x72, 0x73, 0x69, 0x6F, 0x6E, // "version"
+        0x01, // unsigned(1)
+        0x67, // text(7)
+        0x76, 0x65, 0x72, 0x73, 0x69, 0x6F, 0x6E, // "version"
+        0x02, // unsigned(2)
+    ];
+    let res = cbor::from_slice_non_strict::<EmbedCollision>(&enc);
+    assert!(matches!(res, Err(cbor::DecodeError::DuplicateField)));
 }
 
 #[test]
-fn test_arrays() {
-    let a: [u64; 3] = [1, 2, 3];
-    let enc = cbor::to_vec(a);
+fn test_flatten_rest() {
+    let enc = vec![
+        // {1: true, "a": 1, "id": 7, "zzz": [2]}
+        0xA4, // map(4)
+        0x01, // unsigned(1)
+        0xF5, // true
+        0x61, 0x61, // "a"
+        0x01, // unsigned(1)
+        0x62, // text(2)
+        0x69, 0x64, // "id"
+        0x07, // unsigned(7)
+        0x63, // text(3)
+        0x7A, 0x7A, 0x7A, // "zzz"
+        0x81, 0x02, // [2]
+    ];
+    let dec: WithRest = cbor::from_slice(&enc).expect("decoding should succeed");
     assert_eq!(
-        enc,
-        vec![
-            // [1, 2, 3]
-            0x83, // array(3)
-            0x01, // unsigned(1)
-            0x02, // unsigned(2)
-            0x03, // unsigned(3)
-        ]
+        dec,
+        WithRest {
+            id: 7,
+            name: "".to_owned(),
+            rest: BTreeMap::from([
+                (
+                    cbor::Value::Unsigned(1),
+                    cbor::Value::Simple(cbor::SimpleValue::TrueValue)
+                ),
+                ("a".into(), cbor::Value::Unsigned(1)),
+                (
+                    "zzz".into(),
+                    cbor::Value::Array(vec![cbor::Value::Unsigned(2)])
+                ),
+            ]),
+        }
     );
-    let dec: [u64; 3] = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, a, "serialization should round-trip");
 
-    let a: [String; 2] = ["foo".to_string(), "bar".to_string()];
-    let enc = cbor::to_vec(a.clone());
+    // Unknown entries are merged back in canonical order when re-encoding.
+    assert_eq!(cbor::to_vec(dec.clone()), enc);
+    assert_eq!(cbor::Encode::encoded_len(&dec), enc.len());
+    assert_eq!(cbor::to_vec(&dec), enc);
+
+    // Known fields are never collected.
+    let msg = WithRest {
+        id: 1,
+        name: "x".to_owned(),
+        rest: BTreeMap::new(),
+    };
+    let enc = cbor::to_vec(msg.clone());
+    let dec: WithRest = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, msg, "serialization should round-trip");
+
+    // Named fields take precedence over collected entries with the same key, whether they are
+    // encoded or omitted.
+    let msg = WithRest {
+        id: 1,
+        name: "".to_owned(),
+        rest: BTreeMap::from([
+            ("id".into(), cbor::Value::Unsigned(2)),
+            ("name".into(), "y".into()),
+            ("zzz".into(), cbor::Value::Unsigned(3)),
+        ]),
+    };
+    let enc = cbor::to_vec(msg.clone());
     assert_eq!(
         enc,
         vec![
-            // ["foo", "bar"]
-            0x82, // array(2)
-            0x63, // text(3)
-            0x66, 0x6F, 0x6F, // "foo"
-            0x63, // text(3)
-            0x62, 0x61, 0x72, // "bar"
+            0xA2, // map(2)
+            0x62, 0x69, 0x64, // "id"
+            0x01, // unsigned(1)
+            0x63, 0x7A, 0x7A, 0x7A, // "zzz"
+            0x03, // unsigned(3)
         ]
     );
-    let dec: [String; 2] = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, a, "serialization should round-trip");
+    assert_eq!(cbor::Encode::encoded_len(&msg), enc.len());
+    assert_eq!(cbor::to_vec(&msg), enc);
+    assert_eq!(cbor::EncodeAsMap::cbor_map_len(&msg), 2);
 }
 
 #[test]
-fn test_bytes() {
-    let a: Vec<u8> = vec![1, 2, 3];
-    let enc = cbor::to_vec(a.clone());
+fn test_unexpected_key_type() {
+    let map = |extra: cbor::Value| {
+        cbor::to_vec(cbor::Value::Map(vec![
+            (extra, cbor::Value::Unsigned(0)),
+            ("foo".into(), cbor::Value::Unsigned(1)),
+            ("bytes".into(), cbor::Value::ByteString(vec![])),
+        ]))
+    };
+    let integer_key = map(cbor::Value::Unsigned(1));
+    let array_key = map(cbor::Value::Array(vec![cbor::Value::Unsigned(1)]));
+    let text_key = map("zzz".into());
+
+    // Keys of a type no field uses are reported as such, whether they sort before or after the
+    // field keys.
+    for (enc, key) in [
+        (&integer_key, cbor::Value::Unsigned(1)),
+        (
+            &array_key,
+            cbor::Value::Array(vec![cbor::Value::Unsigned(1)]),
+        ),
+    ] {
+        let err = cbor::from_slice::<B>(enc).unwrap_err();
+        assert!(
+            matches!(&err, cbor::DecodeError::UnexpectedKeyType { key: k } if *k == key),
+            "unexpected error: {:?}",
+            err
+        );
+        let mut dec = B::default();
+        let err = cbor::from_slice_in_place(enc, &mut dec).unwrap_err();
+        assert!(matches!(err, cbor::DecodeError::UnexpectedKeyType { .. }));
+    }
+    let err = cbor::from_slice::<B>(&integer_key).unwrap_err();
+    assert_eq!(err.to_string(), "unexpected key type of key 1");
+    let err = cbor::from_slice::<B>(&text_key).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnknownField { .. }));
+
+    // Unknown entries are skipped regardless of their key type when allowed.
+    let expected = BWithUnknown {
+        foo: 1,
+        bytes: vec![],
+    };
+    for enc in [&integer_key, &array_key, &text_key] {
+        let dec: BWithUnknown = cbor::from_slice(enc).expect("unknown keys should be skipped");
+        assert_eq!(dec, expected);
+        let mut dec = BWithUnknown::default();
+        cbor::from_slice_in_place(enc, &mut dec).expect("unknown keys should be skipped");
+        assert_eq!(dec, expected);
+    }
+
+    // Negative integers are unknown keys of structs with integer keys, other types are not.
+    let mixed = |extra: cbor::Value| {
+        cbor::to_vec(cbor::Value::Map(vec![
+            (extra, cbor::Value::Unsigned(0)),
+            (cbor::Value::Unsigned(1), cbor::Value::Unsigned(1)),
+            ("name".into(), "".into()),
+        ]))
+    };
+    let err = cbor::from_slice::<MixedKeys>(&mixed(cbor::Value::Negative(-1))).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnknownField { .. }));
+    let err = cbor::from_slice::<MixedKeys>(&mixed(cbor::Value::ByteString(vec![]))).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnexpectedKeyType { .. }));
+
+    // A catch-all field collects entries with keys of any type.
+    let enc = cbor::to_vec(cbor::Value::Map(vec![
+        (cbor::Value::Unsigned(1), cbor::Value::Unsigned(0)),
+        (cbor::Value::Array(vec![]), cbor::Value::Unsigned(0)),
+        ("id".into(), cbor::Value::Unsigned(7)),
+    ]));
+    let dec: WithRest = cbor::from_slice(&enc).expect("decoding should succeed");
     assert_eq!(
-        enc,
-        vec![
-            // h'010203'
-            0x43, // bytes(3)
-            0x01, 0x02, 0x03 // "\x01\x02\x03"
-        ]
+        dec.rest.keys().collect::<Vec<_>>(),
+        vec![&cbor::Value::Unsigned(1), &cbor::Value::Array(vec![])]
     );
-    let dec: Vec<u8> = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, a, "serialization should round-trip");
+}
 
-    let a: [u8; 3] = [1, 2, 3];
-    let enc = cbor::to_vec(a);
+#[test]
+fn test_field_default() {
+    // Missing keys use the configured default values.
+    let dec: WithDefaults = cbor::from_slice(&[0xA0]).unwrap();
     assert_eq!(
-        enc,
-        vec![
-            // h'010203'
-            0x43, // bytes(3)
-            0x01, 0x02, 0x03 // "\x01\x02\x03"
-        ]
+        dec,
+        WithDefaults {
+            inner: NoTryDefault { foo: 0 },
+            count: 10,
+        }
     );
-    let dec: [u8; 3] = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, a, "serialization should round-trip");
 
-    let result = cbor::from_slice::<[u8; 2]>(&enc).expect_err("serialization should fail");
-    assert!(matches!(result, cbor::DecodeError::UnexpectedType));
+    // Present keys are decoded as usual.
+    let wd = WithDefaults {
+        inner: NoTryDefault { foo: 1 },
+        count: 2,
+    };
+    let enc = cbor::to_vec(wd.clone());
+    let dec: WithDefaults = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, wd, "serialization should round-trip");
+
+    // Present but null keys do not use the configured default values.
+    let enc = vec![
+        // {"count": null}
+        0xA1, // map(1)
+        0x65, // text(5)
+        0x63, 0x6F, 0x75, 0x6E, 0x74, // "count"
+        0xF6, // null
+    ];
+    let dec: WithDefaults = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec.count, 0);
+
+    let enc = vec![
+        // {"inner": null}
+        0xA1, // map(1)
+        0x65, // text(5)
+        0x69, 0x6E, 0x6E, 0x65, 0x72, // "inner"
+        0xF6, // null
+    ];
+    let err = cbor::from_slice::<WithDefaults>(&enc).unwrap_err();
+    assert!(matches!(err.root_cause(), cbor::DecodeError::MissingField));
+    assert_eq!(err.to_string(), "inner: missing field");
 }
 
 #[test]
-fn test_char() {
-    let t1 = 'A';
-    let enc = cbor::to_vec(t1.clone());
+fn test_skip_serializing_if_default() {
+    let sd = SkipIfDefault {
+        id: 1,
+        ..Default::default()
+    };
+    let enc = cbor::to_vec(sd.clone());
     assert_eq!(
         enc,
         vec![
-            0x18, 0x41, // unsigned(65)
+            // {"id": 1}
+            0xA1, // map(1)
+            0x62, // text(2)
+            0x69, 0x64, // "id"
+            0x01, // unsigned(1)
         ]
     );
+    let dec: SkipIfDefault = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, sd, "serialization should round-trip");
 
-    let dec: char = cbor::from_slice(&enc).unwrap();
-    assert_eq!(dec, t1, "serialization should round-trip");
-
-    let bad_char = cbor::Value::Unsigned(0x110000); // invalid codepoint; unicode goes to 0x10ffff
-    let result: Result<char, _> = cbor::from_value(bad_char);
-    assert!(matches!(
-        result.expect_err("deserialization should fail"),
-        cbor::DecodeError::UnexpectedType
-    ));
-}
-
-#[test]
-fn test_skip_field() {
-    let sk = SkipVariantsAndFields::First { foo: 10, bar: 20 };
-    let enc = cbor::to_vec(sk);
+    let sd = SkipIfDefault {
+        id: 1,
+        items: vec![2],
+        inner: NoTryDefault { foo: 3 },
+        note: Some("a".to_owned()),
+    };
+    let enc = cbor::to_vec(sd.clone());
     assert_eq!(
         enc,
         vec![
-            // {"First": {"foo": 10}}
-            0xA1, // map(1)
+            // {"id": 1, "note": "a", "inner": {"foo": 3}, "items": [2]}
+            0xA4, // map(4)
+            0x62, // text(2)
+            0x69, 0x64, // "id"
+            0x01, // unsigned(1)
+            0x64, // text(4)
+            0x6E, 0x6F, 0x74, 0x65, // "note"
+            0x61, 0x61, // "a"
             0x65, // text(5)
-            0x46, 0x69, 0x72, 0x73, 0x74, // "First"
+            0x69, 0x6E, 0x6E, 0x65, 0x72, // "inner"
             0xA1, // map(1)
             0x63, // text(3)
             0x66, 0x6F, 0x6F, // "foo"
-            0x0A, // unsigned(10)
-        ],
+            0x03, // unsigned(3)
+            0x65, // text(5)
+            0x69, 0x74, 0x65, 0x6D, 0x73, // "items"
+            0x81, // array(1)
+            0x02, // unsigned(2)
+        ]
     );
-    let dec: SkipVariantsAndFields = cbor::from_slice(&enc).expect("deserialization should work");
-    let expected = SkipVariantsAndFields::First {
-        foo: 10,
-        bar: 0, // Should be replaced with default value.
-    };
-    assert_eq!(dec, expected, "deserialization should work");
+    let dec: SkipIfDefault = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, sd, "serialization should round-trip");
 }
 
 #[test]
-fn test_skip_variant() {
-    let skv_data = vec![
-        // {"Second": {"a": 10}}
-        0xA1, // map(1)
-        0x66, // text(6)
-        0x53, 0x65, 0x63, 0x6F, 0x6E, 0x64, // "Second"
-        0xA1, // map(1)
-        0x61, // text(1)
-        0x61, // "a"
-        0x0A, // unsigned(10)
-    ];
-    let result = cbor::from_slice::<SkipVariantsAndFields>(&skv_data)
-        .expect_err("deserialization of skipped variant should fail");
-    assert!(matches!(result, cbor::DecodeError::UnknownField));
-
-    // Serialization of an unserializable variant should result in undefined.
-    let sk = SkipVariantsAndFields::Second { a: 10 };
-    let enc = cbor::to_vec(sk);
-    assert_eq!(enc, vec![247]);
-}
+fn test_optional_presence() {
+    // None and values which would encode as null are omitted.
+    let op = WithOptionalPresence {
+        count: None,
+        value: Some(cbor::Value::Simple(cbor::SimpleValue::NullValue)),
+    };
+    let enc = cbor::to_vec(op.clone());
+    assert_eq!(enc, vec![0xA0]); // {}
+    assert_eq!(cbor::Encode::encoded_len(&op), enc.len());
+    assert_eq!(cbor::to_vec(&op), enc);
+    let dec: WithOptionalPresence = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, WithOptionalPresence::default());
 
-#[test]
-fn test_unit_variant_as_struct() {
-    let uv = UnitEnumVariantAsStruct::One;
-    let enc = cbor::to_vec(uv.clone());
+    // Present values are decoded as Some, even when empty.
+    let op = WithOptionalPresence {
+        count: Some(0),
+        value: Some(cbor::Value::Unsigned(7)),
+    };
+    let enc = cbor::to_vec(op.clone());
     assert_eq!(
         enc,
         vec![
-            // {"one": {}}
-            0xA1, // map(1)
-            0x63, // text(3)
-            0x6F, 0x6E, 0x65, // "one"
-            0xA0, // map(0)
-        ],
+            // {"count": 0, "value": 7}
+            0xA2, // map(2)
+            0x65, // text(5)
+            0x63, 0x6F, 0x75, 0x6E, 0x74, // "count"
+            0x00, // unsigned(0)
+            0x65, // text(5)
+            0x76, 0x61, 0x6C, 0x75, 0x65, // "value"
+            0x07, // unsigned(7)
+        ]
     );
-    let dec: UnitEnumVariantAsStruct =
+    let dec: WithOptionalPresence =
         cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, uv, "serialization should round-trip");
+    assert_eq!(dec, op, "serialization should round-trip");
+
+    // Present null values are decoded as None.
+    let enc = vec![
+        // {"count": null}
+        0xA1, // map(1)
+        0x65, // text(5)
+        0x63, 0x6F, 0x75, 0x6E, 0x74, // "count"
+        0xF6, // null
+    ];
+    let dec: WithOptionalPresence = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, WithOptionalPresence::default());
 }
 
 #[test]
-fn test_embed_variant() {
-    let ep = EmbedParent::B(EmbedChild::E(42));
-    let enc = cbor::to_vec(ep.clone());
+fn test_nested_option() {
+    #[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+    struct Patch {
+        #[cbor(rename = 1, optional)]
+        fee: Option<Option<u64>>,
+        #[cbor(rename = 2)]
+        memo: Option<Option<String>>,
+    }
+
+    #[derive(Debug, Default, PartialEq, cbor::Decode)]
+    struct PatchBorrowed<'a> {
+        #[cbor(rename = 1, optional)]
+        fee: Option<Option<u64>>,
+        #[cbor(rename = 2)]
+        memo: &'a str,
+    }
+
+    #[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+    #[cbor(as_array)]
+    struct PatchArray {
+        nonce: u64,
+        #[cbor(optional)]
+        fee: Option<Option<u64>>,
+    }
+
+    // An absent key decodes as None, a present null as Some(None) and any other value as Some.
+    let tcs: Vec<(Patch, Vec<u8>)> = vec![
+        (
+            Patch {
+                fee: None,
+                memo: None,
+            },
+            vec![0xA1, 0x02, 0xF7], // {2: undefined}
+        ),
+        (
+            Patch {
+                fee: Some(None),
+                memo: Some(None),
+            },
+            vec![0xA2, 0x01, 0xF6, 0x02, 0xF6], // {1: null, 2: null}
+        ),
+        (
+            Patch {
+                fee: Some(Some(0)),
+                memo: Some(Some("a".to_owned())),
+            },
+            vec![0xA2, 0x01, 0x00, 0x02, 0x61, 0x61], // {1: 0, 2: "a"}
+        ),
+    ];
+    for (patch, enc) in tcs {
+        assert_eq!(cbor::to_vec(patch.clone()), enc);
+        assert_eq!(cbor::Encode::encoded_len(&patch), enc.len());
+        assert_eq!(cbor::to_vec(&patch), enc);
+        let dec: Patch = cbor::from_slice(&enc).expect("serialization should round-trip");
+        assert_eq!(dec, patch, "serialization should round-trip");
+
+        let mut scratch = Patch {
+            fee: Some(Some(1)),
+            memo: Some(Some("b".to_owned())),
+        };
+        cbor::from_slice_in_place(&enc, &mut scratch).unwrap();
+        assert_eq!(scratch, patch, "decoding in place should match");
+    }
+
+    // Both absent keys decode as None.
+    let dec: Patch = cbor::from_slice(&[0xA0]).unwrap();
+    assert_eq!(dec, Patch::default());
+    let dec: PatchBorrowed<'_> = cbor::from_slice_borrowed(&[0xA0]).unwrap();
+    assert_eq!(dec, PatchBorrowed::default());
+    let dec: PatchBorrowed<'_> =
+        cbor::from_slice_borrowed(&[0xA2, 0x01, 0xF6, 0x02, 0x61, 0x61]).unwrap();
     assert_eq!(
-        enc,
-        vec![
-            // {"E": 42}
-            0xA1, // map(1)
-            0x61, // text(1)
-            0x45, // "E"
-            0x18, 0x2A, // unsigned(42)
-        ],
+        dec,
+        PatchBorrowed {
+            fee: Some(None),
+            memo: "a",
+        }
     );
-    let dec: EmbedParent = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, ep, "serialization should round-trip");
 
-    // When there's an overlapping field, the parent field is always used when decoding.
-    let ep = EmbedParent::C(42);
-    let enc = cbor::to_vec(ep.clone());
+    // A missing trailing array element decodes as None, a null one as Some(None).
+    let tcs: Vec<(PatchArray, Vec<u8>)> = vec![
+        (
+            PatchArray {
+                nonce: 1,
+                fee: None,
+            },
+            vec![0x81, 0x01],
+        ),
+        (
+            PatchArray {
+                nonce: 1,
+                fee: Some(None),
+            },
+            vec![0x82, 0x01, 0xF6],
+        ),
+        (
+            PatchArray {
+                nonce: 1,
+                fee: Some(Some(2)),
+            },
+            vec![0x82, 0x01, 0x02],
+        ),
+    ];
+    for (patch, enc) in tcs {
+        assert_eq!(cbor::to_vec(patch.clone()), enc);
+        let dec: PatchArray = cbor::from_slice(&enc).expect("serialization should round-trip");
+        assert_eq!(dec, patch, "serialization should round-trip");
+    }
+
+    // The same applies to nested options on their own, while plain options decode null as None.
+    assert_eq!(cbor::to_vec(None::<Option<u64>>), vec![0xF7]);
+    assert_eq!(cbor::to_vec(Some(None::<u64>)), vec![0xF6]);
     assert_eq!(
-        enc,
-        vec![
-            // {"C": 42}
-            0xA1, // map(1)
-            0x61, // text(1)
-            0x43, // "C"
-            0x18, 0x2A, // unsigned(42)
-        ],
+        cbor::from_slice::<Option<Option<u64>>>(&[0xF7]).unwrap(),
+        None
     );
-    let dec: EmbedParent = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, ep, "serialization should round-trip");
-
-    // Using the child field that overlaps will not round-trip.
-    let ep = EmbedParent::B(EmbedChild::C("foo".to_string()));
-    let enc = cbor::to_vec(ep);
     assert_eq!(
-        enc,
-        vec![
-            // {"C": "foo"}
-            0xA1, // map(1)
-            0x61, // text(1)
-            0x43, // "C"
-            0x63, // text(3)
-            0x66, 0x6F, 0x6F, // "foo"
-        ],
+        cbor::from_slice::<Option<Option<u64>>>(&[0xF6]).unwrap(),
+        Some(None)
     );
-    let result =
-        cbor::from_slice::<EmbedParent>(&enc).expect_err("parent field should take precedence");
-    assert!(matches!(result, cbor::DecodeError::UnexpectedType));
+    assert_eq!(cbor::from_slice::<Option<u64>>(&[0xF6]).unwrap(), None);
+    assert_eq!(cbor::from_slice::<Option<u64>>(&[0xF7]).unwrap(), None);
 }
 
 #[test]
-fn test_custom_encode_decode() {
+fn test_decode_borrowed() {
+    let msg = OwnedMessage {
+        name: "foo".to_owned(),
+        data: vec![1, 2, 3],
+        count: 0,
+    };
+    let enc = cbor::to_vec(msg);
+    let dec: BorrowedMessage = cbor::from_slice_borrowed(&enc).unwrap();
+    assert_eq!(
+        dec,
+        BorrowedMessage {
+            name: "foo",
+            data: &[1, 2, 3],
+            count: 0,
+        }
+    );
+    // Make sure the fields actually borrow from the encoded data.
+    let range = enc.as_ptr_range();
+    assert!(range.contains(&dec.name.as_ptr()));
+    assert!(range.contains(&dec.data.as_ptr()));
+
+    let enc = vec![
+        // ["a", {"data": h'', "name": "b"}]
+        0x82, // array(2)
+        0x61, 0x61, // "a"
+        0xA2, // map(2)
+        0x64, // text(4)
+        0x64, 0x61, 0x74, 0x61, // "data"
+        0x40, // bytes(0)
+        0x64, // text(4)
+        0x6E, 0x61, 0x6D, 0x65, // "name"
+        0x61, 0x62, // "b"
+    ];
+    let dec: BorrowedTuple = cbor::from_slice_borrowed(&enc).unwrap();
+    assert_eq!(
+        dec,
+        BorrowedTuple(
+            "a",
+            BorrowedMessage {
+                name: "b",
+                data: &[],
+                count: 0,
+            }
+        )
+    );
+
+    // Chunked strings cannot be borrowed.
+    let enc = vec![
+        // ["a", {"data": h'', "name": (_ "b")}]
+        0x82, // array(2)
+        0x61, 0x61, // "a"
+        0xA2, // map(2)
+        0x64, // text(4)
+        0x64, 0x61, 0x74, 0x61, // "data"
+        0x40, // bytes(0)
+        0x64, // text(4)
+        0x6E, 0x61, 0x6D, 0x65, // "name"
+        0x7F, // text(*)
+        0x61, 0x62, // "b"
+        0xFF, // break
+    ];
+    let err =
+        cbor::from_slice_borrowed_with::<BorrowedTuple>(&enc, &Default::default()).unwrap_err();
+    assert!(matches!(
+        err.root_cause(),
+        cbor::DecodeError::UnexpectedType
+    ));
+    assert_eq!(err.to_string(), "1.name: unexpected type");
+}
+
+#[test]
+fn test_decode_arena() {
+    let mut buffer = cbor::to_vec(OwnedMessage {
+        name: "foo".to_owned(),
+        data: vec![1, 2, 3],
+        count: 0,
+    });
+    let mut arena = cbor::Arena::new();
+    let mut allocated = None;
+    for _ in 0..2 {
+        let first: BorrowedMessage = arena.decode(&buffer).unwrap();
+        let first_len = buffer.len();
+        // The fields borrow from the arena, so the input buffer can be reused.
+        buffer = cbor::to_vec(OwnedMessage {
+            name: "bar".to_owned(),
+            data: vec![],
+            count: 1,
+        });
+        let second: BorrowedMessage = arena.decode(&buffer).unwrap();
+        assert_eq!(
+            (first.name, first.data, first.count),
+            ("foo", &[1, 2, 3][..], 0)
+        );
+        assert_eq!(
+            (second.name, second.data, second.count),
+            ("bar", &[][..], 1)
+        );
+        assert!(!buffer.as_ptr_range().contains(&second.name.as_ptr()));
+        // The arena holds both encodings as well as the maps they were decoded from (with two and
+        // three entries), which take up the same amount of memory for each batch.
+        let entry_len = std::mem::size_of::<(cbor::ValueRef, cbor::ValueRef)>();
+        assert!(arena.allocated() >= first_len + buffer.len() + 5 * entry_len);
+        assert_eq!(
+            *allocated.get_or_insert(arena.allocated()),
+            arena.allocated()
+        );
+
+        arena.reset();
+        assert_eq!(arena.allocated(), 0);
+        buffer = cbor::to_vec(OwnedMessage {
+            name: "foo".to_owned(),
+            data: vec![1, 2, 3],
+            count: 0,
+        });
+    }
+}
+
+#[test]
+fn test_decode_cow() {
+    let msg = CowMessage {
+        name: Cow::Borrowed("foo"),
+        data: Cow::Owned(vec![1, 2, 3]),
+        count: 0,
+    };
+    let enc = cbor::to_vec(msg.clone());
+    assert_eq!(
+        enc,
+        cbor::to_vec(OwnedMessage {
+            name: "foo".to_owned(),
+            data: vec![1, 2, 3],
+            count: 0,
+        })
+    );
+    let dec: CowMessage = cbor::from_slice_borrowed(&enc).unwrap();
+    assert_eq!(dec, msg, "serialization should round-trip");
+    // Make sure contiguous strings borrow from the encoded data.
+    assert!(matches!(dec.name, Cow::Borrowed(_)));
+    assert!(matches!(dec.data, Cow::Borrowed(_)));
+
+    // Chunked strings are decoded into owned values.
+    let enc = vec![
+        // {"data": (_ h'01', h'02'), "name": (_ "f", "oo")}
+        0xA2, // map(2)
+        0x64, // text(4)
+        0x64, 0x61, 0x74, 0x61, // "data"
+        0x5F, // bytes(*)
+        0x41, 0x01, // h'01'
+        0x41, 0x02, // h'02'
+        0xFF, // break
+        0x64, // text(4)
+        0x6E, 0x61, 0x6D, 0x65, // "name"
+        0x7F, // text(*)
+        0x61, 0x66, // "f"
+        0x62, 0x6F, 0x6F, // "oo"
+        0xFF, // break
+    ];
+    let dec: CowMessage = cbor::from_slice_borrowed_with(&enc, &Default::default()).unwrap();
+    assert_eq!(dec.name, "foo");
+    assert_eq!(dec.data, &[1, 2][..]);
+    assert!(matches!(dec.name, Cow::Owned(_)));
+    assert!(matches!(dec.data, Cow::Owned(_)));
+}
+
+#[test]
+fn test_semantic_tag() {
+    let tagged = SemanticallyTagged { foo: 10 };
+    let enc = cbor::to_vec(tagged.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // 1234({"foo": 10})
+            0xD9, 0x04, 0xD2, // tag(1234)
+            0xA1, // map(1)
+            0x63, // text(3)
+            0x66, 0x6F, 0x6F, // "foo"
+            0x0A, // unsigned(10)
+        ]
+    );
+    let dec: SemanticallyTagged = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, tagged);
+
+    let newtype = SemanticallyTaggedNewtype(vec![0x01, 0x02]);
+    let enc = cbor::to_vec(newtype.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // 42(h'0102')
+            0xD8, 0x2A, // tag(42)
+            0x42, // bytes(2)
+            0x01, 0x02, // "\x01\x02"
+        ]
+    );
+    let dec: SemanticallyTaggedNewtype = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, newtype);
+
+    // Wrong tag.
+    let res: Result<SemanticallyTaggedNewtype, _> =
+        cbor::from_slice(&[0xD8, 0x2B, 0x42, 0x01, 0x02]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnexpectedTag {
+            expected: 42,
+            got: Some(43)
+        })
+    ));
+
+    // Missing tag.
+    let res: Result<SemanticallyTaggedNewtype, _> = cbor::from_slice(&[0x42, 0x01, 0x02]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnexpectedTag {
+            expected: 42,
+            got: None
+        })
+    ));
+}
+
+#[test]
+fn test_transparent_with_custom_encoding() {
+    let custom = TransparentCustom(CustomType("ab".to_string()));
+    let enc = cbor::to_vec(custom.clone());
+    assert_eq!(
+        enc,
+        vec![
+            0x62, // text(2)
+            0x61, 0x62, // "ab"
+        ],
+        "should encode directly as the result of the custom function"
+    );
+    assert_eq!(cbor::Encode::encoded_len(&custom), enc.len());
+    assert_eq!(cbor::to_vec(&custom), enc);
+    let dec: TransparentCustom = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, custom);
+
+    // The tag wraps the value returned by the custom function.
+    let tagged = SemanticallyTaggedCustomNewtype(CustomType("ab".to_string()));
+    let enc = cbor::to_vec(tagged.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // 42(h'6162')
+            0xD8, 0x2A, // tag(42)
+            0x42, // bytes(2)
+            0x61, 0x62, // "ab"
+        ]
+    );
+    assert_eq!(cbor::Encode::encoded_len(&tagged), enc.len());
+    assert_eq!(cbor::to_vec(&tagged), enc);
+    let dec: SemanticallyTaggedCustomNewtype = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, tagged);
+
+    // Decoding requires both the tag and the custom encoding.
+    let res: Result<SemanticallyTaggedCustomNewtype, _> = cbor::from_slice(&[0x42, 0x61, 0x62]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnexpectedTag {
+            expected: 42,
+            got: None
+        })
+    ));
+    let res: Result<SemanticallyTaggedCustomNewtype, _> =
+        cbor::from_slice(&[0xD8, 0x2A, 0x62, 0x61, 0x62]);
+    assert!(matches!(res, Err(cbor::DecodeError::UnexpectedType)));
+    let res: Result<SemanticallyTaggedCustomNewtype, _> =
+        cbor::from_slice(&[0xD8, 0x2A, 0x42, 0xFF, 0xFF]);
+    assert!(matches!(res, Err(cbor::DecodeError::UnexpectedType)));
+
+    // Tags of nested transparent newtypes are applied outermost first.
+    let nested = NestedSemanticallyTaggedNewtype(tagged);
+    let enc = cbor::to_vec(nested.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // 7(42(h'6162'))
+            0xC7, // tag(7)
+            0xD8, 0x2A, // tag(42)
+            0x42, // bytes(2)
+            0x61, 0x62, // "ab"
+        ]
+    );
+    assert_eq!(cbor::Encode::encoded_len(&nested), enc.len());
+    assert_eq!(cbor::to_vec(&nested), enc);
+    let dec: NestedSemanticallyTaggedNewtype = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, nested);
+    let res: Result<NestedSemanticallyTaggedNewtype, _> =
+        cbor::from_slice(&[0xD8, 0x2A, 0xC7, 0x42, 0x61, 0x62]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnexpectedTag {
+            expected: 7,
+            got: Some(42)
+        })
+    ));
+}
+
+#[test]
+fn test_enum_internally_tagged() {
+    let it = InternallyTagged::V1 { bar: 42 };
+    let enc = cbor::to_vec(it.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"v": 1, "bar": 42}
+            0xA2, // map(2)
+            0x61, // text(1)
+            0x76, // "v"
+            0x01, // unsigned(1)
+            0x63, // text(3)
+            0x62, 0x61, 0x72, // "bar"
+            0x18, 0x2A, // unsigned(42)
+        ],
+        "should encode as expected"
+    );
+
+    let dec: InternallyTagged = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, it, "serialization should round-trip");
+
+    // With a missing tag.
+    let enc = vec![
+        // {"foo": 42}
+        0xA1, // map(1)
+        0x63, // text(3)
+        0x66, 0x6F, 0x6F, // "foo"
+        0x18, 0x2A, // unsigned(42)
+    ];
+    let dec: InternallyTagged =
+        cbor::from_slice(&enc).expect("missing tag deserialization should work");
+    assert_eq!(
+        dec,
+        InternallyTagged::V0 { foo: 42 },
+        "deserialization should be correct"
+    );
+
+    // With a missing tag but without any variant with the missing attribute.
+    cbor::from_slice::<InternallyTaggedNoMissing>(&enc)
+        .expect_err("missing tag deserialization without any missing variant should fail");
+}
+
+#[test]
+fn test_enum_unknown_variant() {
+    for new in [
+        VersionedNew::C { x: 1 },
+        VersionedNew::D,
+        VersionedNew::A,
+        VersionedNew::B(2),
+    ] {
+        let enc = cbor::to_vec(new.clone());
+
+        // Unknown variants are captured and re-encoded unchanged.
+        let old: VersionedOld = cbor::from_slice(&enc).expect("decoding should succeed");
+        match (&new, &old) {
+            (VersionedNew::A, VersionedOld::A) | (VersionedNew::B(2), VersionedOld::B(2)) => {}
+            (VersionedNew::C { .. } | VersionedNew::D, VersionedOld::Unknown(value)) => {
+                assert_eq!(value, &cbor::from_slice::<cbor::Value>(&enc).unwrap());
+            }
+            _ => panic!("unexpected variant {:?} for {:?}", old, new),
+        }
+        let reenc = cbor::to_vec(old);
+        assert_eq!(
+            reenc, enc,
+            "unknown variants should be re-encoded unchanged"
+        );
+        let dec: VersionedNew = cbor::from_slice(&reenc).expect("decoding should succeed");
+        assert_eq!(dec, new);
+
+        // Unit fallback variants drop the value.
+        let old: VersionedOldUnit = cbor::from_slice(&enc).expect("decoding should succeed");
+        if matches!(new, VersionedNew::C { .. } | VersionedNew::D) {
+            assert_eq!(old, VersionedOldUnit::Unknown);
+        }
+    }
+
+    // Known variants with invalid contents are still rejected.
+    let enc = cbor::to_vec(VersionedNew::B(2));
+    let enc = [&enc[..3], &[0x61, 0x78]].concat(); // {"B": "x"}
+    let err = cbor::from_slice::<VersionedOld>(&enc).unwrap_err();
+    assert!(matches!(
+        err.root_cause(),
+        cbor::DecodeError::UnexpectedType
+    ));
+    assert_eq!(err.to_string(), "B: unexpected type");
+
+    // Internally tagged enums capture the whole map, including the tag.
+    let enc = vec![
+        // {"v": 2, "baz": 42}
+        0xA2, // map(2)
+        0x61, // text(1)
+        0x76, // "v"
+        0x02, // unsigned(2)
+        0x63, // text(3)
+        0x62, 0x61, 0x7A, // "baz"
+        0x18, 0x2A, // unsigned(42)
+    ];
+    let dec: VersionedInternallyTagged = cbor::from_slice(&enc).expect("decoding should succeed");
+    assert_eq!(
+        dec,
+        VersionedInternallyTagged::Unknown(cbor::from_slice(&enc).unwrap())
+    );
+    assert_eq!(cbor::to_vec(dec), enc);
+}
+
+#[test]
+fn test_enum_repr_int() {
+    for (status, enc) in [
+        (Status::Pending, vec![0x00]),
+        (Status::Active, vec![0x01]),
+        (Status::Failed, vec![0x18, 0x1E]),
+        (Status::Retired, vec![0x18, 0x1F]),
+    ] {
+        assert_eq!(cbor::to_vec(status), enc, "should encode as expected");
+        assert_eq!(cbor::Encode::encoded_len(&status), enc.len());
+        let dec: Status = cbor::from_slice(&enc).expect("serialization should round-trip");
+        assert_eq!(dec, status, "serialization should round-trip");
+    }
+
+    let res = cbor::from_slice::<Status>(&[0x02]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnknownVariant { discriminant: 2 })
+    ));
+    let res = cbor::from_slice::<Status>(&cbor::to_vec("Active"));
+    assert!(matches!(res, Err(cbor::DecodeError::UnexpectedType)));
+
+    // Unknown discriminants can also be routed into a fallback variant.
+    let dec: StatusWithUnknown = cbor::from_slice(&[0x02]).expect("decoding should succeed");
+    assert_eq!(dec, StatusWithUnknown::Unknown(cbor::Value::Unsigned(2)));
+    assert_eq!(cbor::to_vec(dec), vec![0x02]);
+}
+
+#[test]
+fn test_btree_map() {
+    let mut map = BTreeMap::new();
+    map.insert("a", 10);
+    map.insert("b", 11);
+    let enc = cbor::to_vec(map);
+    assert_eq!(
+        enc,
+        vec![
+            // {"a": 10, "b": 11}
+            0xA2, // map(2)
+            0x61, // text(1)
+            0x61, // "a"
+            0x0A, // unsigned(10)
+            0x61, // text(1)
+            0x62, // "b"
+            0x0B, // unsigned(11)
+        ]
+    );
+}
+
+#[test]
+fn test_hash_map() {
+    let mut map = HashMap::new();
+    map.insert("a", 10);
+    map.insert("b", 11);
+    let enc = cbor::to_vec(map);
+    assert_eq!(
+        enc,
+        vec![
+            // {"a": 10, "b": 11}
+            0xA2, // map(2)
+            0x61, // text(1)
+            0x61, // "a"
+            0x0A, // unsigned(10)
+            0x61, // text(1)
+            0x62, // "b"
+            0x0B, // unsigned(11)
+        ]
+    );
+}
+
+#[test]
+fn test_btree_set() {
+    let set = BTreeSet::from(["b".to_owned(), "aa".to_owned(), "c".to_owned()]);
+    let enc = cbor::to_vec(set.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // ["b", "c", "aa"]
+            0x83, // array(3)
+            0x61, // text(1)
+            0x62, // "b"
+            0x61, // text(1)
+            0x63, // "c"
+            0x62, // text(2)
+            0x61, 0x61, // "aa"
+        ]
+    );
+
+    // Encoding is deterministic.
+    let dec: BTreeSet<String> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, set);
+    assert_eq!(cbor::to_vec(dec), enc);
+
+    // Elements in another order are accepted unless canonical order is required.
+    let unsorted = vec![
+        // ["aa", "b", "c"]
+        0x83, // array(3)
+        0x62, // text(2)
+        0x61, 0x61, // "aa"
+        0x61, // text(1)
+        0x62, // "b"
+        0x61, // text(1)
+        0x63, // "c"
+    ];
+    let dec: BTreeSet<String> = cbor::from_slice(&unsorted).unwrap();
+    assert_eq!(dec, set);
+
+    #[derive(Debug, Default, PartialEq, cbor::Decode)]
+    struct Sorted {
+        #[cbor(deserialize_with = "cbor::decode::sorted_btree_set")]
+        set: BTreeSet<String>,
+    }
+    let sorted = |enc: &[u8]| {
+        let mut data = vec![0xA1, 0x63, 0x73, 0x65, 0x74]; // {"set": ...}
+        data.extend_from_slice(enc);
+        cbor::from_slice::<Sorted>(&data).map(|s| s.set)
+    };
+    assert_eq!(sorted(&enc).unwrap(), set);
+    assert!(matches!(
+        sorted(&unsorted),
+        Err(cbor::DecodeError::InField { ref source, .. })
+            if matches!(**source, cbor::DecodeError::UnsortedSetElements)
+    ));
+    assert!(matches!(
+        sorted(&[0x82, 0x61, 0x61, 0x61, 0x61]), // ["a", "a"]
+        Err(cbor::DecodeError::InField { ref source, .. })
+            if matches!(**source, cbor::DecodeError::DuplicateSetElement)
+    ));
+
+    // Duplicate elements are merged unless they are required to be unique.
+    let enc = vec![
+        // ["a", "a"]
+        0x82, // array(2)
+        0x61, // text(1)
+        0x61, // "a"
+        0x61, // text(1)
+        0x61, // "a"
+    ];
+    let dec: BTreeSet<String> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, BTreeSet::from(["a".to_owned()]));
+    let dec: BTreeSet<String> = cbor::from_slice_non_strict(&enc).unwrap();
+    assert_eq!(dec, BTreeSet::from(["a".to_owned()]));
+
+    #[derive(Debug, Default, PartialEq, cbor::Decode)]
+    struct Unique {
+        #[cbor(deserialize_with = "cbor::decode::unique_set")]
+        set: BTreeSet<String>,
+    }
+    let unique = |enc: &[u8]| {
+        let mut data = vec![0xA1, 0x63, 0x73, 0x65, 0x74]; // {"set": ...}
+        data.extend_from_slice(enc);
+        cbor::from_slice::<Unique>(&data).map(|s| s.set)
+    };
+    assert_eq!(unique(&unsorted).unwrap(), set);
+    assert!(matches!(
+        unique(&enc),
+        Err(cbor::DecodeError::InField { ref source, .. })
+            if matches!(**source, cbor::DecodeError::DuplicateSetElement)
+    ));
+}
+
+#[test]
+fn test_hash_set() {
+    let values = ["b", "aa", "c"];
+    let enc = cbor::to_vec(HashSet::from(values));
+    assert_eq!(
+        enc,
+        vec![
+            // ["b", "c", "aa"]
+            0x83, // array(3)
+            0x61, // text(1)
+            0x62, // "b"
+            0x61, // text(1)
+            0x63, // "c"
+            0x62, // text(2)
+            0x61, 0x61, // "aa"
+        ]
+    );
+
+    // Encoding does not depend on the iteration order.
+    for _ in 0..10 {
+        let mut set = HashSet::new();
+        for v in values.iter().rev() {
+            set.insert(*v);
+        }
+        assert_eq!(cbor::to_vec(set), enc);
+    }
+
+    let dec: HashSet<String> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, HashSet::from(values.map(String::from)));
+
+    // Duplicate elements are merged unless they are required to be unique.
+    let enc = vec![
+        // [1, 1]
+        0x82, // array(2)
+        0x01, // unsigned(1)
+        0x01, // unsigned(1)
+    ];
+    let dec: HashSet<u64> = cbor::from_slice_non_strict(&enc).unwrap();
+    assert_eq!(dec, HashSet::from([1]));
+    let dec: Result<HashSet<u64>, _> =
+        cbor::from_value(cbor::from_slice(&enc).unwrap()).and_then(cbor::decode::unique_set);
+    assert!(matches!(dec, Err(cbor::DecodeError::DuplicateSetElement)));
+}
+
+#[test]
+fn test_encode_into() {
+    let mut buf = Vec::new();
+    for i in 0..3 {
+        buf.clear();
+        let mut map = HashMap::new();
+        map.insert("bb", i);
+        map.insert("a", 10);
+        cbor::encode_into(map, &mut buf).unwrap();
+        assert_eq!(
+            buf,
+            vec![
+                // {"a": 10, "bb": i}
+                0xA2, // map(2)
+                0x61, // text(1)
+                0x61, // "a"
+                0x0A, // unsigned(10)
+                0x62, // text(2)
+                0x62, 0x62, // "bb"
+                i,    // unsigned(i)
+            ]
+        );
+    }
+
+    // Encoding appends to any existing data.
+    cbor::encode_into(A::default(), &mut buf).unwrap();
+    assert_eq!(&buf[8..], &cbor::to_vec(A::default())[..]);
+
+    // Errors are returned and leave the existing data unchanged.
+    let before = buf.clone();
+    let duplicate = cbor::Value::Map(vec![
+        ("a".into(), cbor::Value::Unsigned(0)),
+        ("a".into(), cbor::Value::Unsigned(1)),
+    ]);
+    let res = cbor::encode_into(cbor::Value::Array(vec![0.into(), duplicate]), &mut buf);
+    assert!(matches!(res, Err(cbor::EncodeError::DuplicateMapKey)));
+    assert_eq!(buf, before);
+}
+
+#[test]
+fn test_to_diagnostic() {
+    let enc = cbor::to_vec((
+        1u64,
+        "foo",
+        vec![1u8, 2],
+        BTreeMap::from([(-1i64, Some(true)), (1, None)]),
+    ));
+    assert_eq!(
+        cbor::to_diagnostic(&enc).unwrap(),
+        "[1, \"foo\", h'0102', {1: null, -1: true}]"
+    );
+
+    let res = cbor::to_diagnostic(&[0x01, 0x02]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::TrailingData { offset: 1 })
+    ));
+}
+
+#[test]
+fn test_as_array() {
+    let asa = AsArray {
+        foo: 10,
+        bytes: b"here".to_vec(),
+    };
+    let enc = cbor::to_vec(asa);
+    assert_eq!(
+        enc,
+        vec![
+            // [10, h'68657265']
+            0x82, // array(2)
+            0x0A, // unsigned(10)
+            0x44, // bytes(4)
+            0x68, 0x65, 0x72, 0x65, // "here"
+        ]
+    );
+}
+
+#[test]
+fn test_as_array_omitted_tail() {
+    let tcs = vec![
+        (
+            AsArrayWithTail {
+                foo: 1,
+                ..Default::default()
+            },
+            // [1, 0]
+            vec![0x82, 0x01, 0x00],
+        ),
+        (
+            AsArrayWithTail {
+                foo: 1,
+                baz: Some(2),
+                ..Default::default()
+            },
+            // [1, 0, 2]
+            vec![0x83, 0x01, 0x00, 0x02],
+        ),
+        (
+            AsArrayWithTail {
+                foo: 1,
+                qux: "a".to_string(),
+                ..Default::default()
+            },
+            // [1, 0, null, "a"]
+            vec![0x84, 0x01, 0x00, 0xF6, 0x61, 0x61],
+        ),
+    ];
+    for (value, expected) in tcs {
+        let enc = cbor::to_vec(value.clone());
+        assert_eq!(
+            enc, expected,
+            "omittable fields should only be omitted at the end"
+        );
+        assert_eq!(cbor::Encode::encoded_len(&value), enc.len());
+        assert_eq!(cbor::to_vec(&value), enc);
+        let dec: AsArrayWithTail = cbor::from_slice(&enc).expect("serialization should round-trip");
+        assert_eq!(dec, value, "serialization should round-trip");
+    }
+
+    // All omittable fields may be left out.
+    let dec: AsArrayWithTail = cbor::from_slice(&[0x81, 0x01]).unwrap();
+    assert_eq!(
+        dec,
+        AsArrayWithTail {
+            foo: 1,
+            ..Default::default()
+        }
+    );
+
+    // Required fields cannot be left out and extra elements are rejected.
+    let err = cbor::from_slice::<AsArrayWithTail>(&[0x80]).unwrap_err();
+    assert!(matches!(err.root_cause(), cbor::DecodeError::MissingField));
+    let res: Result<AsArrayWithTail, _> =
+        cbor::from_slice(&[0x85, 0x01, 0x00, 0xF6, 0x61, 0x61, 0x00]);
+    assert!(matches!(res, Err(cbor::DecodeError::UnknownField { .. })));
+
+    let variant = VariantWithTail::Tuple(1, None);
+    let enc = cbor::to_vec(variant.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"Tuple": [1]}
+            0xA1, // map(1)
+            0x65, // text(5)
+            0x54, 0x75, 0x70, 0x6C, 0x65, // "Tuple"
+            0x81, // array(1)
+            0x01, // unsigned(1)
+        ]
+    );
+    assert_eq!(cbor::Encode::encoded_len(&variant), enc.len());
+    assert_eq!(cbor::to_vec(&variant), enc);
+    let dec: VariantWithTail = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, variant);
+    let variant = VariantWithTail::Tuple(1, Some(2));
+    let enc = cbor::to_vec(variant.clone());
+    let dec: VariantWithTail = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, variant);
+}
+
+#[test]
+fn test_accept_array_or_map() {
+    let value = ArrayOrMap {
+        foo: 10,
+        bytes: b"here".to_vec(),
+        baz: None,
+    };
+
+    // Encoding always uses the map form.
+    let enc = cbor::to_vec(value.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"foo": 10, "bytes": h'68657265'}
+            0xA2, // map(2)
+            0x63, // text(3)
+            0x66, 0x6F, 0x6F, // "foo"
+            0x0A, // unsigned(10)
+            0x65, // text(5)
+            0x62, 0x79, 0x74, 0x65, 0x73, // "bytes"
+            0x44, // bytes(4)
+            0x68, 0x65, 0x72, 0x65, // "here"
+        ]
+    );
+    assert_eq!(cbor::Encode::encoded_len(&value), enc.len());
+    assert_eq!(cbor::to_vec(&value), enc);
+    let dec: ArrayOrMap = cbor::from_slice(&enc).expect("map form should decode");
+    assert_eq!(dec, value);
+
+    // The array form decodes positionally, in field declaration order.
+    let dec: ArrayOrMap = cbor::from_slice(&[0x82, 0x0A, 0x44, 0x68, 0x65, 0x72, 0x65])
+        .expect("array form should decode");
+    assert_eq!(dec, value);
+    let dec: ArrayOrMap = cbor::from_slice(&[0x83, 0x0A, 0x40, 0x02]).unwrap();
+    assert_eq!(
+        dec,
+        ArrayOrMap {
+            foo: 10,
+            bytes: vec![],
+            baz: Some(2),
+        }
+    );
+
+    // Decoding in place accepts both forms as well.
+    let mut dec = ArrayOrMap::default();
+    cbor::Decode::decode_in_place(&mut dec, cbor::from_slice(&enc).unwrap()).unwrap();
+    assert_eq!(dec, value);
+    let mut dec = ArrayOrMap::default();
+    cbor::Decode::decode_in_place(
+        &mut dec,
+        cbor::from_slice(&[0x82, 0x0A, 0x44, 0x68, 0x65, 0x72, 0x65]).unwrap(),
+    )
+    .unwrap();
+    assert_eq!(dec, value);
+
+    // Each form is validated as usual.
+    let err = cbor::from_slice::<ArrayOrMap>(&[0x81, 0x0A]).unwrap_err();
+    assert!(matches!(err.root_cause(), cbor::DecodeError::MissingField));
+    let res: Result<ArrayOrMap, _> = cbor::from_slice(&[0x84, 0x0A, 0x40, 0x02, 0x00]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnknownField {
+            key: Some(cbor::Value::Unsigned(3))
+        })
+    ));
+    let res: Result<ArrayOrMap, _> = cbor::from_slice(&[0xA1, 0x61, 0x61, 0x00]);
+    assert!(matches!(res, Err(cbor::DecodeError::UnknownField { .. })));
+    let res: Result<ArrayOrMap, _> = cbor::from_slice(&[0x0A]);
+    assert!(matches!(res, Err(cbor::DecodeError::UnexpectedType)));
+}
+
+#[test]
+fn test_encode_as_map() {
+    fn validate<T: cbor::EncodeAsMap>(_x: T) {}
+    validate(AlwaysEncodesAsMap::Two(12));
+}
+
+/// A manual implementation which only encodes the value.
+struct Point {
+    x: u64,
+    y: u64,
+}
+
+impl cbor::Encode for Point {
+    fn to_cbor_value(&self) -> cbor::Value {
+        cbor::Value::Map(vec![
+            ("x".into(), cbor::Value::Unsigned(self.x)),
+            ("y".into(), cbor::Value::Unsigned(self.y)),
+        ])
+    }
+}
+
+impl cbor::EncodeAsMap for Point {}
+
+#[test]
+fn test_encode_default_len() {
+    let point = Point { x: 1, y: 1000 };
+    let enc = cbor::to_vec(&point);
+    assert_eq!(cbor::Encode::encoded_len(&point), enc.len());
+    assert_eq!(cbor::EncodeAsMap::cbor_map_len(&point), 2);
+    assert_eq!(cbor::to_vec(point), enc);
+}
+
+#[test]
+fn test_tuples() {
+    let t1 = (1u64, "two".to_string(), 3u64, 4u128);
+    let enc = cbor::to_vec(t1.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // [1, "two", 3, h'04']
+            0x84, // array(4)
+            0x01, // unsigned(1)
+            0x63, // text(3)
+            0x74, 0x77, 0x6F, // "two"
+            0x03, // unsigned(3)
+            0x41, // bytes(1)
+            0x04, // "\x04"
+        ]
+    );
+
+    let dec: (u64, String, u64, u128) = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, t1, "serialization should round-trip");
+
+    let t2 = (42u64, vec![0x01, 0x02], true);
+    let enc = cbor::to_vec(t2.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // [42, h'0102', true]
+            0x83, // array(3)
+            0x18, 0x2A, // unsigned(42)
+            0x42, // bytes(2)
+            0x01, 0x02, // "\x01\x02"
+            0xF5, // primitive(21)
+        ]
+    );
+    assert_eq!(cbor::Encode::encoded_len(&t2), enc.len());
+    let dec: (u64, Vec<u8>, bool) = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, t2, "serialization should round-trip");
+
+    // The array must have exactly as many elements as the tuple.
+    let result = cbor::from_slice::<(u64, Vec<u8>)>(&enc).expect_err("decoding should fail");
+    assert!(matches!(
+        result,
+        cbor::DecodeError::LengthMismatch {
+            expected: 2,
+            got: 3
+        }
+    ));
+    let result =
+        cbor::from_slice::<(u64, Vec<u8>, bool, u64)>(&enc).expect_err("decoding should fail");
+    assert!(matches!(
+        result,
+        cbor::DecodeError::LengthMismatch {
+            expected: 4,
+            got: 3
+        }
+    ));
+    let result = cbor::from_slice::<(u64,)>(&[0x80]).expect_err("decoding should fail");
+    assert!(matches!(
+        result,
+        cbor::DecodeError::LengthMismatch {
+            expected: 1,
+            got: 0
+        }
+    ));
+
+    // Largest supported tuple.
+    let t12 = (0u8, 1u8, 2u8, 3u8, 4u8, 5u8, 6u8, 7u8, 8u8, 9u8, 10u8, 11u8);
+    let enc = cbor::to_vec(t12);
+    let mut expected = vec![0x8C]; // array(12)
+    expected.extend(0..12);
+    assert_eq!(enc, expected);
+    assert_eq!(cbor::Encode::encoded_len(&t12), enc.len());
+    let dec: (u8, u8, u8, u8, u8, u8, u8, u8, u8, u8, u8, u8) = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, t12, "serialization should round-trip");
+
+    // The unit type encodes as null rather than as an empty array.
+    assert_eq!(cbor::to_vec(()), vec![0xF6]);
+    assert!(matches!(
+        cbor::from_slice::<()>(&[0x80]),
+        Err(cbor::DecodeError::UnexpectedType)
+    ));
+}
+
+#[test]
+fn test_non_string_keys() {
+    let nsk = NonStringKeys::One(10, 20);
+    let enc = cbor::to_vec(nsk.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {1: [10, 20]}
+            0xA1, // map(1)
+            0x01, // unsigned(1)
+            0x82, // array(2)
+            0x0A, // unsigned(10)
+            0x14, // unsigned(20)
+        ]
+    );
+
+    let dec: NonStringKeys = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, nsk, "serialization should round-trip");
+}
+
+#[test]
+fn test_unit_encode_decode() {
+    let data = vec![0xf6]; // Null.
+    let _dec: () = cbor::from_slice(&data).expect("unit type can be decoded from CBOR null");
+
+    let data = vec![0xf7]; // Undefined.
+    let _dec: () = cbor::from_slice(&data).expect("unit type can be decoded from CBOR undefined");
+}
+
+#[test]
+fn test_arrays() {
+    let a: [u64; 3] = [1, 2, 3];
+    let enc = cbor::to_vec(a);
+    assert_eq!(
+        enc,
+        vec![
+            // [1, 2, 3]
+            0x83, // array(3)
+            0x01, // unsigned(1)
+            0x02, // unsigned(2)
+            0x03, // unsigned(3)
+        ]
+    );
+    let dec: [u64; 3] = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, a, "serialization should round-trip");
+
+    let a: [String; 2] = ["foo".to_string(), "bar".to_string()];
+    let enc = cbor::to_vec(a.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // ["foo", "bar"]
+            0x82, // array(2)
+            0x63, // text(3)
+            0x66, 0x6F, 0x6F, // "foo"
+            0x63, // text(3)
+            0x62, 0x61, 0x72, // "bar"
+        ]
+    );
+    let dec: [String; 2] = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, a, "serialization should round-trip");
+
+    let result = cbor::from_slice::<[String; 3]>(&enc).expect_err("serialization should fail");
+    assert!(matches!(
+        result,
+        cbor::DecodeError::LengthMismatch {
+            expected: 3,
+            got: 2
+        }
+    ));
+}
+
+#[test]
+fn test_bytes() {
+    let a: Vec<u8> = vec![1, 2, 3];
+    let enc = cbor::to_vec(a.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // h'010203'
+            0x43, // bytes(3)
+            0x01, 0x02, 0x03 // "\x01\x02\x03"
+        ]
+    );
+    let dec: Vec<u8> = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, a, "serialization should round-trip");
+
+    let a: [u8; 3] = [1, 2, 3];
+    let enc = cbor::to_vec(a);
+    assert_eq!(
+        enc,
+        vec![
+            // h'010203'
+            0x43, // bytes(3)
+            0x01, 0x02, 0x03 // "\x01\x02\x03"
+        ]
+    );
+    let dec: [u8; 3] = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, a, "serialization should round-trip");
+
+    let result = cbor::from_slice::<[u8; 2]>(&enc).expect_err("serialization should fail");
+    assert!(matches!(
+        result,
+        cbor::DecodeError::LengthMismatch {
+            expected: 2,
+            got: 3
+        }
+    ));
+
+    // Fixed-size byte arrays must be encoded as byte strings.
+    let enc = cbor::to_vec([1u64, 2, 3]);
+    let result = cbor::from_slice::<[u8; 3]>(&enc).expect_err("serialization should fail");
+    assert!(matches!(result, cbor::DecodeError::UnexpectedType));
+}
+
+#[test]
+fn test_net_addresses() {
+    use std::net::{IpAddr, Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4, SocketAddrV6};
+
+    let ip = Ipv4Addr::new(192, 168, 0, 1);
+    let enc = cbor::to_vec(ip);
+    assert_eq!(enc, vec![0x44, 0xC0, 0xA8, 0x00, 0x01]);
+    assert_eq!(cbor::Encode::encoded_len(&ip), enc.len());
+    let dec: Ipv4Addr = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, ip);
+    let dec: IpAddr = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, IpAddr::V4(ip));
+
+    let ip = Ipv6Addr::new(0x2001, 0xDB8, 0, 0, 0, 0, 0, 1);
+    let enc = cbor::to_vec(IpAddr::V6(ip));
+    assert_eq!(enc.len(), 17);
+    assert_eq!(enc[0], 0x50); // bytes(16)
+    assert_eq!(enc[1..], ip.octets());
+    assert_eq!(cbor::Encode::encoded_len(&IpAddr::V6(ip)), enc.len());
+    let dec: Ipv6Addr = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, ip);
+    let dec: IpAddr = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, IpAddr::V6(ip));
+
+    // Byte strings of any other length are rejected.
+    let enc = cbor::to_vec(vec![0u8; 5]);
+    let err = cbor::from_slice::<Ipv4Addr>(&enc).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::LengthMismatch {
+            expected: 4,
+            got: 5
+        }
+    ));
+    let err = cbor::from_slice::<IpAddr>(&enc).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::LengthMismatch {
+            expected: 16,
+            got: 5
+        }
+    ));
+    let err = cbor::from_slice::<IpAddr>(&cbor::to_vec("127.0.0.1")).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnexpectedType));
+
+    let addr = SocketAddr::from(([127, 0, 0, 1], 8080));
+    let enc = cbor::to_vec(addr);
+    assert_eq!(
+        enc,
+        vec![
+            0x82, // array(2)
+            0x44, 0x7F, 0x00, 0x00, 0x01, // h'7F000001'
+            0x19, 0x1F, 0x90, // 8080
+        ]
+    );
+    assert_eq!(cbor::Encode::encoded_len(&addr), enc.len());
+    let dec: SocketAddr = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, addr);
+    let dec: SocketAddrV4 = cbor::from_slice(&enc).unwrap();
+    assert_eq!(SocketAddr::V4(dec), addr);
+
+    let addr = SocketAddr::V6(SocketAddrV6::new(ip, 443, 0, 0));
+    let enc = cbor::to_vec(addr);
+    assert_eq!(enc[..2], [0x82, 0x50]);
+    assert_eq!(cbor::Encode::encoded_len(&addr), enc.len());
+    let dec: SocketAddr = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, addr);
+
+    // Socket addresses must be pairs with a port that fits into 16 bits.
+    let enc = cbor::to_vec((Ipv4Addr::LOCALHOST, 80u16, 0u8));
+    let err = cbor::from_slice::<SocketAddr>(&enc).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::LengthMismatch {
+            expected: 2,
+            got: 3
+        }
+    ));
+    let enc = cbor::to_vec((Ipv4Addr::LOCALHOST, 65536u32));
+    let err = cbor::from_slice::<SocketAddr>(&enc).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::IntegerOverflow {
+            value: Some(65536),
+            target: "u16"
+        }
+    ));
+}
+
+#[test]
+fn test_char() {
+    let t1 = 'A';
+    let enc = cbor::to_vec(t1.clone());
+    assert_eq!(
+        enc,
+        vec![
+            0x18, 0x41, // unsigned(65)
+        ]
+    );
+
+    let dec: char = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, t1, "serialization should round-trip");
+
+    let bad_char = cbor::Value::Unsigned(0x110000); // invalid codepoint; unicode goes to 0x10ffff
+    let result: Result<char, _> = cbor::from_value(bad_char);
+    assert!(matches!(
+        result.expect_err("deserialization should fail"),
+        cbor::DecodeError::UnexpectedType
+    ));
+}
+
+#[test]
+fn test_invalid_utf8() {
+    #[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    struct Named {
+        name: String,
+    }
+
+    // Overlong encoding of "/".
+    let err = cbor::from_slice::<String>(&[0x62, 0xC0, 0xAF]).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::InvalidUtf8 { offset: 0 }));
+    assert_eq!(err.offset(), Some(0));
+
+    // Lone surrogate (U+D800) as a field value.
+    let err =
+        cbor::from_slice::<Named>(&[0xA1, 0x64, 0x6E, 0x61, 0x6D, 0x65, 0x63, 0xED, 0xA0, 0x80])
+            .unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::InvalidUtf8 { offset: 6 }));
+    assert_eq!(err.to_string(), "invalid UTF-8 in text string at offset 6");
+
+    // Byte strings are not validated.
+    let dec: Vec<u8> = cbor::from_slice(&[0x42, 0xC0, 0xAF]).unwrap();
+    assert_eq!(dec, vec![0xC0, 0xAF]);
+}
+
+#[test]
+fn test_skip_field() {
+    let sk = SkipVariantsAndFields::First { foo: 10, bar: 20 };
+    let enc = cbor::to_vec(sk);
+    assert_eq!(
+        enc,
+        vec![
+            // {"First": {"foo": 10}}
+            0xA1, // map(1)
+            0x65, // text(5)
+            0x46, 0x69, 0x72, 0x73, 0x74, // "First"
+            0xA1, // map(1)
+            0x63, // text(3)
+            0x66, 0x6F, 0x6F, // "foo"
+            0x0A, // unsigned(10)
+        ],
+    );
+    let dec: SkipVariantsAndFields = cbor::from_slice(&enc).expect("deserialization should work");
+    let expected = SkipVariantsAndFields::First {
+        foo: 10,
+        bar: 0, // Should be replaced with default value.
+    };
+    assert_eq!(dec, expected, "deserialization should work");
+}
+
+#[test]
+fn test_skip_field_default() {
+    let value = SkipCachedFields {
+        data: vec![1, 2],
+        len: 2,
+        checksum: Checksum(3),
+    };
+    let enc = cbor::to_vec(value.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"data": h'0102'}
+            0xA1, // map(1)
+            0x64, // text(4)
+            0x64, 0x61, 0x74, 0x61, // "data"
+            0x42, // bytes(2)
+            0x01, 0x02,
+        ],
+    );
+    assert_eq!(cbor::Encode::encoded_len(&value), enc.len());
+    assert_eq!(cbor::to_vec(&value), enc);
+    let dec: SkipCachedFields = cbor::from_slice(&enc).expect("decoding should work");
+    assert_eq!(
+        dec,
+        SkipCachedFields {
+            data: vec![1, 2],
+            len: 0,
+            checksum: unknown_checksum(),
+        },
+        "skipped fields should be reconstructed from their defaults"
+    );
+
+    // Skipped fields cannot be decoded even when present in the encoding.
+    let res: Result<SkipCachedFields, _> = cbor::from_slice(&[
+        0xA2, // map(2)
+        0x63, // text(3)
+        0x6C, 0x65, 0x6E, // "len"
+        0x02, // unsigned(2)
+        0x64, // text(4)
+        0x64, 0x61, 0x74, 0x61, // "data"
+        0x40, // bytes(0)
+    ]);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::UnknownField { key: Some(cbor::Value::TextString(key)) }) if key == "len"
+    ));
+}
+
+#[test]
+fn test_skip_variant() {
+    let skv_data = vec![
+        // {"Second": {"a": 10}}
+        0xA1, // map(1)
+        0x66, // text(6)
+        0x53, 0x65, 0x63, 0x6F, 0x6E, 0x64, // "Second"
+        0xA1, // map(1)
+        0x61, // text(1)
+        0x61, // "a"
+        0x0A, // unsigned(10)
+    ];
+    let result = cbor::from_slice::<SkipVariantsAndFields>(&skv_data)
+        .expect_err("deserialization of skipped variant should fail");
+    assert!(matches!(
+        result,
+        cbor::DecodeError::UnknownField { key: Some(cbor::Value::TextString(ref key)) } if key == "Second"
+    ));
+
+    // Serialization of an unserializable variant should result in undefined.
+    let sk = SkipVariantsAndFields::Second { a: 10 };
+    let enc = cbor::to_vec(sk);
+    assert_eq!(enc, vec![247]);
+}
+
+#[test]
+fn test_unit_variant_as_struct() {
+    let uv = UnitEnumVariantAsStruct::One;
+    let enc = cbor::to_vec(uv.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"one": {}}
+            0xA1, // map(1)
+            0x63, // text(3)
+            0x6F, 0x6E, 0x65, // "one"
+            0xA0, // map(0)
+        ],
+    );
+    let dec: UnitEnumVariantAsStruct =
+        cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, uv, "serialization should round-trip");
+}
+
+#[test]
+fn test_unit_variant_map_forms() {
+    // Unit variants are encoded as their bare key.
+    let enc = cbor::to_vec(UnitOnlyAction::Instantiate);
+    assert_eq!(enc, cbor::to_vec("instantiate"));
+    let enc = cbor::to_vec(MixedAction::Instantiate);
+    assert_eq!(enc, cbor::to_vec("instantiate"));
+
+    // But also decode from a map of the key to null or to an empty map.
+    let forms = vec![
+        cbor::to_vec("instantiate"),
+        cbor::to_vec(cbor::cbor_map! { "instantiate" => cbor::cbor_null!() }),
+        cbor::to_vec(cbor::cbor_map! { "instantiate" => cbor::cbor_map! {} }),
+    ];
+    for enc in forms {
+        let dec: UnitOnlyAction = cbor::from_slice(&enc).expect("unit variant should decode");
+        assert_eq!(dec, UnitOnlyAction::Instantiate);
+        let dec: MixedAction = cbor::from_slice(&enc).expect("unit variant should decode");
+        assert_eq!(dec, MixedAction::Instantiate);
+    }
+
+    // Variants with fields are not affected.
+    let ma = MixedAction::Call {
+        method: "transfer".to_string(),
+    };
+    let enc = cbor::to_vec(ma.clone());
+    let dec: MixedAction = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, ma, "serialization should round-trip");
+    let enc = cbor::to_vec(cbor::cbor_map! { "upgrade" => 2 });
+    let dec: MixedAction = cbor::from_slice(&enc).expect("newtype variant should decode");
+    assert_eq!(dec, MixedAction::Upgrade(2));
+
+    // Any other value of the entry is rejected.
+    let enc = cbor::to_vec(cbor::cbor_map! { "instantiate" => 1 });
+    let err = cbor::from_slice::<UnitOnlyAction>(&enc).expect_err("value should be rejected");
+    assert_eq!(err.to_string(), "instantiate: unexpected type");
+    let err = cbor::from_slice::<MixedAction>(&enc).expect_err("value should be rejected");
+    assert_eq!(err.to_string(), "instantiate: unexpected type");
+    let enc = cbor::to_vec(cbor::cbor_map! { "instantiate" => cbor::cbor_map! { "foo" => 1 } });
+    cbor::from_slice::<UnitOnlyAction>(&enc).expect_err("non-empty map should be rejected");
+
+    // As are maps with more than one entry.
+    let enc = cbor::to_vec(cbor::cbor_map! {
+        "instantiate" => cbor::cbor_null!(),
+        "upgrade" => cbor::cbor_null!()
+    });
+    cbor::from_slice::<UnitOnlyAction>(&enc).expect_err("multiple entries should be rejected");
+    cbor::from_slice::<MixedAction>(&enc).expect_err("multiple entries should be rejected");
+}
+
+#[test]
+fn test_embed_variant() {
+    let ep = EmbedParent::B(EmbedChild::E(42));
+    let enc = cbor::to_vec(ep.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"E": 42}
+            0xA1, // map(1)
+            0x61, // text(1)
+            0x45, // "E"
+            0x18, 0x2A, // unsigned(42)
+        ],
+    );
+    let dec: EmbedParent = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, ep, "serialization should round-trip");
+
+    // When there's an overlapping field, the parent field is always used when decoding.
+    let ep = EmbedParent::C(42);
+    let enc = cbor::to_vec(ep.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"C": 42}
+            0xA1, // map(1)
+            0x61, // text(1)
+            0x43, // "C"
+            0x18, 0x2A, // unsigned(42)
+        ],
+    );
+    let dec: EmbedParent = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, ep, "serialization should round-trip");
+
+    // Using the child field that overlaps will not round-trip.
+    let ep = EmbedParent::B(EmbedChild::C("foo".to_string()));
+    let enc = cbor::to_vec(ep);
+    assert_eq!(
+        enc,
+        vec![
+            // {"C": "foo"}
+            0xA1, // map(1)
+            0x61, // text(1)
+            0x43, // "C"
+            0x63, // text(3)
+            0x66, 0x6F, 0x6F, // "foo"
+        ],
+    );
+    let result =
+        cbor::from_slice::<EmbedParent>(&enc).expect_err("parent field should take precedence");
+    assert!(matches!(
+        result.root_cause(),
+        cbor::DecodeError::UnexpectedType
+    ));
+    assert_eq!(result.to_string(), "C: unexpected type");
+}
+
+#[test]
+fn test_custom_encode_decode() {
     let ct = CustomEncodeDecode {
         foo: CustomType("almost a string".to_owned()),
     };
-    let enc = cbor::to_vec(ct.clone());
-    let dec: CustomEncodeDecode = cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, ct);
+    let enc = cbor::to_vec(ct.clone());
+    let dec: CustomEncodeDecode = cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, ct);
+}
+
+#[test]
+fn test_custom_encode_decode_with() {
+    let ct = CustomEncodeDecodeWith {
+        foo: CustomType("ab".to_owned()),
+    };
+    let enc = cbor::to_vec(ct.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"foo": h'6162'}
+            0xA1, // map(1)
+            0x63, // text(3)
+            0x66, 0x6F, 0x6F, // "foo"
+            0x42, // bytes(2)
+            0x61, 0x62, // "ab"
+        ]
+    );
+    let dec: CustomEncodeDecodeWith =
+        cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, ct);
+}
+
+#[test]
+fn test_custom_encode_decode_array() {
+    let ct = CustomEncodeDecodeArray {
+        foo: CustomType("almost a string".to_owned()),
+    };
+    let enc = cbor::to_vec(ct.clone());
+    let dec: CustomEncodeDecodeArray =
+        cbor::from_slice(&enc).expect("serialization should round-trip");
+    assert_eq!(dec, ct);
+}
+
+#[test]
+fn test_encoded_len() {
+    fn check<T: cbor::Encode + Clone + std::fmt::Debug>(value: T) {
+        let len = cbor::Encode::encoded_len(&value);
+        assert_eq!(
+            cbor::to_vec(value.clone()).len(),
+            len,
+            "encoded length should match for {:?}",
+            value
+        );
+    }
+
+    // Primitive types, including the boundaries of each header width.
+    for v in [
+        0u64,
+        23,
+        24,
+        0xFF,
+        0x100,
+        0xFFFF,
+        0x10000,
+        0xFFFF_FFFF,
+        0x1_0000_0000,
+        u64::MAX,
+    ] {
+        check(v);
+        check(&v);
+    }
+    for v in [0i64, -1, -24, -25, -0x100, -0x101, i64::MIN, i64::MAX] {
+        check(v);
+    }
+    for v in [0i8, -24, -25, i8::MIN, i8::MAX] {
+        check(v);
+    }
+    for v in [
+        std::time::UNIX_EPOCH,
+        std::time::UNIX_EPOCH + std::time::Duration::from_secs(0x1_0000_0000),
+        std::time::UNIX_EPOCH + std::time::Duration::from_nanos(1),
+        std::time::UNIX_EPOCH - std::time::Duration::from_secs(24),
+        std::time::UNIX_EPOCH - std::time::Duration::from_secs(25),
+        std::time::UNIX_EPOCH - std::time::Duration::from_nanos(1),
+    ] {
+        check(v);
+    }
+    for v in [
+        std::time::Duration::ZERO,
+        std::time::Duration::new(u64::MAX, 999_999_999),
+    ] {
+        check(v);
+    }
+    for v in [0u128, 1, 0x100, u128::MAX] {
+        check(v);
+    }
+    for v in [
+        0i128,
+        -1,
+        i64::MIN as i128 - 1,
+        u64::MAX as i128 + 1,
+        i128::MIN,
+        i128::MAX,
+    ] {
+        check(v);
+    }
+    check(1.5f32);
+    check(-4.1f64);
+    check(true);
+    check('a');
+    check('\u{1F600}');
+    check(());
+    check("");
+    check("a".repeat(24));
+    check("a".repeat(0x100));
+    check(vec![0x2Au8; 24]);
+    check([0x2Au8; 32]);
+    check(Cow::Borrowed("foo"));
+    check(Cow::<[u8]>::Owned(vec![0x2Au8; 24]));
+    check(vec![1u64; 24]);
+    check([0x10000u64; 3]);
+    check(None::<u64>);
+    check(Some(1000u64));
+    check((1u64, "foo", vec![true]));
+    check(BTreeMap::from([(1u64, "one"), (24, "twenty-four")]));
+    check(HashMap::from([
+        ("a".to_owned(), 1u64),
+        ("b".to_owned(), 0x10000),
+    ]));
+    check(BTreeSet::from([1u64, 0x100]));
+    check(HashSet::from([1u64, 0x100]));
+    check(cbor::Value::Tag(24, Box::new(cbor::Value::Float(1.0))));
+
+    // Derived structures.
+    check(A {
+        foo: 0xFFFF,
+        bar: "a".repeat(30),
+        nested: B {
+            foo: 1,
+            bytes: vec![0; 300],
+        },
+        optional: None,
+        always: Some(true),
+        renamed: false,
+    });
+    check(E(24, "foo".to_owned(), true));
+    check(Transparent(0x10000));
+    check(NonTransparent(0x10000));
+    check(WithOptionalDefault::default());
+    check(WithOptional {
+        bar: "bar".to_owned(),
+    });
+    check(Unit);
+    check(Untagged::First { a: 1, b: 0x100 });
+    check(AsArray {
+        foo: 42,
+        bytes: vec![1, 2, 3],
+    });
+    check(CustomEncodeDecode {
+        foo: CustomType("custom".to_owned()),
+    });
+    check(CustomEncodeDecodeWith {
+        foo: CustomType("custom".to_owned()),
+    });
+    check(CustomEncodeDecodeArray {
+        foo: CustomType("custom".to_owned()),
+    });
+    check(RenameAll::default());
+    check(IntegerKeys {
+        version: 1,
+        body: "body".to_owned(),
+        kind: 2,
+    });
+    check(MixedKeys::default());
+    check(EmbedMessage {
+        header: EmbedHeader {
+            version: 1,
+            nonce: 0,
+        },
+        body: "body".to_owned(),
+    });
+    check(EmbedMessage {
+        header: EmbedHeader {
+            version: 1,
+            nonce: 0x10000,
+        },
+        body: "body".to_owned(),
+    });
+    check(WithDefaults::default());
+    check(SkipIfDefault::default());
+    check(SkipIfDefault {
+        id: 1,
+        items: vec![1, 2],
+        inner: NoTryDefault { foo: 3 },
+        note: Some("note".to_owned()),
+    });
+    check(SemanticallyTagged { foo: 24 });
+    check(SemanticallyTaggedNewtype(vec![0; 24]));
+    check(OwnedMessage::default());
+
+    // Derived enums.
+    for v in [C::One, C::Two, C::Three, C::Four, C::Five] {
+        check(v);
+    }
+    check(D::One);
+    check(D::Two(24));
+    check(D::Three(1, 0x100));
+    check(D::Four {
+        foo: 1,
+        bar: "bar".to_owned(),
+        nested: B::default(),
+    });
+    check(NonStringKeys::One(1, 2));
+    check(NonStringKeys::Two);
+    check(NonStringKeys::Three { foo: 3 });
+    check(OrderEnum::Foo {
+        second: 2,
+        first: "".to_owned(),
+        thirdd: true,
+    });
+    check(SkipVariantsAndFields::First { foo: 1, bar: 2 });
+    check(SkipVariantsAndFields::Second { a: 1 });
+    check(UnitEnumVariantAsStruct::One);
+    check(UnitEnumVariantAsStruct::Two {});
+    check(EmbedParent::A("a".to_owned()));
+    check(EmbedParent::B(EmbedChild::E(1)));
+    check(InternallyTagged::V0 { foo: 1 });
+    check(InternallyTagged::V1 { bar: 0x100 });
+    check(InternallyTagged::V2(Order::default()));
+    check(RenameAllEnum::FirstVariant);
+    check(RenameAllEnum::SecondVariant { inner_field: 1 });
+
+    // Maps with enough entries to require a wider header.
+    check((0..24u64).map(|i| (i, Unit)).collect::<BTreeMap<_, _>>());
+}
+
+#[test]
+fn test_null_decode() {
+    fn decode_from_null<T: cbor::Decode + Default + std::fmt::Debug + PartialEq>() {
+        let data = vec![0xf6]; // Null.
+        let dec1: T = cbor::from_slice(&data).expect(&format!(
+            "type {} can be decoded from CBOR null",
+            std::any::type_name::<T>()
+        ));
+
+        let data = vec![0xf7]; // Undefined.
+        let dec2: T = cbor::from_slice(&data).expect(&format!(
+            "type {} can be decoded from CBOR undefined",
+            std::any::type_name::<T>()
+        ));
+
+        assert_eq!(dec1, dec2);
+        assert_eq!(dec1, Default::default());
+    }
+
+    fn decode_from_null_special<T: cbor::Decode + std::fmt::Debug + PartialEq>(value: T) {
+        let data = vec![0xf6]; // Null.
+        let dec1: T = cbor::from_slice(&data).expect(&format!(
+            "type {} can be decoded from CBOR null",
+            std::any::type_name::<T>()
+        ));
+
+        let data = vec![0xf7]; // Undefined.
+        let dec2: T = cbor::from_slice(&data).expect(&format!(
+            "type {} can be decoded from CBOR undefined",
+            std::any::type_name::<T>()
+        ));
+
+        assert_eq!(dec1, dec2);
+        assert_eq!(dec1, value);
+    }
+
+    fn not_decode_from_null<T: cbor::Decode + std::fmt::Debug>() {
+        let data = vec![0xf6]; // Null.
+        cbor::from_slice::<T>(&data).expect_err(&format!(
+            "type {} should not be decoded from CBOR null",
+            std::any::type_name::<T>()
+        ));
+
+        let data = vec![0xf7]; // Undefined.
+        cbor::from_slice::<T>(&data).expect_err(&format!(
+            "type {} should not be decoded from CBOR undefined",
+            std::any::type_name::<T>()
+        ));
+    }
+
+    decode_from_null::<A>();
+    decode_from_null::<B>();
+    decode_from_null::<C>();
+    decode_from_null::<bool>();
+    decode_from_null::<u8>();
+    decode_from_null::<u32>();
+    decode_from_null::<u128>();
+    decode_from_null::<i128>();
+    decode_from_null::<i8>();
+    decode_from_null::<i32>();
+    decode_from_null::<char>();
+    decode_from_null::<String>();
+    decode_from_null::<Vec<u8>>();
+    decode_from_null::<Vec<String>>();
+    decode_from_null::<BTreeMap<String, String>>();
+    decode_from_null::<BTreeSet<String>>();
+    decode_from_null::<HashMap<String, String>>();
+    decode_from_null::<HashSet<String>>();
+    decode_from_null::<Option<String>>();
+    decode_from_null::<()>();
+    decode_from_null::<[u8; 32]>();
+
+    decode_from_null_special::<cbor::Value>(cbor::Value::Simple(cbor::SimpleValue::NullValue));
+
+    not_decode_from_null::<[u16; 32]>();
+    not_decode_from_null::<[String; 32]>();
+    not_decode_from_null::<D>();
+    not_decode_from_null::<E>(); // Tagged with cbor(no_default).
+}
+
+#[test]
+fn encode_empty() {
+    fn encode_is_empty<T: cbor::Encode>(value: T) {
+        #[derive(cbor::Encode)]
+        struct WithField<U: cbor::Encode> {
+            #[cbor(optional)]
+            field: U,
+        }
+
+        let enc = cbor::to_vec(WithField { field: value });
+        assert_eq!(enc, vec![0xA0]) // {}
+    }
+
+    encode_is_empty(false);
+    encode_is_empty(0u8);
+    encode_is_empty(0u16);
+    encode_is_empty(0u32);
+    encode_is_empty(0u64);
+    encode_is_empty(0u128);
+    encode_is_empty(0i8);
+    encode_is_empty(0i16);
+    encode_is_empty(0i32);
+    encode_is_empty(0i64);
+    encode_is_empty(&0u8);
+    encode_is_empty(&0u16);
+    encode_is_empty(&0u32);
+    encode_is_empty(&0u64);
+    encode_is_empty(&0u128);
+    encode_is_empty(&0i8);
+    encode_is_empty(&0i16);
+    encode_is_empty(&0i32);
+    encode_is_empty(&0i64);
+    encode_is_empty('\x00');
+    encode_is_empty(String::new());
+    encode_is_empty("");
+    encode_is_empty(None::<String>);
+    encode_is_empty(vec![]);
+    encode_is_empty(BTreeMap::<String, String>::new());
+    encode_is_empty(BTreeSet::<String>::new());
+    encode_is_empty(HashMap::<String, String>::new());
+    encode_is_empty(HashSet::<String>::new());
+    encode_is_empty(());
+    encode_is_empty((false, 0u8));
+    encode_is_empty((false, 0u8, String::new()));
+    encode_is_empty((false, 0u8, String::new(), 0i64));
+    encode_is_empty((false, 0u8, 0u16, 0u128, vec![]));
+    encode_is_empty(cbor::Value::Simple(cbor::SimpleValue::NullValue));
+    encode_is_empty(cbor::Value::Simple(cbor::SimpleValue::Undefined));
+}
+
+#[test]
+fn test_seq() {
+    let items = vec![
+        B {
+            foo: 1,
+            bytes: vec![],
+        },
+        B {
+            foo: 2,
+            bytes: vec![0xFF],
+        },
+    ];
+    let mut enc = cbor::encode_seq(items.clone());
+    // The sequence is simply the concatenation of the encoded items.
+    assert_eq!(
+        enc,
+        [
+            cbor::to_vec(items[0].clone()),
+            cbor::to_vec(items[1].clone())
+        ]
+        .concat()
+    );
+    let dec: Vec<B> = cbor::decode_seq(&enc).unwrap();
+    assert_eq!(dec, items, "serialization should round-trip");
+
+    // More items can be appended later.
+    cbor::encode_into(items[0].clone(), &mut enc).unwrap();
+    let dec: Vec<B> = cbor::decode_seq(&enc).unwrap();
+    assert_eq!(dec.len(), 3);
+    assert_eq!(dec[2], items[0]);
+
+    // An empty sequence has no items.
+    assert!(cbor::encode_seq(Vec::<B>::new()).is_empty());
+    assert!(cbor::decode_seq::<B>(&[]).unwrap().is_empty());
+
+    // A partial trailing item is an error, with an offset from the start of the sequence.
+    let err = cbor::decode_seq::<B>(&enc[..enc.len() - 1]).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::UnexpectedEof { offset } if offset == enc.len() - 1
+    ));
+
+    // Errors converting an item include its index.
+    let enc = cbor::encode_seq([1u64, 1000, 2]);
+    let err = cbor::decode_seq::<u8>(&enc).unwrap_err();
+    assert!(matches!(
+        err.root_cause(),
+        cbor::DecodeError::IntegerOverflow {
+            value: Some(1000),
+            target: "u8"
+        }
+    ));
+    assert_eq!(err.to_string(), "1: integer 1000 out of range for u8");
+}
+
+#[test]
+fn test_decode_into() {
+    use cbor::DecodeInto;
+
+    let b = B {
+        foo: 42,
+        bytes: vec![1, 2],
+    };
+    let enc = cbor::to_vec(b.clone());
+    let value: cbor::Value = cbor::from_slice(&enc).unwrap();
+    // Route on a field before decoding into the concrete type.
+    let is_b = match &value {
+        cbor::Value::Map(items) => items
+            .iter()
+            .any(|(k, _)| k == &cbor::Value::TextString("bytes".to_owned())),
+        _ => false,
+    };
+    assert!(is_b);
+    let dec: B = value.decode_into().unwrap();
+    assert_eq!(dec, b);
+    let err = value.decode_into::<A>().unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnknownField { .. }));
+
+    let enc = vec![
+        // {"foo": 1, "foo": 2, "bytes": h''}
+        0xA3, // map(3)
+        0x63, // text(3)
+        0x66, 0x6F, 0x6F, // "foo"
+        0x01, // unsigned(1)
+        0x63, // text(3)
+        0x66, 0x6F, 0x6F, // "foo"
+        0x02, // unsigned(2)
+        0x65, // text(5)
+        0x62, 0x79, 0x74, 0x65, 0x73, // "bytes"
+        0x40, // bytes(0)
+    ];
+    let value: cbor::Value = cbor::from_slice_non_strict(&enc).unwrap();
+    // The same options are honored as when decoding from the encoding.
+    let err = value.decode_into::<B>().unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::NonCanonical { offset: 6 }));
+    let err = value
+        .decode_into_with::<B>(&cbor::DecodeOptions {
+            reject_duplicate_keys: true,
+            ..Default::default()
+        })
+        .unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::DuplicateMapKey { offset: 6 }
+    ));
+    let err = cbor::from_slice_with::<B>(
+        &enc,
+        &cbor::DecodeOptions {
+            reject_duplicate_keys: true,
+            ..Default::default()
+        },
+    )
+    .unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::DuplicateMapKey { offset: 6 }
+    ));
+    let err = value
+        .decode_into_with::<B>(&cbor::DecodeOptions {
+            max_depth: Some(0),
+            ..Default::default()
+        })
+        .unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::DepthLimitExceeded { offset: 1 }
+    ));
+}
+
+#[test]
+fn test_decode_in_place() {
+    #[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+    #[cbor(transparent)]
+    struct Ids(Vec<u64>);
+
+    #[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+    struct Inner {
+        values: Vec<u64>,
+    }
+
+    #[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+    struct Scratch {
+        ids: Ids,
+        names: Vec<String>,
+        counts: HashMap<String, u64>,
+        inner: Vec<Inner>,
+        boxed: Box<Inner>,
+        #[cbor(optional)]
+        note: Option<Inner>,
+        #[cbor(skip)]
+        cache: u64,
+        data: Vec<u8>,
+        label: String,
+    }
+
+    let first = Scratch {
+        ids: Ids((0..100).collect()),
+        names: vec!["a".to_owned(), "b".to_owned()],
+        counts: (0..50).map(|i| (i.to_string(), i)).collect(),
+        inner: vec![
+            Inner {
+                values: (0..100).collect(),
+            },
+            Inner { values: vec![1] },
+        ],
+        boxed: Box::new(Inner {
+            values: (0..100).collect(),
+        }),
+        note: Some(Inner {
+            values: (0..100).collect(),
+        }),
+        cache: 0,
+        data: vec![0xAB; 100],
+        label: "x".repeat(100),
+    };
+    let second = Scratch {
+        ids: Ids(vec![1, 2, 3]),
+        names: vec!["c".to_owned()],
+        counts: vec![("x".to_owned(), 1)].into_iter().collect(),
+        inner: vec![Inner { values: vec![4] }],
+        boxed: Box::new(Inner { values: vec![5] }),
+        note: Some(Inner { values: vec![6] }),
+        cache: 0,
+        data: vec![0xCD; 10],
+        label: "y".to_owned(),
+    };
+
+    let mut scratch = Scratch {
+        cache: 42,
+        ..Default::default()
+    };
+    cbor::from_slice_in_place(&cbor::to_vec(&first), &mut scratch).unwrap();
+    assert_eq!(scratch, first);
+
+    // Decoding again reuses the allocations of the collections.
+    let ids = scratch.ids.0.as_ptr();
+    let inner = scratch.inner[0].values.as_ptr();
+    let boxed = scratch.boxed.values.as_ptr();
+    let note = scratch.note.as_ref().unwrap().values.as_ptr();
+    let counts_capacity = scratch.counts.capacity();
+    let data = scratch.data.as_ptr();
+    let label = scratch.label.as_ptr();
+    cbor::from_slice_in_place(&cbor::to_vec(&second), &mut scratch).unwrap();
+    assert_eq!(scratch, second);
+    assert_eq!(scratch.ids.0.as_ptr(), ids);
+    assert_eq!(scratch.inner[0].values.as_ptr(), inner);
+    assert_eq!(scratch.boxed.values.as_ptr(), boxed);
+    assert_eq!(scratch.note.as_ref().unwrap().values.as_ptr(), note);
+    assert_eq!(scratch.counts.capacity(), counts_capacity);
+    assert_eq!(scratch.data.as_ptr(), data);
+    assert_eq!(scratch.label.as_ptr(), label);
+
+    #[derive(cbor::Encode)]
+    struct Partial {
+        ids: Vec<u64>,
+        boxed: Inner,
+    }
+
+    // Missing fields are reset the same as when decoding into a new instance.
+    let enc = cbor::to_vec(Partial {
+        ids: vec![7],
+        boxed: Inner::default(),
+    });
+    cbor::from_slice_in_place(&enc, &mut scratch).unwrap();
+    assert_eq!(scratch, cbor::from_slice::<Scratch>(&enc).unwrap());
+    assert_eq!(scratch.ids.0.as_ptr(), ids);
+
+    // Errors are reported the same as when decoding into a new instance.
+    #[derive(cbor::Encode)]
+    struct Invalid {
+        ids: String,
+    }
+    #[derive(cbor::Encode)]
+    struct Unknown {
+        unknown: u64,
+    }
+
+    let enc = cbor::to_vec(Invalid {
+        ids: "x".to_owned(),
+    });
+    let err = cbor::from_slice_in_place(&enc, &mut scratch).unwrap_err();
+    assert!(matches!(
+        err.root_cause(),
+        cbor::DecodeError::UnexpectedType
+    ));
+    assert_eq!(err.to_string(), "ids: unexpected type");
+    let enc = cbor::to_vec(Unknown { unknown: 1 });
+    let err = cbor::from_slice_in_place(&enc, &mut scratch).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnknownField { .. }));
+    let err = cbor::from_slice_in_place(&[0x80], &mut scratch).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnexpectedType));
+}
+
+#[test]
+fn test_decode_with_visitor() {
+    /// Visitor summing all integers and collecting top-level text strings, without building a `Value`.
+    #[derive(Default)]
+    struct Collector {
+        depth: usize,
+        strings: Vec<String>,
+        sum: u64,
+    }
+
+    impl cbor::Visitor for Collector {
+        type Error = cbor::DecodeError;
+
+        fn visit_u64(&mut self, value: u64) -> Result<(), cbor::DecodeError> {
+            self.sum += value;
+            Ok(())
+        }
+
+        fn visit_str(&mut self, value: &str) -> Result<(), cbor::DecodeError> {
+            if self.depth == 1 {
+                self.strings.push(value.to_owned());
+            }
+            Ok(())
+        }
+
+        fn visit_array_start(&mut self, _len: Option<u64>) -> Result<(), cbor::DecodeError> {
+            Err(cbor::DecodeError::UnexpectedType)
+        }
+
+        fn visit_map_start(&mut self, _len: Option<u64>) -> Result<(), cbor::DecodeError> {
+            self.depth += 1;
+            Ok(())
+        }
+
+        fn visit_end(&mut self) -> Result<(), cbor::DecodeError> {
+            self.depth -= 1;
+            Ok(())
+        }
+    }
+
+    let enc = cbor::to_vec(A {
+        foo: 40,
+        bar: "baz".to_owned(),
+        nested: B {
+            foo: 2,
+            ..Default::default()
+        },
+        ..Default::default()
+    });
+    let mut collector = Collector::default();
+    cbor::decode_with_visitor(&enc, &mut collector).unwrap();
+    assert_eq!(collector.depth, 0);
+    assert_eq!(collector.sum, 42);
+    assert_eq!(
+        collector.strings,
+        vec!["bar", "baz", "foo", "always", "nested", "different"]
+    );
+
+    // Errors from the visitor abort the walk.
+    let mut collector = Collector::default();
+    let err = cbor::decode_with_visitor(&[0xA1, 0x01, 0x80], &mut collector).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnexpectedType));
+
+    // Trailing data is rejected.
+    let mut collector = Collector::default();
+    let err = cbor::decode_with_visitor(&[0x01, 0x02], &mut collector).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::TrailingData { offset: 1 }));
+}
+
+#[test]
+fn test_unassigned_simple_values() {
+    let value: cbor::Value = cbor::from_slice(&[0x82, 0xF0, 0xF8, 0xFF]).unwrap();
+    assert_eq!(
+        value,
+        cbor::Value::Array(vec![
+            cbor::Value::Simple(cbor::SimpleValue::from_integer(16).unwrap()),
+            cbor::Value::Simple(cbor::SimpleValue::from_integer(255).unwrap()),
+        ])
+    );
+    assert_eq!(cbor::to_vec(value), vec![0x82, 0xF0, 0xF8, 0xFF]);
+
+    // Reserved and ill-formed two-byte encodings are rejected.
+    cbor::from_slice::<cbor::Value>(&[0xF8, 0x1C]).unwrap_err();
+    cbor::from_slice_non_strict::<cbor::Value>(&[0xF8, 0x10]).unwrap_err();
+
+    // Unassigned values are not booleans.
+    let err = cbor::from_slice::<bool>(&[0xF0]).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnexpectedType));
+}
+
+#[test]
+fn test_shrink_floats() {
+    #[derive(Debug, Clone, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    struct Reading {
+        half: f64,
+        single: f32,
+        double: f64,
+    }
+
+    let shrink = cbor::EncodeOptions {
+        shrink_floats: true,
+        ..Default::default()
+    };
+    let reading = Reading {
+        half: 0.5,
+        single: 0.1,
+        double: 0.1,
+    };
+    let enc = cbor::to_vec_with(reading.clone(), &shrink).unwrap();
+    assert_eq!(
+        enc,
+        vec![
+            0xA3, // map(3)
+            0x64, // text(4)
+            0x68, 0x61, 0x6C, 0x66, // "half"
+            0xF9, 0x38, 0x00, // half(0.5)
+            0x66, // text(6)
+            0x64, 0x6F, 0x75, 0x62, 0x6C, 0x65, // "double"
+            0xFB, 0x3F, 0xB9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A, // double(0.1)
+            0x66, // text(6)
+            0x73, 0x69, 0x6E, 0x67, 0x6C, 0x65, // "single"
+            0xFA, 0x3D, 0xCC, 0xCC, 0xCD, // single(0.1)
+        ],
+    );
+    assert!(enc.len() < cbor::to_vec(reading.clone()).len());
+
+    // Shorter floats are widened when decoding.
+    let dec: Reading = cbor::from_slice_non_strict(&enc).unwrap();
+    assert_eq!(dec, reading);
+}
+
+#[test]
+fn test_non_finite_floats() {
+    #[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    struct A {
+        value: f64,
+    }
+
+    let reject = cbor::DecodeOptions {
+        reject_non_finite: true,
+        ..Default::default()
+    };
+    let enc = cbor::to_vec(A { value: 1.5 });
+    let dec: A = cbor::from_slice_with(&enc, &reject).unwrap();
+    assert_eq!(dec, A { value: 1.5 });
+
+    // {"value": Infinity} and {"value": NaN} in half precision.
+    for enc in [
+        [0xA1, 0x65, 0x76, 0x61, 0x6C, 0x75, 0x65, 0xF9, 0x7C, 0x00],
+        [0xA1, 0x65, 0x76, 0x61, 0x6C, 0x75, 0x65, 0xF9, 0x7E, 0x00],
+    ] {
+        let err = cbor::from_slice_with::<A>(&enc, &reject).unwrap_err();
+        assert!(matches!(
+            err,
+            cbor::DecodeError::NonFiniteFloat { offset: 7 }
+        ));
+        cbor::from_slice_non_strict::<A>(&enc).unwrap();
+    }
+
+    // Encoding rejects non-finite floats only when asked to.
+    let reject = cbor::EncodeOptions {
+        reject_non_finite: true,
+        ..Default::default()
+    };
+    let err = cbor::to_vec_with(
+        A {
+            value: f64::NEG_INFINITY,
+        },
+        &reject,
+    )
+    .unwrap_err();
+    assert!(matches!(err, cbor::EncodeError::NonFiniteFloat));
+    assert_eq!(
+        cbor::to_vec_with(A { value: 1.5 }, &reject).unwrap(),
+        cbor::to_vec(A { value: 1.5 })
+    );
+
+    // All NaNs are encoded the same, whatever their sign, payload or precision.
+    let nan = cbor::to_vec(f64::NAN);
+    assert_eq!(
+        nan,
+        vec![0xFB, 0x7F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00]
+    );
+    assert_eq!(cbor::to_vec(-f64::NAN), nan);
+    assert_eq!(cbor::to_vec(f32::from_bits(0x7FC0_0001)), nan);
+    let dec: f64 = cbor::from_slice_non_strict(&[0xF9, 0xFE, 0x01]).unwrap();
+    assert_eq!(cbor::to_vec(dec), nan);
+}
+
+#[test]
+fn test_allowed_tags() {
+    #[derive(Clone, Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    struct A {
+        id: SemanticallyTaggedNewtype,
+        amount: i128,
+    }
+
+    let allowed = |tags| cbor::DecodeOptions {
+        allowed_tags: Some(tags),
+        ..Default::default()
+    };
+    let a = A {
+        id: SemanticallyTaggedNewtype(vec![1, 2]),
+        amount: i128::MAX,
+    };
+    // {"id": 42(h'0102'), "amount": 2(h'7fff...')}
+    let enc = cbor::to_vec(a.clone());
+    let dec: A = cbor::from_slice_with(&enc, &allowed(vec![2, 42])).unwrap();
+    assert_eq!(dec, a);
+    let dec: A = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, a);
+
+    let err = cbor::from_slice_with::<A>(&enc, &allowed(vec![42])).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::DisallowedTag { tag: 2, offset: 16 }
+    ));
+    assert_eq!(err.to_string(), "disallowed tag 2 at offset 16");
+    let err = cbor::from_slice_with::<A>(&enc, &allowed(vec![2])).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::DisallowedTag { tag: 42, offset: 4 }
+    ));
+
+    // Integers small enough to not need a bignum are not tagged.
+    let a = A {
+        amount: 1,
+        ..Default::default()
+    };
+    let dec: A = cbor::from_slice_with(&cbor::to_vec(a.clone()), &allowed(vec![42])).unwrap();
+    assert_eq!(dec, a);
+}
+
+#[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+struct Wrapper<T> {
+    inner: T,
+}
+
+#[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+struct Pair<K, V>
+where
+    K: Ord,
+{
+    keys: Vec<K>,
+    #[cbor(optional)]
+    value: Option<V>,
+    #[cbor(skip)]
+    marker: std::marker::PhantomData<NotCodable>,
+}
+
+#[derive(Debug, Default, PartialEq)]
+struct NotCodable;
+
+#[derive(Debug, PartialEq, cbor::Encode, cbor::Decode)]
+enum Either<L, R> {
+    Left(L),
+    Right { value: R },
+}
+
+#[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+struct Tagged<T, M> {
+    value: u64,
+    marker: std::marker::PhantomData<M>,
+    #[cbor(optional)]
+    inner: Option<T>,
+}
+
+#[derive(Debug, Default, PartialEq, cbor::Decode)]
+struct BorrowedWrapper<'a, T> {
+    name: &'a str,
+    inner: T,
 }
 
 #[test]
-fn test_custom_encode_decode_array() {
-    let ct = CustomEncodeDecodeArray {
-        foo: CustomType("almost a string".to_owned()),
+fn test_generics() {
+    let wrapper = Wrapper {
+        inner: vec![1u8, 2, 3],
     };
-    let enc = cbor::to_vec(ct.clone());
-    let dec: CustomEncodeDecodeArray =
-        cbor::from_slice(&enc).expect("serialization should round-trip");
-    assert_eq!(dec, ct);
+    let enc = cbor::to_vec(Wrapper {
+        inner: vec![1u8, 2, 3],
+    });
+    assert_eq!(enc.len(), cbor::Encode::encoded_len(&wrapper));
+    let dec: Wrapper<Vec<u8>> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, wrapper);
+    // The same encoding as the non-generic equivalent.
+    assert_eq!(
+        enc,
+        cbor::to_vec(cbor::cbor_map! { "inner" => cbor::cbor_bytes!(vec![1, 2, 3]) })
+    );
+
+    let pair = Pair {
+        keys: vec!["a".to_owned(), "b".to_owned()],
+        value: Some(Wrapper { inner: 42u64 }),
+        marker: std::marker::PhantomData,
+    };
+    let enc = cbor::to_vec(Pair {
+        keys: vec!["a".to_owned(), "b".to_owned()],
+        value: Some(Wrapper { inner: 42u64 }),
+        marker: std::marker::PhantomData,
+    });
+    let dec: Pair<String, Wrapper<u64>> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, pair);
+    let dec: Pair<String, Wrapper<u64>> =
+        cbor::from_slice(&[0xA1, 0x64, b'k', b'e', b'y', b's', 0x80]).unwrap();
+    assert_eq!(dec, Pair::default());
+
+    let enc = cbor::to_vec(Either::<u64, String>::Right {
+        value: "foo".to_owned(),
+    });
+    let dec: Either<u64, String> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(
+        dec,
+        Either::Right {
+            value: "foo".to_owned()
+        }
+    );
+    let enc = cbor::to_vec(Either::<u64, String>::Left(10));
+    let dec: Either<u64, String> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, Either::Left(10));
+
+    // Parameters only used in PhantomData need not be encodable.
+    let enc = cbor::to_vec(Tagged::<u8, NotCodable> {
+        value: 1,
+        ..Default::default()
+    });
+    let dec: Tagged<u8, NotCodable> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec.value, 1);
+
+    // Type parameters of borrowing decoders may borrow as well.
+    let enc = cbor::to_vec(cbor::cbor_map! { "name" => "foo", "inner" => "bar" });
+    let dec: BorrowedWrapper<'_, &str> = cbor::from_slice_borrowed(&enc).unwrap();
+    assert_eq!(
+        dec,
+        BorrowedWrapper {
+            name: "foo",
+            inner: "bar"
+        }
+    );
+}
+
+#[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+struct Tree {
+    value: u64,
+    #[cbor(optional)]
+    left: Option<Box<Tree>>,
+    #[cbor(optional)]
+    right: Option<Box<Tree>>,
+}
+
+#[derive(Debug, PartialEq, cbor::Encode)]
+struct Unique {
+    name: String,
+}
+
+#[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+struct Shared {
+    rc: std::rc::Rc<String>,
+    arc: std::sync::Arc<Vec<u8>>,
 }
 
 #[test]
-fn test_null_decode() {
-    fn decode_from_null<T: cbor::Decode + Default + std::fmt::Debug + PartialEq>() {
-        let data = vec![0xf6]; // Null.
-        let dec1: T = cbor::from_slice(&data).expect(&format!(
-            "type {} can be decoded from CBOR null",
-            std::any::type_name::<T>()
-        ));
+fn test_pointers() {
+    let tree = Tree {
+        value: 1,
+        left: Some(Box::new(Tree {
+            value: 2,
+            left: None,
+            right: None,
+        })),
+        right: None,
+    };
+    let enc = cbor::to_vec(tree.clone());
+    assert_eq!(
+        enc,
+        cbor::to_vec(cbor::cbor_map! { "left" => cbor::cbor_map! { "value" => 2 }, "value" => 1 })
+    );
+    assert_eq!(cbor::Encode::encoded_len(&tree), enc.len());
+    let dec: Tree = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, tree);
 
-        let data = vec![0xf7]; // Undefined.
-        let dec2: T = cbor::from_slice(&data).expect(&format!(
-            "type {} can be decoded from CBOR undefined",
-            std::any::type_name::<T>()
-        ));
+    // References encode as the referenced value.
+    assert_eq!(cbor::to_vec::<&Tree>(&tree), enc);
+    assert_eq!(cbor::to_vec::<&&Tree>(&&tree), enc);
+    assert_eq!(cbor::to_vec::<&u64>(&42), cbor::to_vec(42u64));
+    // The referenced value need not be cloneable, as it is encoded by reference.
+    let unique = Unique {
+        name: "foo".to_string(),
+    };
+    let enc = cbor::to_vec(cbor::cbor_map! { "name" => "foo" });
+    assert_eq!(cbor::to_vec(&unique), enc);
+    let shared = std::rc::Rc::new(unique);
+    let other = shared.clone();
+    assert_eq!(cbor::to_vec(shared), enc);
+    assert_eq!(cbor::to_vec(other), enc);
 
-        assert_eq!(dec1, dec2);
-        assert_eq!(dec1, Default::default());
-    }
+    let text = std::rc::Rc::new("foo".to_string());
+    let shared = Shared {
+        rc: text.clone(),
+        arc: std::sync::Arc::new(vec![1, 2]),
+    };
+    let enc = cbor::to_vec(shared.clone());
+    assert_eq!(
+        enc,
+        cbor::to_vec(cbor::cbor_map! { "rc" => "foo", "arc" => cbor::cbor_bytes!(vec![1, 2]) })
+    );
+    assert_eq!(cbor::Encode::encoded_len(&shared), enc.len());
+    let dec: Shared = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, shared);
+    // Encoding leaves other references to the shared value intact.
+    assert_eq!(*text, "foo");
+    assert_eq!(std::rc::Rc::strong_count(&text), 2);
 
-    fn decode_from_null_special<T: cbor::Decode + std::fmt::Debug + PartialEq>(value: T) {
-        let data = vec![0xf6]; // Null.
-        let dec1: T = cbor::from_slice(&data).expect(&format!(
-            "type {} can be decoded from CBOR null",
-            std::any::type_name::<T>()
-        ));
+    // Pointers decode from null the same as their inner value.
+    let dec: Box<Option<u64>> = cbor::from_slice(&[0xF6]).unwrap();
+    assert_eq!(dec, Box::new(None));
+}
 
-        let data = vec![0xf7]; // Undefined.
-        let dec2: T = cbor::from_slice(&data).expect(&format!(
-            "type {} can be decoded from CBOR undefined",
-            std::any::type_name::<T>()
-        ));
+#[derive(Debug, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+enum Expr<T> {
+    Leaf(T),
+    Node(Box<Expr<T>>, Box<Expr<T>>),
+    Neg { inner: Box<Expr<T>> },
+}
 
-        assert_eq!(dec1, dec2);
-        assert_eq!(dec1, value);
+#[derive(Debug, Default, Clone, PartialEq, cbor::Encode, cbor::Decode)]
+struct List<T> {
+    head: T,
+    #[cbor(optional)]
+    tail: Option<Box<List<T>>>,
+}
+
+impl Expr<u64> {
+    /// A chain of negations of the given length ending in a leaf.
+    fn negations(depth: usize) -> Self {
+        (0..depth).fold(Expr::Leaf(0), |inner, _| Expr::Neg {
+            inner: Box::new(inner),
+        })
     }
+}
 
-    fn not_decode_from_null<T: cbor::Decode + std::fmt::Debug>() {
-        let data = vec![0xf6]; // Null.
-        cbor::from_slice::<T>(&data).expect_err(&format!(
-            "type {} should not be decoded from CBOR null",
-            std::any::type_name::<T>()
-        ));
+#[test]
+fn test_recursive_types() {
+    let expr = Expr::Node(
+        Box::new(Expr::Leaf(1u64)),
+        Box::new(Expr::Neg {
+            inner: Box::new(Expr::Leaf(2)),
+        }),
+    );
+    let enc = cbor::to_vec(expr.clone());
+    assert_eq!(
+        enc,
+        vec![
+            // {"Node": [{"Leaf": 1}, {"Neg": {"inner": {"Leaf": 2}}}]}
+            0xA1, // map(1)
+            0x64, // text(4)
+            0x4E, 0x6F, 0x64, 0x65, // "Node"
+            0x82, // array(2)
+            0xA1, // map(1)
+            0x64, // text(4)
+            0x4C, 0x65, 0x61, 0x66, // "Leaf"
+            0x01, // unsigned(1)
+            0xA1, // map(1)
+            0x63, // text(3)
+            0x4E, 0x65, 0x67, // "Neg"
+            0xA1, // map(1)
+            0x65, // text(5)
+            0x69, 0x6E, 0x6E, 0x65, 0x72, // "inner"
+            0xA1, // map(1)
+            0x64, // text(4)
+            0x4C, 0x65, 0x61, 0x66, // "Leaf"
+            0x02, // unsigned(2)
+        ]
+    );
+    assert_eq!(cbor::Encode::encoded_len(&expr), enc.len());
+    assert_eq!(cbor::to_vec(&expr), enc);
+    let dec: Expr<u64> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, expr);
 
-        let data = vec![0xf7]; // Undefined.
-        cbor::from_slice::<T>(&data).expect_err(&format!(
-            "type {} should not be decoded from CBOR undefined",
-            std::any::type_name::<T>()
-        ));
-    }
+    let list = List {
+        head: "a".to_string(),
+        tail: Some(Box::new(List {
+            head: "b".to_string(),
+            tail: None,
+        })),
+    };
+    let enc = cbor::to_vec(list.clone());
+    let dec: List<String> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, list);
 
-    decode_from_null::<A>();
-    decode_from_null::<B>();
-    decode_from_null::<C>();
-    decode_from_null::<bool>();
-    decode_from_null::<u8>();
-    decode_from_null::<u32>();
-    decode_from_null::<u128>();
-    decode_from_null::<i8>();
-    decode_from_null::<i32>();
-    decode_from_null::<char>();
-    decode_from_null::<String>();
-    decode_from_null::<Vec<u8>>();
-    decode_from_null::<Vec<String>>();
-    decode_from_null::<BTreeMap<String, String>>();
-    decode_from_null::<BTreeSet<String>>();
-    decode_from_null::<HashMap<String, String>>();
-    decode_from_null::<HashSet<String>>();
-    decode_from_null::<Option<String>>();
-    decode_from_null::<()>();
-    decode_from_null::<[u8; 32]>();
+    // Each negation nests two levels, so the default depth limit rejects pathological input.
+    let enc = cbor::to_vec(Expr::negations(40));
+    let res: Result<Expr<u64>, _> = cbor::from_slice(&enc);
+    assert!(matches!(
+        res,
+        Err(cbor::DecodeError::DepthLimitExceeded { .. })
+    ));
+    let dec: Expr<u64> = cbor::from_slice_with(
+        &enc,
+        &cbor::DecodeOptions {
+            max_depth: Some(100),
+            ..Default::default()
+        },
+    )
+    .unwrap();
+    assert_eq!(dec, Expr::negations(40));
 
-    decode_from_null_special::<cbor::Value>(cbor::Value::Simple(cbor::SimpleValue::NullValue));
+    // Encoding is bounded as well.
+    let res = cbor::to_vec_with(Expr::negations(70), &cbor::EncodeOptions::default());
+    assert!(matches!(res, Err(cbor::EncodeError::DepthLimitExceeded)));
+}
 
-    not_decode_from_null::<[u16; 32]>();
-    not_decode_from_null::<[String; 32]>();
-    not_decode_from_null::<D>();
-    not_decode_from_null::<E>(); // Tagged with cbor(no_default).
+trait Backend {
+    type Id;
+}
+
+#[derive(Debug, PartialEq)]
+struct MemoryBackend; // Not encodable itself.
+
+impl Backend for MemoryBackend {
+    type Id = u64;
+}
+
+#[derive(Debug, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(bound = "B::Id: cbor::Encode + cbor::Decode", no_default)]
+struct Handle<B: Backend> {
+    id: B::Id,
+}
+
+#[derive(Debug, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(
+    bound(encode = "B::Id: cbor::Encode", decode = "B::Id: cbor::Decode"),
+    no_default
+)]
+struct SplitHandle<B: Backend> {
+    id: B::Id,
+}
+
+#[derive(Debug, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(bound(decode = "T: cbor::Decode"), no_default)]
+struct Cached<T> {
+    value: T,
+    #[cbor(skip)]
+    cache: Option<T>,
+}
+
+#[derive(Debug, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(no_default)]
+struct Count {
+    n: u64,
+}
+
+#[derive(Debug, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(bound = "", no_default)]
+struct Unbounded<T> {
+    #[cbor(skip)]
+    cached: Option<T>,
+    count: u64,
 }
 
 #[test]
-fn encode_empty() {
-    fn encode_is_empty<T: cbor::Encode>(value: T) {
-        #[derive(cbor::Encode)]
-        struct WithField<U: cbor::Encode> {
-            #[cbor(optional)]
-            field: U,
+fn test_custom_bound() {
+    // The inferred bound would require the backend itself to be encodable.
+    let handle = Handle::<MemoryBackend> { id: 7 };
+    let enc = cbor::to_vec(Handle::<MemoryBackend> { id: 7 });
+    assert_eq!(enc, cbor::to_vec(cbor::cbor_map! { "id" => 7 }));
+    assert_eq!(cbor::Encode::encoded_len(&handle), enc.len());
+    let dec: Handle<MemoryBackend> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, handle);
+
+    // Bounds can be given separately for each derive.
+    let handle = SplitHandle::<MemoryBackend> { id: 7 };
+    let enc = cbor::to_vec(SplitHandle::<MemoryBackend> { id: 7 });
+    assert_eq!(enc, cbor::to_vec(cbor::cbor_map! { "id" => 7 }));
+    let dec: SplitHandle<MemoryBackend> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, handle);
+
+    // A derive without a bound keeps the inferred ones, while the skipped field no longer
+    // requires a default value of the parameter for decoding.
+    let cached = Cached {
+        value: Count { n: 3 },
+        cache: None,
+    };
+    let enc = cbor::to_vec(Cached {
+        value: Count { n: 3 },
+        cache: Some(Count { n: 4 }),
+    });
+    assert_eq!(
+        enc,
+        cbor::to_vec(cbor::cbor_map! { "value" => cbor::cbor_map! { "n" => 3 } })
+    );
+    let dec: Cached<Count> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, cached);
+
+    // An empty bound removes all inferred bounds.
+    let enc = cbor::to_vec(Unbounded::<NotCodable> {
+        cached: None,
+        count: 3,
+    });
+    let dec: Unbounded<NotCodable> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(
+        dec,
+        Unbounded {
+            cached: None,
+            count: 3
         }
+    );
+}
 
-        let enc = cbor::to_vec(WithField { field: value });
-        assert_eq!(enc, vec![0xA0]) // {}
+#[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+struct Marker<T> {
+    _p: std::marker::PhantomData<T>,
+}
+
+#[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+struct MarkedTuple<T>(u64, std::marker::PhantomData<T>);
+
+#[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+#[cbor(as_null)]
+struct NullMarker<T> {
+    _p: std::marker::PhantomData<T>,
+    #[cbor(skip)]
+    cached: u64,
+}
+
+#[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+struct Empty {}
+
+#[test]
+fn test_phantom_data_and_empty_structs() {
+    // PhantomData fields are skipped, so the struct encodes as an empty map.
+    let enc = cbor::to_vec(Marker::<NotCodable>::default());
+    assert_eq!(enc, vec![0xA0]);
+    assert_eq!(
+        cbor::Encode::encoded_len(&Marker::<NotCodable>::default()),
+        1
+    );
+    let dec: Marker<NotCodable> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, Marker::default());
+    let err = cbor::from_slice::<Marker<NotCodable>>(&[0xA1, 0x62, 0x5F, 0x70, 0xF6]).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnknownField { .. }));
+
+    let enc = cbor::to_vec(MarkedTuple::<NotCodable>(42, std::marker::PhantomData));
+    assert_eq!(enc, vec![0x81, 0x18, 0x2A]);
+    let dec: MarkedTuple<NotCodable> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, MarkedTuple(42, std::marker::PhantomData));
+
+    let enc = cbor::to_vec(Empty {});
+    assert_eq!(enc, vec![0xA0]);
+    let dec: Empty = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, Empty {});
+
+    // Structs marked as_null encode as null and use the default for all fields.
+    let enc = cbor::to_vec(NullMarker::<NotCodable> {
+        cached: 10,
+        ..Default::default()
+    });
+    assert_eq!(enc, vec![0xF6]);
+    assert_eq!(
+        cbor::Encode::encoded_len(&NullMarker::<NotCodable>::default()),
+        1
+    );
+    let dec: NullMarker<NotCodable> = cbor::from_slice(&enc).unwrap();
+    assert_eq!(dec, NullMarker::default());
+    let dec: NullMarker<NotCodable> = cbor::from_slice_non_strict(&[0xF7]).unwrap();
+    assert_eq!(dec, NullMarker::default());
+    let err = cbor::from_slice::<NullMarker<NotCodable>>(&[0xA0]).unwrap_err();
+    assert!(matches!(err, cbor::DecodeError::UnexpectedType));
+}
+
+#[test]
+fn test_max_alloc_bytes() {
+    #[derive(Debug, Default, PartialEq, cbor::Encode, cbor::Decode)]
+    struct A {
+        items: Vec<Vec<u8>>,
     }
 
-    encode_is_empty(false);
-    encode_is_empty(0u8);
-    encode_is_empty(0u16);
-    encode_is_empty(0u32);
-    encode_is_empty(0u64);
-    encode_is_empty(0u128);
-    encode_is_empty(0i8);
-    encode_is_empty(0i16);
-    encode_is_empty(0i32);
-    encode_is_empty(0i64);
-    encode_is_empty(&0u8);
-    encode_is_empty(&0u16);
-    encode_is_empty(&0u32);
-    encode_is_empty(&0u64);
-    encode_is_empty(&0u128);
-    encode_is_empty(&0i8);
-    encode_is_empty(&0i16);
-    encode_is_empty(&0i32);
-    encode_is_empty(&0i64);
-    encode_is_empty('\x00');
-    encode_is_empty(String::new());
-    encode_is_empty("");
-    encode_is_empty(None::<String>);
-    encode_is_empty(vec![]);
-    encode_is_empty(BTreeMap::<String, String>::new());
-    encode_is_empty(BTreeSet::<String>::new());
-    encode_is_empty(HashMap::<String, String>::new());
-    encode_is_empty(HashSet::<String>::new());
-    encode_is_empty(());
-    encode_is_empty((false, 0u8));
-    encode_is_empty((false, 0u8, String::new()));
-    encode_is_empty((false, 0u8, String::new(), 0i64));
-    encode_is_empty((false, 0u8, 0u16, 0u128, vec![]));
-    encode_is_empty(cbor::Value::Simple(cbor::SimpleValue::NullValue));
-    encode_is_empty(cbor::Value::Simple(cbor::SimpleValue::Undefined));
+    let a = A {
+        items: vec![vec![0; 100]; 10],
+    };
+    let enc = cbor::to_vec(A {
+        items: vec![vec![0; 100]; 10],
+    });
+    let options = |max_alloc_bytes| cbor::DecodeOptions {
+        canonical: true,
+        max_alloc_bytes: Some(max_alloc_bytes),
+        ..Default::default()
+    };
+
+    let dec: A = cbor::from_slice_with(&enc, &options(4096)).unwrap();
+    assert_eq!(dec, a);
+
+    // Each string fits, but not all of them together.
+    let err = cbor::from_slice_with::<A>(&enc, &options(1024)).unwrap_err();
+    assert!(matches!(
+        err,
+        cbor::DecodeError::AllocationLimitExceeded { .. }
+    ));
+    assert!(err.offset().is_some());
 }
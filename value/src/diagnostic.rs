@@ -0,0 +1,324 @@
+//! Functionality for rendering CBOR data in diagnostic notation (RFC 8949, Section 8).
+
+use alloc::{string::String, vec::Vec};
+use core::fmt::{self, Write};
+
+use super::{
+    reader::DecoderError,
+    values::{MajorType, SimpleValue},
+    visitor::{visit, Visitor},
+};
+
+/// Render CBOR binary data containing a single data item in diagnostic notation, expecting that
+/// there is no additional data.
+///
+/// The data is parsed without any canonicality checks so that any well-formed item can be
+/// inspected. Indefinite-length items are rendered with the `_` marker, e.g. `[_ 1, 2]` or
+/// `(_ h'01', h'02')` for a chunked byte string, or `''_` if it has no chunks.
+pub fn to_diagnostic(encoded_cbor: &[u8]) -> Result<String, DecoderError> {
+    let mut renderer = Renderer {
+        output: String::new(),
+        frames: Vec::new(),
+    };
+    visit(encoded_cbor, &mut renderer)?;
+    Ok(renderer.output)
+}
+
+/// An item which is still being rendered.
+enum Frame {
+    /// An array, a map or an indefinite-length string, with its closing character and the number
+    /// of items (counting map keys and values separately) rendered so far.
+    Container {
+        close: char,
+        is_map: bool,
+        count: u64,
+    },
+    /// An indefinite-length string, with its rendering when it has no chunks and the number of
+    /// chunks rendered so far.
+    Chunks { empty: &'static str, count: u64 },
+    /// A tag, which is closed after the tagged item.
+    Tag,
+}
+
+struct Renderer {
+    output: String,
+    frames: Vec<Frame>,
+}
+
+impl Renderer {
+    /// Write the separator preceding the next item of the innermost container.
+    fn start_item(&mut self) {
+        match self.frames.last_mut() {
+            Some(Frame::Container { is_map, count, .. }) => {
+                if *is_map && *count % 2 == 1 {
+                    self.output.push_str(": ");
+                } else if *count > 0 {
+                    self.output.push_str(", ");
+                }
+                *count += 1;
+            }
+            // The chunks are only opened once there is one, as there is no `(_ )` notation.
+            Some(Frame::Chunks { count, .. }) => {
+                self.output.push_str(if *count == 0 { "(_ " } else { ", " });
+                *count += 1;
+            }
+            Some(Frame::Tag) | None => {}
+        }
+    }
+
+    /// Close the tags around an item which was completely rendered.
+    fn end_item(&mut self) {
+        while let Some(Frame::Tag) = self.frames.last() {
+            self.frames.pop();
+            self.output.push(')');
+        }
+    }
+
+    fn start_container(&mut self, open: &str, close: char, is_map: bool) {
+        self.start_item();
+        self.output.push_str(open);
+        self.frames.push(Frame::Container {
+            close,
+            is_map,
+            count: 0,
+        });
+    }
+
+    fn render_scalar(&mut self, value: impl fmt::Display) -> Result<(), DecoderError> {
+        self.start_item();
+        write!(self.output, "{}", value).unwrap();
+        self.end_item();
+        Ok(())
+    }
+}
+
+impl Visitor for Renderer {
+    type Error = DecoderError;
+
+    fn visit_u64(&mut self, value: u64) -> Result<(), DecoderError> {
+        self.render_scalar(value)
+    }
+
+    fn visit_negative(&mut self, value: i128) -> Result<(), DecoderError> {
+        self.render_scalar(value)
+    }
+
+    fn visit_bytes(&mut self, value: &[u8]) -> Result<(), DecoderError> {
+        self.start_item();
+        self.output.push_str("h'");
+        for byte in value {
+            write!(self.output, "{:02x}", byte).unwrap();
+        }
+        self.output.push('\'');
+        self.end_item();
+        Ok(())
+    }
+
+    fn visit_str(&mut self, value: &str) -> Result<(), DecoderError> {
+        self.start_item();
+        self.output.push('"');
+        for c in value.chars() {
+            match c {
+                '"' => self.output.push_str("\\\""),
+                '\\' => self.output.push_str("\\\\"),
+                '\n' => self.output.push_str("\\n"),
+                '\r' => self.output.push_str("\\r"),
+                '\t' => self.output.push_str("\\t"),
+                c if c.is_control() => write!(self.output, "\\u{:04x}", c as u32).unwrap(),
+                c => self.output.push(c),
+            }
+        }
+        self.output.push('"');
+        self.end_item();
+        Ok(())
+    }
+
+    fn visit_chunks_start(&mut self, major_type: MajorType) -> Result<(), DecoderError> {
+        self.start_item();
+        self.frames.push(Frame::Chunks {
+            empty: if major_type == MajorType::ByteString {
+                "''_"
+            } else {
+                "\"\"_"
+            },
+            count: 0,
+        });
+        Ok(())
+    }
+
+    fn visit_array_start(&mut self, len: Option<u64>) -> Result<(), DecoderError> {
+        self.start_container(if len.is_some() { "[" } else { "[_ " }, ']', false);
+        Ok(())
+    }
+
+    fn visit_map_start(&mut self, len: Option<u64>) -> Result<(), DecoderError> {
+        self.start_container(if len.is_some() { "{" } else { "{_ " }, '}', true);
+        Ok(())
+    }
+
+    fn visit_end(&mut self) -> Result<(), DecoderError> {
+        match self.frames.pop() {
+            Some(Frame::Container { close, .. }) => self.output.push(close),
+            Some(Frame::Chunks { empty, count: 0 }) => self.output.push_str(empty),
+            Some(Frame::Chunks { .. }) => self.output.push(')'),
+            Some(Frame::Tag) | None => {}
+        }
+        self.end_item();
+        Ok(())
+    }
+
+    fn visit_tag(&mut self, tag: u64) -> Result<(), DecoderError> {
+        self.start_item();
+        write!(self.output, "{}(", tag).unwrap();
+        self.frames.push(Frame::Tag);
+        Ok(())
+    }
+
+    fn visit_simple(&mut self, value: SimpleValue) -> Result<(), DecoderError> {
+        match value {
+            SimpleValue::FalseValue => self.render_scalar("false"),
+            SimpleValue::TrueValue => self.render_scalar("true"),
+            SimpleValue::NullValue => self.render_scalar("null"),
+            SimpleValue::Undefined => self.render_scalar("undefined"),
+            SimpleValue::Unassigned(value) => {
+                self.render_scalar(format_args!("simple({})", value.get()))
+            }
+        }
+    }
+
+    fn visit_f64(&mut self, value: f64) -> Result<(), DecoderError> {
+        if value.is_nan() {
+            self.render_scalar("NaN")
+        } else if value.is_infinite() {
+            self.render_scalar(if value > 0.0 { "Infinity" } else { "-Infinity" })
+        } else {
+            self.render_scalar(format_args!("{:?}", value))
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use alloc::{vec, vec::Vec};
+
+    use super::*;
+
+    #[test]
+    fn test_to_diagnostic() {
+        let cases: Vec<(Vec<u8>, &str)> = vec![
+            (vec![0x00], "0"),
+            (vec![0x18, 0x2A], "42"),
+            (
+                vec![0x1B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF],
+                "18446744073709551615",
+            ),
+            (vec![0x20], "-1"),
+            (
+                vec![0x3B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF],
+                "-18446744073709551616",
+            ),
+            (vec![0x40], "h''"),
+            (vec![0x42, 0x01, 0xAB], "h'01ab'"),
+            (vec![0x60], "\"\""),
+            (vec![0x63, 0x66, 0x6F, 0x6F], "\"foo\""),
+            (vec![0x64, 0x22, 0x5C, 0x0A, 0x01], "\"\\\"\\\\\\n\\u0001\""),
+            (vec![0x62, 0xC3, 0xBC], "\"\u{fc}\""),
+            (vec![0x80], "[]"),
+            (vec![0x81, 0x18, 0x2A], "[42]"),
+            (vec![0x82, 0x01, 0x82, 0x02, 0x03], "[1, [2, 3]]"),
+            (vec![0xA0], "{}"),
+            (vec![0xA1, 0x63, 0x66, 0x6F, 0x6F, 0x0A], "{\"foo\": 10}"),
+            (
+                vec![0xA2, 0x01, 0x80, 0x61, 0x61, 0xA0],
+                "{1: [], \"a\": {}}",
+            ),
+            (
+                vec![
+                    0xC0, 0x74, 0x32, 0x30, 0x31, 0x33, 0x2D, 0x30, 0x33, 0x2D, 0x32, 0x31, 0x54,
+                    0x32, 0x30, 0x3A, 0x30, 0x34, 0x3A, 0x30, 0x30, 0x5A,
+                ],
+                "0(\"2013-03-21T20:04:00Z\")",
+            ),
+            (vec![0xD8, 0x18, 0x41, 0x00], "24(h'00')"),
+            (vec![0xF4], "false"),
+            (vec![0xF5], "true"),
+            (vec![0xF6], "null"),
+            (vec![0xF7], "undefined"),
+            (vec![0xF0], "simple(16)"),
+            (vec![0xF8, 0xFF], "simple(255)"),
+            (vec![0xF9, 0x3C, 0x00], "1.0"),
+            (vec![0xFA, 0x47, 0xC3, 0x50, 0x00], "100000.0"),
+            (
+                vec![0xFB, 0xC0, 0x10, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66],
+                "-4.1",
+            ),
+            (vec![0xF9, 0x7C, 0x00], "Infinity"),
+            (vec![0xF9, 0xFC, 0x00], "-Infinity"),
+            (vec![0xF9, 0x7E, 0x00], "NaN"),
+            // Non-minimal encodings are accepted.
+            (vec![0x18, 0x01], "1"),
+            // Indefinite-length items.
+            (vec![0x9F, 0xFF], "[_ ]"),
+            (vec![0x9F, 0x01, 0x9F, 0x02, 0xFF, 0xFF], "[_ 1, [_ 2]]"),
+            (vec![0xBF, 0x61, 0x61, 0x01, 0xFF], "{_ \"a\": 1}"),
+            (
+                vec![0x5F, 0x41, 0x01, 0x42, 0x02, 0x03, 0xFF],
+                "(_ h'01', h'0203')",
+            ),
+            (vec![0x7F, 0x61, 0x61, 0x61, 0x62, 0xFF], "(_ \"a\", \"b\")"),
+            (vec![0x5F, 0xFF], "''_"),
+            (vec![0x7F, 0xFF], "\"\"_"),
+            (vec![0x82, 0x7F, 0xFF, 0x5F, 0xFF], "[\"\"_, ''_]"),
+            (vec![0xC1, 0x5F, 0xFF], "1(''_)"),
+        ];
+        for (cbor, diagnostic) in cases {
+            assert_eq!(to_diagnostic(&cbor).as_deref(), Ok(diagnostic));
+        }
+    }
+
+    #[test]
+    fn test_to_diagnostic_errors() {
+        let cases = vec![
+            (vec![], DecoderError::IncompleteCborData { offset: 0 }),
+            (
+                vec![0x82, 0x01],
+                DecoderError::IncompleteCborData { offset: 2 },
+            ),
+            (
+                vec![0x9F, 0x01],
+                DecoderError::IncompleteCborData { offset: 2 },
+            ),
+            (
+                vec![0x81, 0x43, 0x01],
+                DecoderError::IncompleteCborData { offset: 1 },
+            ),
+            (
+                vec![0x1C],
+                DecoderError::UnknownAdditionalInfo { offset: 0 },
+            ),
+            (
+                vec![0x81, 0x1F],
+                DecoderError::UnknownAdditionalInfo { offset: 1 },
+            ),
+            (
+                vec![0x81, 0x62, 0xC3, 0x28],
+                DecoderError::InvalidUtf8 { offset: 1 },
+            ),
+            (
+                vec![0x5F, 0x61, 0x61, 0xFF],
+                DecoderError::InvalidStringChunk { offset: 1 },
+            ),
+            (vec![0x01, 0x02], DecoderError::ExtraneousData { offset: 1 }),
+        ];
+        for (cbor, error) in cases {
+            assert_eq!(to_diagnostic(&cbor), Err(error));
+        }
+
+        let mut nested = vec![0x81; 100];
+        nested.push(0x01);
+        assert_eq!(
+            to_diagnostic(&nested),
+            Err(DecoderError::TooMuchNesting { offset: 65 })
+        );
+    }
+}
@@ -13,16 +13,20 @@
 // limitations under the License.
 
 #![no_std]
+#![feature(allocator_api)]
 
 extern crate alloc;
 
+pub mod diagnostic;
 pub mod macros;
 pub mod reader;
 pub mod values;
+pub mod visitor;
 pub mod writer;
 
 pub use self::{
-    reader::read,
-    values::{SimpleValue, Value},
-    writer::write,
+    reader::{read, DecodeOptions},
+    values::{ContainerAlloc, MajorType, SimpleValue, UnassignedSimpleValue, Value, ValueRef},
+    visitor::{visit, Visitor},
+    writer::{write, EncodeOptions, MapOrdering},
 };
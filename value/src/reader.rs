@@ -14,26 +14,107 @@
 
 //! Functionality for deserializing CBOR data into values.
 
-use alloc::{str, vec::Vec};
+use alloc::{borrow::Cow, boxed::Box, str, string::String, vec::Vec};
+use core::{convert::TryFrom, mem};
 
-use super::values::{Constants, SimpleValue, Value};
-use crate::{
-    cbor_array_vec, cbor_bytes_lit, cbor_map_collection, cbor_tagged, cbor_text, cbor_unsigned,
+use super::{
+    values::{Constants, ContainerAlloc, SimpleValue, Value, ValueRef},
+    visitor::{visit_prefix, Visitor},
+    writer::{encoded_len, header_len},
 };
 
 /// Possible errors from a deserialization operation.
+///
+/// Each error carries the byte offset of the data item which could not be decoded.
 #[derive(Debug, PartialEq)]
 pub enum DecoderError {
-    UnsupportedMajorType,
-    UnknownAdditionalInfo,
-    IncompleteCborData,
-    TooMuchNesting,
-    InvalidUtf8,
-    ExtraneousData,
-    OutOfOrderKey,
-    NonMinimalCborEncoding,
-    UnsupportedSimpleValue,
-    UnsupportedFloatingPointValue,
+    UnsupportedMajorType { offset: usize },
+    UnknownAdditionalInfo { offset: usize },
+    IndefiniteLength { offset: usize },
+    IncompleteCborData { offset: usize },
+    TooMuchNesting { offset: usize },
+    InvalidUtf8 { offset: usize },
+    ExtraneousData { offset: usize },
+    OutOfOrderKey { offset: usize },
+    DuplicateMapKey { offset: usize },
+    NonMinimalCborEncoding { offset: usize },
+    InvalidStringChunk { offset: usize },
+    UnsupportedSimpleValue { offset: usize },
+    UnsupportedFloatingPointValue { offset: usize },
+    NonFiniteFloat { offset: usize },
+    AllocationLimitExceeded { offset: usize },
+    DisallowedTag { tag: u64, offset: usize },
+}
+
+impl DecoderError {
+    /// Byte offset of the data item which could not be decoded.
+    pub fn offset(&self) -> usize {
+        match *self {
+            DecoderError::UnsupportedMajorType { offset }
+            | DecoderError::UnknownAdditionalInfo { offset }
+            | DecoderError::IndefiniteLength { offset }
+            | DecoderError::IncompleteCborData { offset }
+            | DecoderError::TooMuchNesting { offset }
+            | DecoderError::InvalidUtf8 { offset }
+            | DecoderError::ExtraneousData { offset }
+            | DecoderError::OutOfOrderKey { offset }
+            | DecoderError::DuplicateMapKey { offset }
+            | DecoderError::NonMinimalCborEncoding { offset }
+            | DecoderError::InvalidStringChunk { offset }
+            | DecoderError::UnsupportedSimpleValue { offset }
+            | DecoderError::UnsupportedFloatingPointValue { offset }
+            | DecoderError::NonFiniteFloat { offset }
+            | DecoderError::AllocationLimitExceeded { offset }
+            | DecoderError::DisallowedTag { offset, .. } => offset,
+        }
+    }
+}
+
+/// Default maximum nesting depth used by [`DecodeOptions`].
+pub const DEFAULT_MAX_DEPTH: i8 = 64;
+
+/// Options controlling how CBOR binary data is deserialized.
+#[derive(Clone, Debug)]
+pub struct DecodeOptions {
+    /// Whether the data must be in canonical form. When set, non-minimal integer and length
+    /// encodings, bignums with leading zero bytes and unsorted map keys are rejected (with the
+    /// offset of the first offending item), as are indefinite-length items (returning
+    /// [`DecoderError::IndefiniteLength`]) and floating point values which are not in double
+    /// precision (as always produced by the default encoding) or which are NaN other than the
+    /// canonical quiet NaN (returning [`DecoderError::UnsupportedFloatingPointValue`]).
+    pub canonical: bool,
+    /// Maximum nesting depth of arrays, maps and tagged values. If `Some(max)`, then nested
+    /// structures are only supported up to the given limit (returning
+    /// [`DecoderError::TooMuchNesting`] if the limit is hit).
+    pub max_depth: Option<i8>,
+    /// Whether to reject maps containing duplicate keys (returning
+    /// [`DecoderError::DuplicateMapKey`] with the offset of the first duplicate key).
+    pub reject_duplicate_keys: bool,
+    /// Whether to reject floating point values which are NaN or infinite (returning
+    /// [`DecoderError::NonFiniteFloat`] with the offset of the float).
+    pub reject_non_finite: bool,
+    /// Maximum number of bytes allocated for the decoded value. If `Some(max)`, the contents of
+    /// all strings and each element of all arrays, maps and tags (counting the size of a
+    /// [`Value`]) are charged against the limit before they are read, returning
+    /// [`DecoderError::AllocationLimitExceeded`] with the offset of the item which would exceed
+    /// it. Unlike `max_depth`, this bounds the total size of many moderately sized items.
+    pub max_alloc_bytes: Option<usize>,
+    /// Tags which may appear in the data. If `Some(tags)`, any other tag is rejected before its
+    /// content is read (returning [`DecoderError::DisallowedTag`] with the offset of the tag).
+    pub allowed_tags: Option<Vec<u64>>,
+}
+
+impl Default for DecodeOptions {
+    fn default() -> Self {
+        Self {
+            canonical: false,
+            max_depth: Some(DEFAULT_MAX_DEPTH),
+            reject_duplicate_keys: false,
+            reject_non_finite: false,
+            max_alloc_bytes: None,
+            allowed_tags: None,
+        }
+    }
 }
 
 /// Deserialize CBOR binary data to produce a single [`Value`], expecting that there is no additional data.
@@ -48,9 +129,11 @@ pub fn read(encoded_cbor: &[u8]) -> Result<Value, DecoderError> {
 /// [`DecoderError::TooMuchNesting`] if the limit is hit).
 pub fn read_nested(encoded_cbor: &[u8], max_nest: Option<i8>) -> Result<Value, DecoderError> {
     let mut reader = Reader::new(encoded_cbor);
-    let value = reader.decode_complete_data_item(max_nest)?;
+    let value = reader.decode_complete_data_item(max_nest)?.into_owned();
     if !reader.remaining_cbor.is_empty() {
-        return Err(DecoderError::ExtraneousData);
+        return Err(DecoderError::ExtraneousData {
+            offset: reader.offset,
+        });
     }
     Ok(value)
 }
@@ -63,36 +146,204 @@ pub fn read_nested_non_strict(
     max_nest: Option<i8>,
 ) -> Result<Value, DecoderError> {
     let mut reader = Reader::new_non_strict(encoded_cbor);
-    let value = reader.decode_complete_data_item(max_nest)?;
+    let value = reader.decode_complete_data_item(max_nest)?.into_owned();
+    Ok(value)
+}
+
+/// Deserialize CBOR binary data to produce a single [`Value`] according to the given options,
+/// expecting that there is no additional data.
+pub fn read_with_options(
+    encoded_cbor: &[u8],
+    options: &DecodeOptions,
+) -> Result<Value, DecoderError> {
+    let (value, remaining_cbor) = read_prefix_with_options(encoded_cbor, options)?;
+    if !remaining_cbor.is_empty() {
+        return Err(DecoderError::ExtraneousData {
+            offset: encoded_cbor.len() - remaining_cbor.len(),
+        });
+    }
+    Ok(value)
+}
+
+/// Deserialize the first data item of CBOR binary data to produce a single [`Value`] according to
+/// the given options, returning it together with any remaining data.
+pub fn read_prefix_with_options<'a>(
+    encoded_cbor: &'a [u8],
+    options: &DecodeOptions,
+) -> Result<(Value, &'a [u8]), DecoderError> {
+    let (value, remaining_cbor) = read_borrowed_prefix_with_options(encoded_cbor, options)?;
+    Ok((value.into_owned(), remaining_cbor))
+}
+
+/// Deserialize CBOR binary data to produce a single [`ValueRef`] borrowing from the data according
+/// to the given options, expecting that there is no additional data.
+pub fn read_borrowed_with_options<'a>(
+    encoded_cbor: &'a [u8],
+    options: &DecodeOptions,
+) -> Result<ValueRef<'a>, DecoderError> {
+    read_borrowed_with_options_in(encoded_cbor, options, ContainerAlloc::default())
+}
+
+/// Same as [`read_borrowed_with_options`], but allocating the arrays, maps and tagged values of the
+/// [`ValueRef`] with the given allocator.
+pub fn read_borrowed_with_options_in<'a>(
+    encoded_cbor: &'a [u8],
+    options: &DecodeOptions,
+    alloc: ContainerAlloc<'a>,
+) -> Result<ValueRef<'a>, DecoderError> {
+    let mut reader = Reader::with_options(encoded_cbor, options);
+    reader.alloc = alloc;
+    let value = reader.decode_complete_data_item(options.max_depth)?;
+    if !reader.remaining_cbor.is_empty() {
+        return Err(DecoderError::ExtraneousData {
+            offset: reader.offset,
+        });
+    }
     Ok(value)
 }
 
-struct Reader<'a> {
-    non_strict: bool,
-    remaining_cbor: &'a [u8],
+/// Deserialize the first data item of CBOR binary data to produce a single [`ValueRef`] borrowing
+/// from the data according to the given options, returning it together with any remaining data.
+pub fn read_borrowed_prefix_with_options<'a>(
+    encoded_cbor: &'a [u8],
+    options: &DecodeOptions,
+) -> Result<(ValueRef<'a>, &'a [u8]), DecoderError> {
+    let mut reader = Reader::with_options(encoded_cbor, options);
+    let value = reader.decode_complete_data_item(options.max_depth)?;
+    Ok((value, reader.remaining_cbor))
+}
+
+/// Deserialize a CBOR sequence (RFC 8742), i.e. zero or more back-to-back data items, to produce
+/// a [`Value`] for each item according to the given options.
+///
+/// Reading stops at the end of the data, so the only way for the data to be malformed (besides
+/// invalid items) is an incomplete trailing item. Offsets in errors are relative to the start of
+/// the sequence.
+pub fn read_seq_with_options(
+    encoded_cbor: &[u8],
+    options: &DecodeOptions,
+) -> Result<Vec<Value>, DecoderError> {
+    let mut reader = Reader::with_options(encoded_cbor, options);
+    let mut values = Vec::new();
+    while !reader.remaining_cbor.is_empty() {
+        values.push(
+            reader
+                .decode_complete_data_item(options.max_depth)?
+                .into_owned(),
+        );
+    }
+    Ok(values)
+}
+
+/// Skip over the first data item of CBOR binary data according to the given options without
+/// decoding it, returning the remaining data.
+///
+/// Only the structure of the item (including any nested items), the encoding of text strings and,
+/// if non-finite floats are rejected, floating point values are checked, so map keys are not
+/// checked for order or duplicates.
+pub fn skip_prefix_with_options<'a>(
+    encoded_cbor: &'a [u8],
+    options: &DecodeOptions,
+) -> Result<&'a [u8], DecoderError> {
+    let mut reader = Reader::with_options(encoded_cbor, options);
+    visit_prefix(&mut reader, &mut Skipper, options.max_depth)?;
+    Ok(reader.remaining_cbor)
+}
+
+/// Visitor ignoring all tokens, for skipping items.
+struct Skipper;
+
+impl Visitor for Skipper {
+    type Error = DecoderError;
+}
+
+/// Check that the given value satisfies the given options, as if it were read from its encoding
+/// with map entries kept in their current order.
+///
+/// This allows applying the options to values which were not read with them, e.g. values that
+/// were read non-strictly or constructed in memory. The offsets in the returned errors are those
+/// the offending items would have in such an encoding. As values always use minimal-length
+/// encodings and floats are always encoded in double precision, canonical checks are limited to
+/// map key order.
+pub fn validate_with_options(value: &Value, options: &DecodeOptions) -> Result<(), DecoderError> {
+    let mut validator = Validator {
+        options,
+        offset: 0,
+        alloc_budget: options.max_alloc_bytes,
+    };
+    validator.validate(value, options.max_depth)
+}
+
+pub(crate) struct Reader<'a, 'o> {
+    pub(crate) non_strict: bool,
+    reject_duplicate_keys: bool,
+    reject_non_finite: bool,
+    /// Number of bytes which may still be allocated, if limited.
+    alloc_budget: Option<usize>,
+    allowed_tags: Option<&'o [u64]>,
+    /// Number of elements for which capacity may still be reserved up front. It is shared by all
+    /// containers of the decode, so nested containers cannot each reserve the maximum.
+    reserve_budget: usize,
+    /// Allocator of the arrays, maps and tagged values which are read.
+    alloc: ContainerAlloc<'a>,
+    pub(crate) remaining_cbor: &'a [u8],
+    pub(crate) offset: usize,
 }
 
-impl<'a> Reader<'a> {
-    pub fn new(cbor: &'a [u8]) -> Reader<'a> {
+impl<'a, 'o> Reader<'a, 'o> {
+    pub fn new(cbor: &'a [u8]) -> Reader<'a, 'o> {
         Reader {
             non_strict: false,
+            reject_duplicate_keys: false,
+            reject_non_finite: false,
+            alloc_budget: None,
+            allowed_tags: None,
+            reserve_budget: cbor.len(),
+            alloc: ContainerAlloc::default(),
+            remaining_cbor: cbor,
+            offset: 0,
+        }
+    }
+
+    /// Create a reader applying the given options, except for `max_depth`, which is passed when
+    /// reading each item.
+    pub fn with_options(cbor: &'a [u8], options: &'o DecodeOptions) -> Reader<'a, 'o> {
+        Reader {
+            non_strict: !options.canonical,
+            reject_duplicate_keys: options.reject_duplicate_keys,
+            reject_non_finite: options.reject_non_finite,
+            alloc_budget: options.max_alloc_bytes,
+            allowed_tags: options.allowed_tags.as_deref(),
+            reserve_budget: cbor.len(),
+            alloc: ContainerAlloc::default(),
             remaining_cbor: cbor,
+            offset: 0,
         }
     }
 
-    pub fn new_non_strict(cbor: &'a [u8]) -> Reader<'a> {
+    pub fn new_non_strict(cbor: &'a [u8]) -> Reader<'a, 'o> {
         Reader {
             non_strict: true,
+            reject_duplicate_keys: false,
+            reject_non_finite: false,
+            alloc_budget: None,
+            allowed_tags: None,
+            reserve_budget: cbor.len(),
+            alloc: ContainerAlloc::default(),
             remaining_cbor: cbor,
+            offset: 0,
         }
     }
 
     pub fn decode_complete_data_item(
         &mut self,
         remaining_depth: Option<i8>,
-    ) -> Result<Value, DecoderError> {
+    ) -> Result<ValueRef<'a>, DecoderError> {
+        let item_offset = self.offset;
         if remaining_depth.map_or(false, |d| d < 0) {
-            return Err(DecoderError::TooMuchNesting);
+            return Err(DecoderError::TooMuchNesting {
+                offset: item_offset,
+            });
         }
 
         match self.read_bytes(1) {
@@ -100,41 +351,94 @@ impl<'a> Reader<'a> {
                 // Unsigned byte means logical shift, so only zeros get shifted in.
                 let major_type_value = first_byte >> Constants::MAJOR_TYPE_BIT_SHIFT;
                 let additional_info = first_byte & Constants::ADDITIONAL_INFORMATION_MASK;
-                let size_value = self.read_variadic_length_integer(additional_info)?;
+                if additional_info == Constants::ADDITIONAL_INFORMATION_INDEFINITE
+                    && (2..=5).contains(&major_type_value)
+                {
+                    if !self.non_strict {
+                        return Err(DecoderError::IndefiniteLength {
+                            offset: item_offset,
+                        });
+                    }
+                    match major_type_value {
+                        2 | 3 => return self.read_chunked_string_content(major_type_value),
+                        4 => return self.read_array_content(None, remaining_depth, item_offset),
+                        _ => return self.read_map_content(None, remaining_depth, item_offset),
+                    }
+                }
+                let size_value =
+                    self.read_argument(major_type_value, additional_info, item_offset)?;
                 match major_type_value {
                     0 => self.decode_value_to_unsigned(size_value),
                     1 => self.decode_value_to_negative(size_value),
-                    2 => self.read_byte_string_content(size_value),
-                    3 => self.read_text_string_content(size_value),
-                    4 => self.read_array_content(size_value, remaining_depth),
-                    5 => self.read_map_content(size_value, remaining_depth),
-                    6 => self.read_tagged_content(size_value, remaining_depth),
-                    7 => self.decode_to_simple_value(size_value, additional_info),
-                    _ => Err(DecoderError::UnsupportedMajorType),
+                    2 => self.read_byte_string_content(size_value, item_offset),
+                    3 => self.read_text_string_content(size_value, item_offset),
+                    4 => self.read_array_content(Some(size_value), remaining_depth, item_offset),
+                    5 => self.read_map_content(Some(size_value), remaining_depth, item_offset),
+                    6 => self.read_tagged_content(size_value, remaining_depth, item_offset),
+                    7 => self.decode_to_simple_value(size_value, additional_info, item_offset),
+                    _ => Err(DecoderError::UnsupportedMajorType {
+                        offset: item_offset,
+                    }),
                 }
             }
-            _ => Err(DecoderError::IncompleteCborData),
+            _ => Err(DecoderError::IncompleteCborData {
+                offset: item_offset,
+            }),
         }
     }
 
-    fn read_bytes(&mut self, num_bytes: usize) -> Option<&[u8]> {
+    pub(crate) fn read_bytes(&mut self, num_bytes: usize) -> Option<&'a [u8]> {
         if num_bytes > self.remaining_cbor.len() {
             None
         } else {
             let (left, right) = self.remaining_cbor.split_at(num_bytes);
             self.remaining_cbor = right;
+            self.offset += num_bytes;
             Some(left)
         }
     }
 
-    fn read_variadic_length_integer(&mut self, additional_info: u8) -> Result<u64, DecoderError> {
+    /// Read the argument of a data item of the given major type, i.e. its value, length or tag, or
+    /// the bits of a float.
+    pub(crate) fn read_argument(
+        &mut self,
+        major_type_value: u8,
+        additional_info: u8,
+        item_offset: usize,
+    ) -> Result<u64, DecoderError> {
+        if major_type_value == 7 && additional_info > Constants::ADDITIONAL_INFORMATION_1_BYTE {
+            // The bits of a float are not an integer, so they need not be minimally encoded.
+            self.read_argument_bytes(additional_info, item_offset, false)
+        } else {
+            self.read_variadic_length_integer(additional_info, item_offset)
+        }
+    }
+
+    pub(crate) fn read_variadic_length_integer(
+        &mut self,
+        additional_info: u8,
+        item_offset: usize,
+    ) -> Result<u64, DecoderError> {
+        self.read_argument_bytes(additional_info, item_offset, true)
+    }
+
+    fn read_argument_bytes(
+        &mut self,
+        additional_info: u8,
+        item_offset: usize,
+        check_minimal: bool,
+    ) -> Result<u64, DecoderError> {
         let additional_bytes_num = match additional_info {
             0..=Constants::ADDITIONAL_INFORMATION_MAX_INT => return Ok(additional_info as u64),
             Constants::ADDITIONAL_INFORMATION_1_BYTE => 1,
             Constants::ADDITIONAL_INFORMATION_2_BYTES => 2,
             Constants::ADDITIONAL_INFORMATION_4_BYTES => 4,
             Constants::ADDITIONAL_INFORMATION_8_BYTES => 8,
-            _ => return Err(DecoderError::UnknownAdditionalInfo),
+            _ => {
+                return Err(DecoderError::UnknownAdditionalInfo {
+                    offset: item_offset,
+                })
+            }
         };
         match self.read_bytes(additional_bytes_num) {
             Some(bytes) => {
@@ -145,104 +449,459 @@ impl<'a> Reader<'a> {
                 }
                 if ((additional_bytes_num == 1 && size_value < 24)
                     || size_value < (1u64 << (8 * (additional_bytes_num >> 1))))
+                    && check_minimal
                     && !self.non_strict
                 {
-                    Err(DecoderError::NonMinimalCborEncoding)
+                    Err(DecoderError::NonMinimalCborEncoding {
+                        offset: item_offset,
+                    })
                 } else {
                     Ok(size_value)
                 }
             }
-            None => Err(DecoderError::IncompleteCborData),
+            None => Err(DecoderError::IncompleteCborData {
+                offset: item_offset,
+            }),
         }
     }
 
-    fn decode_value_to_unsigned(&self, size_value: u64) -> Result<Value, DecoderError> {
-        Ok(cbor_unsigned!(size_value))
+    fn decode_value_to_unsigned(&self, size_value: u64) -> Result<ValueRef<'a>, DecoderError> {
+        Ok(ValueRef::Unsigned(size_value))
     }
 
-    fn decode_value_to_negative(&self, size_value: u64) -> Result<Value, DecoderError> {
-        Ok(Value::Negative(-(size_value as i128) - 1))
+    fn decode_value_to_negative(&self, size_value: u64) -> Result<ValueRef<'a>, DecoderError> {
+        Ok(ValueRef::Negative(-(size_value as i128) - 1))
     }
 
-    fn read_byte_string_content(&mut self, size_value: u64) -> Result<Value, DecoderError> {
+    fn read_byte_string_content(
+        &mut self,
+        size_value: u64,
+        item_offset: usize,
+    ) -> Result<ValueRef<'a>, DecoderError> {
+        charge_alloc(&mut self.alloc_budget, size_value, item_offset)?;
         match self.read_bytes(size_value as usize) {
-            Some(bytes) => Ok(cbor_bytes_lit!(bytes)),
-            None => Err(DecoderError::IncompleteCborData),
+            Some(bytes) => Ok(ValueRef::ByteString(Cow::Borrowed(bytes))),
+            None => Err(DecoderError::IncompleteCborData {
+                offset: item_offset,
+            }),
         }
     }
 
-    fn read_text_string_content(&mut self, size_value: u64) -> Result<Value, DecoderError> {
+    fn read_text_string_content(
+        &mut self,
+        size_value: u64,
+        item_offset: usize,
+    ) -> Result<ValueRef<'a>, DecoderError> {
+        charge_alloc(&mut self.alloc_budget, size_value, item_offset)?;
         match self.read_bytes(size_value as usize) {
             Some(bytes) => match str::from_utf8(bytes) {
-                Ok(s) => Ok(cbor_text!(s)),
-                Err(_) => Err(DecoderError::InvalidUtf8),
+                Ok(s) => Ok(ValueRef::TextString(Cow::Borrowed(s))),
+                Err(_) => Err(DecoderError::InvalidUtf8 {
+                    offset: item_offset,
+                }),
+            },
+            None => Err(DecoderError::IncompleteCborData {
+                offset: item_offset,
+            }),
+        }
+    }
+
+    /// Read the chunks of an indefinite-length byte or text string, concatenating them. Each chunk
+    /// must be a definite-length string of the same major type.
+    fn read_chunked_string_content(
+        &mut self,
+        major_type_value: u8,
+    ) -> Result<ValueRef<'a>, DecoderError> {
+        let mut bytes = Vec::new();
+        let mut text = String::new();
+        while self.has_next_item(None, 0)? {
+            let chunk_offset = self.offset;
+            let first_byte = self.read_bytes(1).unwrap()[0];
+            let additional_info = first_byte & Constants::ADDITIONAL_INFORMATION_MASK;
+            if first_byte >> Constants::MAJOR_TYPE_BIT_SHIFT != major_type_value
+                || additional_info == Constants::ADDITIONAL_INFORMATION_INDEFINITE
+            {
+                return Err(DecoderError::InvalidStringChunk {
+                    offset: chunk_offset,
+                });
+            }
+            let size_value = self.read_variadic_length_integer(additional_info, chunk_offset)?;
+            match major_type_value {
+                2 => {
+                    if let ValueRef::ByteString(chunk) =
+                        self.read_byte_string_content(size_value, chunk_offset)?
+                    {
+                        bytes.extend_from_slice(&chunk);
+                    }
+                }
+                _ => {
+                    if let ValueRef::TextString(chunk) =
+                        self.read_text_string_content(size_value, chunk_offset)?
+                    {
+                        text.push_str(&chunk);
+                    }
+                }
+            }
+        }
+        match major_type_value {
+            2 => Ok(ValueRef::ByteString(Cow::Owned(bytes))),
+            _ => Ok(ValueRef::TextString(Cow::Owned(text))),
+        }
+    }
+
+    /// Check whether there are more items in a container of the given size (`None` meaning
+    /// indefinite length) after reading `count` items, consuming the break code if present.
+    pub(crate) fn has_next_item(
+        &mut self,
+        size_value: Option<u64>,
+        count: u64,
+    ) -> Result<bool, DecoderError> {
+        match size_value {
+            Some(size_value) => Ok(count < size_value),
+            None => match self.remaining_cbor.first() {
+                Some(&Constants::BREAK) => {
+                    self.read_bytes(1);
+                    Ok(false)
+                }
+                Some(_) => Ok(true),
+                None => Err(DecoderError::IncompleteCborData {
+                    offset: self.offset,
+                }),
             },
-            None => Err(DecoderError::IncompleteCborData),
         }
     }
 
+    /// Charge the allocation budget for all elements of a definite-length container up front and
+    /// return the capacity to reserve for them, so that a declared length exceeding the budget is
+    /// rejected before reading any of them.
+    ///
+    /// As the declared length is unsanitized input, the capacity is capped by the number of
+    /// elements of at least `min_element_len` bytes which the remaining data could hold. As the
+    /// elements of nested containers are part of the same data, all reservations together are
+    /// also capped by its length, so their total stays linear in the size of the input.
+    fn reserve_elements(
+        &mut self,
+        size_value: Option<u64>,
+        element_size: u64,
+        min_element_len: usize,
+        item_offset: usize,
+    ) -> Result<usize, DecoderError> {
+        let size_value = match size_value {
+            Some(size_value) => size_value,
+            None => return Ok(0),
+        };
+        charge_alloc(
+            &mut self.alloc_budget,
+            size_value.saturating_mul(element_size),
+            item_offset,
+        )?;
+        let max_elements = (self.remaining_cbor.len() / min_element_len).min(self.reserve_budget);
+        let capacity = size_value.min(max_elements as u64) as usize;
+        self.reserve_budget -= capacity;
+        Ok(capacity)
+    }
+
     fn read_array_content(
         &mut self,
-        size_value: u64,
+        size_value: Option<u64>,
         remaining_depth: Option<i8>,
-    ) -> Result<Value, DecoderError> {
-        // Don't set the capacity already, it is an unsanitized input.
-        let mut value_array = Vec::new();
-        for _ in 0..size_value {
+        item_offset: usize,
+    ) -> Result<ValueRef<'a>, DecoderError> {
+        let capacity = self.reserve_elements(size_value, ALLOC_ITEM_SIZE, 1, item_offset)?;
+        let mut value_array = Vec::with_capacity_in(capacity, self.alloc);
+        while self.has_next_item(size_value, value_array.len() as u64)? {
+            if size_value.is_none() {
+                charge_alloc(&mut self.alloc_budget, ALLOC_ITEM_SIZE, item_offset)?;
+            }
             value_array.push(self.decode_complete_data_item(remaining_depth.map(|d| d - 1))?);
         }
-        Ok(cbor_array_vec!(value_array))
+        Ok(ValueRef::Array(value_array))
     }
 
     fn read_map_content(
         &mut self,
-        size_value: u64,
+        size_value: Option<u64>,
         remaining_depth: Option<i8>,
-    ) -> Result<Value, DecoderError> {
-        let mut value_map = Vec::<(Value, Value)>::new();
-        for _ in 0..size_value {
+        item_offset: usize,
+    ) -> Result<ValueRef<'a>, DecoderError> {
+        let capacity = self.reserve_elements(size_value, 2 * ALLOC_ITEM_SIZE, 2, item_offset)?;
+        let mut value_map =
+            Vec::<(ValueRef<'a>, ValueRef<'a>), _>::with_capacity_in(capacity, self.alloc);
+        // Key offsets are only needed to report duplicates in keys which are not ordered.
+        let check_duplicates = self.non_strict && self.reject_duplicate_keys;
+        let mut key_offsets = Vec::with_capacity(if check_duplicates { capacity } else { 0 });
+        while self.has_next_item(size_value, value_map.len() as u64)? {
+            if size_value.is_none() {
+                charge_alloc(&mut self.alloc_budget, 2 * ALLOC_ITEM_SIZE, item_offset)?;
+            }
+            let key_offset = self.offset;
             let key = self.decode_complete_data_item(remaining_depth.map(|d| d - 1))?;
             if let Some(last_item) = value_map.last() {
                 if last_item.0 >= key && !self.non_strict {
-                    return Err(DecoderError::OutOfOrderKey);
+                    if last_item.0 == key && self.reject_duplicate_keys {
+                        return Err(DecoderError::DuplicateMapKey { offset: key_offset });
+                    }
+                    return Err(DecoderError::OutOfOrderKey { offset: key_offset });
                 }
             }
             value_map.push((
                 key,
                 self.decode_complete_data_item(remaining_depth.map(|d| d - 1))?,
             ));
+            if check_duplicates {
+                key_offsets.push(key_offset);
+            }
         }
-        Ok(cbor_map_collection!(value_map))
+        if check_duplicates {
+            check_duplicate_keys(&value_map, &key_offsets)?;
+        }
+        Ok(ValueRef::Map(value_map))
     }
 
     fn read_tagged_content(
         &mut self,
         tag_value: u64,
         remaining_depth: Option<i8>,
-    ) -> Result<Value, DecoderError> {
+        item_offset: usize,
+    ) -> Result<ValueRef<'a>, DecoderError> {
+        check_allowed_tag(self.allowed_tags, tag_value, item_offset)?;
+        charge_alloc(&mut self.alloc_budget, ALLOC_ITEM_SIZE, item_offset)?;
+        let content_offset = self.offset;
         let inner_value = self.decode_complete_data_item(remaining_depth.map(|d| d - 1))?;
-        Ok(cbor_tagged!(tag_value, inner_value))
+        if !self.non_strict {
+            if let ValueRef::ByteString(bytes) = &inner_value {
+                check_bignum_magnitude(tag_value, bytes, content_offset)?;
+            }
+        }
+        Ok(ValueRef::Tag(
+            tag_value,
+            Box::new_in(inner_value, self.alloc),
+        ))
     }
 
-    fn decode_to_simple_value(
+    pub(crate) fn decode_to_simple_value(
         &self,
         size_value: u64,
         additional_info: u8,
-    ) -> Result<Value, DecoderError> {
+        item_offset: usize,
+    ) -> Result<ValueRef<'a>, DecoderError> {
+        if self.non_strict {
+            let float = match additional_info {
+                Constants::ADDITIONAL_INFORMATION_2_BYTES => Some(f16_to_f64(size_value as u16)),
+                Constants::ADDITIONAL_INFORMATION_4_BYTES => {
+                    Some(f32::from_bits(size_value as u32).into())
+                }
+                Constants::ADDITIONAL_INFORMATION_8_BYTES => Some(f64::from_bits(size_value)),
+                _ => None,
+            };
+            if let Some(float) = float {
+                return self.check_float(float, item_offset);
+            }
+        }
+        // Canonical floats are in double precision, with a single encoding of NaN.
+        if additional_info == Constants::ADDITIONAL_INFORMATION_8_BYTES {
+            let float = f64::from_bits(size_value);
+            if !float.is_nan() || size_value == Constants::CANONICAL_NAN_BITS {
+                return self.check_float(float, item_offset);
+            }
+        }
         if additional_info > Constants::ADDITIONAL_INFORMATION_MAX_INT
             && additional_info != Constants::ADDITIONAL_INFORMATION_1_BYTE
             && !self.non_strict
         {
             // TODO(kaczmarczyck) the chromium C++ reference allows equality to 24 here, why?
             // Also, why not just disallow ANY additional_info != size_value?
-            return Err(DecoderError::UnsupportedFloatingPointValue);
+            return Err(DecoderError::UnsupportedFloatingPointValue {
+                offset: item_offset,
+            });
+        }
+        // Simple values below 32 must be encoded in the initial byte, the two-byte form of them is
+        // not well-formed (RFC 8949 section 3.3).
+        if additional_info == Constants::ADDITIONAL_INFORMATION_1_BYTE && size_value < 32 {
+            return Err(DecoderError::UnsupportedSimpleValue {
+                offset: item_offset,
+            });
         }
         match SimpleValue::from_integer(size_value) {
-            Some(simple_value) => Ok(Value::Simple(simple_value)),
-            None if self.non_strict => Ok(Value::Simple(SimpleValue::Undefined)),
-            None => Err(DecoderError::UnsupportedSimpleValue),
+            Some(simple_value) => Ok(ValueRef::Simple(simple_value)),
+            None => Err(DecoderError::UnsupportedSimpleValue {
+                offset: item_offset,
+            }),
+        }
+    }
+}
+
+impl<'a> Reader<'a, '_> {
+    /// Return the given float read at the given offset, unless it is rejected by the options.
+    fn check_float(&self, float: f64, item_offset: usize) -> Result<ValueRef<'a>, DecoderError> {
+        if self.reject_non_finite && !float.is_finite() {
+            return Err(DecoderError::NonFiniteFloat {
+                offset: item_offset,
+            });
+        }
+        Ok(ValueRef::Float(float))
+    }
+}
+
+/// Convert an IEEE 754 half precision (binary16) value into a double precision value.
+pub(crate) fn f16_to_f64(half: u16) -> f64 {
+    let sign = u64::from(half >> 15) << 63;
+    let exponent = u64::from((half >> 10) & 0x1f);
+    let mantissa = u64::from(half & 0x3ff);
+    match exponent {
+        // Zero and subnormal numbers, i.e. mantissa * 2^-24.
+        0 => {
+            let magnitude = mantissa as f64 / (1u64 << 24) as f64;
+            if sign != 0 {
+                -magnitude
+            } else {
+                magnitude
+            }
+        }
+        // Infinity and NaN.
+        0x1f => f64::from_bits(sign | (0x7ff << 52) | (mantissa << 42)),
+        // Normal numbers.
+        _ => f64::from_bits(sign | ((exponent + 1023 - 15) << 52) | (mantissa << 42)),
+    }
+}
+
+struct Validator<'a> {
+    options: &'a DecodeOptions,
+    offset: usize,
+    alloc_budget: Option<usize>,
+}
+
+impl Validator<'_> {
+    fn validate(&mut self, value: &Value, remaining_depth: Option<i8>) -> Result<(), DecoderError> {
+        let item_offset = self.offset;
+        if remaining_depth.map_or(false, |d| d < 0) {
+            return Err(DecoderError::TooMuchNesting {
+                offset: item_offset,
+            });
+        }
+        let nested_depth = remaining_depth.map(|d| d - 1);
+
+        match value {
+            Value::Array(array) => {
+                charge_alloc(
+                    &mut self.alloc_budget,
+                    array.len() as u64 * ALLOC_ITEM_SIZE,
+                    item_offset,
+                )?;
+                self.offset += header_len(array.len() as u64);
+                for item in array {
+                    self.validate(item, nested_depth)?;
+                }
+            }
+            Value::Map(map) => {
+                charge_alloc(
+                    &mut self.alloc_budget,
+                    map.len() as u64 * 2 * ALLOC_ITEM_SIZE,
+                    item_offset,
+                )?;
+                self.offset += header_len(map.len() as u64);
+                let mut key_offsets = Vec::with_capacity(map.len());
+                for (i, (key, value)) in map.iter().enumerate() {
+                    let key_offset = self.offset;
+                    self.validate(key, nested_depth)?;
+                    if i > 0 && self.options.canonical && map[i - 1].0 >= *key {
+                        if map[i - 1].0 == *key && self.options.reject_duplicate_keys {
+                            return Err(DecoderError::DuplicateMapKey { offset: key_offset });
+                        }
+                        return Err(DecoderError::OutOfOrderKey { offset: key_offset });
+                    }
+                    self.validate(value, nested_depth)?;
+                    key_offsets.push(key_offset);
+                }
+                if !self.options.canonical && self.options.reject_duplicate_keys {
+                    check_duplicate_keys(map, &key_offsets)?;
+                }
+            }
+            Value::Tag(tag, inner_value) => {
+                check_allowed_tag(self.options.allowed_tags.as_deref(), *tag, item_offset)?;
+                charge_alloc(&mut self.alloc_budget, ALLOC_ITEM_SIZE, item_offset)?;
+                self.offset += header_len(*tag);
+                let content_offset = self.offset;
+                self.validate(inner_value, nested_depth)?;
+                if self.options.canonical {
+                    if let Value::ByteString(bytes) = &**inner_value {
+                        check_bignum_magnitude(*tag, bytes, content_offset)?;
+                    }
+                }
+            }
+            Value::ByteString(bytes) => {
+                charge_alloc(&mut self.alloc_budget, bytes.len() as u64, item_offset)?;
+                self.offset += encoded_len(value);
+            }
+            Value::TextString(text) => {
+                charge_alloc(&mut self.alloc_budget, text.len() as u64, item_offset)?;
+                self.offset += encoded_len(value);
+            }
+            Value::Float(float) if self.options.reject_non_finite && !float.is_finite() => {
+                return Err(DecoderError::NonFiniteFloat {
+                    offset: item_offset,
+                });
+            }
+            _ => self.offset += encoded_len(value),
+        }
+        Ok(())
+    }
+}
+
+/// Number of bytes charged against the allocation budget for each element of an array, map or tag.
+const ALLOC_ITEM_SIZE: u64 = mem::size_of::<Value>() as u64;
+
+/// Charge an allocation of the given number of bytes for the item at the given offset against the
+/// remaining budget (if limited), failing if it would be exceeded.
+fn charge_alloc(budget: &mut Option<usize>, bytes: u64, offset: usize) -> Result<(), DecoderError> {
+    if let Some(remaining) = budget {
+        match usize::try_from(bytes) {
+            Ok(bytes) if bytes <= *remaining => *remaining -= bytes,
+            _ => return Err(DecoderError::AllocationLimitExceeded { offset }),
         }
     }
+    Ok(())
+}
+
+/// Check that the tag at the given offset is among the allowed tags (if restricted).
+fn check_allowed_tag(
+    allowed_tags: Option<&[u64]>,
+    tag: u64,
+    offset: usize,
+) -> Result<(), DecoderError> {
+    match allowed_tags {
+        Some(tags) if !tags.contains(&tag) => Err(DecoderError::DisallowedTag { tag, offset }),
+        _ => Ok(()),
+    }
+}
+
+/// Check that the byte string content (at the given offset) of an item with the given tag is a
+/// minimal bignum magnitude if the tag denotes a bignum (RFC 8949 section 3.4.3), i.e. that it has
+/// no leading zero bytes.
+fn check_bignum_magnitude(tag: u64, bytes: &[u8], offset: usize) -> Result<(), DecoderError> {
+    match (tag, bytes.first()) {
+        (2 | 3, Some(0)) => Err(DecoderError::NonMinimalCborEncoding { offset }),
+        _ => Ok(()),
+    }
+}
+
+/// Check that the given map entries (read from the given offsets) contain no duplicate keys.
+fn check_duplicate_keys<V: Ord>(
+    value_map: &[(V, V)],
+    key_offsets: &[usize],
+) -> Result<(), DecoderError> {
+    // Stable sort keeps duplicate keys in input order, so the later one is the duplicate.
+    let mut indices: Vec<usize> = (0..value_map.len()).collect();
+    indices.sort_by(|&a, &b| value_map[a].0.cmp(&value_map[b].0));
+    let duplicate = indices
+        .windows(2)
+        .filter(|w| value_map[w[0]].0 == value_map[w[1]].0)
+        .map(|w| key_offsets[w[1]])
+        .min();
+    match duplicate {
+        Some(offset) => Err(DecoderError::DuplicateMapKey { offset }),
+        None => Ok(()),
+    }
 }
 
 #[cfg(test)]
@@ -251,8 +910,8 @@ mod test {
 
     use super::*;
     use crate::{
-        cbor_array, cbor_bytes, cbor_false, cbor_int, cbor_map, cbor_null, cbor_true,
-        cbor_undefined,
+        cbor_array, cbor_array_vec, cbor_bytes, cbor_false, cbor_int, cbor_map, cbor_null,
+        cbor_tagged, cbor_text, cbor_true, cbor_undefined,
     };
 
     #[test]
@@ -280,47 +939,67 @@ mod test {
         for (unsigned, mut cbor) in cases {
             assert_eq!(read(&cbor), Ok(cbor_int!(unsigned)));
             cbor.push(0x01);
-            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData));
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::ExtraneousData {
+                    offset: cbor.len() - 1
+                })
+            );
         }
     }
 
     #[test]
     fn test_read_unsigned_non_minimum_byte_length() {
-        let encodings = vec![
+        let cases = vec![
             // Uint 23 encoded with 1 byte.
-            vec![0x18, 0x17],
+            (vec![0x18, 0x17], 0),
             // Uint 255 encoded with 2 bytes.
-            vec![0x19, 0x00, 0xff],
+            (vec![0x19, 0x00, 0xff], 0),
             // Uint 65535 encoded with 4 bytes.
-            vec![0x1a, 0x00, 0x00, 0xff, 0xff],
+            (vec![0x1a, 0x00, 0x00, 0xff, 0xff], 0),
             // Uint 4294967295 encoded with 8 bytes.
-            vec![0x1b, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff],
+            (
+                vec![0x1b, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff],
+                0,
+            ),
             // When decoding byte has more than one syntax error, the first syntax
             // error encountered during deserialization is returned as the error code.
-            vec![
-                0xa2, // map with non-minimally encoded key
-                0x17, // key 24
-                0x61, 0x42, // value :"B"
-                0x18, 0x17, // key 23 encoded with extra byte
-                0x61, 0x45, // value "E"
-            ],
-            vec![
-                0xa2, // map with out of order and non-minimally encoded key
-                0x18, 0x17, // key 23 encoded with extra byte
-                0x61, 0x45, // value "E"
-                0x17, // key 23
-                0x61, 0x42, // value :"B"
-            ],
-            vec![
-                0xa2, // map with duplicate non-minimally encoded key
-                0x18, 0x17, // key 23 encoded with extra byte
-                0x61, 0x45, // value "E"
-                0x18, 0x17, // key 23 encoded with extra byte
-                0x61, 0x42, // value :"B"
-            ],
+            (
+                vec![
+                    0xa2, // map with non-minimally encoded key
+                    0x17, // key 24
+                    0x61, 0x42, // value :"B"
+                    0x18, 0x17, // key 23 encoded with extra byte
+                    0x61, 0x45, // value "E"
+                ],
+                4,
+            ),
+            (
+                vec![
+                    0xa2, // map with out of order and non-minimally encoded key
+                    0x18, 0x17, // key 23 encoded with extra byte
+                    0x61, 0x45, // value "E"
+                    0x17, // key 23
+                    0x61, 0x42, // value :"B"
+                ],
+                1,
+            ),
+            (
+                vec![
+                    0xa2, // map with duplicate non-minimally encoded key
+                    0x18, 0x17, // key 23 encoded with extra byte
+                    0x61, 0x45, // value "E"
+                    0x18, 0x17, // key 23 encoded with extra byte
+                    0x61, 0x42, // value :"B"
+                ],
+                1,
+            ),
         ];
-        for encoding in encodings {
-            assert_eq!(read(&encoding), Err(DecoderError::NonMinimalCborEncoding));
+        for (encoding, offset) in cases {
+            assert_eq!(
+                read(&encoding),
+                Err(DecoderError::NonMinimalCborEncoding { offset })
+            );
         }
     }
 
@@ -342,7 +1021,12 @@ mod test {
         for (negative, mut cbor) in cases {
             assert_eq!(read(&cbor), Ok(cbor_int!(negative)));
             cbor.push(0x01);
-            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData));
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::ExtraneousData {
+                    offset: cbor.len() - 1
+                })
+            );
         }
     }
 
@@ -358,7 +1042,12 @@ mod test {
         for (byte_string, mut cbor) in cases {
             assert_eq!(read(&cbor), Ok(cbor_bytes!(byte_string)));
             cbor.push(0x01);
-            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData));
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::ExtraneousData {
+                    offset: cbor.len() - 1
+                })
+            );
         }
     }
 
@@ -380,7 +1069,12 @@ mod test {
         for (text_string, mut cbor) in cases {
             assert_eq!(read(&cbor), Ok(cbor_text!(text_string)));
             cbor.push(0x01);
-            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData));
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::ExtraneousData {
+                    offset: cbor.len() - 1
+                })
+            );
         }
     }
 
@@ -418,7 +1112,12 @@ mod test {
         for (text_string, mut cbor) in cases {
             assert_eq!(read(&cbor), Ok(cbor_text!(text_string)));
             cbor.push(0x01);
-            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData));
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::ExtraneousData {
+                    offset: cbor.len() - 1
+                })
+            );
         }
     }
 
@@ -426,7 +1125,7 @@ mod test {
     fn test_read_text_string_with_invalid_byte_sequence_after_nul() {
         assert_eq!(
             read(&vec![0x63, 0x00, 0x00, 0xA6]),
-            Err(DecoderError::InvalidUtf8)
+            Err(DecoderError::InvalidUtf8 { offset: 0 })
         );
     }
 
@@ -440,7 +1139,12 @@ mod test {
         ];
         assert_eq!(read(&test_cbor.clone()), Ok(cbor_array_vec!(value_vec)));
         test_cbor.push(0x01);
-        assert_eq!(read(&test_cbor), Err(DecoderError::ExtraneousData));
+        assert_eq!(
+            read(&test_cbor),
+            Err(DecoderError::ExtraneousData {
+                offset: test_cbor.len() - 1
+            })
+        );
     }
 
     #[test]
@@ -464,7 +1168,12 @@ mod test {
         ];
         assert_eq!(read(&test_cbor), Ok(value_map));
         test_cbor.push(0x01);
-        assert_eq!(read(&test_cbor), Err(DecoderError::ExtraneousData));
+        assert_eq!(
+            read(&test_cbor),
+            Err(DecoderError::ExtraneousData {
+                offset: test_cbor.len() - 1
+            })
+        );
     }
 
     #[test]
@@ -488,7 +1197,12 @@ mod test {
         ];
         assert_eq!(read(&test_cbor), Ok(value_map));
         test_cbor.push(0x01);
-        assert_eq!(read(&test_cbor), Err(DecoderError::ExtraneousData));
+        assert_eq!(
+            read(&test_cbor),
+            Err(DecoderError::ExtraneousData {
+                offset: test_cbor.len() - 1
+            })
+        );
     }
 
     #[test]
@@ -509,7 +1223,12 @@ mod test {
         ];
         assert_eq!(read(&test_cbor), Ok(value_map));
         test_cbor.push(0x01);
-        assert_eq!(read(&test_cbor), Err(DecoderError::ExtraneousData));
+        assert_eq!(
+            read(&test_cbor),
+            Err(DecoderError::ExtraneousData {
+                offset: test_cbor.len() - 1
+            })
+        );
     }
 
     #[test]
@@ -527,7 +1246,12 @@ mod test {
         ];
         assert_eq!(read(&test_cbor), Ok(value_map));
         test_cbor.push(0x01);
-        assert_eq!(read(&test_cbor), Err(DecoderError::ExtraneousData));
+        assert_eq!(
+            read(&test_cbor),
+            Err(DecoderError::ExtraneousData {
+                offset: test_cbor.len() - 1
+            })
+        );
     }
 
     #[test]
@@ -544,7 +1268,12 @@ mod test {
         ];
         assert_eq!(read(&test_cbor), Ok(value_map));
         test_cbor.push(0x01);
-        assert_eq!(read(&test_cbor), Err(DecoderError::ExtraneousData));
+        assert_eq!(
+            read(&test_cbor),
+            Err(DecoderError::ExtraneousData {
+                offset: test_cbor.len() - 1
+            })
+        );
     }
 
     #[test]
@@ -561,7 +1290,12 @@ mod test {
         ];
         assert_eq!(read(&test_cbor), Ok(value_map));
         test_cbor.push(0x01);
-        assert_eq!(read(&test_cbor), Err(DecoderError::ExtraneousData));
+        assert_eq!(
+            read(&test_cbor),
+            Err(DecoderError::ExtraneousData {
+                offset: test_cbor.len() - 1
+            })
+        );
     }
 
     #[test]
@@ -583,7 +1317,12 @@ mod test {
         ];
         assert_eq!(read(&test_cbor), Ok(value_map));
         test_cbor.push(0x01);
-        assert_eq!(read(&test_cbor), Err(DecoderError::ExtraneousData));
+        assert_eq!(
+            read(&test_cbor),
+            Err(DecoderError::ExtraneousData {
+                offset: test_cbor.len() - 1
+            })
+        );
     }
 
     #[test]
@@ -611,7 +1350,46 @@ mod test {
         for (value, mut cbor) in cases {
             assert_eq!(read(&cbor), Ok(value));
             cbor.push(0x01);
-            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData));
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::ExtraneousData {
+                    offset: cbor.len() - 1
+                })
+            );
+        }
+    }
+
+    #[test]
+    fn test_read_bignum_leading_zeros() {
+        let cases = vec![
+            // 2(h'0001')
+            (vec![0xc2, 0x42, 0x00, 0x01], 1),
+            // 3(h'00')
+            (vec![0xc3, 0x41, 0x00], 1),
+            // [0, 2(h'000000')]
+            (vec![0x82, 0x00, 0xc2, 0x43, 0x00, 0x00, 0x00], 3),
+        ];
+        for (cbor, offset) in cases {
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::NonMinimalCborEncoding { offset })
+            );
+            assert!(read_nested_non_strict(&cbor, None).is_ok());
+        }
+        // Other tags may contain any byte string, and zero is the empty magnitude.
+        let cases = vec![
+            (cbor_tagged!(2, cbor_bytes!(vec![])), vec![0xc2, 0x40]),
+            (
+                cbor_tagged!(3, cbor_bytes!(vec![0x01, 0x00])),
+                vec![0xc3, 0x42, 0x01, 0x00],
+            ),
+            (
+                cbor_tagged!(4, cbor_bytes!(vec![0x00])),
+                vec![0xc4, 0x41, 0x00],
+            ),
+        ];
+        for (value, cbor) in cases {
+            assert_eq!(read(&cbor), Ok(value));
         }
     }
 
@@ -638,44 +1416,93 @@ mod test {
         for (simple, mut cbor) in cases {
             assert_eq!(read(&cbor.clone()), Ok(simple));
             cbor.push(0x01);
-            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData));
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::ExtraneousData {
+                    offset: cbor.len() - 1
+                })
+            );
         }
     }
 
     #[test]
     fn test_read_unsupported_floating_point_numbers() {
+        // Only double precision floats are canonical, and only the quiet NaN without payload.
         let cases = vec![
             vec![0xF9, 0x10, 0x00],
             vec![0xFA, 0x10, 0x00, 0x00, 0x00],
-            vec![0xFB, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+            vec![0xFB, 0x7F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01],
+            vec![0xFB, 0xFF, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
         ];
         for cbor in cases {
             assert_eq!(
                 read(&cbor),
-                Err(DecoderError::UnsupportedFloatingPointValue)
+                Err(DecoderError::UnsupportedFloatingPointValue { offset: 0 })
             );
         }
+
+        let cases = vec![
+            (
+                vec![0xFB, 0x3F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+                1.5,
+            ),
+            (
+                vec![0xFB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+                0.0,
+            ),
+            (
+                vec![0xFB, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+                -0.0,
+            ),
+            (
+                // The bits of floats are not subject to the minimal encoding of integers.
+                vec![0xFB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01],
+                f64::from_bits(1),
+            ),
+            (
+                vec![0xFB, 0xFF, 0xF0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+                f64::NEG_INFINITY,
+            ),
+            (
+                vec![0xFB, 0x7F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+                f64::NAN,
+            ),
+        ];
+        let canonical = DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        };
+        for (cbor, float) in cases {
+            match read(&cbor) {
+                Ok(Value::Float(f)) => assert_eq!(f.to_bits(), float.to_bits()),
+                value => panic!("expected a float value, got {:?}", value),
+            }
+            assert_eq!(skip_prefix_with_options(&cbor, &canonical), Ok(&[][..]));
+        }
     }
 
     #[test]
     fn test_read_incomplete_cbor_data_error() {
         let cases = vec![
-            vec![0x19, 0x03],
-            vec![0x44, 0x01, 0x02, 0x03],
-            vec![0x65, 0x49, 0x45, 0x54, 0x46],
-            vec![0x82, 0x02],
-            vec![0xA2, 0x61, 0x61, 0x01],
-            vec![0x18],
-            vec![0x99],
-            vec![0xBA],
-            vec![0x5B],
-            vec![0x3B],
-            vec![0x99, 0x01],
-            vec![0xBA, 0x01, 0x02, 0x03],
-            vec![0x3B, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07],
+            (vec![0x19, 0x03], 0),
+            (vec![0x44, 0x01, 0x02, 0x03], 0),
+            (vec![0x65, 0x49, 0x45, 0x54, 0x46], 0),
+            (vec![0x82, 0x02], 2),
+            (vec![0xA2, 0x61, 0x61, 0x01], 4),
+            (vec![0x18], 0),
+            (vec![0x99], 0),
+            (vec![0xBA], 0),
+            (vec![0x5B], 0),
+            (vec![0x3B], 0),
+            (vec![0x99, 0x01], 0),
+            (vec![0xBA, 0x01, 0x02, 0x03], 0),
+            (vec![0x3B, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07], 0),
         ];
-        for cbor in cases {
-            assert_eq!(read(&cbor), Err(DecoderError::IncompleteCborData));
+        for (cbor, offset) in cases {
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::IncompleteCborData { offset })
+            );
         }
     }
 
@@ -685,14 +1512,19 @@ mod test {
             vec![0x7C, 0x49, 0x45, 0x54, 0x46],
             vec![0x7D, 0x22, 0x5C],
             vec![0x7E, 0xC3, 0xBC],
-            vec![0x7F, 0xE6, 0xB0, 0xB4],
+            vec![0x1F],
+            vec![0x3F],
+            vec![0xDF],
             vec![0xFC],
             vec![0xFD],
             vec![0xFE],
             vec![0xFF],
         ];
         for cbor in cases {
-            assert_eq!(read(&cbor), Err(DecoderError::UnknownAdditionalInfo));
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::UnknownAdditionalInfo { offset: 0 })
+            );
         }
     }
 
@@ -719,7 +1551,7 @@ mod test {
         let mut reader = Reader::new(&map_cbor);
         assert_eq!(
             reader.decode_complete_data_item(Some(1)),
-            Err(DecoderError::TooMuchNesting)
+            Err(DecoderError::TooMuchNesting { offset: 7 })
         );
         reader = Reader::new(&map_cbor);
         assert!(reader.decode_complete_data_item(Some(2)).is_ok());
@@ -728,44 +1560,59 @@ mod test {
     #[test]
     fn test_read_out_of_order_key_error() {
         let cases = vec![
-            vec![
-                0xa2, // map with 2 keys with same major type and length
-                0x61, 0x62, // key "b"
-                0x61, 0x42, // value "B"
-                0x61, 0x61, // key "a" (out of order byte-wise lexically)
-                0x61, 0x45, // value "E"
-            ],
-            vec![
-                0xa2, // map with 2 keys with different major type
-                0x61, 0x62, // key "b"
-                0x02, // value 2
-                // key 1000 (out of order since lower major type sorts first)
-                0x19, 0x03, 0xe8, 0x61, 0x61, // value a
-            ],
-            vec![
-                0xa2, // map with 2 keys with same major type
-                0x19, 0x03, 0xe8, // key 1000  (out of order due to longer length)
-                0x61, 0x61, //value "a"
-                0x0a, // key 10
-                0x61, 0x62, // value "b"
-            ],
-            vec![
-                0xa2, // map with 2 text string keys
-                0x62, b'a', b'a', // key text string "aa"
-                // (out of order due to longer length)
-                0x02, 0x61, b'b', // key "b"
-                0x01,
-            ],
-            vec![
-                0xa2, // map with 2 byte string keys
-                0x42, b'x', b'x', // key byte string "xx"
-                // (out of order due to longer length)
-                0x02, 0x41, b'y', // key byte string "y"
-                0x01,
-            ],
+            (
+                vec![
+                    0xa2, // map with 2 keys with same major type and length
+                    0x61, 0x62, // key "b"
+                    0x61, 0x42, // value "B"
+                    0x61, 0x61, // key "a" (out of order byte-wise lexically)
+                    0x61, 0x45, // value "E"
+                ],
+                5,
+            ),
+            (
+                vec![
+                    0xa2, // map with 2 keys with different major type
+                    0x61, 0x62, // key "b"
+                    0x02, // value 2
+                    // key 1000 (out of order since lower major type sorts first)
+                    0x19, 0x03, 0xe8, 0x61, 0x61, // value a
+                ],
+                4,
+            ),
+            (
+                vec![
+                    0xa2, // map with 2 keys with same major type
+                    0x19, 0x03, 0xe8, // key 1000  (out of order due to longer length)
+                    0x61, 0x61, //value "a"
+                    0x0a, // key 10
+                    0x61, 0x62, // value "b"
+                ],
+                6,
+            ),
+            (
+                vec![
+                    0xa2, // map with 2 text string keys
+                    0x62, b'a', b'a', // key text string "aa"
+                    // (out of order due to longer length)
+                    0x02, 0x61, b'b', // key "b"
+                    0x01,
+                ],
+                5,
+            ),
+            (
+                vec![
+                    0xa2, // map with 2 byte string keys
+                    0x42, b'x', b'x', // key byte string "xx"
+                    // (out of order due to longer length)
+                    0x02, 0x41, b'y', // key byte string "y"
+                    0x01,
+                ],
+                5,
+            ),
         ];
-        for cbor in cases {
-            assert_eq!(read(&cbor), Err(DecoderError::OutOfOrderKey));
+        for (cbor, offset) in cases {
+            assert_eq!(read(&cbor), Err(DecoderError::OutOfOrderKey { offset }));
         }
     }
 
@@ -788,7 +1635,58 @@ mod test {
         ];
         assert_eq!(
             read(&map_with_duplicate_key),
-            Err(DecoderError::OutOfOrderKey)
+            Err(DecoderError::OutOfOrderKey { offset: 8 })
+        );
+    }
+
+    #[test]
+    fn test_read_duplicate_key_with_options() {
+        let options = DecodeOptions {
+            reject_duplicate_keys: true,
+            ..Default::default()
+        };
+        let cases = vec![
+            (
+                vec![
+                    0xa3, // map of 3 pairs:
+                    0x61, 0x62, // "b"
+                    0x01, // 1
+                    0x61, 0x61, // "a"
+                    0x02, // 2
+                    0x61, 0x62, // "b" (Duplicate key)
+                    0x03, // 3
+                ],
+                7,
+            ),
+            (
+                vec![
+                    0xa1, // map of 1 pair:
+                    0x00, // 0
+                    0xa2, // map of 2 pairs:
+                    0x01, // 1
+                    0x01, // 1
+                    0x01, // 1 (Duplicate key)
+                    0x02, // 2
+                ],
+                5,
+            ),
+        ];
+        for (cbor, offset) in cases {
+            assert!(read_with_options(&cbor, &DecodeOptions::default()).is_ok());
+            assert_eq!(
+                read_with_options(&cbor, &options),
+                Err(DecoderError::DuplicateMapKey { offset })
+            );
+        }
+
+        let canonical = DecodeOptions {
+            canonical: true,
+            reject_duplicate_keys: true,
+            ..Default::default()
+        };
+        assert_eq!(
+            read_with_options(&[0xa2, 0x01, 0x01, 0x01, 0x02], &canonical),
+            Err(DecoderError::DuplicateMapKey { offset: 3 })
         );
     }
 
@@ -803,39 +1701,386 @@ mod test {
             assert!(read(&cbor).is_ok());
         }
         let impossible_utf_byte = vec![0x64, 0xFE, 0xFE, 0xFF, 0xFF];
-        assert_eq!(read(&impossible_utf_byte), Err(DecoderError::InvalidUtf8));
+        assert_eq!(
+            read(&impossible_utf_byte),
+            Err(DecoderError::InvalidUtf8 { offset: 0 })
+        );
     }
 
     #[test]
     fn test_read_extraneous_cbor_data_error() {
         let cases = vec![
-            vec![0x19, 0x03, 0x05, 0x00],
-            vec![0x44, 0x01, 0x02, 0x03, 0x04, 0x00],
-            vec![0x64, 0x49, 0x45, 0x54, 0x46, 0x00],
-            vec![0x82, 0x01, 0x02, 0x00],
-            vec![0xa1, 0x61, 0x63, 0x02, 0x61, 0x64, 0x03],
+            (vec![0x19, 0x03, 0x05, 0x00], 3),
+            (vec![0x44, 0x01, 0x02, 0x03, 0x04, 0x00], 5),
+            (vec![0x64, 0x49, 0x45, 0x54, 0x46, 0x00], 5),
+            (vec![0x82, 0x01, 0x02, 0x00], 3),
+            (vec![0xa1, 0x61, 0x63, 0x02, 0x61, 0x64, 0x03], 4),
         ];
-        for cbor in cases {
-            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData));
+        for (cbor, offset) in cases {
+            assert_eq!(read(&cbor), Err(DecoderError::ExtraneousData { offset }));
+            assert_eq!(
+                read_with_options(&cbor, &DecodeOptions::default()),
+                Err(DecoderError::ExtraneousData { offset })
+            );
+            let (_, remaining_cbor) =
+                read_prefix_with_options(&cbor, &DecodeOptions::default()).unwrap();
+            assert_eq!(remaining_cbor, &cbor[offset..]);
         }
     }
 
     #[test]
     fn test_read_unsupported_simple_type() {
+        // The two-byte form of values below 24 is already rejected as non-minimal in canonical
+        // mode; in non-strict mode it is still ill-formed.
         let cases = vec![
-            vec![0xE0],
-            vec![0xF3],
-            vec![0xF8, 0x18],
-            vec![0xF8, 0x1C],
-            vec![0xF8, 0x1D],
-            vec![0xF8, 0x1E],
-            vec![0xF8, 0x1F],
-            vec![0xF8, 0x20],
-            vec![0xF8, 0xFF],
+            (
+                vec![0xF8, 0x00],
+                DecoderError::NonMinimalCborEncoding { offset: 0 },
+            ),
+            (
+                vec![0xF8, 0x13],
+                DecoderError::NonMinimalCborEncoding { offset: 0 },
+            ),
+            (
+                vec![0xF8, 0x14],
+                DecoderError::NonMinimalCborEncoding { offset: 0 },
+            ),
+            (
+                vec![0xF8, 0x18],
+                DecoderError::UnsupportedSimpleValue { offset: 0 },
+            ),
+            (
+                vec![0xF8, 0x1C],
+                DecoderError::UnsupportedSimpleValue { offset: 0 },
+            ),
+            (
+                vec![0xF8, 0x1D],
+                DecoderError::UnsupportedSimpleValue { offset: 0 },
+            ),
+            (
+                vec![0xF8, 0x1E],
+                DecoderError::UnsupportedSimpleValue { offset: 0 },
+            ),
+            (
+                vec![0xF8, 0x1F],
+                DecoderError::UnsupportedSimpleValue { offset: 0 },
+            ),
+        ];
+        for (cbor, error) in cases {
+            assert_eq!(read(&cbor), Err(error));
+            assert_eq!(
+                read_nested_non_strict(&cbor, None),
+                Err(DecoderError::UnsupportedSimpleValue { offset: 0 })
+            );
+        }
+    }
+
+    #[test]
+    fn test_read_unassigned_simple_value() {
+        let cases = vec![
+            (SimpleValue::from_integer(0).unwrap(), vec![0xE0]),
+            (SimpleValue::from_integer(19).unwrap(), vec![0xF3]),
+            (SimpleValue::from_integer(32).unwrap(), vec![0xF8, 0x20]),
+            (SimpleValue::from_integer(255).unwrap(), vec![0xF8, 0xFF]),
+        ];
+        for (simple_value, cbor) in cases {
+            assert_eq!(read(&cbor), Ok(Value::Simple(simple_value.clone())));
+            assert_eq!(
+                read_nested_non_strict(&cbor, None),
+                Ok(Value::Simple(simple_value))
+            );
+        }
+    }
+
+    #[test]
+    fn test_read_with_options() {
+        let canonical = DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        };
+        let lenient = DecodeOptions::default();
+        let cases = vec![
+            // Uint 23 encoded with 1 byte.
+            (vec![0x18, 0x17], Value::Unsigned(23), 0),
+            // Array with a non-minimally encoded element.
+            (
+                vec![0x81, 0x19, 0x00, 0x01],
+                Value::Array(vec![Value::Unsigned(1)]),
+                1,
+            ),
+            // Array with a non-minimally encoded length.
+            (
+                vec![0x98, 0x01, 0x01],
+                Value::Array(vec![Value::Unsigned(1)]),
+                0,
+            ),
+        ];
+        for (cbor, value, offset) in cases {
+            assert_eq!(read_with_options(&cbor, &lenient), Ok(value));
+            assert_eq!(
+                read_with_options(&cbor, &canonical),
+                Err(DecoderError::NonMinimalCborEncoding { offset })
+            );
+        }
+    }
+
+    #[test]
+    fn test_read_max_depth() {
+        let cases = vec![
+            // [[0]]
+            (vec![0x81, 0x81, 0x00], 2),
+            // {0: {0: 0}}
+            (vec![0xa1, 0x00, 0xa1, 0x00, 0x00], 3),
+            // 1(1(0))
+            (vec![0xc1, 0xc1, 0x00], 2),
+        ];
+        for (cbor, offset) in cases {
+            let options = DecodeOptions {
+                max_depth: Some(2),
+                ..Default::default()
+            };
+            assert!(read_with_options(&cbor, &options).is_ok());
+            let options = DecodeOptions {
+                max_depth: Some(1),
+                ..Default::default()
+            };
+            assert_eq!(
+                read_with_options(&cbor, &options),
+                Err(DecoderError::TooMuchNesting { offset })
+            );
+        }
+
+        // Deeply nested input is rejected by default.
+        let mut cbor = vec![0x81; 1000];
+        cbor.push(0x00);
+        assert_eq!(
+            read_with_options(&cbor, &DecodeOptions::default()),
+            Err(DecoderError::TooMuchNesting { offset: 65 })
+        );
+    }
+
+    #[test]
+    fn test_read_floating_point_numbers_non_strict() {
+        let cases = vec![
+            // Half precision.
+            (vec![0xF9, 0x00, 0x00], 0.0),
+            (vec![0xF9, 0x80, 0x00], -0.0),
+            (vec![0xF9, 0x3C, 0x00], 1.0),
+            (vec![0xF9, 0x3E, 0x00], 1.5),
+            (vec![0xF9, 0x7B, 0xFF], 65504.0),
+            (vec![0xF9, 0xC4, 0x00], -4.0),
+            (vec![0xF9, 0x00, 0x01], 5.960464477539063e-8),
+            (vec![0xF9, 0x04, 0x00], 0.00006103515625),
+            (vec![0xF9, 0x7C, 0x00], f64::INFINITY),
+            (vec![0xF9, 0xFC, 0x00], f64::NEG_INFINITY),
+            // Single precision.
+            (vec![0xFA, 0x47, 0xC3, 0x50, 0x00], 100000.0),
+            (vec![0xFA, 0x7F, 0x80, 0x00, 0x00], f64::INFINITY),
+            // Double precision.
+            (
+                vec![0xFB, 0x3F, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A],
+                1.1,
+            ),
+            (
+                vec![0xFB, 0xC0, 0x10, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66],
+                -4.1,
+            ),
+        ];
+        for (cbor, float) in cases {
+            let value = read_with_options(&cbor, &DecodeOptions::default()).unwrap();
+            match value {
+                Value::Float(f) => assert_eq!(f.to_bits(), float.to_bits()),
+                _ => panic!("expected a float value, got {:?}", value),
+            }
+        }
+
+        for cbor in [
+            vec![0xF9, 0x7E, 0x00],
+            vec![0xFA, 0x7F, 0xC0, 0x00, 0x00],
+            vec![0xFB, 0x7F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+        ] {
+            let value = read_with_options(&cbor, &DecodeOptions::default()).unwrap();
+            assert!(matches!(value, Value::Float(f) if f.is_nan()));
+        }
+    }
+
+    #[test]
+    fn test_read_non_finite_floats() {
+        let options = DecodeOptions {
+            reject_non_finite: true,
+            ..Default::default()
+        };
+        let cases = vec![
+            vec![0xF9, 0x7C, 0x00],
+            vec![0xF9, 0xFC, 0x00],
+            vec![0xF9, 0x7E, 0x00],
+            vec![0xFA, 0x7F, 0x80, 0x00, 0x00],
+            vec![0xFA, 0x7F, 0xC0, 0x00, 0x01],
+            vec![0xFB, 0x7F, 0xF0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+            vec![0xFB, 0xFF, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
         ];
         for cbor in cases {
-            assert_eq!(read(&cbor), Err(DecoderError::UnsupportedSimpleValue));
+            assert_eq!(
+                read_with_options(&cbor, &options),
+                Err(DecoderError::NonFiniteFloat { offset: 0 })
+            );
+            // Non-finite floats are accepted by default.
+            assert!(read_with_options(&cbor, &DecodeOptions::default()).is_ok());
+        }
+
+        // Finite floats are still accepted, and the offset of the failing float is reported.
+        assert_eq!(
+            read_with_options(&[0xF9, 0x7B, 0xFF], &options),
+            Ok(Value::Float(65504.0))
+        );
+        assert_eq!(
+            read_with_options(&[0x82, 0xF9, 0x3C, 0x00, 0xF9, 0x7C, 0x00], &options),
+            Err(DecoderError::NonFiniteFloat { offset: 4 })
+        );
+    }
+
+    #[test]
+    fn test_read_indefinite_length_non_strict() {
+        let cases = vec![
+            (vec![0x9F, 0xFF], cbor_array![]),
+            (vec![0x9F, 0x01, 0x02, 0xFF], cbor_array![1, 2]),
+            (
+                vec![0x9F, 0x01, 0x9F, 0x02, 0xFF, 0x83, 0x03, 0x04, 0x05, 0xFF],
+                cbor_array![1, cbor_array![2], cbor_array![3, 4, 5]],
+            ),
+            (vec![0xBF, 0xFF], cbor_map! {}),
+            (
+                vec![
+                    0xBF, 0x61, 0x61, 0x01, 0x61, 0x62, 0x9F, 0x02, 0x03, 0xFF, 0xFF,
+                ],
+                cbor_map! {
+                    "a" => 1,
+                    "b" => cbor_array![2, 3],
+                },
+            ),
+        ];
+        for (cbor, value) in cases {
+            assert_eq!(
+                read_with_options(&cbor, &DecodeOptions::default()),
+                Ok(value)
+            );
+            // Indefinite-length items are not canonical.
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::IndefiniteLength { offset: 0 })
+            );
+        }
+
+        for (cbor, offset) in [
+            (vec![0x9F], 1),
+            (vec![0x9F, 0x01, 0x02], 3),
+            (vec![0xBF, 0x61, 0x61], 3),
+            (vec![0xBF, 0x61, 0x61, 0x01], 4),
+        ] {
+            assert_eq!(
+                read_with_options(&cbor, &DecodeOptions::default()),
+                Err(DecoderError::IncompleteCborData { offset })
+            );
+        }
+
+        // A break code in place of a map value or outside of an indefinite-length item.
+        for (cbor, offset) in [
+            (vec![0xFF], 0),
+            (vec![0xBF, 0x61, 0x61, 0xFF], 3),
+            (vec![0x81, 0xFF], 1),
+        ] {
+            assert_eq!(
+                read_with_options(&cbor, &DecodeOptions::default()),
+                Err(DecoderError::UnknownAdditionalInfo { offset })
+            );
+        }
+    }
+
+    #[test]
+    fn test_read_chunked_strings_non_strict() {
+        let cases = vec![
+            (vec![0x5F, 0xFF], cbor_bytes!(vec![])),
+            (
+                vec![0x5F, 0x41, 0x01, 0x40, 0x42, 0x02, 0x03, 0xFF],
+                cbor_bytes!(vec![0x01, 0x02, 0x03]),
+            ),
+            (vec![0x7F, 0xFF], cbor_text!("")),
+            (
+                vec![0x7F, 0x61, 0x61, 0x60, 0x62, 0x62, 0x63, 0xFF],
+                cbor_text!("abc"),
+            ),
+            (
+                vec![0x82, 0x7F, 0x61, 0x61, 0xFF, 0x5F, 0x41, 0x01, 0xFF],
+                cbor_array![cbor_text!("a"), cbor_bytes!(vec![0x01])],
+            ),
+        ];
+        for (cbor, value) in cases {
+            assert_eq!(
+                read_with_options(&cbor, &DecodeOptions::default()),
+                Ok(value)
+            );
+            // Indefinite-length items are not canonical.
+            assert!(read(&cbor).is_err());
+        }
+
+        let cases = vec![
+            // Byte string chunk inside a text string.
+            (vec![0x7F, 0x61, 0x61, 0x41, 0x62, 0xFF], 3),
+            // Text string chunk inside a byte string.
+            (vec![0x5F, 0x41, 0x01, 0x61, 0x61, 0xFF], 3),
+            // Nested indefinite-length chunk.
+            (vec![0x5F, 0x5F, 0x41, 0x01, 0xFF, 0xFF], 1),
+            // Non-string chunk.
+            (vec![0x7F, 0x01, 0xFF], 1),
+        ];
+        for (cbor, offset) in cases {
+            assert_eq!(
+                read_with_options(&cbor, &DecodeOptions::default()),
+                Err(DecoderError::InvalidStringChunk { offset })
+            );
         }
+
+        // Each text chunk must be valid UTF-8 on its own, even if the concatenation would be.
+        let split_code_point = vec![0x7F, 0x61, 0xC3, 0x61, 0xBC, 0xFF];
+        assert_eq!(
+            read_with_options(&split_code_point, &DecodeOptions::default()),
+            Err(DecoderError::InvalidUtf8 { offset: 1 })
+        );
+        let missing_break = vec![0x7F, 0x61, 0x61];
+        assert_eq!(
+            read_with_options(&missing_break, &DecodeOptions::default()),
+            Err(DecoderError::IncompleteCborData { offset: 3 })
+        );
+    }
+
+    #[test]
+    fn test_read_borrowed() {
+        let cbor = vec![0x82, 0x42, 0x01, 0x02, 0x61, 0x61];
+        let value = read_borrowed_with_options(&cbor, &DecodeOptions::default()).unwrap();
+        match &value {
+            ValueRef::Array(items) => {
+                assert!(
+                    matches!(&items[0], ValueRef::ByteString(Cow::Borrowed(b)) if b == &[1, 2])
+                );
+                assert!(matches!(
+                    &items[1],
+                    ValueRef::TextString(Cow::Borrowed("a"))
+                ));
+            }
+            _ => panic!("expected an array, got {:?}", value),
+        }
+        assert_eq!(value.into_owned(), read(&cbor).unwrap());
+
+        // Chunked strings cannot be borrowed.
+        let cbor = vec![0x7F, 0x61, 0x61, 0x61, 0x62, 0xFF];
+        let value = read_borrowed_with_options(&cbor, &DecodeOptions::default()).unwrap();
+        assert!(matches!(&value, ValueRef::TextString(Cow::Owned(s)) if s == "ab"));
+
+        let cbor = vec![0x61, 0x61, 0x00];
+        assert_eq!(
+            read_borrowed_with_options(&cbor, &DecodeOptions::default()),
+            Err(DecoderError::ExtraneousData { offset: 2 })
+        );
     }
 
     #[test]
@@ -845,7 +2090,396 @@ mod test {
             vec![0xBB, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF],
         ];
         for cbor in cases {
-            assert_eq!(read(&cbor), Err(DecoderError::IncompleteCborData));
+            // The first item of the container is missing.
+            assert_eq!(
+                read(&cbor),
+                Err(DecoderError::IncompleteCborData { offset: 9 })
+            );
+        }
+    }
+
+    #[test]
+    fn test_skip_prefix() {
+        let cases = vec![
+            vec![0x18, 0x64],
+            vec![0x39, 0x03, 0xE7],
+            vec![0x44, 0x01, 0x02, 0x03, 0x04],
+            vec![0x82, 0x81, 0x01, 0xA1, 0x01, 0x80],
+            vec![0xA2, 0x02, 0x00, 0x01, 0x00], // Keys are not checked for order.
+            vec![0xC1, 0xC2, 0x41, 0x00],
+            vec![0xFB, 0x3F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+            vec![0x9F, 0xBF, 0x01, 0x9F, 0xFF, 0xFF, 0xFF],
+            vec![0x5F, 0x41, 0x01, 0x40, 0xFF],
+        ];
+        for cbor in cases {
+            let mut data = cbor.clone();
+            data.push(0x00);
+            assert_eq!(
+                skip_prefix_with_options(&data, &DecodeOptions::default()),
+                Ok(&[0x00][..]),
+                "data: {:02X?}",
+                cbor
+            );
+        }
+
+        let cases = vec![
+            (
+                vec![0x82, 0x01],
+                DecoderError::IncompleteCborData { offset: 2 },
+            ),
+            (
+                vec![0x9F, 0x01],
+                DecoderError::IncompleteCborData { offset: 2 },
+            ),
+            (
+                vec![0xA1, 0x01, 0xFF],
+                DecoderError::UnknownAdditionalInfo { offset: 2 },
+            ),
+            (
+                vec![0xBF, 0x01, 0xFF],
+                DecoderError::UnknownAdditionalInfo { offset: 2 },
+            ),
+            (
+                vec![0x7F, 0x41, 0x01, 0xFF],
+                DecoderError::InvalidStringChunk { offset: 1 },
+            ),
+            (
+                vec![0x62, 0xFF, 0xFE],
+                DecoderError::InvalidUtf8 { offset: 0 },
+            ),
+            (
+                vec![0xFF],
+                DecoderError::UnknownAdditionalInfo { offset: 0 },
+            ),
+            (
+                vec![0x81, 0x81, 0x81, 0x00],
+                DecoderError::TooMuchNesting { offset: 2 },
+            ),
+        ];
+        let options = DecodeOptions {
+            max_depth: Some(1),
+            ..Default::default()
+        };
+        for (cbor, error) in cases {
+            assert_eq!(
+                skip_prefix_with_options(&cbor, &options),
+                Err(error),
+                "data: {:02X?}",
+                cbor
+            );
         }
+
+        // Canonical form is required when decoding canonically.
+        let canonical = DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        };
+        assert_eq!(
+            skip_prefix_with_options(&[0x81, 0x18, 0x01], &canonical),
+            Err(DecoderError::NonMinimalCborEncoding { offset: 1 })
+        );
+        assert_eq!(
+            skip_prefix_with_options(&[0x9F, 0xFF], &canonical),
+            Err(DecoderError::IndefiniteLength { offset: 0 })
+        );
+
+        // Other options apply as well.
+        let reject_non_finite = DecodeOptions {
+            reject_non_finite: true,
+            ..Default::default()
+        };
+        assert_eq!(
+            skip_prefix_with_options(&[0x81, 0xF9, 0x7C, 0x00], &reject_non_finite),
+            Err(DecoderError::NonFiniteFloat { offset: 1 })
+        );
+    }
+
+    #[test]
+    fn test_validate_with_options() {
+        let cases: Vec<Vec<u8>> = vec![
+            vec![0x82, 0x01, 0x62, 0x68, 0x69],       // [1, "hi"]
+            vec![0xc1, 0x1a, 0x00, 0x01, 0x00, 0x00], // 1(65536)
+            vec![0x82, 0x01, 0xc2, 0x42, 0x00, 0x01], // [1, 2(h'0001')]
+            vec![0xfb, 0x3f, 0xf1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a], // 1.1
+            vec![
+                0x82, 0x01, 0xfb, 0x7f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+            ], // [1, NaN]
+            vec![
+                0x82, 0x01, 0xfb, 0x7f, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+            ], // [1, Infinity]
+            vec![
+                0xa3, // map of 3 pairs:
+                0x61, 0x62, // "b"
+                0x01, // 1
+                0x61, 0x61, // "a"
+                0x02, // 2
+                0x61, 0x62, // "b" (Duplicate key)
+                0x03, // 3
+            ],
+            vec![
+                0xa2, // map of 2 pairs:
+                0x00, // 0
+                0xa2, // map of 2 pairs:
+                0x01, // 1
+                0x01, // 1
+                0x01, // 1 (Duplicate key)
+                0x02, // 2
+                0x18, 0x64, // 100
+                0x80, // []
+            ],
+            [0x81; 64].iter().copied().chain([0x00]).collect(),
+            [0x81; 65].iter().copied().chain([0x00]).collect(),
+        ];
+        let options = [
+            DecodeOptions::default(),
+            DecodeOptions {
+                canonical: true,
+                ..Default::default()
+            },
+            DecodeOptions {
+                reject_duplicate_keys: true,
+                ..Default::default()
+            },
+            DecodeOptions {
+                canonical: true,
+                reject_duplicate_keys: true,
+                ..Default::default()
+            },
+            DecodeOptions {
+                max_depth: Some(1),
+                ..Default::default()
+            },
+            DecodeOptions {
+                reject_non_finite: true,
+                ..Default::default()
+            },
+            DecodeOptions {
+                max_alloc_bytes: Some(4 * ALLOC_ITEM_SIZE as usize),
+                ..Default::default()
+            },
+            DecodeOptions {
+                allowed_tags: Some(vec![0, 2]),
+                ..Default::default()
+            },
+        ];
+        for cbor in cases {
+            let value = read_nested_non_strict(&cbor, None).unwrap();
+            for options in &options {
+                // Validating the value must give the same result as reading its encoding.
+                assert_eq!(
+                    validate_with_options(&value, options),
+                    read_with_options(&cbor, options).map(|_| ()),
+                    "cbor: {:02x?}, options: {:?}",
+                    cbor,
+                    options
+                );
+            }
+        }
+    }
+
+    #[test]
+    fn test_reserve_elements() {
+        // Four bytes remain after the header of an array declaring 2^32 elements.
+        let cbor = vec![
+            0x9B, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04,
+        ];
+        let reserve = |size_value, min_element_len| {
+            Reader::new(&cbor[9..]).reserve_elements(size_value, 1, min_element_len, 0)
+        };
+        assert_eq!(reserve(None, 1), Ok(0));
+        assert_eq!(reserve(Some(3), 1), Ok(3));
+        assert_eq!(reserve(Some(1 << 32), 1), Ok(4));
+        assert_eq!(reserve(Some(1 << 32), 2), Ok(2));
+        assert_eq!(reserve(Some(u64::MAX), 1), Ok(4));
+
+        // Later reservations get what is left of the data.
+        let mut reader = Reader::new(&cbor[9..]);
+        assert_eq!(reader.reserve_elements(Some(3), 1, 1, 0), Ok(3));
+        assert_eq!(reader.reserve_elements(Some(1 << 32), 1, 1, 0), Ok(1));
+        assert_eq!(reader.reserve_elements(Some(1 << 32), 1, 1, 0), Ok(0));
+        assert_eq!(
+            read(&cbor),
+            Err(DecoderError::IncompleteCborData { offset: 13 })
+        );
+        let cbor = vec![
+            0xBB, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x01, 0x02,
+        ];
+        assert_eq!(
+            read(&cbor),
+            Err(DecoderError::IncompleteCborData { offset: 11 })
+        );
+    }
+
+    #[test]
+    fn test_reserve_elements_nested() {
+        // Arrays declaring 2^31 - 1 elements, each nested in the previous one.
+        let header = [0x9A, 0x7F, 0xFF, 0xFF, 0xFF];
+        let cbor = header.repeat(1 << 16);
+
+        // The capacity reserved for all of them is bounded by the length of the data, rather than
+        // each of them reserving that much.
+        let mut reader = Reader::new(&cbor);
+        let mut reserved = 0;
+        while reader.read_bytes(header.len()).is_some() {
+            reserved += reader
+                .reserve_elements(Some(0x7FFF_FFFF), ALLOC_ITEM_SIZE, 1, 0)
+                .unwrap();
+        }
+        assert!(reserved <= cbor.len(), "reserved: {}", reserved);
+
+        // Reading them hits the depth limit, without reserving memory for every level first.
+        for options in [
+            DecodeOptions::default(),
+            DecodeOptions {
+                canonical: true,
+                ..Default::default()
+            },
+        ] {
+            assert_eq!(
+                read_with_options(&cbor, &options),
+                Err(DecoderError::TooMuchNesting {
+                    offset: header.len() * (DEFAULT_MAX_DEPTH as usize + 1)
+                })
+            );
+        }
+    }
+
+    #[test]
+    fn test_read_max_alloc_bytes() {
+        let item = ALLOC_ITEM_SIZE as usize;
+        let limited = |max_alloc_bytes| DecodeOptions {
+            max_alloc_bytes: Some(max_alloc_bytes),
+            ..Default::default()
+        };
+        // [h'0102', {"a": 1}, 1(2)] needs 3 items for the array, 2 bytes, 2 items for the map, 1
+        // byte and 1 item for the tag.
+        let cbor = vec![0x83, 0x42, 0x01, 0x02, 0xA1, 0x61, 0x61, 0x01, 0xC1, 0x02];
+        let needed = 6 * item + 3;
+        assert!(read_with_options(&cbor, &limited(needed)).is_ok());
+        assert!(read_with_options(&cbor, &DecodeOptions::default()).is_ok());
+        let cases = vec![
+            (0, 0),
+            (3 * item - 1, 0),
+            (3 * item + 1, 1),
+            (5 * item + 1, 4),
+            (5 * item + 2, 5),
+            (needed - 1, 8),
+        ];
+        for (max_alloc_bytes, offset) in cases {
+            assert_eq!(
+                read_with_options(&cbor, &limited(max_alloc_bytes)),
+                Err(DecoderError::AllocationLimitExceeded { offset }),
+                "max_alloc_bytes: {}",
+                max_alloc_bytes
+            );
+        }
+
+        // Declared lengths are charged before reading any elements.
+        let cbor = vec![0x9B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF];
+        assert_eq!(
+            read_with_options(&cbor, &limited(1 << 20)),
+            Err(DecoderError::AllocationLimitExceeded { offset: 0 })
+        );
+        assert_eq!(
+            read_with_options(&cbor, &DecodeOptions::default()),
+            Err(DecoderError::IncompleteCborData { offset: 9 })
+        );
+
+        // Many small containers exceed the budget together.
+        let cbor: Vec<u8> = [0x9F]
+            .iter()
+            .copied()
+            .chain([0x81, 0x00].iter().copied().cycle().take(200))
+            .chain([0xFF])
+            .collect();
+        assert!(read_with_options(&cbor, &limited(200 * item)).is_ok());
+        // Elements of indefinite-length containers are charged to the container as they are read.
+        assert_eq!(
+            read_with_options(&cbor, &limited(150 * item)),
+            Err(DecoderError::AllocationLimitExceeded { offset: 0 })
+        );
+        assert_eq!(
+            read_with_options(&cbor, &limited(149 * item)),
+            Err(DecoderError::AllocationLimitExceeded { offset: 149 })
+        );
+
+        // The budget is shared by all chunks of a string.
+        let cbor = vec![0x5F, 0x42, 0x01, 0x02, 0x41, 0x03, 0xFF];
+        assert!(read_with_options(&cbor, &limited(3)).is_ok());
+        assert_eq!(
+            read_with_options(&cbor, &limited(2)),
+            Err(DecoderError::AllocationLimitExceeded { offset: 4 })
+        );
+    }
+
+    #[test]
+    fn test_read_allowed_tags() {
+        let allowed = DecodeOptions {
+            allowed_tags: Some(vec![1, 2]),
+            ..Default::default()
+        };
+        let cases = vec![
+            (vec![0xC1, 0x00], Ok(())),                          // 1(0)
+            (vec![0x82, 0x00, 0xC2, 0x40], Ok(())),              // [0, 2(h'')]
+            (vec![0xC1, 0xC2, 0x41, 0x01], Ok(())),              // 1(2(h'01'))
+            (vec![0xC0, 0x60], Err((0, 0))),                     // 0("")
+            (vec![0x82, 0x00, 0xD8, 0x2A, 0x00], Err((42, 2))),  // [0, 42(0)]
+            (vec![0xC1, 0xD9, 0x01, 0x00, 0x00], Err((256, 1))), // 1(256(0))
+        ];
+        for (cbor, expected) in cases {
+            let expected =
+                expected.map_err(|(tag, offset)| DecoderError::DisallowedTag { tag, offset });
+            assert_eq!(
+                read_with_options(&cbor, &allowed).map(|_| ()),
+                expected,
+                "cbor: {:02x?}",
+                cbor
+            );
+            assert!(read_with_options(&cbor, &DecodeOptions::default()).is_ok());
+        }
+
+        // An empty set rejects all tags, including in CBOR sequences.
+        let none = DecodeOptions {
+            allowed_tags: Some(Vec::new()),
+            ..Default::default()
+        };
+        assert_eq!(
+            read_seq_with_options(&[0x00, 0xC1, 0x00], &none),
+            Err(DecoderError::DisallowedTag { tag: 1, offset: 1 })
+        );
+        assert_eq!(
+            read_seq_with_options(&[0x00, 0x01], &none).unwrap().len(),
+            2
+        );
+    }
+
+    #[test]
+    fn test_read_seq() {
+        let canonical = DecodeOptions {
+            canonical: true,
+            ..Default::default()
+        };
+        assert_eq!(read_seq_with_options(&[], &canonical), Ok(vec![]));
+        assert_eq!(
+            read_seq_with_options(&[0x01, 0x61, 0x61, 0x80], &canonical),
+            Ok(vec![
+                Value::Unsigned(1),
+                Value::TextString("a".into()),
+                Value::Array(vec![])
+            ])
+        );
+        // Offsets are relative to the start of the sequence.
+        assert_eq!(
+            read_seq_with_options(&[0x01, 0x82, 0x01], &canonical),
+            Err(DecoderError::IncompleteCborData { offset: 3 })
+        );
+        assert_eq!(
+            read_seq_with_options(&[0x01, 0x18, 0x01], &canonical),
+            Err(DecoderError::NonMinimalCborEncoding { offset: 1 })
+        );
+        assert_eq!(
+            read_seq_with_options(&[0x01, 0x18, 0x01], &DecodeOptions::default()),
+            Ok(vec![Value::Unsigned(1), Value::Unsigned(1)])
+        );
     }
 }
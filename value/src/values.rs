@@ -15,11 +15,13 @@
 //! Types for expressing CBOR values.
 
 use alloc::{
+    alloc::{AllocError, Allocator, Global, Layout},
+    borrow::Cow,
     boxed::Box,
     string::{String, ToString},
     vec::Vec,
 };
-use core::cmp::Ordering;
+use core::{cmp::Ordering, fmt, ptr::NonNull};
 
 /// Possible CBOR values.
 #[derive(Clone, Debug)]
@@ -40,15 +42,138 @@ pub enum Value {
     Tag(u64, Box<Value>),
     /// Simple value.
     Simple(SimpleValue),
+    /// Floating point value. Half and single precision values are widened on decode.
+    Float(f64),
+}
+
+/// Possible CBOR values, borrowing byte and text strings from the encoded data where possible.
+///
+/// Strings are only borrowed when they are encoded as a single definite-length chunk, otherwise
+/// they are owned. Arrays, maps and tagged values are allocated with a [`ContainerAlloc`].
+#[derive(Clone, Debug)]
+pub enum ValueRef<'a> {
+    /// Unsigned integer value (uint).
+    Unsigned(u64),
+    /// Signed integer value (nint).
+    Negative(i128),
+    /// Byte string (bstr).
+    ByteString(Cow<'a, [u8]>),
+    /// Text string (tstr).
+    TextString(Cow<'a, str>),
+    /// Array/tuple of values.
+    Array(Vec<ValueRef<'a>, ContainerAlloc<'a>>),
+    /// Map of key-value pairs.
+    Map(Vec<(ValueRef<'a>, ValueRef<'a>), ContainerAlloc<'a>>),
+    /// Tagged value.
+    Tag(u64, Box<ValueRef<'a>, ContainerAlloc<'a>>),
+    /// Simple value.
+    Simple(SimpleValue),
+    /// Floating point value.
+    Float(f64),
+}
+
+/// Allocator of the arrays, maps and tagged values of a [`ValueRef`].
+///
+/// This is the global allocator (the default), unless the value was read using another allocator
+/// which lives at least as long as the data it borrows from, e.g. an arena holding that data.
+#[derive(Clone, Copy, Default)]
+pub struct ContainerAlloc<'a>(Option<&'a dyn Allocator>);
+
+impl<'a> ContainerAlloc<'a> {
+    /// Allocate from the given allocator instead of the global one.
+    pub fn new(alloc: &'a dyn Allocator) -> Self {
+        Self(Some(alloc))
+    }
+}
+
+impl fmt::Debug for ContainerAlloc<'_> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self.0 {
+            Some(_) => f.write_str("ContainerAlloc(custom)"),
+            None => f.write_str("ContainerAlloc(global)"),
+        }
+    }
+}
+
+unsafe impl Allocator for ContainerAlloc<'_> {
+    fn allocate(&self, layout: Layout) -> Result<NonNull<[u8]>, AllocError> {
+        match self.0 {
+            Some(alloc) => alloc.allocate(layout),
+            None => Global.allocate(layout),
+        }
+    }
+
+    unsafe fn deallocate(&self, ptr: NonNull<u8>, layout: Layout) {
+        match self.0 {
+            Some(alloc) => alloc.deallocate(ptr, layout),
+            None => Global.deallocate(ptr, layout),
+        }
+    }
 }
 
 /// Specific simple CBOR values.
-#[derive(Clone, Debug, PartialEq, Eq, PartialOrd, Ord)]
+///
+/// Simple values are ordered by their encoded value, which matches the canonical order.
+#[derive(Clone, Debug, PartialEq, Eq)]
 pub enum SimpleValue {
-    FalseValue = 20,
-    TrueValue = 21,
-    NullValue = 22,
-    Undefined = 23,
+    FalseValue,
+    TrueValue,
+    NullValue,
+    Undefined,
+    /// Simple value without an assigned meaning.
+    Unassigned(UnassignedSimpleValue),
+}
+
+/// Simple value without an assigned meaning, i.e. 0 to 19 or 32 to 255.
+///
+/// Values 20 to 23 are the named simple values and values 24 to 31 are reserved, so that they
+/// cannot be represented and every simple value has a valid encoding.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct UnassignedSimpleValue(u8);
+
+impl UnassignedSimpleValue {
+    /// Create an unassigned simple value, returning `None` for the named and the reserved values.
+    pub fn new(value: u8) -> Option<UnassignedSimpleValue> {
+        match value {
+            0..=19 | 32..=255 => Some(UnassignedSimpleValue(value)),
+            _ => None,
+        }
+    }
+
+    /// The encoded value of the simple value.
+    pub fn get(self) -> u8 {
+        self.0
+    }
+}
+
+/// Major type of a CBOR data item (RFC 8949 section 3.1).
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum MajorType {
+    Unsigned = 0,
+    Negative = 1,
+    ByteString = 2,
+    TextString = 3,
+    Array = 4,
+    Map = 5,
+    Tag = 6,
+    /// Simple values and floating point values.
+    Simple = 7,
+}
+
+impl MajorType {
+    /// Major type of the data item starting with the given initial byte.
+    pub fn from_initial_byte(byte: u8) -> MajorType {
+        match byte >> Constants::MAJOR_TYPE_BIT_SHIFT {
+            0 => MajorType::Unsigned,
+            1 => MajorType::Negative,
+            2 => MajorType::ByteString,
+            3 => MajorType::TextString,
+            4 => MajorType::Array,
+            5 => MajorType::Map,
+            6 => MajorType::Tag,
+            _ => MajorType::Simple,
+        }
+    }
 }
 
 /// Constant values required for CBOR encoding.
@@ -70,6 +195,12 @@ impl Constants {
     pub const ADDITIONAL_INFORMATION_4_BYTES: u8 = 26;
     /// Additional information value indicating that an 8-byte length follows.
     pub const ADDITIONAL_INFORMATION_8_BYTES: u8 = 27;
+    /// Additional information value indicating an indefinite-length item.
+    pub const ADDITIONAL_INFORMATION_INDEFINITE: u8 = 31;
+    /// Byte terminating an indefinite-length item.
+    pub const BREAK: u8 = 0xFF;
+    /// Bit pattern of the quiet NaN all NaN values are encoded as.
+    pub const CANONICAL_NAN_BITS: u64 = 0x7FF8_0000_0000_0000;
 }
 
 impl Value {
@@ -104,7 +235,7 @@ impl Value {
             Value::Array(_) => 4,
             Value::Map(_) => 5,
             Value::Tag(_, _) => 6,
-            Value::Simple(_) => 7,
+            Value::Simple(_) | Value::Float(_) => 7,
         }
     }
 }
@@ -112,7 +243,7 @@ impl Value {
 impl Ord for Value {
     fn cmp(&self, other: &Value) -> Ordering {
         use super::values::Value::{
-            Array, ByteString, Map, Negative, Simple, Tag, TextString, Unsigned,
+            Array, ByteString, Float, Map, Negative, Simple, Tag, TextString, Unsigned,
         };
         let self_type_value = self.type_label();
         let other_type_value = other.type_label();
@@ -150,6 +281,10 @@ impl Ord for Value {
             }
             (Tag(t1, v1), Tag(t2, v2)) => t1.cmp(t2).then(v1.cmp(v2)),
             (Simple(s1), Simple(s2)) => s1.cmp(s2),
+            // Simple values have a shorter encoding than floats, which compare by their encoding.
+            (Simple(_), Float(_)) => Ordering::Less,
+            (Float(_), Simple(_)) => Ordering::Greater,
+            (Float(f1), Float(f2)) => f1.to_bits().cmp(&f2.to_bits()),
             (_, _) => {
                 // The case of different major types is caught above.
                 unreachable!();
@@ -172,17 +307,151 @@ impl PartialEq for Value {
     }
 }
 
+impl ValueRef<'_> {
+    /// Convert into an owned [`Value`], copying any borrowed strings.
+    pub fn into_owned(self) -> Value {
+        match self {
+            ValueRef::Unsigned(v) => Value::Unsigned(v),
+            ValueRef::Negative(v) => Value::Negative(v),
+            ValueRef::ByteString(v) => Value::ByteString(v.into_owned()),
+            ValueRef::TextString(v) => Value::TextString(v.into_owned()),
+            ValueRef::Array(v) => Value::Array(v.into_iter().map(ValueRef::into_owned).collect()),
+            ValueRef::Map(v) => Value::Map(
+                v.into_iter()
+                    .map(|(k, v)| (k.into_owned(), v.into_owned()))
+                    .collect(),
+            ),
+            ValueRef::Tag(t, v) => Value::Tag(t, Box::new((*v).into_owned())),
+            ValueRef::Simple(v) => Value::Simple(v),
+            ValueRef::Float(v) => Value::Float(v),
+        }
+    }
+
+    /// Return the major type for the [`ValueRef`].
+    pub fn type_label(&self) -> u8 {
+        match self {
+            ValueRef::Unsigned(_) => 0,
+            ValueRef::Negative(_) => 1,
+            ValueRef::ByteString(_) => 2,
+            ValueRef::TextString(_) => 3,
+            ValueRef::Array(_) => 4,
+            ValueRef::Map(_) => 5,
+            ValueRef::Tag(_, _) => 6,
+            ValueRef::Simple(_) | ValueRef::Float(_) => 7,
+        }
+    }
+}
+
+impl Ord for ValueRef<'_> {
+    fn cmp(&self, other: &Self) -> Ordering {
+        use super::values::ValueRef::{
+            Array, ByteString, Float, Map, Negative, Simple, Tag, TextString, Unsigned,
+        };
+        // Same ordering as for Value.
+        let self_type_value = self.type_label();
+        let other_type_value = other.type_label();
+        if self_type_value != other_type_value {
+            return self_type_value.cmp(&other_type_value);
+        }
+        match (self, other) {
+            (Unsigned(u1), Unsigned(u2)) => u1.cmp(u2),
+            (Negative(n1), Negative(n2)) => n1.cmp(n2).reverse(),
+            (ByteString(b1), ByteString(b2)) => b1.len().cmp(&b2.len()).then(b1.cmp(b2)),
+            (TextString(t1), TextString(t2)) => t1.len().cmp(&t2.len()).then(t1.cmp(t2)),
+            (Array(a1), Array(a2)) => a1.len().cmp(&a2.len()).then_with(|| a1.cmp(a2)),
+            (Map(m1), Map(m2)) => m1.len().cmp(&m2.len()).then_with(|| m1.cmp(m2)),
+            (Tag(t1, v1), Tag(t2, v2)) => t1.cmp(t2).then(v1.cmp(v2)),
+            (Simple(s1), Simple(s2)) => s1.cmp(s2),
+            (Simple(_), Float(_)) => Ordering::Less,
+            (Float(_), Simple(_)) => Ordering::Greater,
+            (Float(f1), Float(f2)) => f1.to_bits().cmp(&f2.to_bits()),
+            (_, _) => {
+                // The case of different major types is caught above.
+                unreachable!();
+            }
+        }
+    }
+}
+
+impl PartialOrd for ValueRef<'_> {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl Eq for ValueRef<'_> {}
+
+impl PartialEq for ValueRef<'_> {
+    fn eq(&self, other: &Self) -> bool {
+        self.cmp(other) == Ordering::Equal
+    }
+}
+
+impl From<Value> for ValueRef<'_> {
+    fn from(value: Value) -> Self {
+        match value {
+            Value::Unsigned(v) => ValueRef::Unsigned(v),
+            Value::Negative(v) => ValueRef::Negative(v),
+            Value::ByteString(v) => ValueRef::ByteString(Cow::Owned(v)),
+            Value::TextString(v) => ValueRef::TextString(Cow::Owned(v)),
+            Value::Array(v) => ValueRef::Array(collect_global(v.into_iter().map(ValueRef::from))),
+            Value::Map(v) => ValueRef::Map(collect_global(
+                v.into_iter()
+                    .map(|(k, v)| (ValueRef::from(k), ValueRef::from(v))),
+            )),
+            Value::Tag(t, v) => ValueRef::Tag(
+                t,
+                Box::new_in(ValueRef::from(*v), ContainerAlloc::default()),
+            ),
+            Value::Simple(v) => ValueRef::Simple(v),
+            Value::Float(v) => ValueRef::Float(v),
+        }
+    }
+}
+
+/// Collect the given items into a vector allocated by the global allocator.
+fn collect_global<'a, T>(items: impl ExactSizeIterator<Item = T>) -> Vec<T, ContainerAlloc<'a>> {
+    let mut vec = Vec::with_capacity_in(items.len(), ContainerAlloc::default());
+    vec.extend(items);
+    vec
+}
+
 impl SimpleValue {
-    /// Create a simple value from its encoded value.
+    /// Create a simple value from its encoded value, returning `None` for the reserved values 24
+    /// to 31 and values which do not fit into a byte.
     pub fn from_integer(int: u64) -> Option<SimpleValue> {
         match int {
             20 => Some(SimpleValue::FalseValue),
             21 => Some(SimpleValue::TrueValue),
             22 => Some(SimpleValue::NullValue),
             23 => Some(SimpleValue::Undefined),
+            0..=255 => UnassignedSimpleValue::new(int as u8).map(SimpleValue::Unassigned),
             _ => None,
         }
     }
+
+    /// The encoded value of the simple value.
+    pub fn to_integer(&self) -> u8 {
+        match *self {
+            SimpleValue::FalseValue => 20,
+            SimpleValue::TrueValue => 21,
+            SimpleValue::NullValue => 22,
+            SimpleValue::Undefined => 23,
+            SimpleValue::Unassigned(int) => int.get(),
+        }
+    }
+}
+
+impl Ord for SimpleValue {
+    fn cmp(&self, other: &SimpleValue) -> Ordering {
+        self.to_integer().cmp(&other.to_integer())
+    }
+}
+
+impl PartialOrd for SimpleValue {
+    fn partial_cmp(&self, other: &SimpleValue) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
 }
 
 impl From<u64> for Value {
@@ -239,6 +508,12 @@ impl From<Vec<(Value, Value)>> for Value {
     }
 }
 
+impl From<f64> for Value {
+    fn from(f: f64) -> Self {
+        Value::Float(f)
+    }
+}
+
 impl From<bool> for Value {
     fn from(b: bool) -> Self {
         Value::bool_value(b)
@@ -291,6 +566,21 @@ mod test {
     use super::*;
     use crate::{cbor_array, cbor_bool, cbor_bytes, cbor_int, cbor_map, cbor_tagged, cbor_text};
 
+    #[test]
+    fn test_unassigned_simple_value() {
+        for value in 0..=255 {
+            let expected = if (20..32).contains(&value) {
+                None
+            } else {
+                Some(value)
+            };
+            assert_eq!(
+                UnassignedSimpleValue::new(value).map(UnassignedSimpleValue::get),
+                expected
+            );
+        }
+    }
+
     #[test]
     fn test_value_ordering() {
         assert!(cbor_int!(0) < cbor_int!(23));
@@ -0,0 +1,470 @@
+//! Functionality for decoding CBOR data as a stream of events, without building a `Value`.
+
+use super::{
+    reader::{DecoderError, Reader, DEFAULT_MAX_DEPTH},
+    values::{Constants, MajorType, SimpleValue, ValueRef},
+};
+
+/// Callbacks invoked for each token encountered while walking CBOR data with `visit`.
+///
+/// Every container, definite or indefinite length, is reported by a `visit_*_start` call followed
+/// by its contents (keys and values alternating for maps) and a matching `visit_end` call.
+/// Indefinite-length byte and text strings are reported the same way, using `visit_chunks_start`
+/// followed by one `visit_bytes` or `visit_str` call per chunk. Tags are reported by `visit_tag`
+/// immediately before the tagged item.
+///
+/// All callbacks do nothing by default, so a visitor only needs to implement the ones it is
+/// interested in. Returning an error from any callback aborts the walk.
+pub trait Visitor {
+    /// Error returned by the callbacks.
+    type Error: From<DecoderError>;
+
+    /// Called for an unsigned integer.
+    fn visit_u64(&mut self, _value: u64) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called for a negative integer.
+    fn visit_negative(&mut self, _value: i128) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called for a byte string or a single chunk of an indefinite-length byte string.
+    fn visit_bytes(&mut self, _value: &[u8]) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called for a text string or a single chunk of an indefinite-length text string.
+    fn visit_str(&mut self, _value: &str) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called at the start of an indefinite-length string of the given major type (`ByteString` or
+    /// `TextString`).
+    fn visit_chunks_start(&mut self, _major_type: MajorType) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called at the start of an array of the given length (`None` meaning indefinite length).
+    fn visit_array_start(&mut self, _len: Option<u64>) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called at the start of a map with the given number of entries (`None` meaning indefinite
+    /// length).
+    fn visit_map_start(&mut self, _len: Option<u64>) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called at the end of an array, a map or an indefinite-length string.
+    fn visit_end(&mut self) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called for a tag, before the tagged item.
+    fn visit_tag(&mut self, _tag: u64) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called for a simple value.
+    fn visit_simple(&mut self, _value: SimpleValue) -> Result<(), Self::Error> {
+        Ok(())
+    }
+
+    /// Called for a floating point value of any precision.
+    fn visit_f64(&mut self, _value: f64) -> Result<(), Self::Error> {
+        Ok(())
+    }
+}
+
+/// Walk CBOR binary data containing a single data item, invoking the visitor for each token and
+/// expecting that there is no additional data.
+///
+/// The data is parsed without any canonicality checks (including map key order and duplicate
+/// keys), the same as in non-strict decoding. Nesting is limited to `DEFAULT_MAX_DEPTH`.
+pub fn visit<V: Visitor>(encoded_cbor: &[u8], visitor: &mut V) -> Result<(), V::Error> {
+    let mut reader = Reader::new_non_strict(encoded_cbor);
+    visit_prefix(&mut reader, visitor, Some(DEFAULT_MAX_DEPTH))?;
+    if !reader.remaining_cbor.is_empty() {
+        return Err(DecoderError::ExtraneousData {
+            offset: reader.offset,
+        }
+        .into());
+    }
+    Ok(())
+}
+
+/// Walk the first data item of the reader's remaining data, invoking the visitor for each token.
+///
+/// Headers are parsed by the reader, so its strictness applies: a strict reader rejects
+/// non-minimal lengths, indefinite-length items and floats.
+pub(crate) fn visit_prefix<V: Visitor>(
+    reader: &mut Reader<'_, '_>,
+    visitor: &mut V,
+    max_depth: Option<i8>,
+) -> Result<(), V::Error> {
+    let mut walker = Walker { reader, visitor };
+    walker.visit_data_item(max_depth)
+}
+
+struct Walker<'r, 'a, 'o, 'v, V> {
+    reader: &'r mut Reader<'a, 'o>,
+    visitor: &'v mut V,
+}
+
+impl<'r, 'a, 'o, 'v, V: Visitor> Walker<'r, 'a, 'o, 'v, V> {
+    fn visit_data_item(&mut self, remaining_depth: Option<i8>) -> Result<(), V::Error> {
+        let item_offset = self.reader.offset;
+        if remaining_depth.map_or(false, |d| d < 0) {
+            return Err(DecoderError::TooMuchNesting {
+                offset: item_offset,
+            }
+            .into());
+        }
+        let nested_depth = remaining_depth.map(|d| d - 1);
+
+        let first_byte = self.read_bytes(1, item_offset)?[0];
+        let major_type_value = first_byte >> Constants::MAJOR_TYPE_BIT_SHIFT;
+        let additional_info = first_byte & Constants::ADDITIONAL_INFORMATION_MASK;
+        if additional_info == Constants::ADDITIONAL_INFORMATION_INDEFINITE
+            && (2..=5).contains(&major_type_value)
+        {
+            if !self.reader.non_strict {
+                return Err(DecoderError::IndefiniteLength {
+                    offset: item_offset,
+                }
+                .into());
+            }
+            match major_type_value {
+                2 | 3 => return self.visit_chunked_string(first_byte),
+                4 => return self.visit_array(None, nested_depth),
+                _ => return self.visit_map(None, nested_depth),
+            }
+        }
+        let size_value =
+            self.reader
+                .read_argument(major_type_value, additional_info, item_offset)?;
+        match major_type_value {
+            0 => self.visitor.visit_u64(size_value),
+            1 => self.visitor.visit_negative(-(size_value as i128) - 1),
+            2 | 3 => self.visit_string(major_type_value, size_value, item_offset),
+            4 => self.visit_array(Some(size_value), nested_depth),
+            5 => self.visit_map(Some(size_value), nested_depth),
+            6 => {
+                self.visitor.visit_tag(size_value)?;
+                self.visit_data_item(nested_depth)
+            }
+            7 => match self.reader.decode_to_simple_value(
+                size_value,
+                additional_info,
+                item_offset,
+            )? {
+                ValueRef::Float(float) => self.visitor.visit_f64(float),
+                ValueRef::Simple(simple_value) => self.visitor.visit_simple(simple_value),
+                _ => unreachable!(),
+            },
+            _ => Err(DecoderError::UnsupportedMajorType {
+                offset: item_offset,
+            }
+            .into()),
+        }
+    }
+
+    fn read_bytes(
+        &mut self,
+        num_bytes: usize,
+        item_offset: usize,
+    ) -> Result<&'a [u8], DecoderError> {
+        self.reader
+            .read_bytes(num_bytes)
+            .ok_or(DecoderError::IncompleteCborData {
+                offset: item_offset,
+            })
+    }
+
+    fn visit_string(
+        &mut self,
+        major_type_value: u8,
+        size_value: u64,
+        item_offset: usize,
+    ) -> Result<(), V::Error> {
+        let bytes = self.read_bytes(size_value as usize, item_offset)?;
+        if major_type_value == 2 {
+            return self.visitor.visit_bytes(bytes);
+        }
+        let text = core::str::from_utf8(bytes).map_err(|_| DecoderError::InvalidUtf8 {
+            offset: item_offset,
+        })?;
+        self.visitor.visit_str(text)
+    }
+
+    /// Visit the chunks of an indefinite-length byte or text string. Each chunk must be a
+    /// definite-length string of the same major type.
+    fn visit_chunked_string(&mut self, initial_byte: u8) -> Result<(), V::Error> {
+        let major_type_value = initial_byte >> Constants::MAJOR_TYPE_BIT_SHIFT;
+        self.visitor
+            .visit_chunks_start(MajorType::from_initial_byte(initial_byte))?;
+        while self.reader.has_next_item(None, 0)? {
+            let chunk_offset = self.reader.offset;
+            let first_byte = self.read_bytes(1, chunk_offset)?[0];
+            let additional_info = first_byte & Constants::ADDITIONAL_INFORMATION_MASK;
+            if first_byte >> Constants::MAJOR_TYPE_BIT_SHIFT != major_type_value
+                || additional_info == Constants::ADDITIONAL_INFORMATION_INDEFINITE
+            {
+                return Err(DecoderError::InvalidStringChunk {
+                    offset: chunk_offset,
+                }
+                .into());
+            }
+            let size_value = self
+                .reader
+                .read_variadic_length_integer(additional_info, chunk_offset)?;
+            self.visit_string(major_type_value, size_value, chunk_offset)?;
+        }
+        self.visitor.visit_end()
+    }
+
+    fn visit_array(
+        &mut self,
+        size_value: Option<u64>,
+        nested_depth: Option<i8>,
+    ) -> Result<(), V::Error> {
+        self.visitor.visit_array_start(size_value)?;
+        let mut count = 0;
+        while self.reader.has_next_item(size_value, count)? {
+            self.visit_data_item(nested_depth)?;
+            count += 1;
+        }
+        self.visitor.visit_end()
+    }
+
+    fn visit_map(
+        &mut self,
+        size_value: Option<u64>,
+        nested_depth: Option<i8>,
+    ) -> Result<(), V::Error> {
+        self.visitor.visit_map_start(size_value)?;
+        let mut count = 0;
+        while self.reader.has_next_item(size_value, count)? {
+            self.visit_data_item(nested_depth)?;
+            self.visit_data_item(nested_depth)?;
+            count += 1;
+        }
+        self.visitor.visit_end()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use alloc::{
+        format,
+        string::{String, ToString},
+        vec,
+        vec::Vec,
+    };
+
+    use super::*;
+
+    /// Visitor recording every event as a string.
+    #[derive(Default)]
+    struct Recorder {
+        events: Vec<String>,
+    }
+
+    impl Visitor for Recorder {
+        type Error = DecoderError;
+
+        fn visit_u64(&mut self, value: u64) -> Result<(), DecoderError> {
+            self.events.push(format!("u64({})", value));
+            Ok(())
+        }
+
+        fn visit_negative(&mut self, value: i128) -> Result<(), DecoderError> {
+            self.events.push(format!("negative({})", value));
+            Ok(())
+        }
+
+        fn visit_bytes(&mut self, value: &[u8]) -> Result<(), DecoderError> {
+            self.events.push(format!("bytes({:?})", value));
+            Ok(())
+        }
+
+        fn visit_str(&mut self, value: &str) -> Result<(), DecoderError> {
+            self.events.push(format!("str({:?})", value));
+            Ok(())
+        }
+
+        fn visit_chunks_start(&mut self, major_type: MajorType) -> Result<(), DecoderError> {
+            self.events.push(format!("chunks({:?})", major_type));
+            Ok(())
+        }
+
+        fn visit_array_start(&mut self, len: Option<u64>) -> Result<(), DecoderError> {
+            self.events.push(format!("array({:?})", len));
+            Ok(())
+        }
+
+        fn visit_map_start(&mut self, len: Option<u64>) -> Result<(), DecoderError> {
+            self.events.push(format!("map({:?})", len));
+            Ok(())
+        }
+
+        fn visit_end(&mut self) -> Result<(), DecoderError> {
+            self.events.push("end".to_string());
+            Ok(())
+        }
+
+        fn visit_tag(&mut self, tag: u64) -> Result<(), DecoderError> {
+            self.events.push(format!("tag({})", tag));
+            Ok(())
+        }
+
+        fn visit_simple(&mut self, value: SimpleValue) -> Result<(), DecoderError> {
+            self.events.push(format!("simple({:?})", value));
+            Ok(())
+        }
+
+        fn visit_f64(&mut self, value: f64) -> Result<(), DecoderError> {
+            self.events.push(format!("f64({:?})", value));
+            Ok(())
+        }
+    }
+
+    fn record(cbor: &[u8]) -> Result<Vec<String>, DecoderError> {
+        let mut recorder = Recorder::default();
+        visit(cbor, &mut recorder)?;
+        Ok(recorder.events)
+    }
+
+    #[test]
+    fn test_visit() {
+        let cases: Vec<(Vec<u8>, Vec<&str>)> = vec![
+            (vec![0x18, 0x2A], vec!["u64(42)"]),
+            (
+                vec![0x3B, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF],
+                vec!["negative(-18446744073709551616)"],
+            ),
+            (vec![0x42, 0x01, 0x02], vec!["bytes([1, 2])"]),
+            (vec![0x62, 0x68, 0x69], vec!["str(\"hi\")"]),
+            (
+                vec![0x82, 0x01, 0x81, 0x02],
+                vec![
+                    "array(Some(2))",
+                    "u64(1)",
+                    "array(Some(1))",
+                    "u64(2)",
+                    "end",
+                    "end",
+                ],
+            ),
+            (
+                vec![0xA1, 0x61, 0x61, 0xF5],
+                vec!["map(Some(1))", "str(\"a\")", "simple(TrueValue)", "end"],
+            ),
+            (
+                vec![0xC1, 0x1A, 0x00, 0x01, 0x00, 0x00],
+                vec!["tag(1)", "u64(65536)"],
+            ),
+            (vec![0xF6], vec!["simple(NullValue)"]),
+            (
+                vec![0xF0],
+                vec!["simple(Unassigned(UnassignedSimpleValue(16)))"],
+            ),
+            (
+                vec![0xF8, 0xFF],
+                vec!["simple(Unassigned(UnassignedSimpleValue(255)))"],
+            ),
+            (vec![0xF9, 0x3C, 0x00], vec!["f64(1.0)"]),
+            (
+                vec![0xFB, 0x3F, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A],
+                vec!["f64(1.1)"],
+            ),
+        ];
+        for (cbor, events) in cases {
+            assert_eq!(record(&cbor).unwrap(), events, "cbor: {:02x?}", cbor);
+        }
+    }
+
+    #[test]
+    fn test_visit_indefinite() {
+        let cases: Vec<(Vec<u8>, Vec<&str>)> = vec![
+            (
+                vec![0x9F, 0x01, 0x9F, 0xFF, 0xFF],
+                vec!["array(None)", "u64(1)", "array(None)", "end", "end"],
+            ),
+            (
+                vec![0xBF, 0x01, 0x02, 0xFF],
+                vec!["map(None)", "u64(1)", "u64(2)", "end"],
+            ),
+            (
+                vec![0x5F, 0x41, 0x01, 0x42, 0x02, 0x03, 0xFF],
+                vec!["chunks(ByteString)", "bytes([1])", "bytes([2, 3])", "end"],
+            ),
+            (
+                vec![0x7F, 0x61, 0x61, 0x61, 0x62, 0xFF],
+                vec!["chunks(TextString)", "str(\"a\")", "str(\"b\")", "end"],
+            ),
+        ];
+        for (cbor, events) in cases {
+            assert_eq!(record(&cbor).unwrap(), events, "cbor: {:02x?}", cbor);
+        }
+    }
+
+    #[test]
+    fn test_visit_errors() {
+        let cases: Vec<(Vec<u8>, DecoderError)> = vec![
+            (vec![0x01, 0x02], DecoderError::ExtraneousData { offset: 1 }),
+            (
+                vec![0x82, 0x01],
+                DecoderError::IncompleteCborData { offset: 2 },
+            ),
+            (
+                vec![0x9F, 0x01],
+                DecoderError::IncompleteCborData { offset: 2 },
+            ),
+            (
+                vec![0x5F, 0x61, 0x61, 0xFF],
+                DecoderError::InvalidStringChunk { offset: 1 },
+            ),
+            (
+                vec![0x62, 0xC3, 0x28],
+                DecoderError::InvalidUtf8 { offset: 0 },
+            ),
+            (
+                vec![0xFF],
+                DecoderError::UnknownAdditionalInfo { offset: 0 },
+            ),
+            (
+                [0x81; 65].iter().copied().chain([0x00]).collect(),
+                DecoderError::TooMuchNesting { offset: 65 },
+            ),
+        ];
+        for (cbor, error) in cases {
+            assert_eq!(record(&cbor), Err(error), "cbor: {:02x?}", cbor);
+        }
+    }
+
+    #[test]
+    fn test_visit_abort() {
+        struct Counter(usize);
+
+        impl Visitor for Counter {
+            type Error = DecoderError;
+
+            fn visit_u64(&mut self, _value: u64) -> Result<(), DecoderError> {
+                if self.0 == 2 {
+                    return Err(DecoderError::UnsupportedMajorType { offset: 0 });
+                }
+                self.0 += 1;
+                Ok(())
+            }
+        }
+
+        let mut counter = Counter(0);
+        assert_eq!(
+            visit(&[0x83, 0x01, 0x02, 0x03], &mut counter),
+            Err(DecoderError::UnsupportedMajorType { offset: 0 })
+        );
+        assert_eq!(counter.0, 2);
+    }
+}
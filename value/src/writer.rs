@@ -16,13 +16,71 @@
 
 use alloc::vec::Vec;
 
-use super::values::{Constants, Value};
+use super::{
+    reader::f16_to_f64,
+    values::{Constants, MajorType, Value},
+};
 
 /// Possible errors from a serialization operation.
 #[derive(Debug, PartialEq)]
 pub enum EncoderError {
     TooMuchNesting,
     DuplicateMapKey,
+    NonFiniteFloat,
+}
+
+/// Options controlling how CBOR values are serialized.
+#[derive(Clone, Debug)]
+pub struct EncodeOptions {
+    /// Maximum nesting depth of arrays, maps and tagged values. If `Some(max)`, then nested
+    /// structures are only supported up to the given limit (returning
+    /// [`EncoderError::TooMuchNesting`] if the limit is hit).
+    pub max_depth: Option<i8>,
+    /// Whether to reject floating point values which are NaN or infinite (returning
+    /// [`EncoderError::NonFiniteFloat`]). When allowed, all NaN values are encoded as the same
+    /// quiet NaN regardless of their sign and payload.
+    pub reject_non_finite: bool,
+    /// Order in which the keys of maps are serialized. Only the default
+    /// [`MapOrdering::Bytewise`] order is accepted when decoding canonically, so maps encoded in
+    /// another order may be rejected by canonical decoders.
+    pub map_ordering: MapOrdering,
+    /// Whether to encode floating point values in the shortest of half, single or double
+    /// precision which represents them exactly, as done by preferred serialization (RFC 8949,
+    /// Section 4.1). Otherwise they are always encoded in double precision. Only double precision
+    /// floats are accepted when decoding canonically, so shrunk floats may be rejected by
+    /// canonical decoders. Shorter floats are widened on decode.
+    pub shrink_floats: bool,
+}
+
+impl Default for EncodeOptions {
+    fn default() -> Self {
+        Self {
+            max_depth: Some(i8::MAX),
+            reject_non_finite: false,
+            map_ordering: MapOrdering::default(),
+            shrink_floats: false,
+        }
+    }
+}
+
+/// Order in which the keys of maps are serialized.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum MapOrdering {
+    /// Keys are sorted by the bytewise lexicographic order of their encodings, as required by
+    /// core deterministic encoding (RFC 8949, Section 4.2.1). As the major type is stored in the
+    /// high bits of the first byte, keys with a lower major type always sort first.
+    Bytewise,
+    /// Keys are sorted by the length of their encodings, and keys whose encodings have the same
+    /// length by the bytewise lexicographic order of their encodings, as required by the canonical
+    /// encoding of RFC 7049 (Section 3.9). For maps whose keys all have the same major type, such
+    /// as those used by CTAP2, this is also the CTAP2 canonical order.
+    LengthFirst,
+}
+
+impl Default for MapOrdering {
+    fn default() -> Self {
+        MapOrdering::Bytewise
+    }
 }
 
 /// Convert a [`Value`] to serialized CBOR data, consuming it along the way and appending to the provided vector.
@@ -44,13 +102,145 @@ pub fn write_nested(
     writer.encode_cbor(value, max_nest)
 }
 
+/// Convert a [`Value`] to serialized CBOR data according to the given options, consuming it along
+/// the way and appending to the provided vector.
+pub fn write_with_options(
+    value: Value,
+    encoded_cbor: &mut Vec<u8>,
+    options: &EncodeOptions,
+) -> Result<(), EncoderError> {
+    let mut writer = Writer::new(encoded_cbor);
+    writer.reject_non_finite = options.reject_non_finite;
+    writer.map_ordering = options.map_ordering;
+    writer.shrink_floats = options.shrink_floats;
+    writer.encode_cbor(value, options.max_depth)
+}
+
+/// Compute the length (in bytes) of the serialized CBOR data for the given [`Value`] without
+/// serializing it. The result is only meaningful for values that can be serialized successfully.
+pub fn encoded_len(value: &Value) -> usize {
+    match value {
+        Value::Unsigned(unsigned) => header_len(*unsigned),
+        Value::Negative(negative) => header_len(-(negative + 1) as u64),
+        Value::ByteString(byte_string) => header_len(byte_string.len() as u64) + byte_string.len(),
+        Value::TextString(text_string) => header_len(text_string.len() as u64) + text_string.len(),
+        Value::Array(array) => {
+            header_len(array.len() as u64) + array.iter().map(encoded_len).sum::<usize>()
+        }
+        Value::Map(map) => {
+            header_len(map.len() as u64)
+                + map
+                    .iter()
+                    .map(|(k, v)| encoded_len(k) + encoded_len(v))
+                    .sum::<usize>()
+        }
+        Value::Tag(tag, inner_value) => header_len(*tag) + encoded_len(inner_value),
+        Value::Simple(simple_value) => header_len(simple_value.to_integer().into()),
+        Value::Float(_) => 9,
+    }
+}
+
+/// Floating point value in the precision it is encoded in.
+enum Float {
+    Half(u16),
+    Single(f32),
+    Double(f64),
+}
+
+/// Convert the given value into the shortest precision which represents it exactly, if requested.
+fn shrink_float(float: f64, shrink: bool) -> Float {
+    if !shrink {
+        return Float::Double(float);
+    }
+    if let Some(half) = f64_to_f16(float) {
+        return Float::Half(half);
+    }
+    let single = float as f32;
+    if f64::from(single).to_bits() == float.to_bits() {
+        return Float::Single(single);
+    }
+    Float::Double(float)
+}
+
+/// Convert a double precision value into an IEEE 754 half precision (binary16) value, if it can
+/// be represented exactly (including the sign of zero and the payload of NaN).
+fn f64_to_f16(float: f64) -> Option<u16> {
+    let bits = float.to_bits();
+    let sign = ((bits >> 48) & 0x8000) as u16;
+    let exponent = ((bits >> 52) & 0x7ff) as i64 - 1023;
+    let mantissa = bits & 0x000f_ffff_ffff_ffff;
+    let half = match exponent {
+        // Infinity and NaN.
+        1024 => sign | 0x7c00 | (mantissa >> 42) as u16,
+        // Normal numbers.
+        -14..=15 => sign | (((exponent + 15) as u16) << 10) | (mantissa >> 42) as u16,
+        // Subnormal numbers, i.e. mantissa * 2^-24, and zero.
+        _ if exponent < -14 => {
+            let mantissa = float.abs() * (1u64 << 24) as f64;
+            sign | mantissa as u16
+        }
+        _ => return None,
+    };
+    // Any bits dropped above make the conversion inexact.
+    if f16_to_f64(half).to_bits() == bits {
+        Some(half)
+    } else {
+        None
+    }
+}
+
+/// Compute the length (in bytes) of the header of a CBOR item with the given size or value, as
+/// chosen by the serializer.
+pub fn header_len(size: u64) -> usize {
+    match size {
+        0..=23 => 1,
+        24..=0xFF => 2,
+        0x100..=0xFFFF => 3,
+        0x10000..=0xFFFF_FFFF => 5,
+        _ => 9,
+    }
+}
+
+/// Append the header of a CBOR item with the given major type and size or value to the provided
+/// vector, as chosen by the serializer. This allows writing the elements of arrays and maps
+/// separately after their header.
+pub fn write_header(major_type: MajorType, size: u64, encoded_cbor: &mut Vec<u8>) {
+    Writer::new(encoded_cbor).start_item(major_type as u8, size);
+}
+
+/// Append an unsigned integer to the provided vector, using the same minimal width as the
+/// serializer does for [`Value::Unsigned`]. Together with [`write_header`] for lengths, this allows
+/// custom serializers to produce output byte-identical to the rest of the encoding.
+pub fn write_uint(value: u64, encoded_cbor: &mut Vec<u8>) {
+    write_header(MajorType::Unsigned, value, encoded_cbor);
+}
+
+/// Append a signed integer to the provided vector, as an unsigned integer if it is not negative
+/// and a negative integer (encoding -1 - n) otherwise, using the same minimal width as the
+/// serializer.
+pub fn write_int(value: i64, encoded_cbor: &mut Vec<u8>) {
+    if value < 0 {
+        write_header(MajorType::Negative, !value as u64, encoded_cbor);
+    } else {
+        write_header(MajorType::Unsigned, value as u64, encoded_cbor);
+    }
+}
+
 struct Writer<'a> {
     encoded_cbor: &'a mut Vec<u8>,
+    reject_non_finite: bool,
+    map_ordering: MapOrdering,
+    shrink_floats: bool,
 }
 
 impl<'a> Writer<'a> {
     pub fn new(encoded_cbor: &mut Vec<u8>) -> Writer {
-        Writer { encoded_cbor }
+        Writer {
+            encoded_cbor,
+            reject_non_finite: false,
+            map_ordering: MapOrdering::Bytewise,
+            shrink_floats: false,
+        }
     }
 
     fn encode_cbor(
@@ -79,8 +269,21 @@ impl<'a> Writer<'a> {
                     self.encode_cbor(el, remaining_depth.map(|d| d - 1))?;
                 }
             }
+            Value::Map(map) if self.shrink_floats => {
+                // The ordering of values compares floats by their double precision bits, which
+                // does not match the order of shrunk encodings, so sort by the encodings instead.
+                self.encode_map_by_encoded_keys(type_label, map, remaining_depth)?;
+            }
             Value::Map(mut map) => {
-                map.sort_by(|a, b| a.0.cmp(&b.0));
+                // The ordering of values matches the bytewise order of their encodings.
+                match self.map_ordering {
+                    MapOrdering::Bytewise => map.sort_by(|a, b| a.0.cmp(&b.0)),
+                    MapOrdering::LengthFirst => map.sort_by(|a, b| {
+                        encoded_len(&a.0)
+                            .cmp(&encoded_len(&b.0))
+                            .then_with(|| a.0.cmp(&b.0))
+                    }),
+                }
                 let map_len = map.len();
                 map.dedup_by(|a, b| a.0.eq(&b.0));
                 if map_len != map.len() {
@@ -96,7 +299,77 @@ impl<'a> Writer<'a> {
                 self.start_item(type_label, tag);
                 self.encode_cbor(*inner_value, remaining_depth.map(|d| d - 1))?;
             }
-            Value::Simple(simple_value) => self.start_item(type_label, simple_value as u64),
+            Value::Simple(simple_value) => {
+                self.start_item(type_label, simple_value.to_integer().into())
+            }
+            Value::Float(float) => {
+                if self.reject_non_finite && !float.is_finite() {
+                    return Err(EncoderError::NonFiniteFloat);
+                }
+                // NaN payloads carry no meaning, so encode a single NaN for two encoders to agree.
+                let float = if float.is_nan() {
+                    f64::from_bits(Constants::CANONICAL_NAN_BITS)
+                } else {
+                    float
+                };
+                let initial_byte = type_label << Constants::MAJOR_TYPE_BIT_SHIFT;
+                match shrink_float(float, self.shrink_floats) {
+                    Float::Half(half) => {
+                        self.encoded_cbor
+                            .push(initial_byte | Constants::ADDITIONAL_INFORMATION_2_BYTES);
+                        self.encoded_cbor.extend(half.to_be_bytes());
+                    }
+                    Float::Single(single) => {
+                        self.encoded_cbor
+                            .push(initial_byte | Constants::ADDITIONAL_INFORMATION_4_BYTES);
+                        self.encoded_cbor.extend(single.to_bits().to_be_bytes());
+                    }
+                    Float::Double(double) => {
+                        self.encoded_cbor
+                            .push(initial_byte | Constants::ADDITIONAL_INFORMATION_8_BYTES);
+                        self.encoded_cbor.extend(double.to_bits().to_be_bytes());
+                    }
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Encode a map with its keys sorted by their actual encodings, as required when those do not
+    /// follow the ordering of values.
+    fn encode_map_by_encoded_keys(
+        &mut self,
+        type_label: u8,
+        map: Vec<(Value, Value)>,
+        remaining_depth: Option<i8>,
+    ) -> Result<(), EncoderError> {
+        let mut entries = Vec::with_capacity(map.len());
+        for (k, v) in map {
+            let mut key = Vec::new();
+            let mut writer = Writer {
+                encoded_cbor: &mut key,
+                reject_non_finite: self.reject_non_finite,
+                map_ordering: self.map_ordering,
+                shrink_floats: self.shrink_floats,
+            };
+            writer.encode_cbor(k, remaining_depth.map(|d| d - 1))?;
+            entries.push((key, v));
+        }
+        match self.map_ordering {
+            MapOrdering::Bytewise => entries.sort_by(|a, b| a.0.cmp(&b.0)),
+            MapOrdering::LengthFirst => {
+                entries.sort_by(|a, b| a.0.len().cmp(&b.0.len()).then_with(|| a.0.cmp(&b.0)))
+            }
+        }
+        let map_len = entries.len();
+        entries.dedup_by(|a, b| a.0 == b.0);
+        if map_len != entries.len() {
+            return Err(EncoderError::DuplicateMapKey);
+        }
+        self.start_item(type_label, map_len as u64);
+        for (key, v) in entries {
+            self.encoded_cbor.extend(key);
+            self.encode_cbor(v, remaining_depth.map(|d| d - 1))?;
         }
         Ok(())
     }
@@ -121,11 +394,12 @@ impl<'a> Writer<'a> {
 #[cfg(test)]
 mod test {
     use alloc::vec;
+    use core::convert::TryFrom;
 
     use super::*;
     use crate::{
         cbor_array, cbor_array_vec, cbor_bytes, cbor_false, cbor_int, cbor_map, cbor_null,
-        cbor_tagged, cbor_text, cbor_true, cbor_undefined,
+        cbor_tagged, cbor_text, cbor_true, cbor_undefined, values::SimpleValue,
     };
 
     fn write_return(value: Value) -> Option<Vec<u8>> {
@@ -344,6 +618,68 @@ mod test {
         assert_eq!(write_return(sorted_map), write_return(unsorted_map));
     }
 
+    #[test]
+    fn test_write_map_ordering() {
+        let write_ordered = |value: Value, map_ordering| {
+            let options = EncodeOptions {
+                map_ordering,
+                ..Default::default()
+            };
+            let mut encoded_cbor = Vec::new();
+            write_with_options(value, &mut encoded_cbor, &options).map(|_| encoded_cbor)
+        };
+        let map = || {
+            cbor_map! {
+                "a" => 0,
+                b"\x01\x02" => 1,
+                -1 => 2,
+                1000 => 3,
+                cbor_array![2, 2] => 4,
+                cbor_array![1000] => 5,
+            }
+        };
+
+        assert_eq!(
+            write_ordered(map(), MapOrdering::Bytewise),
+            Ok(vec![
+                0xA6, // map(6)
+                0x19, 0x03, 0xE8, 0x03, // 1000
+                0x20, 0x02, // -1
+                0x42, 0x01, 0x02, 0x01, // h'0102'
+                0x61, 0x61, 0x00, // "a"
+                0x81, 0x19, 0x03, 0xE8, 0x05, // [1000]
+                0x82, 0x02, 0x02, 0x04, // [2, 2]
+            ])
+        );
+        assert_eq!(
+            write_ordered(map(), MapOrdering::Bytewise).ok(),
+            write_return(map())
+        );
+        assert_eq!(
+            write_ordered(map(), MapOrdering::LengthFirst),
+            Ok(vec![
+                0xA6, // map(6)
+                0x20, 0x02, // -1
+                0x61, 0x61, 0x00, // "a"
+                0x19, 0x03, 0xE8, 0x03, // 1000
+                0x42, 0x01, 0x02, 0x01, // h'0102'
+                0x82, 0x02, 0x02, 0x04, // [2, 2]
+                0x81, 0x19, 0x03, 0xE8, 0x05, // [1000]
+            ])
+        );
+
+        // Duplicate keys are still detected.
+        let duplicate = cbor_map! {
+            "a" => 0,
+            1000 => 1,
+            "a" => 2,
+        };
+        assert_eq!(
+            write_ordered(duplicate, MapOrdering::LengthFirst),
+            Err(EncoderError::DuplicateMapKey)
+        );
+    }
+
     #[test]
     fn test_write_map_duplicates() {
         let duplicate0 = cbor_map! {
@@ -451,12 +787,205 @@ mod test {
             (cbor_true!(), vec![0xF5]),
             (cbor_null!(), vec![0xF6]),
             (cbor_undefined!(), vec![0xF7]),
+            (
+                Value::Simple(SimpleValue::from_integer(0).unwrap()),
+                vec![0xE0],
+            ),
+            (
+                Value::Simple(SimpleValue::from_integer(19).unwrap()),
+                vec![0xF3],
+            ),
+            (
+                Value::Simple(SimpleValue::from_integer(32).unwrap()),
+                vec![0xF8, 0x20],
+            ),
+            (
+                Value::Simple(SimpleValue::from_integer(255).unwrap()),
+                vec![0xF8, 0xFF],
+            ),
         ];
         for (value, correct_cbor) in cases {
+            assert_eq!(encoded_len(&value), correct_cbor.len());
             assert_eq!(write_return(value), Some(correct_cbor));
         }
     }
 
+    #[test]
+    fn test_write_non_finite_float() {
+        let canonical_nan = vec![0xFB, 0x7F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00];
+        for nan in [
+            f64::NAN,
+            -f64::NAN,
+            f64::from_bits(0x7FF0_0000_0000_0001),
+            f64::from_bits(0xFFFF_FFFF_FFFF_FFFF),
+        ] {
+            assert_eq!(write_return(Value::Float(nan)), Some(canonical_nan.clone()));
+        }
+
+        let options = EncodeOptions {
+            reject_non_finite: true,
+            ..Default::default()
+        };
+        for float in [f64::NAN, f64::INFINITY, f64::NEG_INFINITY] {
+            let mut encoded_cbor = Vec::new();
+            assert_eq!(
+                write_with_options(
+                    cbor_array![1, Value::Float(float)],
+                    &mut encoded_cbor,
+                    &options
+                ),
+                Err(EncoderError::NonFiniteFloat)
+            );
+        }
+        let mut encoded_cbor = Vec::new();
+        assert_eq!(
+            write_with_options(Value::Float(1.5), &mut encoded_cbor, &options),
+            Ok(())
+        );
+        assert_eq!(
+            encoded_cbor,
+            vec![0xFB, 0x3F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00]
+        );
+    }
+
+    #[test]
+    fn test_write_float() {
+        let cases = vec![
+            (
+                0.0,
+                vec![0xFB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+            ),
+            (
+                1.5,
+                vec![0xFB, 0x3F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+            ),
+            (
+                -4.1,
+                vec![0xFB, 0xC0, 0x10, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66],
+            ),
+            (
+                f64::INFINITY,
+                vec![0xFB, 0x7F, 0xF0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00],
+            ),
+        ];
+        for (float, correct_cbor) in cases {
+            assert_eq!(write_return(Value::Float(float)), Some(correct_cbor));
+        }
+    }
+
+    #[test]
+    fn test_write_shrink_floats() {
+        let options = EncodeOptions {
+            shrink_floats: true,
+            ..Default::default()
+        };
+        let cases = vec![
+            // Exactly representable in half precision.
+            (0.0, vec![0xF9, 0x00, 0x00]),
+            (-0.0, vec![0xF9, 0x80, 0x00]),
+            (1.5, vec![0xF9, 0x3E, 0x00]),
+            (65504.0, vec![0xF9, 0x7B, 0xFF]),
+            // Smallest positive half precision subnormal.
+            (5.960464477539063e-8, vec![0xF9, 0x00, 0x01]),
+            (f64::INFINITY, vec![0xF9, 0x7C, 0x00]),
+            (f64::NEG_INFINITY, vec![0xF9, 0xFC, 0x00]),
+            (f64::NAN, vec![0xF9, 0x7E, 0x00]),
+            // Out of range or too precise for half, but exact in single precision.
+            (65536.0, vec![0xFA, 0x47, 0x80, 0x00, 0x00]),
+            (100000.0, vec![0xFA, 0x47, 0xC3, 0x50, 0x00]),
+            (1.0009765625, vec![0xF9, 0x3C, 0x01]),
+            (1.00048828125, vec![0xFA, 0x3F, 0x80, 0x10, 0x00]),
+            (3.4028234663852886e38, vec![0xFA, 0x7F, 0x7F, 0xFF, 0xFF]),
+            // Only exact in double precision.
+            (
+                1.1,
+                vec![0xFB, 0x3F, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A],
+            ),
+            (
+                1.0e300,
+                vec![0xFB, 0x7E, 0x37, 0xE4, 0x3C, 0x88, 0x00, 0x75, 0x9C],
+            ),
+            (
+                -4.1,
+                vec![0xFB, 0xC0, 0x10, 0x66, 0x66, 0x66, 0x66, 0x66, 0x66],
+            ),
+        ];
+        for (float, correct_cbor) in cases {
+            let mut encoded_cbor = Vec::new();
+            write_with_options(Value::Float(float), &mut encoded_cbor, &options).unwrap();
+            assert_eq!(encoded_cbor, correct_cbor, "{}", float);
+        }
+
+        // Floats are written in double precision by default.
+        assert_eq!(
+            write_return(Value::Float(1.5)),
+            Some(vec![0xFB, 0x3F, 0xF8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00])
+        );
+    }
+
+    #[test]
+    fn test_write_shrink_floats_map_keys() {
+        let write_shrunk = |value: Value, map_ordering: MapOrdering| {
+            let options = EncodeOptions {
+                map_ordering,
+                shrink_floats: true,
+                ..Default::default()
+            };
+            let mut encoded_cbor = Vec::new();
+            write_with_options(value, &mut encoded_cbor, &options).map(|_| encoded_cbor)
+        };
+        // 1.1 sorts before 1.5 by its double precision bits, but is only shrunk to a single
+        // precision float, while 1.5 fits into half precision.
+        let map = || {
+            Value::Map(vec![
+                (Value::Float(1.1), cbor_int!(0)),
+                (Value::Float(1.5), cbor_int!(1)),
+                (Value::Array(vec![Value::Float(1.1)]), cbor_int!(2)),
+                (Value::Array(vec![Value::Float(1.5)]), cbor_int!(3)),
+            ])
+        };
+        let float_1_1 = [0xFB, 0x3F, 0xF1, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9A];
+
+        let mut expected = vec![0xA4]; // map(4)
+        expected.extend_from_slice(&[0x81, 0xF9, 0x3E, 0x00, 0x03]); // [1.5]
+        expected.push(0x81); // [1.1]
+        expected.extend_from_slice(&float_1_1);
+        expected.push(0x02);
+        expected.extend_from_slice(&[0xF9, 0x3E, 0x00, 0x01]); // 1.5
+        expected.extend_from_slice(&float_1_1); // 1.1
+        expected.push(0x00);
+        assert_eq!(write_shrunk(map(), MapOrdering::Bytewise), Ok(expected));
+
+        let mut expected = vec![0xA4]; // map(4)
+        expected.extend_from_slice(&[0xF9, 0x3E, 0x00, 0x01]); // 1.5
+        expected.extend_from_slice(&[0x81, 0xF9, 0x3E, 0x00, 0x03]); // [1.5]
+        expected.extend_from_slice(&float_1_1); // 1.1
+        expected.push(0x00);
+        expected.push(0x81); // [1.1]
+        expected.extend_from_slice(&float_1_1);
+        expected.push(0x02);
+        assert_eq!(write_shrunk(map(), MapOrdering::LengthFirst), Ok(expected));
+
+        // Keys which only differ in their double precision bits are still distinct, while
+        // duplicate keys are still detected.
+        let distinct = Value::Map(vec![
+            (Value::Float(0.0), cbor_int!(0)),
+            (Value::Float(-0.0), cbor_int!(1)),
+        ]);
+        assert_eq!(
+            write_shrunk(distinct, MapOrdering::Bytewise),
+            Ok(vec![0xA2, 0xF9, 0x00, 0x00, 0x00, 0xF9, 0x80, 0x00, 0x01])
+        );
+        let duplicate = Value::Map(vec![
+            (Value::Array(vec![Value::Float(1.5)]), cbor_int!(0)),
+            (Value::Array(vec![Value::Float(1.5)]), cbor_int!(1)),
+        ]);
+        assert_eq!(
+            write_shrunk(duplicate, MapOrdering::Bytewise),
+            Err(EncoderError::DuplicateMapKey)
+        );
+    }
+
     #[test]
     fn test_write_single_levels() {
         let simple_array: Value = cbor_array![2];
@@ -551,4 +1080,112 @@ mod test {
         writer = Writer::new(&mut buf);
         assert!(writer.encode_cbor(cbor_map, Some(4)).is_err());
     }
+
+    #[test]
+    fn test_encoded_len() {
+        let cases = vec![
+            cbor_int!(0),
+            cbor_int!(23),
+            cbor_int!(24),
+            cbor_int!(0xFFFF),
+            cbor_int!(0x10000),
+            cbor_int!(0x100000000),
+            cbor_int!(-24),
+            cbor_int!(-25),
+            cbor_int!(core::i64::MIN),
+            cbor_bytes!(vec![0x2A; 24]),
+            cbor_text!(""),
+            cbor_text!("a".repeat(256)),
+            cbor_array_vec!(vec![cbor_int!(1); 300]),
+            cbor_map! {
+                "a" => 1,
+                "b" => cbor_map! {
+                    "c" => cbor_array![2, cbor_null!(), cbor_false!()],
+                },
+                -1 => cbor_tagged!(24, cbor_bytes!(vec![0x00])),
+                0x10000 => cbor_undefined!(),
+            },
+            cbor_tagged!(0x100, cbor_true!()),
+            Value::Float(1.5),
+        ];
+        for value in cases {
+            let len = encoded_len(&value);
+            assert_eq!(write_return(value).unwrap().len(), len);
+        }
+    }
+
+    #[test]
+    fn test_write_header() {
+        for (len, array) in [0, 23, 24, 0xFF, 0x100, 0x10000]
+            .iter()
+            .map(|&len| (len, cbor_array_vec!(vec![cbor_int!(1); len])))
+        {
+            let mut encoded_cbor = Vec::new();
+            write_header(MajorType::Array, len as u64, &mut encoded_cbor);
+            assert_eq!(encoded_cbor.len(), header_len(len as u64));
+            for _ in 0..len {
+                encoded_cbor.push(0x01);
+            }
+            assert_eq!(Some(encoded_cbor), write_return(array));
+        }
+
+        let mut encoded_cbor = vec![0xFF];
+        write_header(MajorType::Negative, 0x1_0000_0000, &mut encoded_cbor);
+        assert_eq!(
+            encoded_cbor,
+            vec![0xFF, 0x3B, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00]
+        );
+    }
+
+    #[test]
+    fn test_write_int() {
+        let unsigned = [
+            0,
+            23,
+            24,
+            0xFF,
+            0x100,
+            0xFFFF,
+            0x10000,
+            0xFFFF_FFFF,
+            0x1_0000_0000,
+            u64::MAX,
+        ];
+        for value in unsigned {
+            let mut encoded_cbor = Vec::new();
+            write_uint(value, &mut encoded_cbor);
+            assert_eq!(encoded_cbor.len(), header_len(value));
+            assert_eq!(Some(encoded_cbor), write_return(Value::Unsigned(value)));
+            if let Ok(value) = i64::try_from(value) {
+                let mut encoded_cbor = Vec::new();
+                write_int(value, &mut encoded_cbor);
+                assert_eq!(Some(encoded_cbor), write_return(cbor_int!(value)));
+            }
+        }
+
+        let negative = [
+            -1,
+            -24,
+            -25,
+            -0x100,
+            -0x101,
+            -0x1_0000,
+            -0x1_0001,
+            -0x1_0000_0000,
+            -0x1_0000_0001,
+            i64::MIN,
+        ];
+        for value in negative {
+            let mut encoded_cbor = Vec::new();
+            write_int(value, &mut encoded_cbor);
+            assert_eq!(Some(encoded_cbor), write_return(cbor_int!(value)));
+        }
+
+        let mut encoded_cbor = Vec::new();
+        write_int(i64::MIN, &mut encoded_cbor);
+        assert_eq!(
+            encoded_cbor,
+            vec![0x3B, 0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF]
+        );
+    }
 }